@@ -1,17 +1,22 @@
 package aof
 
 import (
+	"errors"
+	"fmt"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/connection"
-	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // CmdLine is alias for [][]byte, represents a command line
@@ -21,51 +26,209 @@ const (
 	aofQueueSize = 1 << 16
 )
 
+const (
+	// FsyncAlways do fsync for every write, client reply waits until command fsynced
+	FsyncAlways = "always"
+	// FsyncEverySec do fsync every second in background
+	FsyncEverySec = "everysec"
+	// FsyncNo leaves fsync to operating system
+	FsyncNo = "no"
+
+	// fsync taking longer than fsyncDelayThreshold is reported as delayed
+	fsyncDelayThreshold = 2 * time.Second
+
+	defaultAutoRewriteMinSize = 64 << 20
+)
+
 type payload struct {
-	cmdLine CmdLine
-	dbIndex int
+	cmdLine   CmdLine
+	dbIndex   int
+	timestamp int64           // unix timestamp when command executed
+	wg        *sync.WaitGroup // not nil if AddAof waits for fsync
+	// not nil for the cut point of rewrite, aof goroutine switches to a new incr file when receiving it
+	rewrite *RewriteCtx
+}
+
+// FsyncStats holds statistics of aof fsync
+type FsyncStats struct {
+	Count        int64
+	Delayed      int64 // count of fsync taking longer than fsyncDelayThreshold
+	LastLatency  time.Duration
+	MaxLatency   time.Duration
+	TotalLatency time.Duration
 }
 
 // Handler receive msgs from channel and write to AOF file
 type Handler struct {
-	db          database.EmbedDB
-	tmpDBMaker  func() database.EmbedDB
-	aofChan     chan *payload
-	aofFile     *os.File
-	aofFilename string
+	db database.EmbedDB
+	// snapshotMaker takes snapshot of db, cut will be called when no command is executing
+	snapshotMaker func(cut func()) (database.Snapshot, error)
+	aofChan       chan *payload
+	aofFile       *os.File // incr file being written
+	aofDir        string
+	aofFilename   string // prefix of file names in aofDir
+	// single file aof of older version, it will be moved into aofDir as base file
+	legacyFilename string
+	// files of multi-part aof, protected by pausingAof
+	manifest  *manifest
+	rewriting int32
+	// size of aof files, accessed atomically
+	currentSize int64
+	baseSize    int64 // size after the latest rewrite or loading, for auto rewrite
+	// rewrite automatically if aof is larger than it, see auto-aof-rewrite-min-size
+	autoRewriteMinSize int64
 	// aof goroutine will send msg to main goroutine through this channel when aof tasks finished and ready to shutdown
 	aofFinished chan struct{}
 	// pause aof for start/finish aof rewrite progress
 	pausingAof sync.RWMutex
 	currentDB  int
+	// timestamp of the latest annotation written in current incr file
+	lastTimestamp int64
+
+	aofFsync   string
+	stopSyncer chan struct{}
+	statsMu    sync.Mutex
+	stats      FsyncStats
+	// error of the latest failed write or fsync, cleared after a successful fsync, protected by statsMu
+	writeErr error
+	// count of failed writes and fsyncs, protected by statsMu
+	writeErrCount int64
+	// fileMu protects fileSize and torn, lock fileMu before statsMu
+	fileMu sync.Mutex
+	// size of complete records in incr file, partial data of a failed write is truncated back to it
+	fileSize int64
+	// a write failed and its partial data has not been truncated yet
+	torn bool
+	// use variables to allow injecting stubs for testing
+	fsyncImpl    func(file *os.File) error
+	writeImpl    func(file *os.File, data []byte) (int, error)
+	truncateImpl func(file *os.File, size int64) error
+}
+
+func getFsyncPolicy() string {
+	policy := strings.ToLower(config.Properties.AppendFsync)
+	switch policy {
+	case FsyncAlways, FsyncEverySec, FsyncNo:
+		return policy
+	case "":
+	default:
+		logger.Warn("illegal appendfsync: " + config.Properties.AppendFsync + ", use everysec instead")
+	}
+	return FsyncEverySec
+}
+
+func getAutoRewriteMinSize() int64 {
+	if config.Properties.AutoAofRewriteMinSize == "" {
+		return defaultAutoRewriteMinSize
+	}
+	size, err := parseSize(config.Properties.AutoAofRewriteMinSize)
+	if err != nil {
+		logger.Warn("illegal auto-aof-rewrite-min-size: " + config.Properties.AutoAofRewriteMinSize + ", use 64mb instead")
+		return defaultAutoRewriteMinSize
+	}
+	return size
 }
 
 // NewAOFHandler creates a new aof.Handler
-func NewAOFHandler(db database.EmbedDB, tmpDBMaker func() database.EmbedDB) (*Handler, error) {
-	handler := &Handler{}
-	handler.aofFilename = config.Properties.AppendFilename
+func NewAOFHandler(db database.EmbedDB, snapshotMaker func(cut func()) (database.Snapshot, error)) (*Handler, error) {
+	handler := &Handler{
+		fsyncImpl:    (*os.File).Sync,
+		writeImpl:    (*os.File).Write,
+		truncateImpl: (*os.File).Truncate,
+	}
+	handler.legacyFilename = config.Properties.AppendFilename
+	if handler.legacyFilename == "" {
+		handler.legacyFilename = defaultAofName
+	}
+	handler.aofFilename = filepath.Base(handler.legacyFilename)
+	handler.aofDir = config.Properties.AppendDirname
+	if handler.aofDir == "" {
+		handler.aofDir = filepath.Dir(handler.legacyFilename)
+	}
 	handler.db = db
-	handler.tmpDBMaker = tmpDBMaker
-	handler.LoadAof(0)
-	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	handler.snapshotMaker = snapshotMaker
+	handler.autoRewriteMinSize = getAutoRewriteMinSize()
+	err := os.MkdirAll(handler.aofDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	handler.manifest, err = handler.loadManifest()
+	if err != nil {
+		return nil, err
+	}
+	err = handler.cleanObsoleteFiles()
+	if err != nil {
+		return nil, err
+	}
+	err = handler.loadFiles(handler.manifest.files(), config.Properties.AofLoadTruncated)
+	if err != nil {
+		return nil, err
+	}
+	if len(handler.manifest.incrs) == 0 {
+		handler.aofFile, err = handler.openNewIncrFile()
+	} else {
+		last := handler.manifest.incrs[len(handler.manifest.incrs)-1]
+		handler.aofFile, err = os.OpenFile(handler.filePath(last), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stat, err := handler.aofFile.Stat()
 	if err != nil {
+		_ = handler.aofFile.Close()
 		return nil, err
 	}
-	handler.aofFile = aofFile
+	handler.fileSize = stat.Size()
+	handler.resetSize()
+	handler.aofFsync = getFsyncPolicy()
 	handler.aofChan = make(chan *payload, aofQueueSize)
 	handler.aofFinished = make(chan struct{})
 	go func() {
 		handler.handleAof()
 	}()
+	handler.stopSyncer = make(chan struct{})
+	go handler.backgroundSync()
 	return handler, nil
 }
 
+// openNewIncrFile creates a new incr file and adds it into manifest, invoker should hold pausingAof
+func (handler *Handler) openNewIncrFile() (*os.File, error) {
+	info := &aofFileInfo{
+		name:     handler.incrFileName(handler.manifest.lastIncrSeq() + 1),
+		seq:      handler.manifest.lastIncrSeq() + 1,
+		fileType: aofTypeIncr,
+	}
+	file, err := os.OpenFile(handler.filePath(info), os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m := handler.manifest.clone()
+	m.incrs = append(m.incrs, info)
+	err = handler.persistManifest(m)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
 // AddAof send command to aof goroutine through channel
+// if appendfsync is always, AddAof blocks until the command has been fsynced
 func (handler *Handler) AddAof(dbIndex int, cmdLine CmdLine) {
 	if config.Properties.AppendOnly && handler.aofChan != nil {
-		handler.aofChan <- &payload{
-			cmdLine: cmdLine,
-			dbIndex: dbIndex,
+		p := &payload{
+			cmdLine:   cmdLine,
+			dbIndex:   dbIndex,
+			timestamp: time.Now().Unix(),
+		}
+		if handler.aofFsync == FsyncAlways {
+			p.wg = &sync.WaitGroup{}
+			p.wg.Add(1)
+		}
+		handler.aofChan <- p
+		if p.wg != nil {
+			p.wg.Wait()
 		}
 	}
 }
@@ -73,31 +236,220 @@ func (handler *Handler) AddAof(dbIndex int, cmdLine CmdLine) {
 // handleAof listen aof channel and write into file
 func (handler *Handler) handleAof() {
 	// serialized execution
-	handler.currentDB = 0
 	for p := range handler.aofChan {
+		if p.rewrite != nil {
+			handler.cutForRewrite(p.rewrite)
+			continue
+		}
 		handler.pausingAof.RLock() // prevent other goroutines from pausing aof
-		if p.dbIndex != handler.currentDB {
-			// select db
-			data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))).ToBytes()
-			_, err := handler.aofFile.Write(data)
-			if err != nil {
-				logger.Warn(err)
-				continue // skip this command
+		handler.writeAof(p)
+		var cut *payload
+		if handler.aofFsync == FsyncAlways {
+			// group commit: write all queued commands then fsync once for them
+			written := []*payload{p}
+		drain:
+			for {
+				select {
+				case next, ok := <-handler.aofChan:
+					if !ok {
+						break drain
+					}
+					if next.rewrite != nil {
+						cut = next
+						break drain
+					}
+					handler.writeAof(next)
+					written = append(written, next)
+				default:
+					break drain
+				}
+			}
+			handler.fsync()
+			for _, w := range written {
+				if w.wg != nil {
+					w.wg.Done()
+				}
 			}
-			handler.currentDB = p.dbIndex
-		}
-		data := protocol.MakeMultiBulkReply(p.cmdLine).ToBytes()
-		_, err := handler.aofFile.Write(data)
-		if err != nil {
-			logger.Warn(err)
 		}
 		handler.pausingAof.RUnlock()
+		if cut != nil {
+			handler.cutForRewrite(cut.rewrite)
+		}
+		handler.checkAutoRewrite()
 	}
 	handler.aofFinished <- struct{}{}
 }
 
-// LoadAof read aof file
-func (handler *Handler) LoadAof(maxBytes int) {
+func (handler *Handler) writeAof(p *payload) {
+	if p.timestamp > handler.lastTimestamp {
+		// annotate time for point-in-time recovery, at most once per second
+		err := handler.write(makeTimestampAnnotation(p.timestamp))
+		if err != nil {
+			handler.setWriteErr(err)
+			return // skip this command
+		}
+		handler.lastTimestamp = p.timestamp
+	}
+	if p.dbIndex != handler.currentDB {
+		// select db
+		err := handler.write(protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(p.dbIndex))).ToBytes())
+		if err != nil {
+			handler.setWriteErr(err)
+			return // skip this command
+		}
+		handler.currentDB = p.dbIndex
+	}
+	err := handler.write(protocol.MakeMultiBulkReply(p.cmdLine).ToBytes())
+	if err != nil {
+		handler.setWriteErr(err)
+	}
+}
+
+// write appends a complete record to incr file. Partial data of a failed write (e.g. ENOSPC) is truncated,
+// otherwise the torn record in the middle of aof makes loading fail.
+func (handler *Handler) write(data []byte) error {
+	handler.fileMu.Lock()
+	defer handler.fileMu.Unlock()
+	err := handler.repairTorn()
+	if err != nil {
+		return err
+	}
+	n, err := handler.writeImpl(handler.aofFile, data)
+	if err != nil {
+		handler.torn = true
+		if repairErr := handler.repairTorn(); repairErr != nil {
+			logger.Warn(repairErr.Error()) // fsync will retry it
+		}
+		return err
+	}
+	handler.fileSize += int64(n)
+	atomic.AddInt64(&handler.currentSize, int64(n))
+	return nil
+}
+
+// repairTorn truncates partial data of the failed write, invoker should hold fileMu
+func (handler *Handler) repairTorn() error {
+	if !handler.torn {
+		return nil
+	}
+	err := handler.truncateImpl(handler.aofFile, handler.fileSize)
+	if err != nil {
+		return errors.New("truncate torn aof record failed: " + err.Error())
+	}
+	// file is opened with O_APPEND, so the next write goes to the new end without seeking
+	handler.torn = false
+	return nil
+}
+
+// setWriteErr records a failed write or fsync, write commands are refused until torn record is truncated and a later fsync succeeds
+func (handler *Handler) setWriteErr(err error) {
+	logger.Warn("aof write failed: " + err.Error())
+	handler.statsMu.Lock()
+	defer handler.statsMu.Unlock()
+	handler.writeErr = err
+	handler.writeErrCount++
+}
+
+// WriteErr returns error of the latest failed write or fsync, it is nil if aof has been fsynced successfully since then.
+// count is increased on every failure, so invoker could find out failures during a period.
+func (handler *Handler) WriteErr() (err error, count int64) {
+	handler.statsMu.Lock()
+	defer handler.statsMu.Unlock()
+	return handler.writeErr, handler.writeErrCount
+}
+
+// fsync flushes aof file to disk and records latency, invoker should hold pausingAof.
+// Write error is cleared only if there is no torn record left and fsync succeeded.
+func (handler *Handler) fsync() {
+	handler.fileMu.Lock()
+	err := handler.repairTorn()
+	handler.fileMu.Unlock()
+	if err != nil {
+		handler.setWriteErr(err)
+		return
+	}
+	start := time.Now()
+	err = handler.fsyncImpl(handler.aofFile)
+	latency := time.Since(start)
+	if err != nil {
+		handler.setWriteErr(errors.New("fsync failed: " + err.Error()))
+		return
+	}
+	handler.fileMu.Lock()
+	defer handler.fileMu.Unlock()
+	handler.statsMu.Lock()
+	defer handler.statsMu.Unlock()
+	if !handler.torn { // a write may fail during fsync
+		handler.writeErr = nil
+	}
+	handler.stats.Count++
+	handler.stats.LastLatency = latency
+	handler.stats.TotalLatency += latency
+	if latency > handler.stats.MaxLatency {
+		handler.stats.MaxLatency = latency
+	}
+	if latency > fsyncDelayThreshold {
+		handler.stats.Delayed++
+		logger.Warn("aof fsync is taking too long (disk is busy?), latency: " + latency.String())
+	}
+}
+
+// backgroundSync does fsync every second if appendfsync is everysec,
+// it also retries fsync every second after a failure whatever the policy is
+func (handler *Handler) backgroundSync() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err, _ := handler.WriteErr(); handler.aofFsync != FsyncEverySec && err == nil {
+				continue
+			}
+			handler.pausingAof.RLock()
+			handler.fsync()
+			handler.pausingAof.RUnlock()
+		case <-handler.stopSyncer:
+			return
+		}
+	}
+}
+
+// GetFsyncStats returns statistics of aof fsync
+func (handler *Handler) GetFsyncStats() FsyncStats {
+	handler.statsMu.Lock()
+	defer handler.statsMu.Unlock()
+	return handler.stats
+}
+
+// GetSize returns current size of aof files and the size after the latest rewrite
+func (handler *Handler) GetSize() (current int64, base int64) {
+	return atomic.LoadInt64(&handler.currentSize), atomic.LoadInt64(&handler.baseSize)
+}
+
+// IsRewriting returns whether aof rewrite is in progress
+func (handler *Handler) IsRewriting() bool {
+	return atomic.LoadInt32(&handler.rewriting) == 1
+}
+
+// GetFsyncPolicy returns appendfsync policy in use
+func (handler *Handler) GetFsyncPolicy() string {
+	return handler.aofFsync
+}
+
+// loadFiles loads base and incr files in order
+// if allowTruncated, partial command at the end of the last file will be truncated
+func (handler *Handler) loadFiles(files []*aofFileInfo, allowTruncated bool) error {
+	for i, info := range files {
+		err := handler.loadFile(handler.filePath(info), allowTruncated && i == len(files)-1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFile reads an aof file, which may be a rdb file or an aof with rdb preamble
+func (handler *Handler) loadFile(filename string, allowTruncated bool) error {
 	// delete aofChan to prevent write again
 	aofChan := handler.aofChan
 	handler.aofChan = nil
@@ -105,42 +457,34 @@ func (handler *Handler) LoadAof(maxBytes int) {
 		handler.aofChan = aofChan
 	}(aofChan)
 
-	file, err := os.Open(handler.aofFilename)
+	file, err := os.Open(filename)
 	if err != nil {
-		if _, ok := err.(*os.PathError); ok {
-			return
-		}
-		logger.Warn(err)
-		return
+		return err
 	}
 	defer file.Close()
 
-	var reader io.Reader
-	if maxBytes > 0 {
-		reader = io.LimitReader(file, int64(maxBytes))
-	} else {
-		reader = file
-	}
-	ch := parser.ParseStream(reader)
-	fakeConn := &connection.FakeConn{} // only used for save dbIndex
-	for p := range ch {
-		if p.Err != nil {
-			if p.Err == io.EOF {
-				break
-			}
-			logger.Error("parse error: " + p.Err.Error())
-			continue
+	reader, err := newCmdReader(file, handler.db.LoadRDB)
+	if err != nil {
+		return errors.New("load rdb preamble of " + filename + " failed: " + err.Error())
+	}
+	fakeConn := &connection.FakeConn{} // only used for save dbIndex, every file starts from db 0
+	for {
+		cmdLine, offset, err := reader.readCmd()
+		if err == io.EOF {
+			return nil
 		}
-		if p.Data == nil {
-			logger.Error("empty payload")
-			continue
+		if err == io.ErrUnexpectedEOF {
+			// the last write is torn, usually caused by crash
+			if !allowTruncated {
+				return fmt.Errorf("aof file %s is truncated at offset %d, set aof-load-truncated or fix it by godis-check-aof", filename, offset)
+			}
+			logger.Warn(fmt.Sprintf("aof file %s is truncated, remove partial command after offset %d", filename, offset))
+			return os.Truncate(filename, offset)
 		}
-		r, ok := p.Data.(*protocol.MultiBulkReply)
-		if !ok {
-			logger.Error("require multi bulk protocol")
-			continue
+		if err != nil {
+			return fmt.Errorf("load aof file %s failed: %v", filename, err)
 		}
-		ret := handler.db.Exec(fakeConn, r.Args)
+		ret := handler.db.Exec(fakeConn, cmdLine)
 		if protocol.IsErrorReply(ret) {
 			logger.Error("exec err", ret.ToBytes())
 		}
@@ -152,6 +496,12 @@ func (handler *Handler) Close() {
 	if handler.aofFile != nil {
 		close(handler.aofChan)
 		<-handler.aofFinished // wait for aof finished
+		if handler.stopSyncer != nil {
+			handler.stopSyncer <- struct{}{} // wait for running fsync finished
+		}
+		if handler.aofFsync != FsyncNo {
+			handler.fsync()
+		}
 		err := handler.aofFile.Close()
 		if err != nil {
 			logger.Warn(err)
@@ -0,0 +1,218 @@
+package aof
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/lib/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDB is never called since aof is empty
+type fakeDB struct {
+	database.EmbedDB
+}
+
+func TestFsyncFailure(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: path.Join(tmpDir, "a.aof"),
+		AppendFsync:    FsyncAlways,
+	}
+	handler, err := NewAOFHandler(&fakeDB{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+
+	var broken int32 = 1
+	handler.fsyncImpl = func(file *os.File) error {
+		if atomic.LoadInt32(&broken) == 1 {
+			return errors.New("disk broken")
+		}
+		return file.Sync()
+	}
+	handler.AddAof(0, utils.ToCmdLine("SET", "a", "a"))
+	err, count := handler.WriteErr()
+	if err == nil || count != 1 {
+		t.Errorf("expect write error after fsync failed, actually %v, %d", err, count)
+	}
+
+	// fsync is retried in background
+	atomic.StoreInt32(&broken, 0)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		err, _ = handler.WriteErr()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Error("write error should be cleared after fsync succeeded")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	handler.AddAof(0, utils.ToCmdLine("SET", "b", "b"))
+	if _, count = handler.WriteErr(); count != 1 {
+		t.Errorf("expect no more failure, actually %d", count)
+	}
+}
+
+func TestTornWrite(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: path.Join(tmpDir, "a.aof"),
+		AppendFsync:    FsyncAlways,
+	}
+	handler, err := NewAOFHandler(&fakeDB{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+
+	handler.AddAof(0, utils.ToCmdLine("SET", "a", "a"))
+	// disk is full, only a part of the record is written
+	var diskFull, truncateBroken int32 = 1, 1
+	handler.writeImpl = func(file *os.File, data []byte) (int, error) {
+		if atomic.LoadInt32(&diskFull) == 1 {
+			n, _ := file.Write(data[:len(data)/2])
+			return n, errors.New("no space left on device")
+		}
+		return file.Write(data)
+	}
+	handler.truncateImpl = func(file *os.File, size int64) error {
+		if atomic.LoadInt32(&truncateBroken) == 1 {
+			return errors.New("io error")
+		}
+		return file.Truncate(size)
+	}
+	handler.AddAof(0, utils.ToCmdLine("SET", "b", "b"))
+	if err, _ := handler.WriteErr(); err == nil {
+		t.Error("expect write error")
+	}
+	// write error is kept until torn record truncated, even if fsync succeeds
+	atomic.StoreInt32(&diskFull, 0)
+	time.Sleep(1500 * time.Millisecond)
+	if err, _ := handler.WriteErr(); err == nil {
+		t.Error("write error should not be cleared before torn record truncated")
+	}
+
+	atomic.StoreInt32(&truncateBroken, 0)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		err, _ = handler.WriteErr()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Error("write error should be cleared after torn record truncated")
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	handler.AddAof(0, utils.ToCmdLine("SET", "c", "c"))
+
+	// aof is still loadable, the failed command is skipped
+	var cmds []string
+	reader, err := os.Open(handler.aofFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	cmdReader, err := newCmdReader(reader, skipRDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		cmdLine, _, err := cmdReader.readCmd()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("aof is corrupted: %v", err)
+		}
+		cmds = append(cmds, string(cmdLine[1]))
+	}
+	if strings.Join(cmds, ",") != "a,c" {
+		t.Errorf("unexpected commands %v", cmds)
+	}
+}
+
+func TestRewriteAfter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: path.Join(tmpDir, "a.aof"),
+	}
+	var snapshots int32
+	handler, err := NewAOFHandler(&fakeDB{}, func(cut func()) (database.Snapshot, error) {
+		atomic.AddInt32(&snapshots, 1)
+		return nil, errors.New("no snapshot")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handler.Close()
+
+	// fn is called after rewriting in progress finished
+	atomic.StoreInt32(&handler.rewriting, 1)
+	var called int32
+	done := make(chan error, 1)
+	go func() {
+		done <- handler.RewriteAfter(func() error {
+			atomic.StoreInt32(&called, 1)
+			return nil
+		})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&called) != 0 {
+		t.Error("fn should wait for rewriting in progress")
+	}
+	atomic.StoreInt32(&handler.rewriting, 0)
+	select {
+	case err = <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("RewriteAfter should not be blocked after rewriting finished")
+	}
+	if err == nil || err.Error() != "no snapshot" || atomic.LoadInt32(&snapshots) != 1 {
+		t.Errorf("expect rewrite after fn, actually %v, %d", err, snapshots)
+	}
+	if handler.IsRewriting() {
+		t.Error("rewriting flag should be released")
+	}
+
+	// rewrite is skipped if fn failed
+	err = handler.RewriteAfter(func() error {
+		return errors.New("fn failed")
+	})
+	if err == nil || err.Error() != "fn failed" || atomic.LoadInt32(&snapshots) != 1 {
+		t.Errorf("expect rewrite skipped, actually %v, %d", err, snapshots)
+	}
+}
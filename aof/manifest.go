@@ -0,0 +1,309 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Multi-part aof persists data in a directory:
+ *   - base file: snapshot written by rewrite, in rdb format (appendonly.aof.1.base.rdb) or aof format (appendonly.aof.1.base.aof)
+ *   - incr files: commands executed after snapshot, only the last one is being written (appendonly.aof.1.incr.aof)
+ *   - manifest file: lists base and incr files in loading order (appendonly.aof.manifest)
+ * Rewrite switches writing to a new incr file then replaces the manifest atomically,
+ * so data files are never modified except for appending.
+ */
+
+const (
+	aofTypeBase    = 'b'
+	aofTypeIncr    = 'i'
+	aofTypeHistory = 'h' // obsolete file waiting for deletion
+
+	baseSuffix     = ".base"
+	incrSuffix     = ".incr"
+	aofExt         = ".aof"
+	rdbExt         = ".rdb"
+	manifestExt    = ".manifest"
+	tempPrefix     = "temp-"
+	defaultAofName = "appendonly.aof"
+)
+
+// aofFileInfo is an entry in manifest
+type aofFileInfo struct {
+	name     string // file name without directory
+	seq      int
+	fileType byte
+}
+
+type manifest struct {
+	base    *aofFileInfo
+	incrs   []*aofFileInfo
+	history []*aofFileInfo
+}
+
+// files returns base and incr files in loading order
+func (m *manifest) files() []*aofFileInfo {
+	var files []*aofFileInfo
+	if m.base != nil {
+		files = append(files, m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *manifest) lastIncrSeq() int {
+	if len(m.incrs) == 0 {
+		return 0
+	}
+	return m.incrs[len(m.incrs)-1].seq
+}
+
+func (m *manifest) baseSeq() int {
+	if m.base == nil {
+		return 0
+	}
+	return m.base.seq
+}
+
+func (m *manifest) clone() *manifest {
+	return &manifest{
+		base:    m.base,
+		incrs:   append([]*aofFileInfo{}, m.incrs...),
+		history: append([]*aofFileInfo{}, m.history...),
+	}
+}
+
+// encode manifest in the same format as redis: file <name> seq <seq> type <b|i|h>
+func (m *manifest) encode() []byte {
+	var builder strings.Builder
+	writeEntry := func(info *aofFileInfo, fileType byte) {
+		builder.WriteString(fmt.Sprintf("file %s seq %d type %c\n", info.name, info.seq, fileType))
+	}
+	if m.base != nil {
+		writeEntry(m.base, aofTypeBase)
+	}
+	for _, info := range m.history {
+		writeEntry(info, aofTypeHistory)
+	}
+	for _, info := range m.incrs {
+		writeEntry(info, aofTypeIncr)
+	}
+	return []byte(builder.String())
+}
+
+func parseManifest(data []byte) (*manifest, error) {
+	m := &manifest{}
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid aof manifest at line %d: %s", lineNum, line)
+		}
+		info := &aofFileInfo{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				info.name = fields[i+1]
+			case "seq":
+				seq, err := strconv.Atoi(fields[i+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid aof manifest at line %d: %s", lineNum, line)
+				}
+				info.seq = seq
+			case "type":
+				info.fileType = fields[i+1][0]
+			}
+		}
+		if info.name == "" || strings.ContainsRune(info.name, filepath.Separator) {
+			return nil, fmt.Errorf("invalid aof manifest at line %d: %s", lineNum, line)
+		}
+		switch info.fileType {
+		case aofTypeBase:
+			if m.base != nil {
+				return nil, fmt.Errorf("invalid aof manifest at line %d: duplicate base file", lineNum)
+			}
+			m.base = info
+		case aofTypeIncr:
+			m.incrs = append(m.incrs, info)
+		case aofTypeHistory:
+			m.history = append(m.history, info)
+		default:
+			return nil, fmt.Errorf("invalid aof manifest at line %d: unknown file type", lineNum)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (handler *Handler) manifestPath() string {
+	return filepath.Join(handler.aofDir, handler.aofFilename+manifestExt)
+}
+
+func (handler *Handler) filePath(info *aofFileInfo) string {
+	return filepath.Join(handler.aofDir, info.name)
+}
+
+func (handler *Handler) baseFileName(seq int, rdbFormat bool) string {
+	ext := aofExt
+	if rdbFormat {
+		ext = rdbExt
+	}
+	return handler.aofFilename + "." + strconv.Itoa(seq) + baseSuffix + ext
+}
+
+func (handler *Handler) incrFileName(seq int) string {
+	return handler.aofFilename + "." + strconv.Itoa(seq) + incrSuffix + aofExt
+}
+
+// loadManifest reads manifest of aof dir, a legacy single aof file will be used as base if manifest not exists
+func (handler *Handler) loadManifest() (*manifest, error) {
+	data, err := ioutil.ReadFile(handler.manifestPath())
+	if err == nil {
+		m, err := parseManifest(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range m.files() {
+			if _, err := os.Stat(handler.filePath(info)); err != nil {
+				return nil, fmt.Errorf("aof file %s listed in manifest is missing: %v", info.name, err)
+			}
+		}
+		return m, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	m := &manifest{}
+	legacy := &aofFileInfo{
+		name:     handler.aofFilename,
+		seq:      1,
+		fileType: aofTypeBase,
+	}
+	if _, err := os.Stat(handler.legacyFilename); err == nil {
+		// upgrade from single file aof, move it into aof dir as base file
+		if handler.legacyFilename != handler.filePath(legacy) {
+			err = os.Rename(handler.legacyFilename, handler.filePath(legacy))
+			if err != nil {
+				return nil, err
+			}
+		}
+		m.base = legacy
+	}
+	return m, nil
+}
+
+// persistManifest replaces manifest atomically, then it becomes the current manifest
+func (handler *Handler) persistManifest(m *manifest) error {
+	tmpPath := filepath.Join(handler.aofDir, tempPrefix+handler.aofFilename+manifestExt)
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(m.encode())
+	if err == nil {
+		err = file.Sync()
+	}
+	_ = file.Close()
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, handler.manifestPath())
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	handler.manifest = m
+	return syncDir(handler.aofDir)
+}
+
+// syncDir makes renaming and creating in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	// some platforms do not support fsync on directory, ignore its error
+	_ = d.Sync()
+	return nil
+}
+
+// cleanObsoleteFiles removes history files and files not referenced by current manifest,
+// which may be left by crashing during rewrite
+func (handler *Handler) cleanObsoleteFiles() error {
+	m := handler.manifest
+	if len(m.history) > 0 {
+		for _, info := range m.history {
+			err := os.Remove(handler.filePath(info))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		m = m.clone()
+		m.history = nil
+		if err := handler.persistManifest(m); err != nil {
+			return err
+		}
+	}
+	referenced := make(map[string]struct{})
+	for _, info := range m.files() {
+		referenced[info.name] = struct{}{}
+	}
+	entries, err := ioutil.ReadDir(handler.aofDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !handler.isManagedFile(name) {
+			continue
+		}
+		if _, ok := referenced[name]; ok {
+			continue
+		}
+		err := os.Remove(filepath.Join(handler.aofDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isManagedFile returns whether the file is a base, incr or temp file of this handler
+func (handler *Handler) isManagedFile(name string) bool {
+	if strings.HasPrefix(name, tempPrefix+handler.aofFilename) {
+		return true
+	}
+	prefix := handler.aofFilename + "."
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	// <seq>.base.aof, <seq>.base.rdb or <seq>.incr.aof
+	parts := strings.SplitN(name[len(prefix):], ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	if _, err := strconv.Atoi(parts[0]); err != nil {
+		return false
+	}
+	switch "." + parts[1] {
+	case baseSuffix + aofExt, baseSuffix + rdbExt, incrSuffix + aofExt:
+		return true
+	}
+	return false
+}
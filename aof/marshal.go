@@ -20,10 +20,12 @@ func EntityToCmd(key string, entity *database.DataEntity) *protocol.MultiBulkRep
 	switch val := entity.Data.(type) {
 	case []byte:
 		cmd = stringToCmd(key, val)
-	case *List.LinkedList:
+	case List.List:
 		cmd = listToCmd(key, val)
 	case *set.Set:
 		cmd = setToCmd(key, val)
+	case *dict.TTLDict:
+		cmd = ttlHashToCmd(key, val)
 	case dict.Dict:
 		cmd = hashToCmd(key, val)
 	case *SortedSet.SortedSet:
@@ -44,7 +46,7 @@ func stringToCmd(key string, bytes []byte) *protocol.MultiBulkReply {
 
 var rPushAllCmd = []byte("RPUSH")
 
-func listToCmd(key string, list *List.LinkedList) *protocol.MultiBulkReply {
+func listToCmd(key string, list List.List) *protocol.MultiBulkReply {
 	args := make([][]byte, 2+list.Len())
 	args[0] = rPushAllCmd
 	args[1] = []byte(key)
@@ -88,6 +90,29 @@ func hashToCmd(key string, hash dict.Dict) *protocol.MultiBulkReply {
 	return protocol.MakeMultiBulkReply(args)
 }
 
+var hMSetPXAtCmd = []byte("HMSETPXAT")
+
+// ttlHashToCmd serializes hash with field-level ttl to HMSETPXAT command, which is a godis specific command,
+// args format: key field value unix-time-milliseconds ..., 0 means no expiration
+func ttlHashToCmd(key string, hash *dict.TTLDict) *protocol.MultiBulkReply {
+	if _, ok := hash.NextExpiration(); !ok {
+		return hashToCmd(key, hash)
+	}
+	args := make([][]byte, 2, 2+hash.Len()*3)
+	args[0] = hMSetPXAtCmd
+	args[1] = []byte(key)
+	hash.ForEach(func(field string, val interface{}) bool {
+		bytes, _ := val.([]byte)
+		var expireAt int64
+		if t, ok := hash.ExpireTime(field); ok {
+			expireAt = t.UnixNano() / 1e6
+		}
+		args = append(args, []byte(field), bytes, []byte(strconv.FormatInt(expireAt, 10)))
+		return true
+	})
+	return protocol.MakeMultiBulkReply(args)
+}
+
 var zAddCmd = []byte("ZADD")
 
 func zSetToCmd(key string, zset *SortedSet.SortedSet) *protocol.MultiBulkReply {
@@ -1,75 +1,94 @@
 package aof
 
 import (
-	"github.com/hdt3213/godis/config"
+	"bytes"
+	"errors"
 	"github.com/hdt3213/godis/datastruct/dict"
 	List "github.com/hdt3213/godis/datastruct/list"
 	"github.com/hdt3213/godis/datastruct/set"
 	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
 	"github.com/hdt3213/godis/interface/database"
-	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
 	rdb "github.com/hdt3213/rdb/encoder"
 	"github.com/hdt3213/rdb/model"
-	"io/ioutil"
-	"os"
+	"io"
 	"strconv"
 	"time"
 )
 
-func (handler *Handler) Rewrite2RDB() error {
-	ctx, err := handler.startRewrite2RDB()
-	if err != nil {
-		return err
-	}
-	err = handler.rewrite2RDB(ctx)
+// ErrFieldTTL means rdb has no field-level ttl, so hash with expiring fields could not be written into it
+var ErrFieldTTL = errors.New("hash with field-level ttl could not be written in rdb")
+
+// WriteRDB dumps snapshot into rdb file and counts keys of each database, len(keys) is the number of databases.
+// Hashes with field-level ttl are appended after rdb as commands, see SplitRDB.
+func WriteRDB(writer io.Writer, snapshot database.Snapshot, keys []int64) error {
+	return writeRDB(writer, snapshot, false, keys)
+}
+
+// writeRDB dumps all data of db in rdb format, aof rewrite uses it to write base file if aof-use-rdb-preamble enabled.
+// Rdb has no field-level ttl, so hashes with expiring fields are appended after rdb as commands,
+// the aof loader replays them after loading rdb. keys counts keys of each database.
+func writeRDB(writer io.Writer, snapshot database.Snapshot, aofPreamble bool, keys []int64) error {
+	encoder := rdb.NewEncoder(writer).EnableCompress()
+	err := writeRDBHeader(encoder, aofPreamble)
 	if err != nil {
 		return err
 	}
-	rdbFilename := config.Properties.RDBFilename
-	if rdbFilename == "" {
-		rdbFilename = "dump.rdb"
-	}
-	err = ctx.tmpFile.Close()
-	if err != nil {
-		return err
+
+	tail := &bytes.Buffer{}
+	for i := range keys {
+		// size of snapshot is unknown until traversing, write db header before the first key
+		headerWritten := false
+		tailSelected := false
+		snapshot.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			if hasFieldTTL(entity) {
+				// entity may be modified once traversed, so it is serialized right now
+				if !tailSelected {
+					tail.Write(protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes())
+					tailSelected = true
+				}
+				tail.Write(EntityToCmd(key, entity).ToBytes())
+				if expiration != nil {
+					tail.Write(MakeExpireCmd(key, *expiration).ToBytes())
+				}
+				keys[i]++
+				return true
+			}
+			if !headerWritten {
+				keyCount, ttlCount := snapshot.GetDBSize(i)
+				err = encoder.WriteDBHeader(uint(i), uint64(keyCount), uint64(ttlCount))
+				if err != nil {
+					return false
+				}
+				headerWritten = true
+			}
+			err = EntityToRDB(encoder, key, entity, expiration)
+			keys[i]++
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
 	}
-	err = os.Rename(ctx.tmpFile.Name(), rdbFilename)
+	err = encoder.WriteEnd()
 	if err != nil {
 		return err
 	}
-	return nil
+	_, err = tail.WriteTo(writer)
+	return err
 }
 
-func (handler *Handler) startRewrite2RDB() (*RewriteCtx, error) {
-	handler.pausingAof.Lock() // pausing aof
-	defer handler.pausingAof.Unlock()
-
-	err := handler.aofFile.Sync()
-	if err != nil {
-		logger.Warn("fsync failed")
-		return nil, err
-	}
-
-	// get current aof file size
-	fileInfo, _ := os.Stat(handler.aofFilename)
-	filesize := fileInfo.Size()
-	// create tmp file
-	file, err := ioutil.TempFile("", "*.aof")
-	if err != nil {
-		logger.Warn("tmp file create failed")
-		return nil, err
-	}
-	return &RewriteCtx{
-		tmpFile:  file,
-		fileSize: filesize,
-	}, nil
+// WriteRDBHeader writes rdb header and aux fields
+func WriteRDBHeader(encoder *rdb.Encoder) error {
+	return writeRDBHeader(encoder, false)
 }
 
-func (handler *Handler) rewrite2RDB(ctx *RewriteCtx) error {
-	// load aof tmpFile
-	tmpHandler := handler.newRewriteHandler()
-	tmpHandler.LoadAof(int(ctx.fileSize))
-	encoder := rdb.NewEncoder(ctx.tmpFile).EnableCompress()
+func writeRDBHeader(encoder *rdb.Encoder, aofPreamble bool) error {
+	preamble := "0"
+	if aofPreamble {
+		preamble = "1"
+	}
 	err := encoder.WriteHeader()
 	if err != nil {
 		return err
@@ -77,7 +96,7 @@ func (handler *Handler) rewrite2RDB(ctx *RewriteCtx) error {
 	auxMap := map[string]string{
 		"redis-ver":    "6.0.0",
 		"redis-bits":   "64",
-		"aof-preamble": "0",
+		"aof-preamble": preamble,
 		"ctime":        strconv.FormatInt(time.Now().Unix(), 10),
 	}
 	for k, v := range auxMap {
@@ -86,73 +105,66 @@ func (handler *Handler) rewrite2RDB(ctx *RewriteCtx) error {
 			return err
 		}
 	}
+	return nil
+}
 
-	for i := 0; i < config.Properties.Databases; i++ {
-		keyCount, ttlCount := tmpHandler.db.GetDBSize(i)
-		if keyCount == 0 {
-			continue
-		}
-		err = encoder.WriteDBHeader(uint(i), uint64(keyCount), uint64(ttlCount))
-		if err != nil {
-			return err
-		}
-		// dump db
-		var err2 error
-		tmpHandler.db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
-			var opts []interface{}
-			if expiration != nil {
-				opts = append(opts, rdb.WithTTL(uint64(expiration.UnixNano()/1e6)))
-			}
-			switch obj := entity.Data.(type) {
-			case []byte:
-				err = encoder.WriteStringObject(key, obj, opts...)
-			case *List.LinkedList:
-				vals := make([][]byte, 0, obj.Len())
-				obj.ForEach(func(i int, v interface{}) bool {
-					bytes, _ := v.([]byte)
-					vals = append(vals, bytes)
-					return true
-				})
-				err = encoder.WriteListObject(key, vals, opts...)
-			case *set.Set:
-				vals := make([][]byte, 0, obj.Len())
-				obj.ForEach(func(m string) bool {
-					vals = append(vals, []byte(m))
-					return true
-				})
-				err = encoder.WriteSetObject(key, vals, opts...)
-			case dict.Dict:
-				hash := make(map[string][]byte)
-				obj.ForEach(func(key string, val interface{}) bool {
-					bytes, _ := val.([]byte)
-					hash[key] = bytes
-					return true
-				})
-				err = encoder.WriteHashMapObject(key, hash, opts...)
-			case *SortedSet.SortedSet:
-				var entries []*model.ZSetEntry
-				obj.ForEach(int64(0), obj.Len(), true, func(element *SortedSet.Element) bool {
-					entries = append(entries, &model.ZSetEntry{
-						Member: element.Member,
-						Score:  element.Score,
-					})
-					return true
-				})
-				err = encoder.WriteZSetObject(key, entries, opts...)
-			}
-			if err != nil {
-				err2 = err
-				return false
-			}
+// hasFieldTTL tells whether entity is a hash with expiring fields
+func hasFieldTTL(entity *database.DataEntity) bool {
+	hash, ok := entity.Data.(*dict.TTLDict)
+	if !ok {
+		return false
+	}
+	_, ok = hash.NextExpiration()
+	return ok
+}
+
+// EntityToRDB writes an entity into rdb, expiration is nil if key has no ttl.
+// It returns ErrFieldTTL instead of dropping ttl of fields silently.
+func EntityToRDB(encoder *rdb.Encoder, key string, entity *database.DataEntity, expiration *time.Time) error {
+	if hasFieldTTL(entity) {
+		return ErrFieldTTL
+	}
+	var opts []interface{}
+	if expiration != nil {
+		opts = append(opts, rdb.WithTTL(uint64(expiration.UnixNano()/1e6)))
+	}
+	switch obj := entity.Data.(type) {
+	case []byte:
+		return encoder.WriteStringObject(key, obj, opts...)
+	case List.List:
+		vals := make([][]byte, 0, obj.Len())
+		obj.ForEach(func(i int, v interface{}) bool {
+			bytes, _ := v.([]byte)
+			vals = append(vals, bytes)
 			return true
 		})
-		if err2 != nil {
-			return err2
-		}
-	}
-	err = encoder.WriteEnd()
-	if err != nil {
-		return err
+		return encoder.WriteListObject(key, vals, opts...)
+	case *set.Set:
+		vals := make([][]byte, 0, obj.Len())
+		obj.ForEach(func(m string) bool {
+			vals = append(vals, []byte(m))
+			return true
+		})
+		return encoder.WriteSetObject(key, vals, opts...)
+	case dict.Dict:
+		// hash with field-level ttl has been refused, TTLDict here has no expiring fields
+		hash := make(map[string][]byte)
+		obj.ForEach(func(key string, val interface{}) bool {
+			bytes, _ := val.([]byte)
+			hash[key] = bytes
+			return true
+		})
+		return encoder.WriteHashMapObject(key, hash, opts...)
+	case *SortedSet.SortedSet:
+		var entries []*model.ZSetEntry
+		obj.ForEach(int64(0), obj.Len(), true, func(element *SortedSet.Element) bool {
+			entries = append(entries, &model.ZSetEntry{
+				Member: element.Member,
+				Score:  element.Score,
+			})
+			return true
+		})
+		return encoder.WriteZSetObject(key, entries, opts...)
 	}
 	return nil
 }
@@ -0,0 +1,245 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	rdbCore "github.com/hdt3213/rdb/core"
+	"github.com/hdt3213/rdb/model"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	rdbMagic = "REDIS"
+	// timestampAnnotation is written before commands every second, e.g. #TS:1660000000
+	timestampAnnotation = "#TS:"
+)
+
+// FormatError reports the first bad record in aof file
+type FormatError struct {
+	Offset int64 // offset of the bad record
+	Msg    string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("bad aof format at offset %d: %s", e.Offset, e.Msg)
+}
+
+// countingReader counts bytes read from underlying reader
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// cmdReader reads commands from aof file and tracks offset.
+// Unlike redis/parser it stops at the first bad record instead of skipping it.
+type cmdReader struct {
+	reader    *bufio.Reader
+	offset    int64 // offset of the next unread byte in file
+	timestamp int64 // unix timestamp of the latest annotation, 0 if no annotation read
+}
+
+// newCmdReader creates reader of aof file, loadRDB will be called with a rdb decoder if the file starts with rdb preamble
+func newCmdReader(reader io.Reader, loadRDB func(dec *rdbCore.Decoder) error) (*cmdReader, error) {
+	counter := &countingReader{reader: reader}
+	bufReader := bufio.NewReader(counter)
+	magic, err := bufReader.Peek(len(rdbMagic))
+	if err != nil || string(magic) != rdbMagic {
+		return &cmdReader{reader: bufReader}, nil
+	}
+	// decoder uses bufReader directly instead of wrapping another buffer because bufReader is large enough,
+	// so bufReader stops right after EOF opcode of rdb
+	err = loadRDB(rdbCore.NewDecoder(bufReader))
+	if err != nil {
+		return nil, err
+	}
+	// skip 8 bytes checksum, the encoder of godis writes an extra LF after it
+	_, err = bufReader.Discard(8)
+	if err != nil {
+		return nil, errors.New("rdb preamble is truncated")
+	}
+	if b, err := bufReader.Peek(1); err == nil && b[0] == '\n' {
+		_, _ = bufReader.Discard(1)
+	}
+	return &cmdReader{
+		reader: bufReader,
+		offset: counter.count - int64(bufReader.Buffered()),
+	}, nil
+}
+
+// SplitRDB splits rdb file written by WriteRDB into rdb and the commands appended after it.
+// If data could not be parsed, it is returned as rdb without commands, so that checksum verifying reports the error.
+func SplitRDB(data []byte) (rdbData []byte, cmds []byte) {
+	counter := &countingReader{reader: bytes.NewReader(data)}
+	bufReader := bufio.NewReader(counter)
+	if skipRDB(rdbCore.NewDecoder(bufReader)) != nil {
+		return data, nil
+	}
+	// godis writes 8 bytes checksum followed by a LF after EOF opcode, redis writes no LF and nothing after checksum
+	end := counter.count - int64(bufReader.Buffered()) + 9
+	if int64(len(data)) <= end || data[end-1] != '\n' {
+		return data, nil
+	}
+	return data[:end], data[end:]
+}
+
+// skipRDB validates rdb preamble without loading it
+func skipRDB(dec *rdbCore.Decoder) error {
+	return dec.Parse(func(o model.RedisObject) bool {
+		return true
+	})
+}
+
+// readLine reads a line and removes CRLF, it returns io.ErrUnexpectedEOF if file ends before CRLF
+func (r *cmdReader) readLine() ([]byte, error) {
+	start := r.offset
+	line, err := r.reader.ReadBytes('\n')
+	r.offset += int64(len(line))
+	if err == io.EOF {
+		if len(line) == 0 {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, &FormatError{Offset: start, Msg: "line is not terminated by CRLF"}
+	}
+	return line[:len(line)-2], nil
+}
+
+// readCmd returns the next command and offset of its first byte, annotations before the command are counted in.
+// It returns io.EOF if there is no more command, io.ErrUnexpectedEOF if file ends in the middle of a command
+// and *FormatError if the command is malformed.
+func (r *cmdReader) readCmd() (CmdLine, int64, error) {
+	start := r.offset
+	var header []byte
+	var headerStart int64
+	for {
+		headerStart = r.offset
+		line, err := r.readLine()
+		if err == io.EOF {
+			return nil, r.offset, err
+		}
+		if err != nil {
+			return nil, start, err
+		}
+		if len(line) == 0 || line[0] != '#' {
+			header = line
+			break
+		}
+		err = r.readAnnotation(line, headerStart)
+		if err != nil {
+			return nil, start, err
+		}
+	}
+	if len(header) == 0 || header[0] != '*' {
+		return nil, start, &FormatError{Offset: headerStart, Msg: "expect '*', got " + strconv.Quote(string(header))}
+	}
+	argc, err := strconv.Atoi(string(header[1:]))
+	if err != nil || argc < 1 {
+		return nil, start, &FormatError{Offset: headerStart, Msg: "invalid argument count " + strconv.Quote(string(header[1:]))}
+	}
+	cmdLine := make(CmdLine, 0, argc)
+	for i := 0; i < argc; i++ {
+		lineStart := r.offset
+		line, err := r.readLine()
+		if err == io.EOF {
+			return nil, start, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, start, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, start, &FormatError{Offset: lineStart, Msg: "expect '$', got " + strconv.Quote(string(line))}
+		}
+		size, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || size < 0 {
+			return nil, start, &FormatError{Offset: lineStart, Msg: "invalid bulk length " + strconv.Quote(string(line[1:]))}
+		}
+		arg := make([]byte, size+2)
+		n, err := io.ReadFull(r.reader, arg)
+		r.offset += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, start, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, start, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, start, &FormatError{Offset: lineStart, Msg: "bulk string is not terminated by CRLF"}
+		}
+		cmdLine = append(cmdLine, arg[:size])
+	}
+	return cmdLine, start, nil
+}
+
+// readAnnotation handles a line starting with '#', unknown annotations are ignored
+func (r *cmdReader) readAnnotation(line []byte, offset int64) error {
+	if !bytes.HasPrefix(line, []byte(timestampAnnotation)) {
+		return nil
+	}
+	timestamp, err := strconv.ParseInt(string(line[len(timestampAnnotation):]), 10, 64)
+	if err != nil {
+		return &FormatError{Offset: offset, Msg: "invalid timestamp annotation " + strconv.Quote(string(line))}
+	}
+	r.timestamp = timestamp
+	return nil
+}
+
+// CheckResult is the result of validating an aof file
+type CheckResult struct {
+	Size      int64
+	Commands  int
+	ValidSize int64 // size of valid prefix, it's also the offset of the first bad record
+	Truncated bool  // file ends in the middle of a command
+	Err       error // reason of the first bad record, nil if file is valid
+}
+
+// CheckFile validates an aof file, a base file in rdb format or an aof file with rdb preamble is also acceptable
+func CheckFile(filename string) (*CheckResult, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	result := &CheckResult{
+		Size: info.Size(),
+	}
+	reader, err := newCmdReader(file, skipRDB)
+	if err != nil {
+		result.Err = errors.New("invalid rdb preamble: " + err.Error())
+		return result, nil
+	}
+	for {
+		_, offset, err := reader.readCmd()
+		if err == io.EOF {
+			result.ValidSize = offset
+			return result, nil
+		}
+		if err != nil {
+			result.ValidSize = offset
+			result.Truncated = err == io.ErrUnexpectedEOF
+			result.Err = err
+			return result, nil
+		}
+		result.Commands++
+	}
+}
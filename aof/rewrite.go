@@ -1,57 +1,84 @@
 package aof
 
 import (
+	"errors"
+	"fmt"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
-	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-func (handler *Handler) newRewriteHandler() *Handler {
-	h := &Handler{}
-	h.aofFilename = handler.aofFilename
-	h.db = handler.tmpDBMaker()
-	return h
-}
-
 // RewriteCtx holds context of an AOF rewriting procedure
 type RewriteCtx struct {
-	tmpFile  *os.File
-	fileSize int64
-	dbIdx    int // selected db index when startRewrite
+	tmpFile   *os.File
+	snapshot  database.Snapshot
+	cutDone   chan error
+	files     []*aofFileInfo // base and incr files before cut point, they will be replaced by new base file
+	incrSeq   int            // seq of the first incr file after cut point
+	rdbFormat bool           // write base file in rdb format
+	timestamp int64          // unix timestamp of cut point
 }
 
 // Rewrite carries out AOF rewrite
 func (handler *Handler) Rewrite() error {
+	if !atomic.CompareAndSwapInt32(&handler.rewriting, 0, 1) {
+		return errors.New("ERR Background append only file rewriting already in progress")
+	}
+	defer atomic.StoreInt32(&handler.rewriting, 0)
+	return handler.rewrite()
+}
+
+// RewriteAfter waits for rewriting in progress, then calls fn and carries out AOF rewrite if fn succeeded.
+// No rewrite starts between them, so that the new base file holds changes made by fn, even if they are not in aof
+func (handler *Handler) RewriteAfter(fn func() error) error {
+	for !atomic.CompareAndSwapInt32(&handler.rewriting, 0, 1) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer atomic.StoreInt32(&handler.rewriting, 0)
+	err := fn()
+	if err != nil {
+		return err
+	}
+	return handler.rewrite()
+}
+
+// rewrite does rewrite procedure, invoker should set handler.rewriting
+func (handler *Handler) rewrite() error {
 	ctx, err := handler.StartRewrite()
 	if err != nil {
 		return err
 	}
 	err = handler.DoRewrite(ctx)
 	if err != nil {
+		_ = ctx.tmpFile.Close()
+		_ = os.Remove(ctx.tmpFile.Name())
 		return err
 	}
-
-	handler.FinishRewrite(ctx)
-	return nil
+	return handler.FinishRewrite(ctx)
 }
 
-// DoRewrite actually rewrite aof file
+// DoRewrite dumps snapshot of live dataset into tmp file, then releases the snapshot
 // makes DoRewrite public for testing only, please use Rewrite instead
 func (handler *Handler) DoRewrite(ctx *RewriteCtx) error {
+	defer ctx.snapshot.Release()
 	tmpFile := ctx.tmpFile
+	if ctx.rdbFormat {
+		return writeRDB(tmpFile, ctx.snapshot, true, make([]int64, config.Properties.Databases))
+	}
 
-	// load aof tmpFile
-	tmpAof := handler.newRewriteHandler()
-	tmpAof.LoadAof(int(ctx.fileSize))
-
-	// rewrite aof tmpFile
+	// rewrite aof tmpFile, the annotation records when the snapshot was taken
+	_, err := tmpFile.Write(makeTimestampAnnotation(ctx.timestamp))
+	if err != nil {
+		return err
+	}
 	for i := 0; i < config.Properties.Databases; i++ {
 		// select db
 		data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes()
@@ -60,101 +87,199 @@ func (handler *Handler) DoRewrite(ctx *RewriteCtx) error {
 			return err
 		}
 		// dump db
-		tmpAof.db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+		ctx.snapshot.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
 			cmd := EntityToCmd(key, entity)
 			if cmd != nil {
-				_, _ = tmpFile.Write(cmd.ToBytes())
+				_, err = tmpFile.Write(cmd.ToBytes())
 			}
-			if expiration != nil {
+			if err == nil && expiration != nil {
 				cmd := MakeExpireCmd(key, *expiration)
 				if cmd != nil {
-					_, _ = tmpFile.Write(cmd.ToBytes())
+					_, err = tmpFile.Write(cmd.ToBytes())
 				}
 			}
-			return true
+			return err == nil
 		})
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// StartRewrite prepares rewrite procedure
+// StartRewrite takes snapshot of live dataset and switches aof to a new incr file at the same moment,
+// so that the snapshot equals to loading files before the new incr file
 func (handler *Handler) StartRewrite() (*RewriteCtx, error) {
-	handler.pausingAof.Lock() // pausing aof
-	defer handler.pausingAof.Unlock()
-
-	err := handler.aofFile.Sync()
+	// create tmp file in aof dir, so that it could be renamed to base file atomically
+	file, err := ioutil.TempFile(handler.aofDir, tempPrefix+handler.aofFilename+".*.rewrite")
 	if err != nil {
-		logger.Warn("fsync failed")
+		logger.Warn("tmp file create failed")
 		return nil, err
 	}
-
-	// get current aof file size
-	fileInfo, _ := os.Stat(handler.aofFilename)
-	filesize := fileInfo.Size()
-
-	// create tmp file
-	file, err := ioutil.TempFile("", "*.aof")
+	ctx := &RewriteCtx{
+		tmpFile:   file,
+		cutDone:   make(chan error, 1),
+		rdbFormat: config.Properties.AofUseRdbPreamble,
+	}
+	// commands executed before the cut point are written into files before it, because they are queued before the cut point
+	ctx.snapshot, err = handler.snapshotMaker(func() {
+		handler.aofChan <- &payload{rewrite: ctx}
+	})
+	if err == nil {
+		err = <-ctx.cutDone
+		if err != nil {
+			ctx.snapshot.Release()
+		}
+	}
 	if err != nil {
-		logger.Warn("tmp file create failed")
+		_ = file.Close()
+		_ = os.Remove(file.Name())
 		return nil, err
 	}
-	return &RewriteCtx{
-		tmpFile:  file,
-		fileSize: filesize,
-		dbIdx:    handler.currentDB,
-	}, nil
+	return ctx, nil
 }
 
-// FinishRewrite finish rewrite procedure
-func (handler *Handler) FinishRewrite(ctx *RewriteCtx) {
+// cutForRewrite switches aof to a new incr file, it is called by aof goroutine when receiving cut point
+func (handler *Handler) cutForRewrite(ctx *RewriteCtx) {
 	handler.pausingAof.Lock() // pausing aof
 	defer handler.pausingAof.Unlock()
 
-	tmpFile := ctx.tmpFile
-	// write commands executed during rewriting to tmp file
-	src, err := os.Open(handler.aofFilename)
+	handler.fileMu.Lock()
+	defer handler.fileMu.Unlock()
+	err := handler.repairTorn() // torn record should not be left in files before cut point
 	if err != nil {
-		logger.Error("open aofFilename failed: " + err.Error())
+		ctx.cutDone <- err
 		return
 	}
-	defer func() {
-		_ = src.Close()
-	}()
-	_, err = src.Seek(ctx.fileSize, 0)
+	err = handler.aofFile.Sync()
 	if err != nil {
-		logger.Error("seek failed: " + err.Error())
+		logger.Warn("fsync failed")
+		ctx.cutDone <- err
 		return
 	}
-
-	// sync tmpFile's db index with online aofFile
-	data := protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(ctx.dbIdx))).ToBytes()
-	_, err = tmpFile.Write(data)
+	files := handler.manifest.files()
+	incrFile, err := handler.openNewIncrFile()
 	if err != nil {
-		logger.Error("tmp file rewrite failed: " + err.Error())
+		ctx.cutDone <- err
 		return
 	}
-	// copy data
-	_, err = io.Copy(tmpFile, src)
+	_ = handler.aofFile.Close()
+	handler.aofFile = incrFile
+	handler.fileSize = 0
+	handler.currentDB = 0 // every aof file starts from db 0
+	handler.lastTimestamp = 0
+	ctx.files = files
+	ctx.incrSeq = handler.manifest.lastIncrSeq()
+	ctx.timestamp = time.Now().Unix()
+	ctx.cutDone <- nil
+}
+
+// FinishRewrite finish rewrite procedure, it replaces files of snapshot by the new base file then removes them
+func (handler *Handler) FinishRewrite(ctx *RewriteCtx) error {
+	tmpFile := ctx.tmpFile
+	err := tmpFile.Sync()
+	_ = tmpFile.Close()
 	if err != nil {
-		logger.Error("copy aof filed failed: " + err.Error())
-		return
+		_ = os.Remove(tmpFile.Name())
+		return err
 	}
 
-	// replace current aof file by tmp file
-	_ = handler.aofFile.Close()
-	_ = os.Rename(tmpFile.Name(), handler.aofFilename)
+	handler.pausingAof.Lock() // protect manifest
+	defer handler.pausingAof.Unlock()
 
-	// reopen aof file for further write
-	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	base := &aofFileInfo{
+		name:     handler.baseFileName(handler.manifest.baseSeq()+1, ctx.rdbFormat),
+		seq:      handler.manifest.baseSeq() + 1,
+		fileType: aofTypeBase,
+	}
+	// new base file is not referenced until manifest persisted, it will be cleaned if crash before that
+	err = os.Rename(tmpFile.Name(), handler.filePath(base))
 	if err != nil {
-		panic(err)
+		_ = os.Remove(tmpFile.Name())
+		return err
 	}
-	handler.aofFile = aofFile
-
-	// reset selected db 重新写入一次 select 指令保证 aof 中的数据库与 handler.currentDB 一致
-	data = protocol.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(handler.currentDB))).ToBytes()
-	_, err = handler.aofFile.Write(data)
+	m := handler.manifest.clone()
+	m.base = base
+	m.history = append(m.history, ctx.files...)
+	m.incrs = nil
+	for _, info := range handler.manifest.incrs {
+		if info.seq >= ctx.incrSeq {
+			m.incrs = append(m.incrs, info)
+		}
+	}
+	err = handler.persistManifest(m)
 	if err != nil {
-		panic(err)
+		_ = os.Remove(handler.filePath(base))
+		return err
+	}
+	err = handler.cleanObsoleteFiles()
+	handler.resetSize()
+	return err
+}
+
+// resetSize sets current size and base size of auto rewrite to size of aof files, invoker should hold pausingAof
+func (handler *Handler) resetSize() {
+	var size int64
+	for _, info := range handler.manifest.files() {
+		if fileInfo, err := os.Stat(handler.filePath(info)); err == nil {
+			size += fileInfo.Size()
+		}
+	}
+	atomic.StoreInt64(&handler.currentSize, size)
+	atomic.StoreInt64(&handler.baseSize, size)
+}
+
+// checkAutoRewrite starts rewrite in background if aof grows over auto-aof-rewrite-percentage of base size
+func (handler *Handler) checkAutoRewrite() {
+	percentage := config.Properties.AutoAofRewritePercentage
+	if percentage <= 0 {
+		return
+	}
+	size := atomic.LoadInt64(&handler.currentSize)
+	if size < handler.autoRewriteMinSize {
+		return
+	}
+	base := atomic.LoadInt64(&handler.baseSize)
+	if base == 0 {
+		base = 1
+	}
+	if size*100/base-100 < int64(percentage) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&handler.rewriting, 0, 1) {
+		return
+	}
+	logger.Info(fmt.Sprintf("starting automatic rewriting of aof on %d%% growth", size*100/base-100))
+	go func() {
+		defer atomic.StoreInt32(&handler.rewriting, 0)
+		err := handler.rewrite()
+		if err != nil {
+			logger.Error("automatic rewriting of aof failed: " + err.Error())
+		}
+	}()
+}
+
+// parseSize parses size with unit like redis, e.g. 64mb, 1gb, 100k
+func parseSize(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+	multiple := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiple = unit.size
+			value = strings.TrimSuffix(value, unit.suffix)
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid size: " + value)
 	}
+	return size * multiple, nil
 }
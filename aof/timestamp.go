@@ -0,0 +1,207 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func makeTimestampAnnotation(timestamp int64) []byte {
+	return []byte(timestampAnnotation + strconv.FormatInt(timestamp, 10) + "\r\n")
+}
+
+// TruncateResult is the result of copying aof until a timestamp
+type TruncateResult struct {
+	Filename string   // source file cut at the timestamp, empty if no command executed after the timestamp
+	Offset   int64    // size of the prefix copied from the cut file
+	Dropped  []string // source incr files after the timestamp, they are not copied
+}
+
+// findTimestamp returns offset of the first command executed after timestamp in aof file.
+// If there is no such command, it returns size of complete commands, an incomplete command at the end
+// is ignored because it may be being appended by server.
+func findTimestamp(filename string, timestamp int64) (int64, bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	reader, err := newCmdReader(file, skipRDB)
+	if err != nil {
+		return 0, false, err
+	}
+	for {
+		_, offset, err := reader.readCmd()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, false, nil
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("%s is not valid, please fix it first: %v", filename, err)
+		}
+		if reader.timestamp > timestamp {
+			return offset, true, nil
+		}
+	}
+}
+
+// copyPrefix copies the first size bytes of src into a new file dst, it never overwrites an existing file
+func copyPrefix(src, dst string, size int64) (err error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcFile.Close()
+	}()
+	dstFile, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := dstFile.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(dst)
+		}
+	}()
+	_, err = io.CopyN(dstFile, srcFile, size)
+	if err != nil {
+		return err
+	}
+	return dstFile.Sync()
+}
+
+// planTruncate finds the first command executed after timestamp, returns files before it and size to keep of each file.
+// filename could be a single aof file, which is regarded as the only file of a multi-part aof, or a manifest of multi-part aof.
+func planTruncate(filename string, timestamp int64) (*Handler, *manifest, map[*aofFileInfo]int64, *TruncateResult, error) {
+	handler := &Handler{
+		aofDir:      filepath.Dir(filename),
+		aofFilename: strings.TrimSuffix(filepath.Base(filename), manifestExt),
+	}
+	m := &manifest{
+		incrs: []*aofFileInfo{{name: filepath.Base(filename), fileType: aofTypeIncr}},
+	}
+	if strings.HasSuffix(filename, manifestExt) {
+		var err error
+		m, err = handler.loadManifest()
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	result := &TruncateResult{}
+	newManifest := &manifest{base: m.base}
+	sizes := make(map[*aofFileInfo]int64)
+	for _, info := range m.files() {
+		if result.Filename != "" {
+			result.Dropped = append(result.Dropped, handler.filePath(info))
+			continue
+		}
+		offset, found, err := findTimestamp(handler.filePath(info), timestamp)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if found && info.fileType == aofTypeBase {
+			return nil, nil, nil, nil, errors.New("the timestamp is earlier than the last rewrite, it cannot be recovered from base file")
+		}
+		if found {
+			result.Filename = handler.filePath(info)
+			result.Offset = offset
+		}
+		if info.fileType == aofTypeIncr {
+			newManifest.incrs = append(newManifest.incrs, info)
+		}
+		sizes[info] = offset
+	}
+	return handler, newManifest, sizes, result, nil
+}
+
+// TruncateToTimestamp copies commands executed before the given unix timestamp to output,
+// so that loading the output restores dataset at that time.
+// Source files are only read, so it is safe to use it on aof which is being written.
+// filename could be a single aof file, then output is path of the new aof file;
+// or a manifest of multi-part aof, then output is a new directory to hold copied files and manifest.
+func TruncateToTimestamp(filename string, timestamp int64, output string) (*TruncateResult, error) {
+	// find the cut point before creating anything
+	handler, newManifest, sizes, result, err := planTruncate(filename, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filename, manifestExt) {
+		return result, copyPrefix(filename, output, sizes[newManifest.incrs[0]])
+	}
+
+	// output dir must be new, so source files could never be overwritten
+	err = os.Mkdir(output, 0755)
+	if err != nil {
+		return nil, err
+	}
+	outputHandler := &Handler{
+		aofDir:      output,
+		aofFilename: handler.aofFilename,
+	}
+	for _, info := range newManifest.files() {
+		err = copyPrefix(handler.filePath(info), outputHandler.filePath(info), sizes[info])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, outputHandler.persistManifest(newManifest)
+}
+
+// LoadToTimestamp replays commands executed before the given unix timestamp into db, nothing is written to disk.
+// filename could be a single aof file or a manifest of multi-part aof, see TruncateToTimestamp
+func LoadToTimestamp(db database.EmbedDB, filename string, timestamp int64) (*TruncateResult, error) {
+	handler, newManifest, sizes, result, err := planTruncate(filename, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	handler.db = db
+	for _, info := range newManifest.files() {
+		err = handler.loadPrefix(handler.filePath(info), sizes[info])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// loadPrefix replays the first size bytes of an aof file, size must be at the end of a command
+func (handler *Handler) loadPrefix(filename string, size int64) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	reader, err := newCmdReader(io.LimitReader(file, size), handler.db.LoadRDB)
+	if err != nil {
+		return errors.New("load rdb preamble of " + filename + " failed: " + err.Error())
+	}
+	fakeConn := &connection.FakeConn{} // only used for save dbIndex, every file starts from db 0
+	for {
+		cmdLine, _, err := reader.readCmd()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("load aof file %s failed: %v", filename, err)
+		}
+		ret := handler.db.Exec(fakeConn, cmdLine)
+		if protocol.IsErrorReply(ret) {
+			logger.Error("exec err", ret.ToBytes())
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	relayBackup      = "_backup"
+	relayRestoreFrom = "_restore-from"
+)
+
+// nodeBackupDir returns sub directory for backup of node, so nodes sharing a file system won't overwrite each other
+func nodeBackupDir(dir string, node string) string {
+	return filepath.Join(dir, strings.NewReplacer(":", "_", "/", "_").Replace(node))
+}
+
+// broadcastToNodeDirs executes command on every node with its own backup directory,
+// peers receive relayCmdName so that they execute it locally instead of broadcasting again
+func broadcastToNodeDirs(cluster *Cluster, c redis.Connection, localCmdName string, relayCmdName string, dir string) redis.Reply {
+	var failed []string
+	for _, node := range cluster.nodes {
+		nodeDir := []byte(nodeBackupDir(dir, node))
+		var reply redis.Reply
+		if node == cluster.self {
+			reply = cluster.db.Exec(c, [][]byte{[]byte(localCmdName), nodeDir})
+		} else {
+			reply = cluster.relay(node, c, [][]byte{[]byte(relayCmdName), nodeDir})
+		}
+		if errReply, ok := reply.(protocol.ErrorReply); ok {
+			failed = append(failed, node+": "+errReply.Error())
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return protocol.MakeErrReply("ERR " + strings.Join(failed, "; "))
+	}
+	return protocol.MakeOkReply()
+}
+
+// Backup backs up all nodes in cluster, backup of each node is written into a sub directory named by its address
+// usage: BACKUP dir
+func Backup(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("backup")
+	}
+	return broadcastToNodeDirs(cluster, c, "backup", relayBackup, string(args[1]))
+}
+
+// RestoreFrom restores all nodes in cluster from backups made by Backup
+// usage: RESTORE-FROM dir
+func RestoreFrom(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeArgNumErrReply("restore-from")
+	}
+	return broadcastToNodeDirs(cluster, c, "restore-from", relayRestoreFrom, string(args[1]))
+}
+
+// onRelayedBackup backs up local node into given directory
+func onRelayedBackup(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return cluster.db.Exec(c, append([][]byte{[]byte("backup")}, args[1:]...))
+}
+
+// onRelayedRestoreFrom restores local node from given directory
+func onRelayedRestoreFrom(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	return cluster.db.Exec(c, append([][]byte{[]byte("restore-from")}, args[1:]...))
+}
@@ -0,0 +1,47 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	conn := &connection.FakeConn{}
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SET", keyA, "a"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", keyB, "b"))
+
+	ret := Backup(testNodeA, conn, toArgs("BACKUP", tmpDir))
+	asserts.AssertStatusReply(t, ret, "OK")
+	for _, node := range testNodeA.nodes {
+		if _, err := os.Stat(nodeBackupDir(tmpDir, node)); err != nil {
+			t.Errorf("backup of %s not found: %v", node, err)
+		}
+	}
+
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	ret = RestoreFrom(testNodeA, conn, toArgs("RESTORE-FROM", tmpDir))
+	asserts.AssertStatusReply(t, ret, "OK")
+	asserts.AssertBulkReply(t, testNodeA.db.Exec(conn, utils.ToCmdLine("GET", keyA)), "a")
+	asserts.AssertBulkReply(t, testNodeB.db.Exec(conn, utils.ToCmdLine("GET", keyB)), "b")
+
+	ret = RestoreFrom(testNodeA, conn, toArgs("RESTORE-FROM", tmpDir+"/none"))
+	if !protocol.IsErrorReply(ret) {
+		t.Errorf("expect error reply, actually %s", ret.ToBytes())
+	}
+}
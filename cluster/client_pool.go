@@ -4,11 +4,95 @@ import (
 	"context"
 	"errors"
 	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/logger"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/jolestar/go-commons-pool/v2"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	defaultPeerMaxWait     = 3 * time.Second
+	defaultPeerIdleTimeout = 30 * time.Minute
+	evictionInterval       = 10 * time.Second
+)
+
+// peerPoolConfig is config of connection pool to a peer
+type peerPoolConfig struct {
+	maxTotal    int
+	maxIdle     int
+	maxWait     time.Duration // max time to wait for a connection from pool
+	idleTimeout time.Duration // idle connection will be evicted after idleTimeout
+}
+
+// getPeerPoolConfig returns pool config of the given peer, settings in `peer-pool` override global `peer-*` settings
+func getPeerPoolConfig(peer string) *peerPoolConfig {
+	cfg := &peerPoolConfig{
+		maxTotal:    pool.DefaultMaxTotal,
+		maxIdle:     pool.DefaultMaxIdle,
+		maxWait:     defaultPeerMaxWait,
+		idleTimeout: defaultPeerIdleTimeout,
+	}
+	if config.Properties.PeerMaxTotal > 0 {
+		cfg.maxTotal = config.Properties.PeerMaxTotal
+	}
+	if config.Properties.PeerMaxIdle > 0 {
+		cfg.maxIdle = config.Properties.PeerMaxIdle
+	}
+	if config.Properties.PeerMaxWait > 0 {
+		cfg.maxWait = time.Duration(config.Properties.PeerMaxWait) * time.Millisecond
+	}
+	if config.Properties.PeerIdleTimeout > 0 {
+		cfg.idleTimeout = time.Duration(config.Properties.PeerIdleTimeout) * time.Second
+	}
+	for _, item := range config.Properties.PeerPool {
+		fields := strings.Fields(item)
+		if len(fields) == 0 || fields[0] != peer {
+			continue
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				logger.Warn("illegal peer-pool setting: " + field)
+				continue
+			}
+			val, err := strconv.Atoi(kv[1])
+			if err != nil || val <= 0 {
+				logger.Warn("illegal peer-pool setting: " + field)
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "max-total":
+				cfg.maxTotal = val
+			case "max-idle":
+				cfg.maxIdle = val
+			case "max-wait":
+				cfg.maxWait = time.Duration(val) * time.Millisecond
+			case "idle-timeout":
+				cfg.idleTimeout = time.Duration(val) * time.Second
+			default:
+				logger.Warn("unknown peer-pool setting: " + field)
+			}
+		}
+	}
+	return cfg
+}
+
+// toObjectPoolConfig makes config for go-commons-pool, connections are validated by PING on borrow and while idle
+func (cfg *peerPoolConfig) toObjectPoolConfig() *pool.ObjectPoolConfig {
+	poolConfig := pool.NewDefaultPoolConfig()
+	poolConfig.MaxTotal = cfg.maxTotal
+	poolConfig.MaxIdle = cfg.maxIdle
+	poolConfig.MinEvictableIdleTime = cfg.idleTimeout
+	poolConfig.TestOnBorrow = true
+	poolConfig.TestWhileIdle = true
+	poolConfig.TimeBetweenEvictionRuns = evictionInterval
+	return poolConfig
+}
+
 type connectionFactory struct {
 	Peer string
 }
@@ -35,9 +119,15 @@ func (f *connectionFactory) DestroyObject(ctx context.Context, object *pool.Pool
 	return nil
 }
 
+// ValidateObject sends PING to peer, broken connection will be destroyed by pool
 func (f *connectionFactory) ValidateObject(ctx context.Context, object *pool.PooledObject) bool {
-	// do validate
-	return true
+	c, ok := object.Object.(*client.Client)
+	if !ok {
+		return false
+	}
+	reply := c.Send(utils.ToCmdLine("PING"))
+	statusReply, ok := reply.(*protocol.StatusReply)
+	return ok && statusReply.Status == "PONG"
 }
 
 func (f *connectionFactory) ActivateObject(ctx context.Context, object *pool.PooledObject) error {
@@ -0,0 +1,37 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/jolestar/go-commons-pool/v2"
+	"testing"
+	"time"
+)
+
+func TestGetPeerPoolConfig(t *testing.T) {
+	backup := *config.Properties
+	defer func() {
+		*config.Properties = backup
+	}()
+	config.Properties.PeerMaxTotal = 0
+	config.Properties.PeerMaxIdle = 4
+	config.Properties.PeerMaxWait = 1000
+	config.Properties.PeerIdleTimeout = 0
+	config.Properties.PeerPool = []string{
+		"127.0.0.1:7379 max-total=16 idle-timeout=60 unknown=1",
+		" 127.0.0.1:7389 max-idle=a max-wait=500",
+	}
+
+	cfg := getPeerPoolConfig("127.0.0.1:7379")
+	if cfg.maxTotal != 16 || cfg.maxIdle != 4 || cfg.maxWait != time.Second || cfg.idleTimeout != time.Minute {
+		t.Errorf("wrong pool config: %+v", cfg)
+	}
+	cfg = getPeerPoolConfig("127.0.0.1:7389")
+	if cfg.maxTotal != pool.DefaultMaxTotal || cfg.maxIdle != 4 || cfg.maxWait != 500*time.Millisecond ||
+		cfg.idleTimeout != defaultPeerIdleTimeout {
+		t.Errorf("wrong pool config: %+v", cfg)
+	}
+	poolConfig := cfg.toObjectPoolConfig()
+	if !poolConfig.TestOnBorrow || !poolConfig.TestWhileIdle || poolConfig.TimeBetweenEvictionRuns <= 0 {
+		t.Error("pooled connections should be validated")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/hdt3213/godis/lib/consistenthash"
 	"github.com/hdt3213/godis/lib/idgenerator"
 	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/routing"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/jolestar/go-commons-pool/v2"
 	"runtime/debug"
@@ -31,6 +32,7 @@ type Cluster struct {
 	nodes          []string
 	peerPicker     PeerPicker
 	peerConnection map[string]*pool.ObjectPool
+	peerPoolConfig map[string]*peerPoolConfig
 
 	db           database.EmbedDB
 	transactions *dict.SimpleDict // id -> Transaction
@@ -40,10 +42,6 @@ type Cluster struct {
 	relayImpl func(cluster *Cluster, node string, c redis.Connection, cmdLine CmdLine) redis.Reply
 }
 
-const (
-	replicas = 4
-)
-
 // if only one node involved in a transaction, just execute the command don't apply tcc procedure
 var allowFastTransaction = true
 
@@ -54,8 +52,9 @@ func MakeCluster() *Cluster {
 
 		db:             database2.NewStandaloneServer(),
 		transactions:   dict.MakeSimple(),
-		peerPicker:     consistenthash.New(replicas, nil),
+		peerPicker:     consistenthash.New(routing.Replicas, nil),
 		peerConnection: make(map[string]*pool.ObjectPool),
+		peerPoolConfig: make(map[string]*peerPoolConfig),
 
 		idGenerator: idgenerator.MakeGenerator(config.Properties.Self),
 		relayImpl:   defaultRelayImpl,
@@ -73,9 +72,11 @@ func MakeCluster() *Cluster {
 	cluster.peerPicker.AddNode(nodes...)
 	ctx := context.Background()
 	for _, peer := range config.Properties.Peers {
-		cluster.peerConnection[peer] = pool.NewObjectPoolWithDefaultConfig(ctx, &connectionFactory{
+		poolConfig := getPeerPoolConfig(peer)
+		cluster.peerPoolConfig[peer] = poolConfig
+		cluster.peerConnection[peer] = pool.NewObjectPool(ctx, &connectionFactory{
 			Peer: peer,
-		})
+		}, poolConfig.toObjectPoolConfig())
 	}
 	cluster.nodes = nodes
 	return cluster
@@ -15,7 +15,13 @@ func (cluster *Cluster) getPeerClient(peer string) (*client.Client, error) {
 	if !ok {
 		return nil, errors.New("connection factory not found")
 	}
-	raw, err := factory.BorrowObject(context.Background())
+	ctx := context.Background()
+	if poolConfig, ok := cluster.peerPoolConfig[peer]; ok && poolConfig.maxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, poolConfig.maxWait)
+		defer cancel()
+	}
+	raw, err := factory.BorrowObject(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -42,20 +42,20 @@ func Del(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 			break
 		}
 	}
-	var respList []redis.Reply
+	var respMap map[string]redis.Reply
 	if rollback {
 		// rollback
 		requestRollback(cluster, c, txID, groupMap)
 	} else {
 		// commit
-		respList, errReply = requestCommit(cluster, c, txID, groupMap)
+		respMap, errReply = requestCommit(cluster, c, txID, groupMap)
 		if errReply != nil {
 			rollback = true
 		}
 	}
 	if !rollback {
 		var deleted int64 = 0
-		for _, resp := range respList {
+		for _, resp := range respMap {
 			intResp := resp.(*protocol.IntReply)
 			deleted += intResp.Code
 		}
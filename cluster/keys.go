@@ -5,6 +5,72 @@ import (
 	"github.com/hdt3213/godis/redis/protocol"
 )
 
+// Exists returns the number of existed keys, keys can be distributed on any node
+func Exists(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 2 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'exists' command")
+	}
+	keys := make([]string, len(args)-1)
+	for i := 1; i < len(args); i++ {
+		keys[i-1] = string(args[i])
+	}
+	var count int64
+	groupMap := cluster.groupBy(keys)
+	for peer, group := range groupMap {
+		resp := cluster.relay(peer, c, makeArgs("EXISTS", group...))
+		if protocol.IsErrorReply(resp) {
+			return resp
+		}
+		intResp, ok := resp.(*protocol.IntReply)
+		if !ok {
+			return protocol.MakeErrReply("ERR invalid reply of exists from " + peer)
+		}
+		count += intResp.Code
+	}
+	return protocol.MakeIntReply(count)
+}
+
+// Keys returns all keys matching the given pattern in cluster
+func Keys(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 2 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'keys' command")
+	}
+	replies := cluster.broadcast(c, args)
+	result := make([][]byte, 0)
+	for node, v := range replies {
+		switch reply := v.(type) {
+		case protocol.ErrorReply:
+			return protocol.MakeErrReply("error occurs: " + reply.Error())
+		case *protocol.MultiBulkReply:
+			result = append(result, reply.Args...)
+		case *protocol.EmptyMultiBulkReply:
+		default:
+			return protocol.MakeErrReply("ERR invalid reply of keys from " + node)
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// DBSize returns the number of keys in cluster
+func DBSize(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'dbsize' command")
+	}
+	replies := cluster.broadcast(c, args)
+	var size int64
+	for node, v := range replies {
+		switch reply := v.(type) {
+		case protocol.ErrorReply:
+			return protocol.MakeErrReply("error occurs: " + reply.Error())
+		case *protocol.IntReply:
+			size += reply.Code
+		default:
+			return protocol.MakeErrReply("ERR invalid reply of dbsize from " + node)
+		}
+	}
+	return protocol.MakeIntReply(size)
+}
+
 // FlushDB removes all data in current database
 func FlushDB(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
 	replies := cluster.broadcast(c, args)
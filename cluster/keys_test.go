@@ -0,0 +1,26 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestExistsAndKeys(t *testing.T) {
+	conn := &connection.FakeConn{}
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10) // route to testNodeB, see mockPicker.PickNode
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SET", keyA, "a"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", keyB, "b"))
+
+	ret := Exists(testNodeA, conn, toArgs("EXISTS", keyA, keyB, keyA, keyB+"1"))
+	asserts.AssertIntReply(t, ret, 3)
+	ret = Keys(testNodeA, conn, toArgs("KEYS", "*"))
+	asserts.AssertMultiBulkReplySize(t, ret, 2)
+	ret = Keys(testNodeA, conn, toArgs("KEYS", testNodeB.self+"*"))
+	asserts.AssertMultiBulkReply(t, ret, []string{keyB})
+	ret = DBSize(testNodeA, conn, toArgs("DBSIZE"))
+	asserts.AssertIntReply(t, ret, 2)
+}
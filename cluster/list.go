@@ -0,0 +1,170 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// RPopLPush pops last element of list-A then insert it to the head of list-B, the two lists can be distributed on different nodes
+func RPopLPush(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 3 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'rpoplpush' command")
+	}
+	srcKey := string(args[1])
+	destKey := string(args[2])
+	srcNode := cluster.peerPicker.PickNode(srcKey)
+	destNode := cluster.peerPicker.PickNode(destKey)
+	if srcNode == destNode {
+		return cluster.relay(srcNode, c, args)
+	}
+	groupMap := map[string][]string{
+		srcNode:  {srcKey},
+		destNode: {destKey},
+	}
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	// prepare rpop, prepareRPopLPushFrom returns the element to be popped
+	srcPrepareResp := cluster.relayPrepare(srcNode, c, makeArgs("Prepare", txIDStr, "RPopLPushFrom", srcKey))
+	if protocol.IsErrorReply(srcPrepareResp) {
+		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
+		return srcPrepareResp
+	}
+	elemResp, ok := srcPrepareResp.(*protocol.BulkReply)
+	if !ok {
+		// source list is empty
+		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
+		return protocol.MakeNullBulkReply()
+	}
+	// prepare lpush
+	destPrepareResp := cluster.relayPrepare(destNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
+		[]byte("LPush"), []byte(destKey), elemResp.Arg))
+	if protocol.IsErrorReply(destPrepareResp) {
+		requestRollback(cluster, c, txID, groupMap)
+		return destPrepareResp
+	}
+	if _, errReply := requestCommit(cluster, c, txID, groupMap); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeBulkReply(elemResp.Arg)
+}
+
+// prepareRPopLPushFrom is prepare-function for RPopLPushFrom, see prepareFuncMap
+// it returns the last element of source list
+func prepareRPopLPushFrom(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 2 {
+		return protocol.MakeArgNumErrReply("RPopLPushFrom")
+	}
+	key := string(cmdLine[1])
+	return cluster.db.ExecWithLock(conn, utils.ToCmdLine("LIndex", key, "-1"))
+}
+
+// LMove pops an element from one side of list-A then pushes it to one side of list-B, the two lists can be distributed on different nodes
+func LMove(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 5 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'lmove' command")
+	}
+	srcKey := string(args[1])
+	destKey := string(args[2])
+	srcNode := cluster.peerPicker.PickNode(srcKey)
+	destNode := cluster.peerPicker.PickNode(destKey)
+	if srcNode == destNode {
+		return cluster.relay(srcNode, c, args)
+	}
+	var pushCmd string
+	switch strings.ToUpper(string(args[4])) {
+	case "LEFT":
+		pushCmd = "LPush"
+	case "RIGHT":
+		pushCmd = "RPush"
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+	groupMap := map[string][]string{
+		srcNode:  {srcKey},
+		destNode: {destKey},
+	}
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	// prepare pop, prepareLMoveFrom returns the element to be popped
+	srcPrepareResp := cluster.relayPrepare(srcNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
+		[]byte("LMoveFrom"), args[1], args[3]))
+	if protocol.IsErrorReply(srcPrepareResp) {
+		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
+		return srcPrepareResp
+	}
+	elemResp, ok := srcPrepareResp.(*protocol.BulkReply)
+	if !ok {
+		// source list is empty
+		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
+		return protocol.MakeNullBulkReply()
+	}
+	// prepare push
+	destPrepareResp := cluster.relayPrepare(destNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
+		[]byte(pushCmd), []byte(destKey), elemResp.Arg))
+	if protocol.IsErrorReply(destPrepareResp) {
+		requestRollback(cluster, c, txID, groupMap)
+		return destPrepareResp
+	}
+	if _, errReply := requestCommit(cluster, c, txID, groupMap); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeBulkReply(elemResp.Arg)
+}
+
+// prepareLMoveFrom is prepare-function for LMoveFrom, see prepareFuncMap
+// it returns the element at given side of source list
+func prepareLMoveFrom(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 3 {
+		return protocol.MakeArgNumErrReply("LMoveFrom")
+	}
+	key := string(cmdLine[1])
+	switch strings.ToUpper(string(cmdLine[2])) {
+	case "LEFT":
+		return cluster.db.ExecWithLock(conn, utils.ToCmdLine("LIndex", key, "0"))
+	case "RIGHT":
+		return cluster.db.ExecWithLock(conn, utils.ToCmdLine("LIndex", key, "-1"))
+	}
+	return protocol.MakeSyntaxErrReply()
+}
+
+// LMPop pops elements from the first non-empty list, the lists can be distributed on different nodes
+// lists are checked one by one in given order, so it is atomic only if all lists belong to one node
+func LMPop(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 4 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'lmpop' command")
+	}
+	numKeys, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys <= 0 || numKeys > len(args)-3 {
+		// let node report the error
+		return cluster.relay(cluster.self, c, args)
+	}
+	keys := args[2 : 2+numKeys]
+	options := args[2+numKeys:]
+	nodes := make(map[string]struct{})
+	for _, key := range keys {
+		nodes[cluster.peerPicker.PickNode(string(key))] = struct{}{}
+	}
+	if len(nodes) == 1 {
+		return cluster.relay(cluster.peerPicker.PickNode(string(keys[0])), c, args)
+	}
+	for _, key := range keys {
+		cmdLine := utils.ToCmdLine3("LMPop", []byte("1"), key)
+		cmdLine = append(cmdLine, options...)
+		resp := cluster.relay(cluster.peerPicker.PickNode(string(key)), c, cmdLine)
+		if _, ok := resp.(*protocol.NullBulkReply); !ok {
+			return resp
+		}
+	}
+	return protocol.MakeNullBulkReply()
+}
+
+func init() {
+	registerPrepareFunc("RPopLPushFrom", prepareRPopLPushFrom)
+	registerPrepareFunc("LMoveFrom", prepareLMoveFrom)
+}
@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestRPopLPush(t *testing.T) {
+	conn := &connection.FakeConn{}
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	src := testNodeA.self + utils.RandString(10)
+	dest := testNodeB.self + utils.RandString(10) // route to testNodeB, see mockPicker.PickNode
+	testNodeA.db.Exec(conn, utils.ToCmdLine("RPUSH", src, "1", "2"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("RPUSH", dest, "3"))
+
+	ret := RPopLPush(testNodeA, conn, toArgs("RPOPLPUSH", src, dest))
+	asserts.AssertBulkReply(t, ret, "2")
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("LRANGE", src, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"1"})
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("LRANGE", dest, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"2", "3"})
+
+	// empty source
+	ret = RPopLPush(testNodeA, conn, toArgs("RPOPLPUSH", src+"1", dest))
+	asserts.AssertNullBulk(t, ret)
+
+	// destination holds wrong type, source should be rolled back
+	wrongDest := testNodeB.self + utils.RandString(10)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", wrongDest, "a"))
+	ret = RPopLPush(testNodeA, conn, toArgs("RPOPLPUSH", src, wrongDest))
+	if !protocol.IsErrorReply(ret) {
+		t.Errorf("expected error reply, actually %s", ret.ToBytes())
+	}
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("LRANGE", src, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"1"})
+}
+
+func TestLMove(t *testing.T) {
+	conn := &connection.FakeConn{}
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	src := testNodeA.self + utils.RandString(10)
+	dest := testNodeB.self + utils.RandString(10) // route to testNodeB, see mockPicker.PickNode
+	testNodeA.db.Exec(conn, utils.ToCmdLine("RPUSH", src, "1", "2", "3"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("RPUSH", dest, "4"))
+
+	ret := LMove(testNodeA, conn, toArgs("LMOVE", src, dest, "LEFT", "RIGHT"))
+	asserts.AssertBulkReply(t, ret, "1")
+	ret = LMove(testNodeA, conn, toArgs("LMOVE", src, dest, "RIGHT", "LEFT"))
+	asserts.AssertBulkReply(t, ret, "3")
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("LRANGE", src, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"2"})
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("LRANGE", dest, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"3", "4", "1"})
+
+	// empty source
+	ret = LMove(testNodeA, conn, toArgs("LMOVE", src+"1", dest, "LEFT", "LEFT"))
+	asserts.AssertNullBulk(t, ret)
+
+	// destination holds wrong type, source should be rolled back
+	wrongDest := testNodeB.self + utils.RandString(10)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", wrongDest, "a"))
+	ret = LMove(testNodeA, conn, toArgs("LMOVE", src, wrongDest, "LEFT", "LEFT"))
+	if !protocol.IsErrorReply(ret) {
+		t.Errorf("expected error reply, actually %s", ret.ToBytes())
+	}
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("LRANGE", src, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"2"})
+}
+
+func TestLMPop(t *testing.T) {
+	conn := &connection.FakeConn{}
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	key1 := testNodeA.self + utils.RandString(10)
+	key2 := testNodeB.self + utils.RandString(10)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("RPUSH", key2, "1", "2", "3"))
+
+	ret := LMPop(testNodeA, conn, toArgs("LMPOP", "2", key1, key2, "LEFT", "COUNT", "2"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(key2)),
+		protocol.MakeMultiBulkReply(utils.ToCmdLine("1", "2")),
+	})
+	if !utils.BytesEquals(ret.ToBytes(), expected.ToBytes()) {
+		t.Errorf("expected %s, actually %s", expected.ToBytes(), ret.ToBytes())
+	}
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("LRANGE", key2, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"3"})
+	ret = LMPop(testNodeA, conn, toArgs("LMPOP", "2", key1, key2+"1", "LEFT"))
+	asserts.AssertNullBulk(t, ret)
+	ret = LMPop(testNodeA, conn, toArgs("LMPOP", "9223372036854775807", key1, "LEFT"))
+	asserts.AssertErrReply(t, ret, "Err syntax error")
+}
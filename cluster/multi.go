@@ -1,15 +1,18 @@
 package cluster
 
 import (
-	"github.com/hdt3213/godis/database"
 	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/routing"
 	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
 	"strconv"
+	"strings"
 )
 
 const relayMulti = "_multi"
 const innerWatch = "_watch"
+const watchingChangedErr = "watching keys changed"
 
 var relayMultiBytes = []byte(relayMulti)
 
@@ -24,7 +27,7 @@ func execMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.R
 	// analysis related keys
 	keys := make([]string, 0) // may contains duplicate
 	for _, cl := range cmdLines {
-		wKeys, rKeys := database.GetRelatedKeys(cl)
+		wKeys, rKeys := routing.GetRelatedKeys(cl)
 		keys = append(keys, wKeys...)
 		keys = append(keys, rKeys...)
 	}
@@ -40,7 +43,7 @@ func execMulti(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.R
 	}
 	groupMap := cluster.groupBy(keys)
 	if len(groupMap) > 1 {
-		return protocol.MakeErrReply("ERR MULTI commands transaction must within one slot in cluster mode")
+		return execMultiOnCluster(cluster, conn, watching, cmdLines)
 	}
 	var peer string
 	// assert len(groupMap) == 1
@@ -159,3 +162,133 @@ func execWatch(cluster *Cluster, conn redis.Connection, args [][]byte) redis.Rep
 	}
 	return protocol.MakeOkReply()
 }
+
+// execMultiOnCluster executes multi commands transaction whose keys are distributed on several nodes
+// It groups queued commands by node and uses try-commit-catch to execute them atomically,
+// keys of each command must within one node.
+func execMultiOnCluster(cluster *Cluster, conn redis.Connection, watching map[string]uint32, cmdLines []CmdLine) redis.Reply {
+	defer func() {
+		conn.ClearQueuedCmds()
+		conn.SetMultiState(false)
+	}()
+	return execCmdLinesOnCluster(cluster, conn, watching, cmdLines)
+}
+
+// execCmdLinesOnCluster atomically executes command lines on the nodes which their keys belong to,
+// returns MultiRawReply of results or EmptyMultiBulkReply if watching keys changed
+func execCmdLinesOnCluster(cluster *Cluster, conn redis.Connection, watching map[string]uint32, cmdLines []CmdLine) redis.Reply {
+	groupCmdLines := make(map[string][]CmdLine) // node -> command lines
+	groupIndexes := make(map[string][]int)      // node -> index of command lines in transaction
+	for i, cmdLine := range cmdLines {
+		wKeys, rKeys := routing.GetRelatedKeys(cmdLine)
+		node := cluster.self // commands without keys, such as PING, execute on coordinator
+		if len(wKeys)+len(rKeys) > 0 {
+			nodes := cluster.groupBy(append(wKeys, rKeys...))
+			if len(nodes) > 1 {
+				cmdName := strings.ToLower(string(cmdLine[0]))
+				return protocol.MakeErrReply("ERR keys of command '" + cmdName + "' must within one node in MULTI")
+			}
+			for n := range nodes {
+				node = n
+			}
+		}
+		groupCmdLines[node] = append(groupCmdLines[node], cmdLine)
+		groupIndexes[node] = append(groupIndexes[node], i)
+	}
+	groupWatching := make(map[string]CmdLine) // node -> watching command line
+	for key, ver := range watching {
+		node := cluster.peerPicker.PickNode(key)
+		watchingCmdLine, ok := groupWatching[node]
+		if !ok {
+			watchingCmdLine = utils.ToCmdLine(innerWatch)
+		}
+		verStr := strconv.FormatUint(uint64(ver), 10)
+		groupWatching[node] = append(watchingCmdLine, []byte(key), []byte(verStr))
+	}
+	groupMap := make(map[string][]string) // participated nodes, used by requestCommit and requestRollback
+	for node := range groupCmdLines {
+		groupMap[node] = nil
+	}
+	for node := range groupWatching {
+		groupMap[node] = nil
+	}
+
+	// prepare
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	for node := range groupMap {
+		watchingCmdLine, ok := groupWatching[node]
+		if !ok {
+			watchingCmdLine = utils.ToCmdLine(innerWatch)
+		}
+		prepareCmdLine := utils.ToCmdLine("Prepare", txIDStr, "MultiPart")
+		prepareCmdLine = append(prepareCmdLine, protocol.MakeMultiBulkReply(watchingCmdLine).ToBytes())
+		for _, cmdLine := range groupCmdLines[node] {
+			prepareCmdLine = append(prepareCmdLine, protocol.MakeMultiBulkReply(cmdLine).ToBytes())
+		}
+		resp := cluster.relayPrepare(node, conn, prepareCmdLine)
+		if protocol.IsErrorReply(resp) {
+			requestRollback(cluster, conn, txID, groupMap)
+			if errReply, ok := resp.(protocol.ErrorReply); ok && errReply.Error() == watchingChangedErr {
+				return protocol.MakeEmptyMultiBulkReply()
+			}
+			return resp
+		}
+	}
+	// commit
+	respMap, errReply := requestCommit(cluster, conn, txID, groupMap)
+	if errReply != nil {
+		return errReply
+	}
+	results := make([]redis.Reply, len(cmdLines))
+	for node, indexes := range groupIndexes {
+		resp, ok := respMap[node].(*protocol.MultiBulkReply)
+		if !ok || len(resp.Args) != len(indexes) {
+			return protocol.MakeErrReply("ERR invalid commit response from " + node)
+		}
+		for i, raw := range resp.Args {
+			reply, err := parser.ParseOne(raw)
+			if err != nil {
+				return protocol.MakeErrReply("ERR invalid commit response from " + node + ": " + err.Error())
+			}
+			results[indexes[i]] = reply
+		}
+	}
+	return protocol.MakeMultiRawReply(results)
+}
+
+// prepareMultiPart is prepare-function for MultiPart, see prepareFuncMap
+// it checks versions of watching keys after they have been locked by tcc prepare
+func prepareMultiPart(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) < 2 {
+		return protocol.MakeArgNumErrReply("MultiPart")
+	}
+	raw, err := parser.ParseOne(cmdLine[1])
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal watching command line: " + err.Error())
+	}
+	watchingCmdLine, ok := raw.(*protocol.MultiBulkReply)
+	if !ok {
+		return protocol.MakeOkReply() // nothing watched
+	}
+	for i := 2; i < len(watchingCmdLine.Args); i += 2 {
+		key := string(watchingCmdLine.Args[i-1])
+		ver, err := strconv.ParseUint(string(watchingCmdLine.Args[i]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR illegal watching version")
+		}
+		resp := cluster.db.ExecWithLock(conn, utils.ToCmdLine("GetVer", key))
+		intResp, ok := resp.(*protocol.IntReply)
+		if !ok {
+			return protocol.MakeErrReply("get version failed")
+		}
+		if uint32(intResp.Code) != uint32(ver) {
+			return protocol.MakeErrReply(watchingChangedErr)
+		}
+	}
+	return protocol.MakeOkReply()
+}
+
+func init() {
+	registerPrepareFunc("MultiPart", prepareMultiPart)
+}
@@ -110,3 +110,86 @@ func TestWatch2(t *testing.T) {
 	result = testNodeA.Exec(conn, utils.ToCmdLine("get", key2))
 	asserts.AssertBulkReply(t, result, value2)
 }
+
+func TestMultiExecOnCluster(t *testing.T) {
+	conn := new(connection.FakeConn)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10) // route to testNodeA, see mockPicker.PickNode
+	keyB := testNodeB.self + utils.RandString(10)
+	value := utils.RandString(10)
+	result := testNodeA.Exec(conn, toArgs("MULTI"))
+	asserts.AssertNotError(t, result)
+	testNodeA.Exec(conn, utils.ToCmdLine("set", keyA, value))
+	testNodeA.Exec(conn, utils.ToCmdLine("rpush", keyB, value))
+	testNodeA.Exec(conn, utils.ToCmdLine("get", keyA))
+	testNodeA.Exec(conn, utils.ToCmdLine("PING"))
+	testNodeA.Exec(conn, utils.ToCmdLine("lrange", keyB, "0", "-1"))
+	result = testNodeA.Exec(conn, utils.ToCmdLine("exec"))
+	asserts.AssertNotError(t, result)
+	rep, ok := result.(*protocol.MultiRawReply)
+	if !ok || len(rep.Replies) != 5 {
+		t.Errorf("expect 5 replies actual %s", result.ToBytes())
+		return
+	}
+	asserts.AssertStatusReply(t, rep.Replies[0], "OK")
+	asserts.AssertIntReply(t, rep.Replies[1], 1)
+	asserts.AssertBulkReply(t, rep.Replies[2], value)
+	asserts.AssertStatusReply(t, rep.Replies[3], "PONG")
+	asserts.AssertMultiBulkReply(t, rep.Replies[4], []string{value})
+	result = testNodeA.db.Exec(conn, utils.ToCmdLine("get", keyA))
+	asserts.AssertBulkReply(t, result, value)
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("lrange", keyB, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{value})
+
+	// rollback all nodes if any command failed
+	value2 := utils.RandString(10)
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	testNodeA.Exec(conn, utils.ToCmdLine("set", keyA, value2))
+	testNodeA.Exec(conn, utils.ToCmdLine("incr", keyB)) // wrong type
+	result = testNodeA.Exec(conn, utils.ToCmdLine("exec"))
+	if !protocol.IsErrorReply(result) {
+		t.Errorf("expect error, actual %s", result.ToBytes())
+	}
+	result = testNodeA.db.Exec(conn, utils.ToCmdLine("get", keyA))
+	asserts.AssertBulkReply(t, result, value)
+
+	// keys of one command must within one node
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	testNodeA.Exec(conn, utils.ToCmdLine("mset", keyA, value2, keyB, value2))
+	testNodeA.Exec(conn, utils.ToCmdLine("get", keyB))
+	result = testNodeA.Exec(conn, utils.ToCmdLine("exec"))
+	asserts.AssertErrReply(t, result, "ERR keys of command 'mset' must within one node in MULTI")
+}
+
+func TestWatchOnCluster(t *testing.T) {
+	conn := new(connection.FakeConn)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10)
+	value := utils.RandString(10)
+
+	// watching key on other node changed
+	testNodeA.Exec(conn, utils.ToCmdLine("watch", keyB))
+	testNodeB.Exec(conn, utils.ToCmdLine("set", keyB, value))
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	testNodeA.Exec(conn, utils.ToCmdLine("set", keyA, value))
+	testNodeA.Exec(conn, utils.ToCmdLine("set", keyB+testNodeB.self, value))
+	result := testNodeA.Exec(conn, utils.ToCmdLine("exec"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testNodeA.db.Exec(conn, utils.ToCmdLine("get", keyA))
+	asserts.AssertNullBulk(t, result)
+
+	// watching key unchanged
+	testNodeA.Exec(conn, utils.ToCmdLine("watch", keyB))
+	testNodeA.Exec(conn, toArgs("MULTI"))
+	testNodeA.Exec(conn, utils.ToCmdLine("set", keyA, value))
+	testNodeA.Exec(conn, utils.ToCmdLine("del", keyB))
+	result = testNodeA.Exec(conn, utils.ToCmdLine("exec"))
+	asserts.AssertNotError(t, result)
+	result = testNodeA.db.Exec(conn, utils.ToCmdLine("get", keyA))
+	asserts.AssertBulkReply(t, result, value)
+	result = testNodeB.db.Exec(conn, utils.ToCmdLine("exists", keyB))
+	asserts.AssertIntReply(t, result, 0)
+}
@@ -21,10 +21,14 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["ttl"] = defaultFunc
 	routerMap["pttl"] = defaultFunc
 	routerMap["persist"] = defaultFunc
-	routerMap["exists"] = defaultFunc
+	routerMap["exists"] = Exists
 	routerMap["type"] = defaultFunc
 	routerMap["rename"] = Rename
 	routerMap["renamenx"] = RenameNx
+	routerMap["keys"] = Keys
+	routerMap["dbsize"] = DBSize
+	routerMap["dump"] = defaultFunc
+	routerMap["restore"] = defaultFunc
 
 	routerMap["set"] = defaultFunc
 	routerMap["setnx"] = defaultFunc
@@ -35,11 +39,25 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["msetnx"] = MSetNX
 	routerMap["get"] = defaultFunc
 	routerMap["getset"] = defaultFunc
+	routerMap["getex"] = defaultFunc
+	routerMap["getdel"] = defaultFunc
+	routerMap["lcs"] = LCS
 	routerMap["incr"] = defaultFunc
 	routerMap["incrby"] = defaultFunc
 	routerMap["incrbyfloat"] = defaultFunc
 	routerMap["decr"] = defaultFunc
 	routerMap["decrby"] = defaultFunc
+	routerMap["strlen"] = defaultFunc
+	routerMap["append"] = defaultFunc
+	routerMap["setrange"] = defaultFunc
+	routerMap["getrange"] = defaultFunc
+	routerMap["setbit"] = defaultFunc
+	routerMap["getbit"] = defaultFunc
+	routerMap["bitcount"] = defaultFunc
+	routerMap["bitpos"] = defaultFunc
+	routerMap["bitop"] = BitOp
+	routerMap["bitfield"] = defaultFunc
+	routerMap["bitfield_ro"] = defaultFunc
 
 	routerMap["lpush"] = defaultFunc
 	routerMap["lpushx"] = defaultFunc
@@ -47,7 +65,12 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["rpushx"] = defaultFunc
 	routerMap["lpop"] = defaultFunc
 	routerMap["rpop"] = defaultFunc
-	//routerMap["rpoplpush"] = RPopLPush
+	routerMap["rpoplpush"] = RPopLPush
+	routerMap["lmove"] = LMove
+	routerMap["lmpop"] = LMPop
+	routerMap["linsert"] = defaultFunc
+	routerMap["lpos"] = defaultFunc
+	routerMap["ltrim"] = defaultFunc
 	routerMap["lrem"] = defaultFunc
 	routerMap["llen"] = defaultFunc
 	routerMap["lindex"] = defaultFunc
@@ -69,6 +92,13 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["hincrby"] = defaultFunc
 	routerMap["hincrbyfloat"] = defaultFunc
 	routerMap["hrandfield"] = defaultFunc
+	routerMap["hexpire"] = defaultFunc
+	routerMap["hpexpire"] = defaultFunc
+	routerMap["hexpireat"] = defaultFunc
+	routerMap["hpexpireat"] = defaultFunc
+	routerMap["httl"] = defaultFunc
+	routerMap["hpttl"] = defaultFunc
+	routerMap["hpersist"] = defaultFunc
 
 	routerMap["sadd"] = defaultFunc
 	routerMap["sismember"] = defaultFunc
@@ -76,13 +106,16 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["spop"] = defaultFunc
 	routerMap["scard"] = defaultFunc
 	routerMap["smembers"] = defaultFunc
-	routerMap["sinter"] = defaultFunc
-	routerMap["sinterstore"] = defaultFunc
-	routerMap["sunion"] = defaultFunc
-	routerMap["sunionstore"] = defaultFunc
-	routerMap["sdiff"] = defaultFunc
-	routerMap["sdiffstore"] = defaultFunc
+	routerMap["sinter"] = execSetOperation
+	routerMap["sinterstore"] = execSetOperation
+	routerMap["sunion"] = execSetOperation
+	routerMap["sunionstore"] = execSetOperation
+	routerMap["sdiff"] = execSetOperation
+	routerMap["sdiffstore"] = execSetOperation
 	routerMap["srandmember"] = defaultFunc
+	routerMap["smove"] = SMove
+	routerMap["smismember"] = defaultFunc
+	routerMap["sintercard"] = SInterCard
 
 	routerMap["zadd"] = defaultFunc
 	routerMap["zscore"] = defaultFunc
@@ -98,6 +131,26 @@ func makeRouter() map[string]CmdFunc {
 	routerMap["zrem"] = defaultFunc
 	routerMap["zremrangebyscore"] = defaultFunc
 	routerMap["zremrangebyrank"] = defaultFunc
+	routerMap["zrangebylex"] = defaultFunc
+	routerMap["zrevrangebylex"] = defaultFunc
+	routerMap["zlexcount"] = defaultFunc
+	routerMap["zremrangebylex"] = defaultFunc
+	routerMap["zrangestore"] = ZRangeStore
+	routerMap["zunion"] = execZSetOperation
+	routerMap["zinter"] = execZSetOperation
+	routerMap["zdiff"] = execZSetOperation
+	routerMap["zunionstore"] = execZSetOperation
+	routerMap["zinterstore"] = execZSetOperation
+	routerMap["zdiffstore"] = execZSetOperation
+	routerMap["zintercard"] = execZSetOperation
+	routerMap["zpopmin"] = defaultFunc
+	routerMap["zpopmax"] = defaultFunc
+	routerMap["zmpop"] = ZMPop
+	routerMap["bzpopmin"] = BZPop
+	routerMap["bzpopmax"] = BZPop
+	routerMap["bzmpop"] = BZPop
+	routerMap["zrandmember"] = defaultFunc
+	routerMap["zmscore"] = defaultFunc
 
 	routerMap["geoadd"] = defaultFunc
 	routerMap["geopos"] = defaultFunc
@@ -113,6 +166,10 @@ func makeRouter() map[string]CmdFunc {
 
 	routerMap["flushdb"] = FlushDB
 	routerMap["flushall"] = FlushAll
+	routerMap["backup"] = Backup
+	routerMap[relayBackup] = onRelayedBackup
+	routerMap["restore-from"] = RestoreFrom
+	routerMap[relayRestoreFrom] = onRelayedRestoreFrom
 	routerMap[relayMulti] = execRelayedMulti
 	routerMap["getver"] = defaultFunc
 	routerMap["watch"] = execWatch
@@ -0,0 +1,216 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/datastruct/set"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// execSetOperation executes SINTER/SUNION/SDIFF and their STORE forms, keys can be distributed on any node.
+// Source nodes read sets during tcc prepare, so they stay locked until the result has been computed or stored.
+// Sets on destination node are read by itself when committing
+func execSetOperation(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(args[0]))
+	store := strings.HasSuffix(cmdName, "store")
+	minArgs := 2
+	if store {
+		minArgs = 3
+	}
+	if len(args) < minArgs {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	keys := make([]string, len(args)-1)
+	for i := 1; i < len(args); i++ {
+		keys[i-1] = string(args[i])
+	}
+	groupMap := cluster.groupBy(keys)
+	if len(groupMap) == 1 && allowFastTransaction { // do fast
+		for peer := range groupMap {
+			return cluster.relay(peer, c, args)
+		}
+	}
+	srcKeys := keys
+	if store {
+		srcKeys = keys[1:]
+	}
+
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	srcGroupMap := cluster.groupBy(srcKeys)
+	destNode := ""
+	if store {
+		destNode = cluster.peerPicker.PickNode(keys[0])
+		delete(srcGroupMap, destNode)
+	}
+	// prepare source nodes, prepareRead returns key-members pairs of sets
+	prepared := make(map[string][]string)
+	remoteSets, errReply := prepareReadFrom(cluster, c, txID, "SetOperationFrom", srcGroupMap, prepared)
+	if errReply != nil {
+		return errReply
+	}
+
+	if store {
+		// prepare destination node, it computes and stores the result with local sets and remote sets when committing
+		cmdLine := utils.ToCmdLine("Prepare", txIDStr, "SetOperationStoreTo", keys[0], cmdName)
+		cmdLine = append(cmdLine, protocol.MakeMultiBulkReply(remoteSets).ToBytes())
+		cmdLine = append(cmdLine, args[2:]...)
+		prepared[destNode] = []string{keys[0]}
+		resp := cluster.relayPrepare(destNode, c, cmdLine)
+		if protocol.IsErrorReply(resp) {
+			requestRollback(cluster, c, txID, prepared)
+			return resp
+		}
+		respMap, errReply := requestCommit(cluster, c, txID, prepared)
+		if errReply != nil {
+			return errReply
+		}
+		return respMap[destNode]
+	}
+
+	// sets are not changed until locks are released
+	defer requestRollback(cluster, c, txID, prepared)
+	sets, errReply := getPreparedSets(remoteSets, srcKeys)
+	if errReply != nil {
+		return errReply
+	}
+	result := database.SetOperation(cmdName, sets)
+	if result.Len() == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	return protocol.MakeMultiBulkReply(utils.ToCmdLine(result.ToSlice()...))
+}
+
+// getPreparedSets decodes reply of SetOperationFrom and returns sets in order of keys, nil set represents a not existed key
+func getPreparedSets(remoteSets [][]byte, keys []string) ([]*set.Set, protocol.ErrorReply) {
+	setMap, err := database.DecodeSets(remoteSets)
+	if err != nil {
+		return nil, protocol.MakeErrReply("ERR invalid prepare response: " + err.Error())
+	}
+	sets := make([]*set.Set, len(keys))
+	for i, key := range keys {
+		sets[i] = setMap[key]
+	}
+	return sets, nil
+}
+
+// SMove moves a member from one set to another, the two sets can be distributed on different nodes
+func SMove(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) != 4 {
+		return protocol.MakeArgNumErrReply("smove")
+	}
+	srcKey := string(args[1])
+	destKey := string(args[2])
+	srcNode := cluster.peerPicker.PickNode(srcKey)
+	destNode := cluster.peerPicker.PickNode(destKey)
+	if srcNode == destNode {
+		return cluster.relay(srcNode, c, args)
+	}
+	groupMap := map[string][]string{
+		srcNode:  {srcKey},
+		destNode: {destKey},
+	}
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	// prepare remove, prepareSMoveFrom returns whether the member exists
+	srcPrepareResp := cluster.relayPrepare(srcNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
+		[]byte("SMoveFrom"), args[1], args[3]))
+	if protocol.IsErrorReply(srcPrepareResp) {
+		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
+		return srcPrepareResp
+	}
+	if intResp, ok := srcPrepareResp.(*protocol.IntReply); !ok || intResp.Code == 0 {
+		// member not exists
+		requestRollback(cluster, c, txID, map[string][]string{srcNode: {srcKey}})
+		return protocol.MakeIntReply(0)
+	}
+	// prepare add
+	destPrepareResp := cluster.relayPrepare(destNode, c, utils.ToCmdLine3("Prepare", []byte(txIDStr),
+		[]byte("SAdd"), args[2], args[3]))
+	if protocol.IsErrorReply(destPrepareResp) {
+		requestRollback(cluster, c, txID, groupMap)
+		return destPrepareResp
+	}
+	if _, errReply := requestCommit(cluster, c, txID, groupMap); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeIntReply(1)
+}
+
+// prepareSMoveFrom is prepare-function for SMoveFrom, see prepareFuncMap
+// it returns 1 if the member exists in source set
+func prepareSMoveFrom(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.Reply {
+	if len(cmdLine) != 3 {
+		return protocol.MakeArgNumErrReply("SMoveFrom")
+	}
+	return cluster.db.ExecWithLock(conn, utils.ToCmdLine3("SIsMember", cmdLine[1], cmdLine[2]))
+}
+
+// SInterCard returns the cardinality of the intersection of sets, the sets can be distributed on different nodes
+func SInterCard(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply("sintercard")
+	}
+	numKeys, err := strconv.Atoi(string(args[1]))
+	if err != nil || numKeys <= 0 || numKeys > len(args)-2 {
+		// let node report the error
+		return cluster.relay(cluster.self, c, args)
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+2])
+	}
+	options := args[2+numKeys:]
+	limit := 0
+	if len(options) > 0 {
+		if len(options) != 2 || strings.ToUpper(string(options[0])) != "LIMIT" {
+			return cluster.relay(cluster.self, c, args)
+		}
+		limit, err = strconv.Atoi(string(options[1]))
+		if err != nil || limit < 0 {
+			return cluster.relay(cluster.self, c, args)
+		}
+	}
+	groupMap := cluster.groupBy(keys)
+	if len(groupMap) == 1 && allowFastTransaction { // do fast
+		for peer := range groupMap {
+			return cluster.relay(peer, c, args)
+		}
+	}
+	// sets are read during tcc prepare and stay locked until computed
+	txID := cluster.idGenerator.NextID()
+	prepared := make(map[string][]string)
+	remoteSets, errReply := prepareReadFrom(cluster, c, txID, "SetOperationFrom", groupMap, prepared)
+	if errReply != nil {
+		return errReply
+	}
+	defer requestRollback(cluster, c, txID, prepared)
+	sets, errReply := getPreparedSets(remoteSets, keys)
+	if errReply != nil {
+		return errReply
+	}
+	var result *set.Set
+	for _, s := range sets {
+		if s == nil {
+			return protocol.MakeIntReply(0)
+		}
+		if result == nil {
+			result = s
+			continue
+		}
+		result = result.Intersect(s)
+	}
+	count := result.Len()
+	if limit > 0 && count > limit {
+		count = limit
+	}
+	return protocol.MakeIntReply(int64(count))
+}
+
+func init() {
+	registerPrepareFunc("SMoveFrom", prepareSMoveFrom)
+	registerPrepareFunc("SetOperationFrom", prepareRead)
+}
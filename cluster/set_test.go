@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestSetOperation(t *testing.T) {
+	conn := &connection.FakeConn{}
+	allowFastTransaction = false
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10) // route to testNodeB, see mockPicker.PickNode
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SADD", keyA, "a", "b", "c"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SADD", keyB, "b", "c", "d"))
+
+	ret := execSetOperation(testNodeA, conn, toArgs("SINTER", keyA, keyB))
+	asserts.AssertMultiBulkReplySize(t, ret, 2)
+	ret = execSetOperation(testNodeA, conn, toArgs("SUNION", keyA, keyB))
+	asserts.AssertMultiBulkReplySize(t, ret, 4)
+	ret = execSetOperation(testNodeA, conn, toArgs("SDIFF", keyA, keyB))
+	asserts.AssertMultiBulkReply(t, ret, []string{"a"})
+	ret = execSetOperation(testNodeA, conn, toArgs("SINTER", keyA, keyB+"1"))
+	asserts.AssertMultiBulkReplySize(t, ret, 0)
+
+	dest := testNodeB.self + utils.RandString(10)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", dest, "a"))
+	ret = execSetOperation(testNodeA, conn, toArgs("SINTERSTORE", dest, keyA, keyB))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("SCARD", dest))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = execSetOperation(testNodeA, conn, toArgs("SUNIONSTORE", dest, keyA, keyB))
+	asserts.AssertIntReply(t, ret, 4)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("SCARD", dest))
+	asserts.AssertIntReply(t, ret, 4)
+	ret = execSetOperation(testNodeA, conn, toArgs("SDIFFSTORE", dest, keyB, keyA))
+	asserts.AssertIntReply(t, ret, 1)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("SMEMBERS", dest))
+	asserts.AssertMultiBulkReply(t, ret, []string{"d"})
+	ret = execSetOperation(testNodeA, conn, toArgs("SDIFFSTORE", dest, keyA, keyA))
+	asserts.AssertIntReply(t, ret, 0)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("EXISTS", dest))
+	asserts.AssertIntReply(t, ret, 0)
+
+	wrongKey := testNodeB.self + utils.RandString(10)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", wrongKey, "a"))
+	ret = execSetOperation(testNodeA, conn, toArgs("SUNION", keyA, wrongKey))
+	asserts.AssertErrReply(t, ret, "WRONGTYPE Operation against a key holding the wrong kind of value")
+
+	// failed transaction releases locks of sources and keeps destination
+	wrongSrc := testNodeA.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SET", wrongSrc, "a"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SADD", dest, "x"))
+	ret = execSetOperation(testNodeA, conn, toArgs("SUNIONSTORE", dest, keyB, wrongSrc))
+	asserts.AssertErrReply(t, ret, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("SMEMBERS", dest))
+	asserts.AssertMultiBulkReply(t, ret, []string{"x"})
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("SADD", keyA, "e"))
+	asserts.AssertIntReply(t, ret, 1)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("SADD", keyB, "e"))
+	asserts.AssertIntReply(t, ret, 1)
+}
+
+func TestSMove(t *testing.T) {
+	conn := &connection.FakeConn{}
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	src := testNodeA.self + utils.RandString(10)
+	dest := testNodeB.self + utils.RandString(10) // route to testNodeB, see mockPicker.PickNode
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SADD", src, "a", "b"))
+
+	ret := SMove(testNodeA, conn, toArgs("SMOVE", src, dest, "a"))
+	asserts.AssertIntReply(t, ret, 1)
+	ret = SMove(testNodeA, conn, toArgs("SMOVE", src, dest, "a"))
+	asserts.AssertIntReply(t, ret, 0)
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("SMEMBERS", src))
+	asserts.AssertMultiBulkReply(t, ret, []string{"b"})
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("SMEMBERS", dest))
+	asserts.AssertMultiBulkReply(t, ret, []string{"a"})
+
+	// destination holds wrong type, source should be rolled back
+	wrongDest := testNodeB.self + utils.RandString(10)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", wrongDest, "a"))
+	ret = SMove(testNodeA, conn, toArgs("SMOVE", src, wrongDest, "b"))
+	if !protocol.IsErrorReply(ret) {
+		t.Errorf("expected error reply, actually %s", ret.ToBytes())
+	}
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("SMEMBERS", src))
+	asserts.AssertMultiBulkReply(t, ret, []string{"b"})
+}
+
+func TestSInterCard(t *testing.T) {
+	conn := &connection.FakeConn{}
+	allowFastTransaction = false
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SADD", keyA, "a", "b", "c"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SADD", keyB, "b", "c", "d"))
+
+	ret := SInterCard(testNodeA, conn, toArgs("SINTERCARD", "2", keyA, keyB))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = SInterCard(testNodeA, conn, toArgs("SINTERCARD", "2", keyA, keyB, "LIMIT", "1"))
+	asserts.AssertIntReply(t, ret, 1)
+	ret = SInterCard(testNodeA, conn, toArgs("SINTERCARD", "2", keyA, keyB+"1"))
+	asserts.AssertIntReply(t, ret, 0)
+	ret = SInterCard(testNodeA, conn, toArgs("SINTERCARD", "2", keyA, keyB, "LIMIT", "-1"))
+	asserts.AssertErrReply(t, ret, "ERR LIMIT can't be negative")
+	ret = SInterCard(testNodeA, conn, toArgs("SINTERCARD", "9223372036854775807", keyA))
+	asserts.AssertErrReply(t, ret, "ERR Number of keys can't be greater than number of args")
+
+	// sources are unlocked after transaction
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("SADD", keyA, "e"))
+	asserts.AssertIntReply(t, ret, 1)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("SADD", keyB, "e"))
+	asserts.AssertIntReply(t, ret, 1)
+}
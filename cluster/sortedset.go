@@ -0,0 +1,278 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/database"
+	"github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ZRangeStore stores members in range of source sorted set into destination, the two keys can be distributed on different nodes.
+// Source node reads members during tcc prepare, so source stays locked until destination has been written
+func ZRangeStore(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 5 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'zrangestore' command")
+	}
+	dest := string(args[1])
+	src := string(args[2])
+	srcNode := cluster.peerPicker.PickNode(src)
+	destNode := cluster.peerPicker.PickNode(dest)
+	if srcNode == destNode {
+		return cluster.relay(srcNode, c, args)
+	}
+	groupMap := map[string][]string{
+		srcNode:  {src},
+		destNode: {dest},
+	}
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	// prepare source, prepareRead returns members with scores in range
+	srcPrepareResp := cluster.relayPrepare(srcNode, c, utils.ToCmdLine3("Prepare",
+		append([][]byte{[]byte(txIDStr), []byte("ZRangeStoreFrom")}, args[2:]...)...))
+	var elements [][]byte
+	switch reply := srcPrepareResp.(type) {
+	case protocol.ErrorReply:
+		requestRollback(cluster, c, txID, map[string][]string{srcNode: {src}})
+		return reply
+	case *protocol.MultiBulkReply:
+		elements = reply.Args
+	case *protocol.EmptyMultiBulkReply:
+	default:
+		requestRollback(cluster, c, txID, map[string][]string{srcNode: {src}})
+		return protocol.MakeErrReply("ERR invalid prepare response from " + srcNode)
+	}
+	// prepare destination
+	storeCmdLine := utils.ToCmdLine("Prepare", txIDStr, "ZRangeStoreTo", dest)
+	for i := 0; i+1 < len(elements); i += 2 {
+		storeCmdLine = append(storeCmdLine, elements[i+1], elements[i]) // score member
+	}
+	destPrepareResp := cluster.relayPrepare(destNode, c, storeCmdLine)
+	if protocol.IsErrorReply(destPrepareResp) {
+		requestRollback(cluster, c, txID, groupMap)
+		return destPrepareResp
+	}
+	if _, errReply := requestCommit(cluster, c, txID, groupMap); errReply != nil {
+		return errReply
+	}
+	return protocol.MakeIntReply(int64(len(elements) / 2))
+}
+
+// execZSetOperation executes ZUNION/ZINTER/ZDIFF, their STORE forms and ZINTERCARD, keys can be distributed on any node.
+// Source nodes read sorted sets during tcc prepare, so they stay locked until the result has been computed or stored.
+// Sorted sets on destination node are read by itself when committing
+func execZSetOperation(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(args[0]))
+	store := strings.HasSuffix(cmdName, "store")
+	minArgs := 3
+	if store {
+		minArgs = 4
+	}
+	if len(args) < minArgs {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	var dest string
+	optArgs := args[1:]
+	if store {
+		dest = string(args[1])
+		optArgs = args[2:]
+	}
+	isDiff := strings.HasPrefix(cmdName, "zdiff")
+	isCard := cmdName == "zintercard"
+	opt, err := sortedset.ParseOperationOption(cmdName, optArgs, !isDiff && !isCard, !store && !isCard, isCard)
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	keys := opt.Keys
+	if store {
+		keys = append([]string{dest}, keys...)
+	}
+	groupMap := cluster.groupBy(keys)
+	if len(groupMap) == 1 && allowFastTransaction { // do fast
+		for peer := range groupMap {
+			return cluster.relay(peer, c, args)
+		}
+	}
+
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	srcGroupMap := cluster.groupBy(opt.Keys)
+	destNode := ""
+	if store {
+		destNode = cluster.peerPicker.PickNode(dest)
+		delete(srcGroupMap, destNode)
+	}
+	// prepare source nodes, prepareRead returns key-members pairs of sorted sets
+	prepared := make(map[string][]string)
+	remoteSets, errReply := prepareReadFrom(cluster, c, txID, "ZSetOperationFrom", srcGroupMap, prepared)
+	if errReply != nil {
+		return errReply
+	}
+
+	if store {
+		// prepare destination node, it computes and stores the result with local sorted sets and remote sets when committing
+		cmdLine := utils.ToCmdLine("Prepare", txIDStr, "ZSetOperationStoreTo", dest, cmdName)
+		cmdLine = append(cmdLine, protocol.MakeMultiBulkReply(remoteSets).ToBytes())
+		cmdLine = append(cmdLine, optArgs...)
+		prepared[destNode] = []string{dest}
+		resp := cluster.relayPrepare(destNode, c, cmdLine)
+		if protocol.IsErrorReply(resp) {
+			requestRollback(cluster, c, txID, prepared)
+			return resp
+		}
+		respMap, errReply := requestCommit(cluster, c, txID, prepared)
+		if errReply != nil {
+			return errReply
+		}
+		return respMap[destNode]
+	}
+
+	// sorted sets are not changed until locks are released
+	defer requestRollback(cluster, c, txID, prepared)
+	setMap, err := database.DecodeSortedSets(remoteSets)
+	if err != nil {
+		return protocol.MakeErrReply("ERR invalid prepare response: " + err.Error())
+	}
+	sets := make([]*sortedset.SortedSet, len(opt.Keys))
+	for i, key := range opt.Keys {
+		sets[i] = setMap[key]
+	}
+	var result *sortedset.SortedSet
+	switch {
+	case strings.HasPrefix(cmdName, "zunion"):
+		result = sortedset.Union(sets, opt.Weights, opt.Aggregate)
+	case strings.HasPrefix(cmdName, "zinter"):
+		result = sortedset.Intersect(sets, opt.Weights, opt.Aggregate)
+	default:
+		result = sortedset.Diff(sets)
+	}
+	if isCard {
+		card := result.Len()
+		if opt.Limit > 0 && card > opt.Limit {
+			card = opt.Limit
+		}
+		return protocol.MakeIntReply(card)
+	}
+	if result.Len() == 0 {
+		return protocol.MakeEmptyMultiBulkReply()
+	}
+	var members [][]byte
+	for _, element := range result.Range(0, result.Len(), false) {
+		members = append(members, []byte(element.Member))
+		if opt.WithScores {
+			members = append(members, []byte(strconv.FormatFloat(element.Score, 'f', -1, 64)))
+		}
+	}
+	return protocol.MakeMultiBulkReply(members)
+}
+
+// ZMPop pops from the first non-empty sorted set in given keys, keys can be distributed on any node.
+// It tries keys one by one in order when they are not in the same node
+func ZMPop(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 4 {
+		return protocol.MakeArgNumErrReply("zmpop")
+	}
+	numKeys, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys <= 0 || numKeys > len(args)-3 {
+		// let node report the error
+		return cluster.relay(cluster.self, c, args)
+	}
+	keys := args[2 : 2+numKeys]
+	options := args[2+numKeys:]
+	nodes := make(map[string]struct{})
+	for _, key := range keys {
+		nodes[cluster.peerPicker.PickNode(string(key))] = struct{}{}
+	}
+	if len(nodes) == 1 {
+		return cluster.relay(cluster.peerPicker.PickNode(string(keys[0])), c, args)
+	}
+	for _, key := range keys {
+		cmdLine := utils.ToCmdLine3("ZMPop", []byte("1"), key)
+		cmdLine = append(cmdLine, options...)
+		resp := cluster.relay(cluster.peerPicker.PickNode(string(key)), c, cmdLine)
+		if _, ok := resp.(*protocol.NullBulkReply); !ok {
+			return resp
+		}
+	}
+	return protocol.MakeNullBulkReply()
+}
+
+// maxPeerBlocking is the max time of a blocking command waiting on peer in one round.
+// Peer client gives up after its read timeout, members popped after that would be lost
+const maxPeerBlocking = time.Second
+
+// BZPop executes BZPOPMIN, BZPOPMAX and BZMPOP, all keys must be on the same node
+// because a client can only be blocked by one node
+func BZPop(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(args[0]))
+	var keys [][]byte
+	var timeoutIndex int
+	if cmdName == "bzmpop" {
+		if len(args) < 5 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		numKeys, err := strconv.Atoi(string(args[2]))
+		if err != nil || numKeys <= 0 || numKeys > len(args)-4 {
+			// let node report the error
+			return cluster.relay(cluster.self, c, args)
+		}
+		keys = args[3 : 3+numKeys]
+		timeoutIndex = 1
+	} else {
+		if len(args) < 3 {
+			return protocol.MakeArgNumErrReply(cmdName)
+		}
+		keys = args[1 : len(args)-1]
+		timeoutIndex = len(args) - 1
+	}
+	node := cluster.peerPicker.PickNode(string(keys[0]))
+	for _, key := range keys[1:] {
+		if cluster.peerPicker.PickNode(string(key)) != node {
+			return protocol.MakeErrReply("ERR keys of " + cmdName + " must be on the same node")
+		}
+	}
+	seconds, err := strconv.ParseFloat(string(args[timeoutIndex]), 64)
+	if node == cluster.self || err != nil || seconds < 0 {
+		return cluster.relay(node, c, args)
+	}
+
+	// wait on peer in rounds
+	timeout := time.Duration(seconds * float64(time.Second))
+	deadline := time.Now().Add(timeout)
+	cmdLine := make([][]byte, len(args))
+	copy(cmdLine, args)
+	for {
+		select {
+		case <-c.Done():
+			// client has disconnected, stop blocking so that later members are not popped for nobody
+			return protocol.MakeNullBulkReply()
+		default:
+		}
+		round := maxPeerBlocking
+		if timeout > 0 {
+			remain := time.Until(deadline)
+			if remain <= 0 {
+				return protocol.MakeNullBulkReply()
+			}
+			if remain < round {
+				round = remain
+			}
+		}
+		cmdLine[timeoutIndex] = []byte(strconv.FormatFloat(round.Seconds(), 'f', -1, 64))
+		resp := cluster.relay(node, c, cmdLine)
+		if _, ok := resp.(*protocol.NullBulkReply); !ok {
+			return resp
+		}
+	}
+}
+
+func init() {
+	registerPrepareFunc("ZRangeStoreFrom", prepareRead)
+	registerPrepareFunc("ZSetOperationFrom", prepareRead)
+}
@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+	"time"
+)
+
+func TestZRangeStore(t *testing.T) {
+	conn := &connection.FakeConn{}
+	allowFastTransaction = false
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	src := testNodeA.self + utils.RandString(10)
+	dest := testNodeB.self + utils.RandString(10) // route to testNodeB, see mockPicker.PickNode
+	testNodeA.db.Exec(conn, utils.ToCmdLine("ZADD", src, "1", "a", "2", "b", "3", "c", "4", "d"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", dest, "a"))
+
+	ret := ZRangeStore(testNodeA, conn, toArgs("ZRANGESTORE", dest, src, "(1", "+inf", "BYSCORE", "LIMIT", "0", "2"))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("ZRANGE", dest, "0", "-1", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"b", "2", "c", "3"})
+
+	ret = ZRangeStore(testNodeA, conn, toArgs("ZRANGESTORE", dest, src, "[c", "-", "BYLEX", "REV"))
+	asserts.AssertIntReply(t, ret, 3)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("ZRANGE", dest, "0", "-1", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"a", "1", "b", "2", "c", "3"})
+
+	ret = ZRangeStore(testNodeA, conn, toArgs("ZRANGESTORE", dest, src, "10", "20"))
+	asserts.AssertIntReply(t, ret, 0)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("EXISTS", dest))
+	asserts.AssertIntReply(t, ret, 0)
+
+	ret = ZRangeStore(testNodeA, conn, toArgs("ZRANGESTORE", dest, src, "0", "1", "LIMIT", "0", "1"))
+	asserts.AssertErrReply(t, ret, "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+
+	// source is unlocked after transaction
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("ZADD", src, "5", "e"))
+	asserts.AssertIntReply(t, ret, 1)
+}
+
+func TestZSetOperation(t *testing.T) {
+	conn := &connection.FakeConn{}
+	allowFastTransaction = false
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("ZADD", keyA, "1", "a", "2", "b", "3", "c"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("ZADD", keyB, "1", "b", "2", "c", "3", "d"))
+
+	ret := execZSetOperation(testNodeA, conn, toArgs("ZUNION", "2", keyA, keyB, "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"a", "1", "b", "3", "d", "3", "c", "5"})
+	ret = execZSetOperation(testNodeA, conn, toArgs("ZINTER", "2", keyA, keyB, "WEIGHTS", "1", "2", "AGGREGATE", "MAX"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"b", "c"})
+	ret = execZSetOperation(testNodeA, conn, toArgs("ZDIFF", "2", keyB, keyA))
+	asserts.AssertMultiBulkReply(t, ret, []string{"d"})
+	ret = execZSetOperation(testNodeA, conn, toArgs("ZINTERCARD", "2", keyA, keyB, "LIMIT", "1"))
+	asserts.AssertIntReply(t, ret, 1)
+
+	dest := testNodeB.self + utils.RandString(10)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", dest, "a"))
+	ret = execZSetOperation(testNodeA, conn, toArgs("ZINTERSTORE", dest, "2", keyA, keyB))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("ZRANGE", dest, "0", "-1", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, ret, []string{"b", "3", "c", "5"})
+	ret = execZSetOperation(testNodeA, conn, toArgs("ZUNIONSTORE", dest, "2", keyA, keyB, "AGGREGATE", "MIN"))
+	asserts.AssertIntReply(t, ret, 4)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("ZCARD", dest))
+	asserts.AssertIntReply(t, ret, 4)
+	ret = execZSetOperation(testNodeA, conn, toArgs("ZDIFFSTORE", dest, "2", keyA, keyA))
+	asserts.AssertIntReply(t, ret, 0)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("EXISTS", dest))
+	asserts.AssertIntReply(t, ret, 0)
+
+	ret = execZSetOperation(testNodeA, conn, toArgs("ZUNION", "3", keyA, keyB))
+	asserts.AssertErrReply(t, ret, "ERR syntax error")
+
+	// failed transaction releases locks of sources and keeps destination
+	wrongType := testNodeA.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SET", wrongType, "a"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("ZADD", dest, "1", "a"))
+	ret = execZSetOperation(testNodeA, conn, toArgs("ZUNIONSTORE", dest, "2", keyB, wrongType))
+	asserts.AssertErrReply(t, ret, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("ZCARD", dest))
+	asserts.AssertIntReply(t, ret, 1)
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("ZADD", keyA, "4", "d"))
+	asserts.AssertIntReply(t, ret, 1)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("ZADD", keyB, "4", "e"))
+	asserts.AssertIntReply(t, ret, 1)
+}
+
+func TestZMPop(t *testing.T) {
+	conn := &connection.FakeConn{}
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("ZADD", keyB, "1", "a", "2", "b"))
+
+	ret := ZMPop(testNodeA, conn, toArgs("ZMPOP", "2", keyA, keyB, "MAX"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(keyB)),
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeMultiBulkReply(utils.ToCmdLine("b", "2")),
+		}),
+	})
+	if !utils.BytesEquals(ret.ToBytes(), expected.ToBytes()) {
+		t.Errorf("expected %s, actually %s", expected.ToBytes(), ret.ToBytes())
+	}
+	ret = ZMPop(testNodeA, conn, toArgs("ZMPOP", "1", keyA, "MIN"))
+	asserts.AssertNullBulk(t, ret)
+	ret = ZMPop(testNodeA, conn, toArgs("ZMPOP", "9223372036854775807", keyA, "MIN"))
+	asserts.AssertErrReply(t, ret, "Err syntax error")
+	ret = BZPop(testNodeA, conn, toArgs("BZMPOP", "1", "9223372036854775807", keyA, "MIN"))
+	asserts.AssertErrReply(t, ret, "Err syntax error")
+}
+
+func TestBZPop(t *testing.T) {
+	conn := &connection.FakeConn{}
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10)
+
+	ret := BZPop(testNodeA, conn, toArgs("BZPOPMIN", keyA, keyB, "1"))
+	asserts.AssertErrReply(t, ret, "ERR keys of bzpopmin must be on the same node")
+	ret = BZPop(testNodeA, conn, toArgs("BZPOPMIN", keyB, "0.1"))
+	asserts.AssertNullBulk(t, ret)
+
+	// wait on peer for more than one round
+	go func() {
+		time.Sleep(maxPeerBlocking + 200*time.Millisecond)
+		testNodeB.db.Exec(conn, utils.ToCmdLine("ZADD", keyB, "1", "a"))
+	}()
+	ret = BZPop(testNodeA, conn, toArgs("BZMPOP", "0", "1", keyB, "MIN"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(keyB)),
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeMultiBulkReply(utils.ToCmdLine("a", "1")),
+		}),
+	})
+	if !utils.BytesEquals(ret.ToBytes(), expected.ToBytes()) {
+		t.Errorf("expected %s, actually %s", expected.ToBytes(), ret.ToBytes())
+	}
+
+	// stop waiting on peer after client disconnected
+	conn2 := &connection.FakeConn{}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = conn2.Close()
+	}()
+	ret = BZPop(testNodeA, conn2, toArgs("BZPOPMIN", keyB, "0"))
+	asserts.AssertNullBulk(t, ret)
+	testNodeB.db.Exec(conn, utils.ToCmdLine("ZADD", keyB, "1", "a"))
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("ZCARD", keyB))
+	asserts.AssertIntReply(t, ret, 1)
+}
@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
+)
+
+// BitOp performs bitwise operation between strings and stores the result in destination key, keys can be distributed on any node.
+// Source nodes read strings during tcc prepare, so they stay locked until the result has been stored.
+// Strings on destination node are read by itself when committing
+func BitOp(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 4 {
+		return protocol.MakeErrReply("ERR wrong number of arguments for 'bitop' command")
+	}
+	op := strings.ToLower(string(args[1]))
+	if op != "and" && op != "or" && op != "xor" && op != "not" {
+		return protocol.MakeErrReply("ERR syntax error")
+	}
+	if op == "not" && len(args) != 4 {
+		return protocol.MakeErrReply("ERR BITOP NOT must be called with a single source key.")
+	}
+	keys := make([]string, len(args)-2)
+	for i := 2; i < len(args); i++ {
+		keys[i-2] = string(args[i])
+	}
+	groupMap := cluster.groupBy(keys)
+	if len(groupMap) == 1 && allowFastTransaction { // do fast
+		for peer := range groupMap {
+			return cluster.relay(peer, c, args)
+		}
+	}
+	dest := keys[0]
+	txID := cluster.idGenerator.NextID()
+	txIDStr := strconv.FormatInt(txID, 10)
+	srcGroupMap := cluster.groupBy(keys[1:])
+	destNode := cluster.peerPicker.PickNode(dest)
+	delete(srcGroupMap, destNode)
+	// prepare source nodes, prepareRead returns key-value pairs of strings
+	prepared := make(map[string][]string)
+	remoteValues, errReply := prepareReadFrom(cluster, c, txID, "BitOpFrom", srcGroupMap, prepared)
+	if errReply != nil {
+		return errReply
+	}
+	// prepare destination node, it computes and stores the result with local strings and remote values when committing
+	cmdLine := utils.ToCmdLine("Prepare", txIDStr, "BitOpTo", dest, op)
+	cmdLine = append(cmdLine, protocol.MakeMultiBulkReply(remoteValues).ToBytes())
+	cmdLine = append(cmdLine, args[3:]...)
+	prepared[destNode] = []string{dest}
+	resp := cluster.relayPrepare(destNode, c, cmdLine)
+	if protocol.IsErrorReply(resp) {
+		requestRollback(cluster, c, txID, prepared)
+		return resp
+	}
+	respMap, errReply := requestCommit(cluster, c, txID, prepared)
+	if errReply != nil {
+		return errReply
+	}
+	return respMap[destNode]
+}
+
+// LCS finds the longest common subsequence of two strings, the two keys must be on the same node
+func LCS(cluster *Cluster, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 3 {
+		return protocol.MakeArgNumErrReply("lcs")
+	}
+	node := cluster.peerPicker.PickNode(string(args[1]))
+	if cluster.peerPicker.PickNode(string(args[2])) != node {
+		return protocol.MakeErrReply("ERR keys of lcs must be on the same node")
+	}
+	return cluster.relay(node, c, args)
+}
+
+func init() {
+	registerPrepareFunc("BitOpFrom", prepareRead)
+}
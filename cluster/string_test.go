@@ -0,0 +1,68 @@
+package cluster
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+)
+
+func TestBitOp(t *testing.T) {
+	conn := &connection.FakeConn{}
+	allowFastTransaction = false
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10) // route to testNodeB, see mockPicker.PickNode
+	dest := testNodeB.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SET", keyA, "\x0f\xff"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", keyB, "\xf1"))
+
+	ret := BitOp(testNodeA, conn, toArgs("BITOP", "AND", dest, keyA, keyB))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("GET", dest))
+	asserts.AssertBulkReply(t, ret, "\x01\x00")
+	ret = BitOp(testNodeA, conn, toArgs("BITOP", "OR", dest, keyA, keyB))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("GET", dest))
+	asserts.AssertBulkReply(t, ret, "\xff\xff")
+	ret = BitOp(testNodeA, conn, toArgs("BITOP", "NOT", dest, keyA))
+	asserts.AssertIntReply(t, ret, 2)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("GET", dest))
+	asserts.AssertBulkReply(t, ret, "\xf0\x00")
+	ret = BitOp(testNodeA, conn, toArgs("BITOP", "XOR", dest, keyA+"1", keyB+"1"))
+	asserts.AssertIntReply(t, ret, 0)
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("EXISTS", dest))
+	asserts.AssertIntReply(t, ret, 0)
+
+	ret = BitOp(testNodeA, conn, toArgs("BITOP", "NOT", dest, keyA, keyB))
+	asserts.AssertErrReply(t, ret, "ERR BITOP NOT must be called with a single source key.")
+
+	// failed transaction releases locks of sources and keeps destination
+	wrongType := testNodeA.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("SADD", wrongType, "a"))
+	testNodeB.db.Exec(conn, utils.ToCmdLine("SET", dest, "d"))
+	ret = BitOp(testNodeA, conn, toArgs("BITOP", "OR", dest, keyB, wrongType))
+	asserts.AssertErrReply(t, ret, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("GET", dest))
+	asserts.AssertBulkReply(t, ret, "d")
+	ret = testNodeA.db.Exec(conn, utils.ToCmdLine("SET", keyA, "a"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	ret = testNodeB.db.Exec(conn, utils.ToCmdLine("SET", keyB, "b"))
+	asserts.AssertStatusReply(t, ret, "OK")
+}
+
+func TestLCS(t *testing.T) {
+	conn := &connection.FakeConn{}
+	FlushAll(testNodeA, conn, toArgs("FLUSHALL"))
+	keyA := testNodeA.self + utils.RandString(10)
+	keyA2 := testNodeA.self + utils.RandString(10)
+	keyB := testNodeB.self + utils.RandString(10)
+	testNodeA.db.Exec(conn, utils.ToCmdLine("MSET", keyA, "ohmytext", keyA2, "mynewtext"))
+
+	ret := LCS(testNodeA, conn, toArgs("LCS", keyA, keyA2))
+	asserts.AssertBulkReply(t, ret, "mytext")
+	ret = LCS(testNodeA, conn, toArgs("LCS", keyA, keyA2, "LEN"))
+	asserts.AssertIntReply(t, ret, 6)
+	ret = LCS(testNodeA, conn, toArgs("LCS", keyA, keyB))
+	asserts.AssertErrReply(t, ret, "ERR keys of lcs must be on the same node")
+}
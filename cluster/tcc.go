@@ -2,10 +2,11 @@ package cluster
 
 import (
 	"fmt"
-	"github.com/hdt3213/godis/database"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/lib/routing"
 	"github.com/hdt3213/godis/lib/timewheel"
+	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"strconv"
 	"strings"
@@ -86,7 +87,7 @@ func (tx *Transaction) prepare() error {
 	tx.mu.Lock()
 	defer tx.mu.Unlock()
 
-	tx.writeKeys, tx.readKeys = database.GetRelatedKeys(tx.cmdLine)
+	tx.writeKeys, tx.readKeys = routing.GetRelatedKeys(tx.cmdLine)
 	// lock writeKeys
 	tx.lockKeys()
 
@@ -111,12 +112,21 @@ func (tx *Transaction) rollback() error {
 	if tx.status != curStatus { // ensure status not changed by other goroutine
 		return fmt.Errorf("tx %s status changed", tx.id)
 	}
+	return tx.rollbackWithLock()
+}
+
+// rollbackWithLock executes undo logs, invoker should hold tx.mu
+func (tx *Transaction) rollbackWithLock() error {
 	if tx.status == rolledBackStatus { // no need to rollback a rolled-back transaction
 		return nil
 	}
 	tx.lockKeys()
-	for _, cmdLine := range tx.undoLog {
-		tx.cluster.db.ExecWithLock(tx.conn, cmdLine)
+	// command of an uncommitted transaction has not been executed, and failed commands take no effect,
+	// executing undo logs like `RPUSH key popped-element` for them would corrupt data
+	if tx.status == committedStatus {
+		for _, cmdLine := range tx.undoLog {
+			tx.cluster.db.ExecWithLock(tx.conn, cmdLine)
+		}
 	}
 	tx.unLockKeys()
 	tx.status = rolledBackStatus
@@ -184,7 +194,7 @@ func execCommit(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Rep
 
 	if protocol.IsErrorReply(result) {
 		// failed
-		err2 := tx.rollback()
+		err2 := tx.rollbackWithLock()
 		return protocol.MakeErrReply(fmt.Sprintf("err occurs when rollback: %v, origin err: %s", err2, result))
 	}
 	// after committed
@@ -199,10 +209,11 @@ func execCommit(cluster *Cluster, c redis.Connection, cmdLine CmdLine) redis.Rep
 }
 
 // requestCommit commands all node to commit transaction as coordinator
-func requestCommit(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) ([]redis.Reply, protocol.ErrorReply) {
+// returns node -> reply of commit
+func requestCommit(cluster *Cluster, c redis.Connection, txID int64, groupMap map[string][]string) (map[string]redis.Reply, protocol.ErrorReply) {
 	var errReply protocol.ErrorReply
 	txIDStr := strconv.FormatInt(txID, 10)
-	respList := make([]redis.Reply, 0, len(groupMap))
+	respMap := make(map[string]redis.Reply, len(groupMap))
 	for node := range groupMap {
 		var resp redis.Reply
 		if node == cluster.self {
@@ -214,13 +225,13 @@ func requestCommit(cluster *Cluster, c redis.Connection, txID int64, groupMap ma
 			errReply = resp.(protocol.ErrorReply)
 			break
 		}
-		respList = append(respList, resp)
+		respMap[node] = resp
 	}
 	if errReply != nil {
 		requestRollback(cluster, c, txID, groupMap)
 		return nil, errReply
 	}
-	return respList, nil
+	return respMap, nil
 }
 
 // requestRollback requests all node rollback transaction as coordinator
@@ -243,3 +254,34 @@ func (cluster *Cluster) relayPrepare(node string, c redis.Connection, cmdLine Cm
 		return cluster.relay(node, c, cmdLine)
 	}
 }
+
+// prepareRead is prepare-function for commands reading sources of cross-node commands, such as ZSetOperationFrom.
+// It reads sources while they are locked by transaction
+func prepareRead(cluster *Cluster, conn redis.Connection, cmdLine CmdLine) redis.Reply {
+	return cluster.db.ExecWithLock(conn, cmdLine)
+}
+
+// prepareReadFrom prepares cmdName on each node of srcGroupMap with its keys, so that source keys stay locked
+// until the transaction finished. It returns concatenated replies of all nodes, prepared nodes are recorded into prepared.
+// Prepared nodes are rolled back if any of them failed
+func prepareReadFrom(cluster *Cluster, c redis.Connection, txID int64, cmdName string,
+	srcGroupMap map[string][]string, prepared map[string][]string) ([][]byte, redis.Reply) {
+	txIDStr := strconv.FormatInt(txID, 10)
+	var result [][]byte
+	for node, nodeKeys := range srcGroupMap {
+		prepared[node] = nodeKeys
+		resp := cluster.relayPrepare(node, c, utils.ToCmdLine2("Prepare", append([]string{txIDStr, cmdName}, nodeKeys...)...))
+		switch reply := resp.(type) {
+		case protocol.ErrorReply:
+			requestRollback(cluster, c, txID, prepared)
+			return nil, reply
+		case *protocol.MultiBulkReply:
+			result = append(result, reply.Args...)
+		case *protocol.EmptyMultiBulkReply:
+		default:
+			requestRollback(cluster, c, txID, prepared)
+			return nil, protocol.MakeErrReply("ERR invalid prepare response from " + node)
+		}
+	}
+	return result, nil
+}
@@ -57,6 +57,11 @@ func makeMockRelay(peer *Cluster) (*bool, func(cluster *Cluster, node string, c
 			return execCommit(peer, c, cmdLine)
 		} else if cmdName == "rollback" {
 			return execRollback(peer, c, cmdLine)
+		} else if strings.HasPrefix(cmdName, "_") {
+			// commands relayed between nodes are handled by router of peer
+			if cmdFunc, ok := router[cmdName]; ok {
+				return cmdFunc(peer, c, cmdLine)
+			}
 		}
 		return peer.db.Exec(c, cmdLine)
 	}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/database"
+	"os"
+	"strconv"
+)
+
+const usage = `usage: godis-check-aof [--fix] <file>
+       godis-check-aof --truncate-to-timestamp <unix> <file | manifest> <output file | output dir>
+       godis-check-aof --truncate-to-timestamp <unix> --rdb <file | manifest> <output rdb file>`
+
+// 校验 aof 文件, 用法: godis-check-aof [--fix] <file>
+// 输出第一条损坏记录的位置, 使用 --fix 时截断文件, 只保留完好的部分
+// 使用 --truncate-to-timestamp 时将该时刻之前执行的命令复制到新的文件或目录, 用于恢复到误操作之前的数据, 原文件不会被修改
+// 同时使用 --rdb 时在内存中重放该时刻之前的命令, 并将数据保存到新的 rdb 文件
+func main() {
+	args := os.Args[1:]
+	switch {
+	case len(args) == 1:
+		os.Exit(check(args[0], false))
+	case len(args) == 2 && args[0] == "--fix":
+		os.Exit(check(args[1], true))
+	case len(args) == 4 && args[0] == "--truncate-to-timestamp":
+		timestamp, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Println("invalid timestamp: " + args[1])
+			os.Exit(1)
+		}
+		os.Exit(truncateToTimestamp(args[2], timestamp, args[3], false))
+	case len(args) == 5 && args[0] == "--truncate-to-timestamp" && args[2] == "--rdb":
+		timestamp, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Println("invalid timestamp: " + args[1])
+			os.Exit(1)
+		}
+		os.Exit(truncateToTimestamp(args[3], timestamp, args[4], true))
+	default:
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+}
+
+func truncateToTimestamp(filename string, timestamp int64, output string, rdbFormat bool) int {
+	var result *aof.TruncateResult
+	var err error
+	if rdbFormat {
+		result, err = database.TruncateAofToRDB(filename, timestamp, output)
+	} else {
+		result, err = aof.TruncateToTimestamp(filename, timestamp, output)
+	}
+	if err != nil {
+		fmt.Println("[error] " + err.Error())
+		return 1
+	}
+	action := "copied"
+	if rdbFormat {
+		action = "saved"
+	}
+	if result.Filename == "" {
+		fmt.Printf("No command executed after %d, %s all commands to %s\n", timestamp, action, output)
+		return 0
+	}
+	for _, dropped := range result.Dropped {
+		fmt.Printf("Skipped %s\n", dropped)
+	}
+	fmt.Printf("Successfully %s the first %d bytes of %s to %s\n", action, result.Offset, result.Filename, output)
+	return 0
+}
+
+func check(filename string, fix bool) int {
+	result, err := aof.CheckFile(filename)
+	if err != nil {
+		fmt.Println("[error] " + err.Error())
+		return 1
+	}
+	if result.Err != nil {
+		if result.Truncated {
+			fmt.Printf("0x%x: unexpected EOF, the last command is truncated\n", result.ValidSize)
+		} else {
+			fmt.Printf("0x%x: %s\n", result.ValidSize, result.Err.Error())
+		}
+	}
+	fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d, commands=%d\n",
+		result.Size, result.ValidSize, result.Size-result.ValidSize, result.Commands)
+	if result.Err == nil {
+		fmt.Println("AOF is valid")
+		return 0
+	}
+	if !fix {
+		fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+		return 1
+	}
+	err = os.Truncate(filename, result.ValidSize)
+	if err != nil {
+		fmt.Println("[error] failed to truncate AOF: " + err.Error())
+		return 1
+	}
+	fmt.Printf("Successfully truncated AOF to %d bytes\n", result.ValidSize)
+	return 0
+}
@@ -10,19 +10,43 @@ import (
 	"strings"
 )
 
+// Version of godis, it is recorded in metadata of backups
+const Version = "1.2.8"
+
 // ServerProperties defines global config properties
 type ServerProperties struct {
 	Bind           string `cfg:"bind"`
 	Port           int    `cfg:"port"`
 	AppendOnly     bool   `cfg:"appendOnly"`
 	AppendFilename string `cfg:"appendFilename"`
-	MaxClients     int    `cfg:"maxclients"`
-	RequirePass    string `cfg:"requirepass"`
-	Databases      int    `cfg:"databases"`
-	RDBFilename    string `cfg:"dbfilename"`
+	AppendFsync    string `cfg:"appendfsync"`   // always, everysec or no
+	AppendDirname  string `cfg:"appenddirname"` // directory of multi-part aof, default is the directory of appendFilename
+	// truncate partial command at the end of aof instead of refusing to start
+	AofLoadTruncated bool   `cfg:"aof-load-truncated"`
+	MaxClients       int    `cfg:"maxclients"`
+	RequirePass      string `cfg:"requirepass"`
+	Databases        int    `cfg:"databases"`
+	RDBFilename      string `cfg:"dbfilename"`
+	// snapshotting rules, format: `<seconds> <changes> [<seconds> <changes> ...]`, save rdb if both satisfied
+	Save string `cfg:"save"`
+	// aof rewrite writes a rdb snapshot followed by incremental commands
+	AofUseRdbPreamble bool `cfg:"aof-use-rdb-preamble"`
+	// rewrite aof automatically when it grows by the percentage since the latest rewrite, 0 means disabled
+	AutoAofRewritePercentage int    `cfg:"auto-aof-rewrite-percentage"`
+	AutoAofRewriteMinSize    string `cfg:"auto-aof-rewrite-min-size"` // e.g. 64mb, aof smaller than it is not rewritten automatically
+	// directory made by BACKUP command, data is replaced by the backup on startup. Remove it after the node restored
+	RestoreFrom string `cfg:"restore-from"`
 
 	Peers []string `cfg:"peers"`
 	Self  string   `cfg:"self"`
+
+	// connection pool of peers, 0 means using default value
+	PeerMaxTotal    int `cfg:"peer-max-total"`
+	PeerMaxIdle     int `cfg:"peer-max-idle"`
+	PeerMaxWait     int `cfg:"peer-max-wait"`     // milliseconds to wait for a connection from pool
+	PeerIdleTimeout int `cfg:"peer-idle-timeout"` // seconds before an idle connection is evicted
+	// override pool config of given peers, format: `addr max-total=16 max-idle=8 max-wait=3000 idle-timeout=60, addr2 ...`
+	PeerPool []string `cfg:"peer-pool"`
 }
 
 // Properties holds global config properties
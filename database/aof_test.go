@@ -1,6 +1,7 @@
 package database
 
 import (
+	"github.com/hdt3213/godis/aof"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
@@ -11,7 +12,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -94,6 +98,14 @@ func validateTestData(t *testing.T, db database.DB, dbIndex int, prefix string,
 	}
 }
 
+// removeAofFiles removes files of multi-part aof created in the directory of aofFilename
+func removeAofFiles(aofFilename string) {
+	files, _ := filepath.Glob(aofFilename + "*")
+	for _, file := range files {
+		_ = os.Remove(file)
+	}
+}
+
 func TestAof(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "godis")
 	if err != nil {
@@ -102,7 +114,7 @@ func TestAof(t *testing.T) {
 	}
 	aofFilename := path.Join(tmpDir, "a.aof")
 	defer func() {
-		_ = os.Remove(aofFilename)
+		_ = os.RemoveAll(tmpDir)
 	}()
 	config.Properties = &config.ServerProperties{
 		AppendOnly:     true,
@@ -172,7 +184,7 @@ func TestRewriteAOF(t *testing.T) {
 	}
 	aofFilename := tmpFile.Name()
 	defer func() {
-		_ = os.Remove(aofFilename)
+		removeAofFiles(aofFilename)
 	}()
 	config.Properties = &config.ServerProperties{
 		AppendOnly:     true,
@@ -208,7 +220,7 @@ func TestRewriteAOF2(t *testing.T) {
 	}
 	aofFilename := tmpFile.Name()
 	defer func() {
-		_ = os.Remove(aofFilename)
+		removeAofFiles(aofFilename)
 	}()
 	config.Properties = &config.ServerProperties{
 		AppendOnly:     true,
@@ -251,3 +263,612 @@ func TestRewriteAOF2(t *testing.T) {
 	}
 	aofReadDB.Close()
 }
+
+// TestRewriteAOFConcurrently tests rewrite from live dataset while commands are executing
+func TestRewriteAOFConcurrently(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	for _, preamble := range []bool{false, true} {
+		config.Properties = &config.ServerProperties{
+			AppendOnly:        true,
+			AppendFilename:    path.Join(tmpDir, "appendonly.aof"),
+			AppendDirname:     path.Join(tmpDir, strconv.FormatBool(preamble)),
+			AofUseRdbPreamble: preamble,
+		}
+		aofWriteDB := NewStandaloneServer()
+		workers := 4
+		count := 500
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				conn := &connection.FakeConn{}
+				conn.SelectDB(i % 2)
+				suffix := strconv.Itoa(i)
+				for j := 0; j < count; j++ {
+					// non-idempotent commands reveal commands applied twice or lost
+					aofWriteDB.Exec(conn, utils.ToCmdLine("INCR", "counter"+suffix))
+					aofWriteDB.Exec(conn, utils.ToCmdLine("RPUSH", "list"+suffix, strconv.Itoa(j)))
+					if j%50 == 0 {
+						aofWriteDB.Exec(conn, utils.ToCmdLine("DEL", "list"+suffix))
+					}
+				}
+			}(i)
+		}
+		for i := 0; i < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			err = aofWriteDB.aofHandler.Rewrite()
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		wg.Wait()
+		aofWriteDB.Close()
+
+		aofReadDB := NewStandaloneServer()
+		for i := 0; i < workers; i++ {
+			conn := &connection.FakeConn{}
+			conn.SelectDB(i % 2)
+			suffix := strconv.Itoa(i)
+			ret := aofReadDB.Exec(conn, utils.ToCmdLine("GET", "counter"+suffix))
+			asserts.AssertBulkReply(t, ret, strconv.Itoa(count))
+			ret = aofReadDB.Exec(conn, utils.ToCmdLine("LLEN", "list"+suffix))
+			asserts.AssertIntReply(t, ret, (count-1)%50)
+		}
+		aofReadDB.Close()
+	}
+}
+
+func TestAutoRewriteAOF(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:               true,
+		AppendFilename:           path.Join(tmpDir, "appendonly.aof"),
+		AutoAofRewritePercentage: 100,
+		AutoAofRewriteMinSize:    "1kb",
+	}
+	db := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	// overwriting the same key makes aof grow without growing dataset
+	for i := 0; i < 100; i++ {
+		db.Exec(conn, utils.ToCmdLine("SET", "key", strconv.Itoa(i)))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, base := db.aofHandler.GetSize(); base > 0 && !db.aofHandler.IsRewriting() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, base := db.aofHandler.GetSize(); base == 0 {
+		t.Error("expect aof rewritten automatically")
+	}
+	db.Close()
+	db = NewStandaloneServer()
+	asserts.AssertBulkReply(t, db.Exec(conn, utils.ToCmdLine("GET", "key")), "99")
+	db.Close()
+}
+
+func TestRewriteAOFWithPreamble(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	aofFilename := path.Join(tmpDir, "a.aof")
+	config.Properties = &config.ServerProperties{
+		AppendOnly:        true,
+		AppendFilename:    aofFilename,
+		AofUseRdbPreamble: true,
+	}
+	aofWriteDB := NewStandaloneServer()
+	dbNum := 4
+	size := 10
+	var prefixes []string
+	for i := 0; i < dbNum; i++ {
+		prefix := utils.RandString(8)
+		prefixes = append(prefixes, prefix)
+		makeTestData(aofWriteDB, i, prefix, size)
+	}
+	ctx, err := aofWriteDB.aofHandler.StartRewrite()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// add data during rewrite
+	conn := &connection.FakeConn{}
+	conn.SelectDB(1)
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "during", "during"))
+	err = aofWriteDB.aofHandler.DoRewrite(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofWriteDB.aofHandler.FinishRewrite(ctx)
+	// add data after rewrite
+	aofWriteDB.Exec(conn, utils.ToCmdLine("SET", "after", "after"))
+	aofWriteDB.Close()
+
+	data, err := ioutil.ReadFile(aofFilename + ".manifest")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(string(data), "file a.aof.1.base.rdb seq 1 type b") {
+		t.Error("expect base file in rdb format, manifest: " + string(data))
+	}
+	aofReadDB := NewStandaloneServer()
+	defer aofReadDB.Close()
+	for i := 0; i < dbNum; i++ {
+		validateTestData(t, aofReadDB, i, prefixes[i], size)
+	}
+	ret := aofReadDB.Exec(conn, utils.ToCmdLine("GET", "during"))
+	asserts.AssertBulkReply(t, ret, "during")
+	ret = aofReadDB.Exec(conn, utils.ToCmdLine("GET", "after"))
+	asserts.AssertBulkReply(t, ret, "after")
+}
+
+func TestMultiPartAof(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	aofDir := path.Join(tmpDir, "appendonlydir")
+	// legacy single file aof will be moved into aof dir
+	legacyFilename := path.Join(tmpDir, "appendonly.aof")
+	legacy := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "legacy", "legacy")).ToBytes()
+	err = ioutil.WriteFile(legacyFilename, legacy, 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: legacyFilename,
+		AppendDirname:  aofDir,
+	}
+	conn := &connection.FakeConn{}
+	db := NewStandaloneServer()
+	asserts.AssertBulkReply(t, db.Exec(conn, utils.ToCmdLine("GET", "legacy")), "legacy")
+	db.Exec(conn, utils.ToCmdLine("SET", "a", "a"))
+	asserts.AssertStatusReply(t, db.Exec(conn, utils.ToCmdLine("rewriteaof")), "OK")
+	db.Exec(conn, utils.ToCmdLine("SET", "b", "b"))
+	db.Close()
+
+	manifest, err := ioutil.ReadFile(path.Join(aofDir, "appendonly.aof.manifest"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := "file appendonly.aof.2.base.aof seq 2 type b\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n"
+	if string(manifest) != expected {
+		t.Errorf("unexpected manifest: %s", string(manifest))
+	}
+	if _, err := os.Stat(legacyFilename); !os.IsNotExist(err) {
+		t.Error("expect legacy aof file moved")
+	}
+
+	// files left by crash during rewrite should be removed on startup
+	leftovers := []string{
+		path.Join(aofDir, "appendonly.aof.3.base.aof"),
+		path.Join(aofDir, "appendonly.aof.1.incr.aof"),
+		path.Join(aofDir, "temp-appendonly.aof.1.rewrite"),
+	}
+	for _, file := range leftovers {
+		_ = ioutil.WriteFile(file, legacy, 0644)
+	}
+	db = NewStandaloneServer()
+	for _, key := range []string{"legacy", "a", "b"} {
+		asserts.AssertBulkReply(t, db.Exec(conn, utils.ToCmdLine("GET", key)), key)
+	}
+	db.Close()
+	for _, file := range leftovers {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expect %s removed", file)
+		}
+	}
+
+	// refuse to start if file listed in manifest is missing
+	_ = os.Remove(path.Join(aofDir, "appendonly.aof.2.incr.aof"))
+	defer func() {
+		if recover() == nil {
+			t.Error("expect panic when aof file is missing")
+		}
+	}()
+	NewStandaloneServer()
+}
+
+func TestAofLoadTruncated(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	aofFilename := path.Join(tmpDir, "appendonly.aof")
+	valid := append(protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "a", "a")).ToBytes(),
+		protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "b", "b")).ToBytes()...)
+	partial := protocol.MakeMultiBulkReply(utils.ToCmdLine("SET", "c", "c")).ToBytes()
+	partial = partial[:len(partial)-3]
+
+	// partial command at the end is truncated if aof-load-truncated is set
+	err = ioutil.WriteFile(aofFilename, append(append([]byte{}, valid...), partial...), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err := aof.CheckFile(aofFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !result.Truncated || result.Commands != 2 || result.ValidSize != int64(len(valid)) {
+		t.Errorf("unexpected check result: %+v", result)
+	}
+	config.Properties = &config.ServerProperties{
+		AppendOnly:       true,
+		AppendFilename:   aofFilename,
+		AofLoadTruncated: true,
+	}
+	conn := &connection.FakeConn{}
+	db := NewStandaloneServer()
+	asserts.AssertBulkReply(t, db.Exec(conn, utils.ToCmdLine("GET", "b")), "b")
+	asserts.AssertNullBulk(t, db.Exec(conn, utils.ToCmdLine("GET", "c")))
+	db.Exec(conn, utils.ToCmdLine("SET", "d", "d"))
+	db.Close()
+	db = NewStandaloneServer()
+	asserts.AssertBulkReply(t, db.Exec(conn, utils.ToCmdLine("GET", "d")), "d")
+	db.Close()
+	result, err = aof.CheckFile(aofFilename)
+	if err != nil || result.Err != nil {
+		t.Errorf("expect valid aof after truncating, got %+v %v", result, err)
+	}
+
+	// corruption in the middle is reported with offset of the bad record
+	corrupted := append(append([]byte{}, valid...), []byte("*2\r\n$3\r\nGET\r\n?1\r\na\r\n")...)
+	corrupted = append(corrupted, valid...)
+	err = ioutil.WriteFile(aofFilename, corrupted, 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err = aof.CheckFile(aofFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	formatErr, ok := result.Err.(*aof.FormatError)
+	if !ok || result.Truncated || result.ValidSize != int64(len(valid)) ||
+		formatErr.Offset != int64(len(valid)+len("*2\r\n$3\r\nGET\r\n")) {
+		t.Errorf("unexpected check result: %+v", result)
+	}
+	assertPanic := func(msg string) {
+		defer func() {
+			if recover() == nil {
+				t.Error(msg)
+			}
+		}()
+		NewStandaloneServer()
+	}
+	assertPanic("expect panic when aof is corrupted in the middle")
+
+	// refuse to start with truncated aof if aof-load-truncated is not set
+	err = ioutil.WriteFile(aofFilename, append(append([]byte{}, valid...), partial...), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	config.Properties.AofLoadTruncated = false
+	assertPanic("expect panic when aof is truncated")
+}
+
+func TestAofTimestamp(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	aofDir := path.Join(tmpDir, "appendonlydir")
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: "appendonly.aof",
+		AppendDirname:  aofDir,
+	}
+	conn := &connection.FakeConn{}
+	db := NewStandaloneServer()
+	db.Exec(conn, utils.ToCmdLine("SET", "a", "a"))
+	db.Close()
+	data, err := ioutil.ReadFile(path.Join(aofDir, "appendonly.aof.1.incr.aof"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(string(data), "#TS:") {
+		t.Errorf("expect timestamp annotation, got %s", strconv.Quote(string(data)))
+	}
+
+	// replay to the time before FLUSHALL
+	toBytes := func(annotation string, cmdLines ...[]string) []byte {
+		buf := []byte(annotation)
+		for _, cmdLine := range cmdLines {
+			buf = append(buf, protocol.MakeMultiBulkReply(utils.ToCmdLine(cmdLine...)).ToBytes()...)
+		}
+		return buf
+	}
+	files := map[string][]byte{
+		"appendonly.aof.1.base.aof": toBytes("#TS:100\r\n", []string{"SET", "base", "base"}),
+		"appendonly.aof.1.incr.aof": append(toBytes("#TS:200\r\n", []string{"SET", "a", "a"}),
+			toBytes("#TS:300\r\n", []string{"FLUSHALL"})...),
+		"appendonly.aof.2.incr.aof": toBytes("#TS:400\r\n", []string{"SET", "b", "b"}),
+		"appendonly.aof.manifest": []byte("file appendonly.aof.1.base.aof seq 1 type b\n" +
+			"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+			"file appendonly.aof.2.incr.aof seq 2 type i\n"),
+	}
+	_ = os.RemoveAll(aofDir)
+	_ = os.MkdirAll(aofDir, 0755)
+	for name, content := range files {
+		_ = ioutil.WriteFile(path.Join(aofDir, name), content, 0644)
+	}
+	manifestFile := path.Join(aofDir, "appendonly.aof.manifest")
+	outputDir := path.Join(tmpDir, "recovered")
+	_, err = aof.TruncateToTimestamp(manifestFile, 50, outputDir)
+	if err == nil {
+		t.Error("expect error when timestamp is earlier than base file")
+	}
+	result, err := aof.TruncateToTimestamp(manifestFile, 250, outputDir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Filename != path.Join(aofDir, "appendonly.aof.1.incr.aof") ||
+		len(result.Dropped) != 1 || result.Offset != int64(len(toBytes("#TS:200\r\n", []string{"SET", "a", "a"}))) {
+		t.Errorf("unexpected truncate result: %+v", result)
+	}
+	_, err = aof.TruncateToTimestamp(manifestFile, 250, outputDir)
+	if err == nil {
+		t.Error("expect error when output dir exists")
+	}
+	// source files are untouched
+	for name, content := range files {
+		data, err := ioutil.ReadFile(path.Join(aofDir, name))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(data) != string(content) {
+			t.Errorf("%s should not be modified", name)
+		}
+	}
+	config.Properties.AppendDirname = outputDir
+	db = NewStandaloneServer()
+	asserts.AssertBulkReply(t, db.Exec(conn, utils.ToCmdLine("GET", "base")), "base")
+	asserts.AssertBulkReply(t, db.Exec(conn, utils.ToCmdLine("GET", "a")), "a")
+	asserts.AssertNullBulk(t, db.Exec(conn, utils.ToCmdLine("GET", "b")))
+	db.Close()
+
+	// single file
+	outputFile := path.Join(tmpDir, "single.aof")
+	result, err = aof.TruncateToTimestamp(path.Join(aofDir, "appendonly.aof.1.incr.aof"), 250, outputFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err = ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != string(toBytes("#TS:200\r\n", []string{"SET", "a", "a"})) {
+		t.Errorf("unexpected output %s", strconv.Quote(string(data)))
+	}
+
+	// rdb output
+	rdbFile := path.Join(tmpDir, "recovered.rdb")
+	result, err = TruncateAofToRDB(manifestFile, 250, rdbFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Filename != path.Join(aofDir, "appendonly.aof.1.incr.aof") || len(result.Dropped) != 1 {
+		t.Errorf("unexpected truncate result: %+v", result)
+	}
+	_, err = TruncateAofToRDB(manifestFile, 250, rdbFile)
+	if err == nil {
+		t.Error("expect error when output file exists")
+	}
+	config.Properties = &config.ServerProperties{
+		RDBFilename: rdbFile,
+	}
+	db = NewStandaloneServer()
+	asserts.AssertBulkReply(t, db.Exec(conn, utils.ToCmdLine("GET", "base")), "base")
+	asserts.AssertBulkReply(t, db.Exec(conn, utils.ToCmdLine("GET", "a")), "a")
+	asserts.AssertNullBulk(t, db.Exec(conn, utils.ToCmdLine("GET", "b")))
+	db.Close()
+}
+
+func TestAofFsync(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	for _, policy := range []string{aof.FsyncAlways, aof.FsyncEverySec, aof.FsyncNo} {
+		aofFilename := path.Join(tmpDir, policy+".aof")
+		config.Properties = &config.ServerProperties{
+			AppendOnly:     true,
+			AppendFilename: aofFilename,
+			AppendFsync:    policy,
+		}
+		aofWriteDB := NewStandaloneServer()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				conn := &connection.FakeConn{}
+				for j := 0; j < 50; j++ {
+					key := strconv.Itoa(i) + ":" + strconv.Itoa(j)
+					aofWriteDB.Exec(conn, utils.ToCmdLine("SET", key, key))
+				}
+			}(i)
+		}
+		wg.Wait()
+		stats := aofWriteDB.aofHandler.GetFsyncStats()
+		switch policy {
+		case aof.FsyncAlways:
+			// replies are sent after fsync, group commit merges concurrent writes
+			if stats.Count == 0 || stats.Count > 200 {
+				t.Errorf("unexpected fsync count %d", stats.Count)
+			}
+		case aof.FsyncEverySec:
+			time.Sleep(1500 * time.Millisecond)
+			if aofWriteDB.aofHandler.GetFsyncStats().Count == 0 {
+				t.Error("background fsync expected")
+			}
+		case aof.FsyncNo:
+			if stats.Count != 0 {
+				t.Errorf("unexpected fsync count %d", stats.Count)
+			}
+		}
+		ret := aofWriteDB.Exec(&connection.FakeConn{}, utils.ToCmdLine("INFO", "persistence"))
+		bulkRet, ok := ret.(*protocol.BulkReply)
+		if !ok || !strings.Contains(string(bulkRet.Arg), "aof_fsync:"+policy) {
+			t.Errorf("unexpected info: %s", ret.ToBytes())
+		}
+		aofWriteDB.Close()
+
+		aofReadDB := NewStandaloneServer()
+		ret = aofReadDB.Exec(&connection.FakeConn{}, utils.ToCmdLine("DBSIZE"))
+		asserts.AssertIntReply(t, ret, 200)
+		aofReadDB.Close()
+	}
+}
+
+func TestHashFieldTTLAof(t *testing.T) {
+	for _, preamble := range []bool{false, true} {
+		testHashFieldTTLAof(t, preamble)
+	}
+}
+
+func testHashFieldTTLAof(t *testing.T, preamble bool) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	aofFilename := path.Join(tmpDir, "a.aof")
+	config.Properties = &config.ServerProperties{
+		AppendOnly:        true,
+		AppendFilename:    aofFilename,
+		AofUseRdbPreamble: preamble,
+	}
+	conn := &connection.FakeConn{}
+	conn1 := &connection.FakeConn{}
+	conn1.SelectDB(1)
+	validate := func(db *MultiDB) {
+		ret := db.Exec(conn, utils.ToCmdLine("HMGET", "hash", "a", "b", "c", "d"))
+		asserts.AssertMultiBulkReply(t, ret, []string{"1", "", "3", "4"})
+		ret = db.Exec(conn, utils.ToCmdLine("HTTL", "hash", "FIELDS", "3", "b", "c", "d"))
+		assertIntsReply(t, ret, -2, -1, -1)
+		// loading and rewriting take a few seconds
+		ret = db.Exec(conn, utils.ToCmdLine("HTTL", "hash", "FIELDS", "1", "a"))
+		ttl := ret.(*protocol.MultiRawReply).Replies[0].(*protocol.IntReply).Code
+		if ttl < 990 || ttl > 1000 {
+			t.Errorf("expected ttl of field a near 1000, actually %s", ret.ToBytes())
+		}
+		ret = db.Exec(conn1, utils.ToCmdLine("HGETALL", "hash1"))
+		asserts.AssertMultiBulkReply(t, ret, []string{"e", "5"})
+		ret = db.Exec(conn1, utils.ToCmdLine("HTTL", "hash1", "FIELDS", "1", "e"))
+		ttl = ret.(*protocol.MultiRawReply).Replies[0].(*protocol.IntReply).Code
+		if ttl < 990 || ttl > 1000 {
+			t.Errorf("expected ttl of field e near 1000, actually %s", ret.ToBytes())
+		}
+		asserts.AssertIntReplyGreaterThan(t, db.Exec(conn1, utils.ToCmdLine("TTL", "hash1")), 1990)
+		asserts.AssertBulkReply(t, db.Exec(conn1, utils.ToCmdLine("GET", "str")), "s")
+	}
+
+	aofWriteDB := NewStandaloneServer()
+	aofWriteDB.Exec(conn, utils.ToCmdLine("HMSET", "hash", "a", "1", "b", "2", "c", "3", "d", "4"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("HEXPIRE", "hash", "1000", "FIELDS", "2", "a", "c"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("HPERSIST", "hash", "FIELDS", "1", "c"))
+	aofWriteDB.Exec(conn, utils.ToCmdLine("HEXPIRE", "hash", "0", "FIELDS", "1", "b"))
+	aofWriteDB.Exec(conn1, utils.ToCmdLine("HSET", "hash1", "e", "5"))
+	aofWriteDB.Exec(conn1, utils.ToCmdLine("HEXPIRE", "hash1", "1000", "FIELDS", "1", "e"))
+	aofWriteDB.Exec(conn1, utils.ToCmdLine("EXPIRE", "hash1", "2000"))
+	aofWriteDB.Exec(conn1, utils.ToCmdLine("SET", "str", "s"))
+	aofWriteDB.Close()
+
+	aofReadDB := NewStandaloneServer()
+	validate(aofReadDB)
+	// field ttl is persisted by aof.EntityToCmd during rewrite, rdb preamble is followed by commands of them
+	ctx, err := aofReadDB.aofHandler.StartRewrite()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = aofReadDB.aofHandler.DoRewrite(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	aofReadDB.aofHandler.FinishRewrite(ctx)
+	aofReadDB.Close()
+
+	aofReadDB2 := NewStandaloneServer()
+	defer aofReadDB2.Close()
+	validate(aofReadDB2)
+	// field ttl is appended after hash by DUMP
+	ret := aofReadDB2.Exec(conn, utils.ToCmdLine("DUMP", "hash"))
+	payload := ret.(*protocol.BulkReply).Arg
+	ret = aofReadDB2.Exec(conn, utils.ToCmdLine3("RESTORE", []byte("hash2"), []byte("0"), payload))
+	asserts.AssertStatusReply(t, ret, "OK")
+	ret = aofReadDB2.Exec(conn, utils.ToCmdLine("HGETALL", "hash2"))
+	asserts.AssertMultiBulkReplySize(t, ret, 6)
+	ret = aofReadDB2.Exec(conn, utils.ToCmdLine("HTTL", "hash2", "FIELDS", "3", "a", "b", "c"))
+	ttl := ret.(*protocol.MultiRawReply).Replies[0].(*protocol.IntReply).Code
+	if ttl < 990 || ttl > 1000 {
+		t.Errorf("expected ttl of restored field a near 1000, actually %s", ret.ToBytes())
+	}
+
+	// field ttl is kept by commands after rdb
+	config.Properties.RDBFilename = path.Join(tmpDir, "dump.rdb")
+	ret = aofReadDB2.Exec(conn, utils.ToCmdLine("SAVE"))
+	asserts.AssertStatusReply(t, ret, "OK")
+	config.Properties.AppendOnly = false
+	rdbReadDB := NewStandaloneServer()
+	defer rdbReadDB.Close()
+	validate(rdbReadDB)
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/protocol"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	backupRDBFilename  = "dump.rdb"
+	backupMetaFilename = "backup.json"
+)
+
+// backupMeta describes rdb file in backup directory
+type backupMeta struct {
+	Version   string  `json:"version"` // version of godis which made the backup
+	CreatedAt int64   `json:"created_at"`
+	Databases int     `json:"databases"`
+	Keys      []int64 `json:"keys"`     // key count of each database
+	Checksum  string  `json:"checksum"` // sha256 of rdb file in hex
+}
+
+// writeFileAtomic writes tmp file in the same directory then renames it, so a broken backup never overwrites the old one
+func writeFileAtomic(filename string, write func(w io.Writer) error) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "temp-*-"+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	err = write(tmpFile)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	_ = tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+	}
+	return err
+}
+
+// backup writes a consistent rdb snapshot and its metadata into dir
+func (mdb *MultiDB) backup(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	snapshot, err := mdb.TakeSnapshot(func() {})
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	meta := &backupMeta{
+		Version:   config.Version,
+		CreatedAt: time.Now().Unix(),
+		Databases: len(mdb.dbSet),
+		Keys:      make([]int64, len(mdb.dbSet)),
+	}
+	hash := sha256.New()
+	err = writeFileAtomic(filepath.Join(dir, backupRDBFilename), func(w io.Writer) error {
+		return aof.WriteRDB(io.MultiWriter(w, hash), snapshot, meta.Keys)
+	})
+	if err != nil {
+		return err
+	}
+	meta.Checksum = hex.EncodeToString(hash.Sum(nil))
+	return writeFileAtomic(filepath.Join(dir, backupMetaFilename), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(meta)
+	})
+}
+
+// readBackup reads rdb file of backup and verifies it with metadata, it returns rdb and commands appended after it
+func readBackup(dir string, databases int) ([]byte, []byte, error) {
+	metaData, err := ioutil.ReadFile(filepath.Join(dir, backupMetaFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+	meta := &backupMeta{}
+	err = json.Unmarshal(metaData, meta)
+	if err != nil {
+		return nil, nil, errors.New("invalid backup metadata: " + err.Error())
+	}
+	if meta.Databases > databases {
+		for i := databases; i < meta.Databases && i < len(meta.Keys); i++ {
+			if meta.Keys[i] > 0 {
+				return nil, nil, fmt.Errorf("backup has keys in db %d, but only %d databases configured", i, databases)
+			}
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, backupRDBFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != meta.Checksum {
+		return nil, nil, errors.New("backup checksum mismatch")
+	}
+	return splitRDBFile(data)
+}
+
+// restoreFrom replaces all data by backup in dir atomically, aof is rewritten after loading so that restored data is persisted
+func (mdb *MultiDB) restoreFrom(dir string) error {
+	rdbData, cmds, err := readBackup(dir, len(mdb.dbSet))
+	if err != nil {
+		return err
+	}
+	if mdb.aofHandler != nil {
+		// restored data is not in aof, so aof is rewritten after replacing. Rewriting in progress holds old data,
+		// it must finish before replacing, otherwise it would be the latest base file
+		return mdb.aofHandler.RewriteAfter(func() error {
+			return mdb.replaceData(rdbData, cmds)
+		})
+	}
+	return mdb.replaceData(rdbData, cmds)
+}
+
+// replaceData replaces all data by the given rdb and commands following it
+func (mdb *MultiDB) replaceData(rdbData, cmds []byte) error {
+	// block snapshots during restoring, they cannot see keys put by loading
+	if !atomic.CompareAndSwapInt32(&mdb.snapshotting, 0, 1) {
+		return errSnapshotInProgress
+	}
+	// block commands of all databases while replacing data, so clients never see a partially restored dataset
+	for _, db := range mdb.dbSet {
+		db.snapshotMu.Lock()
+	}
+	for _, db := range mdb.dbSet {
+		db.data.Clear()
+		db.ttlMap.Clear()
+	}
+	err := mdb.loadRDBData(rdbData, cmds)
+	for _, db := range mdb.dbSet {
+		db.snapshotMu.Unlock()
+	}
+	atomic.StoreInt32(&mdb.snapshotting, 0)
+	if err != nil {
+		return err
+	}
+	var keys int64
+	for i := range mdb.dbSet {
+		keyCount, _ := mdb.GetDBSize(i)
+		keys += int64(keyCount)
+	}
+	atomic.AddInt64(&mdb.dirty, keys)
+	return nil
+}
+
+// Backup writes a consistent rdb snapshot and metadata into given directory
+// usage: BACKUP dir
+func Backup(db *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("backup")
+	}
+	err := db.backup(string(args[0]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR backup failed: " + err.Error())
+	}
+	return protocol.MakeOkReply()
+}
+
+// RestoreFrom verifies backup in given directory then replaces all data by it
+// usage: RESTORE-FROM dir
+func RestoreFrom(db *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 1 {
+		return protocol.MakeArgNumErrReply("restore-from")
+	}
+	dir := string(args[0])
+	err := db.restoreFrom(dir)
+	if err != nil {
+		return protocol.MakeErrReply("ERR restore failed: " + err.Error())
+	}
+	logger.Info("restored from backup " + dir)
+	return protocol.MakeOkReply()
+}
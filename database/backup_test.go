@@ -0,0 +1,146 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:     true,
+		AppendFilename: path.Join(tmpDir, "appendonly.aof"),
+	}
+	backupDir := path.Join(tmpDir, "backup")
+	mdb := NewStandaloneServer()
+	conn := &connection.FakeConn{}
+	conn1 := &connection.FakeConn{}
+	conn1.SelectDB(1)
+	mdb.Exec(conn, utils.ToCmdLine("SET", "a", "1", "EX", "1000"))
+	mdb.Exec(conn, utils.ToCmdLine("RPUSH", "list", "a", "b"))
+	mdb.Exec(conn1, utils.ToCmdLine("SET", "b", "1"))
+	asserts.AssertStatusReply(t, mdb.Exec(conn, utils.ToCmdLine("BACKUP", backupDir)), "OK")
+	meta, err := ioutil.ReadFile(filepath.Join(backupDir, backupMetaFilename))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, expected := range []string{`"version": "` + config.Version + `"`, `"databases": 16`, `"checksum"`} {
+		if !strings.Contains(string(meta), expected) {
+			t.Errorf("expect %s in metadata: %s", expected, meta)
+		}
+	}
+
+	// data changed after backup are discarded by restoring
+	mdb.Exec(conn, utils.ToCmdLine("SET", "a", "2"))
+	mdb.Exec(conn, utils.ToCmdLine("SET", "c", "1"))
+	asserts.AssertStatusReply(t, mdb.Exec(conn, utils.ToCmdLine("RESTORE-FROM", backupDir)), "OK")
+	asserts.AssertBulkReply(t, mdb.Exec(conn, utils.ToCmdLine("GET", "a")), "1")
+	asserts.AssertIntReplyGreaterThan(t, mdb.Exec(conn, utils.ToCmdLine("TTL", "a")), 900)
+	asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("LLEN", "list")), 2)
+	asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("EXISTS", "c")), 0)
+	asserts.AssertBulkReply(t, mdb.Exec(conn1, utils.ToCmdLine("GET", "b")), "1")
+	mdb.Close()
+
+	// restored data has been persisted by aof
+	mdb = NewStandaloneServer()
+	asserts.AssertBulkReply(t, mdb.Exec(conn, utils.ToCmdLine("GET", "a")), "1")
+	asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("EXISTS", "c")), 0)
+	mdb.Close()
+
+	// restore on startup
+	config.Properties = &config.ServerProperties{
+		RestoreFrom: backupDir,
+	}
+	mdb = NewStandaloneServer()
+	asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("LLEN", "list")), 2)
+	asserts.AssertBulkReply(t, mdb.Exec(conn1, utils.ToCmdLine("GET", "b")), "1")
+
+	// corrupted backup is refused and data is kept
+	rdbFile := filepath.Join(backupDir, backupRDBFilename)
+	data, _ := ioutil.ReadFile(rdbFile)
+	data[len(data)/2] ^= 0xff
+	_ = ioutil.WriteFile(rdbFile, data, 0644)
+	asserts.AssertErrReply(t, mdb.Exec(conn, utils.ToCmdLine("RESTORE-FROM", backupDir)), "ERR restore failed: backup checksum mismatch")
+	asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("LLEN", "list")), 2)
+	mdb.Close()
+	config.Properties = &config.ServerProperties{}
+}
+
+func TestRestoreAtomically(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	config.Properties = &config.ServerProperties{}
+	defer func() {
+		config.Properties = &config.ServerProperties{}
+	}()
+	backupDir := path.Join(tmpDir, "backup")
+	mdb := NewStandaloneServer()
+	defer mdb.Close()
+	conn := &connection.FakeConn{}
+	keys := make([]string, 1000)
+	mset := []string{"MSET"}
+	for i := range keys {
+		keys[i] = "k" + strconv.Itoa(i)
+		mset = append(mset, keys[i], "backup")
+	}
+	mdb.Exec(conn, utils.ToCmdLine(mset...))
+	asserts.AssertStatusReply(t, mdb.Exec(conn, utils.ToCmdLine("BACKUP", backupDir)), "OK")
+	for i := 2; i < len(mset); i += 2 {
+		mset[i] = "live"
+	}
+	mdb.Exec(conn, utils.ToCmdLine(mset...))
+
+	// readers see either live data or restored data, never an empty or partially loaded dataset
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readConn := &connection.FakeConn{}
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			reply, ok := mdb.Exec(readConn, utils.ToCmdLine2("MGET", keys...)).(*protocol.MultiBulkReply)
+			if !ok {
+				t.Error("expect multi bulk reply")
+				return
+			}
+			for _, arg := range reply.Args {
+				if string(arg) != string(reply.Args[0]) || arg == nil {
+					t.Errorf("inconsistent read during restoring: %s and %s", reply.Args[0], arg)
+					return
+				}
+			}
+		}
+	}()
+	asserts.AssertStatusReply(t, mdb.Exec(conn, utils.ToCmdLine("RESTORE-FROM", backupDir)), "OK")
+	close(stop)
+	<-done
+	asserts.AssertBulkReply(t, mdb.Exec(conn, utils.ToCmdLine("GET", keys[len(keys)-1])), "backup")
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/redis/protocol"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TimeoutParser returns how long a blocking command waits, 0 means waiting forever
+type TimeoutParser func(args [][]byte) (time.Duration, protocol.ErrorReply)
+
+// blockingTable maps name of blocking commands to their timeout parser
+var blockingTable = make(map[string]TimeoutParser)
+
+// RegisterBlockingCommand registers a command which blocks until data is ready.
+// The command should be registered by RegisterCommand too, its executor tries once without blocking and
+// returns NullBulkReply if there is no data yet, its prepare function returns the keys it waits on as write keys.
+// Within MULTI the executor is called directly, so blocking command never blocks a transaction.
+func RegisterBlockingCommand(name string, parseTimeout TimeoutParser) {
+	blockingTable[strings.ToLower(name)] = parseTimeout
+}
+
+// parseBlockingTimeout parses timeout in seconds, fractional seconds are allowed
+func parseBlockingTimeout(arg []byte) (time.Duration, protocol.ErrorReply) {
+	seconds, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, protocol.MakeErrReply("ERR timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, protocol.MakeErrReply("ERR timeout is negative")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// lastArgTimeout is TimeoutParser of commands like `BZPOPMIN key [key ...] timeout`
+func lastArgTimeout(args [][]byte) (time.Duration, protocol.ErrorReply) {
+	return parseBlockingTimeout(args[len(args)-1])
+}
+
+// firstArgTimeout is TimeoutParser of commands like `BZMPOP timeout numkeys key [key ...]`
+func firstArgTimeout(args [][]byte) (time.Duration, protocol.ErrorReply) {
+	return parseBlockingTimeout(args[0])
+}
+
+// keyWaiters keeps clients blocked on keys, the zero value is ready to use
+type keyWaiters struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{}
+	// number of blocked clients, accessed atomically so writers needn't lock when nobody is blocked
+	count int32
+}
+
+// add registers a waiter on keys, the returned channel receives a signal when any of keys is written
+func (w *keyWaiters) add(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.waiters == nil {
+		w.waiters = make(map[string]map[chan struct{}]struct{})
+	}
+	for _, key := range keys {
+		set, ok := w.waiters[key]
+		if !ok {
+			set = make(map[chan struct{}]struct{})
+			w.waiters[key] = set
+		}
+		set[ch] = struct{}{}
+	}
+	atomic.AddInt32(&w.count, 1)
+	return ch
+}
+
+func (w *keyWaiters) remove(keys []string, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		set := w.waiters[key]
+		delete(set, ch)
+		if len(set) == 0 {
+			delete(w.waiters, key)
+		}
+	}
+	atomic.AddInt32(&w.count, -1)
+}
+
+// notify wakes up clients blocked on the given keys
+func (w *keyWaiters) notify(keys []string) {
+	if atomic.LoadInt32(&w.count) == 0 || len(keys) == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, key := range keys {
+		for ch := range w.waiters[key] {
+			select {
+			case ch <- struct{}{}:
+			default: // already notified
+			}
+		}
+	}
+}
+
+// execBlocking executes blocking command, it retries the command every time its keys are written until
+// the command returns data, timeout or the client disconnected
+func (db *DB) execBlocking(c redis.Connection, cmdLine [][]byte, parseTimeout TimeoutParser) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd := cmdTable[cmdName]
+	if !validateArity(cmd.arity, cmdLine) {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	timeout, errReply := parseTimeout(cmdLine[1:])
+	if errReply != nil {
+		return errReply
+	}
+	keys, _ := cmd.prepare(cmdLine[1:])
+	var timer <-chan time.Time // nil channel blocks forever
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	var done <-chan struct{} // nil if command is not from a client, e.g. loading aof
+	if c != nil {
+		done = c.Done()
+	}
+	for {
+		// register before trying, so writes during the trying won't be missed
+		ch := db.blockedClients.add(keys)
+		reply := db.execNormalCommand(cmdLine)
+		if _, ok := reply.(*protocol.NullBulkReply); !ok {
+			db.blockedClients.remove(keys, ch)
+			return reply
+		}
+		select {
+		case <-ch:
+			db.blockedClients.remove(keys, ch)
+		case <-timer:
+			db.blockedClients.remove(keys, ch)
+			return reply
+		case <-done:
+			// client is gone, stop waiting and never pop data for it
+			db.blockedClients.remove(keys, ch)
+			return reply
+		}
+	}
+}
@@ -1,10 +1,19 @@
 package database
 
 import (
+	"errors"
 	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/datastruct/bitmap"
+	HashSet "github.com/hdt3213/godis/datastruct/set"
+	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/routing"
+	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+	"strings"
 )
 
 // execExistIn returns existing key in given keys
@@ -72,11 +81,11 @@ func execRenameTo(db *DB, args [][]byte) redis.Reply {
 	}
 	ttlCmd.Args[1] = key
 	db.Remove(string(key))
-	dumpResult := db.execWithLock(dumpCmd.Args)
+	dumpResult := db.execNested(dumpCmd.Args)
 	if protocol.IsErrorReply(dumpResult) {
 		return dumpResult
 	}
-	ttlResult := db.execWithLock(ttlCmd.Args)
+	ttlResult := db.execNested(ttlCmd.Args)
 	if protocol.IsErrorReply(ttlResult) {
 		return ttlResult
 	}
@@ -88,11 +97,390 @@ func execRenameNxTo(db *DB, args [][]byte) redis.Reply {
 	return execRenameTo(db, args)
 }
 
+// execRPopLPushFrom is exactly same as execRPop, used for cluster.RPopLPush
+func execRPopLPushFrom(db *DB, args [][]byte) redis.Reply {
+	return execRPop(db, args)
+}
+
+// execLMoveFrom pops an element from given side of list, used for cluster.LMove
+// args format: key LEFT|RIGHT
+func execLMoveFrom(db *DB, args [][]byte) redis.Reply {
+	left, errReply := parseListDirection(args[1])
+	if errReply != nil {
+		return errReply
+	}
+	return execPop(db, args[:1], left)
+}
+
+func undoLMoveFrom(db *DB, args [][]byte) []CmdLine {
+	left, errReply := parseListDirection(args[1])
+	if errReply != nil {
+		return nil
+	}
+	return undoPop(db, args[:1], left)
+}
+
+// execSMoveFrom is exactly same as execSRem, used for cluster.SMove
+// args format: key member
+func execSMoveFrom(db *DB, args [][]byte) redis.Reply {
+	return execSRem(db, args)
+}
+
+// execZRangeStoreFrom returns members with scores selected by ZRANGESTORE, used for cluster.ZRangeStore
+// args format: src min max [BYSCORE|BYLEX] [REV] [LIMIT offset count]
+func execZRangeStoreFrom(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	opt, errReply := parseZRangeOption(args[1:], false)
+	if errReply != nil {
+		return errReply
+	}
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	// scores are needed to store members, even if BYLEX is given
+	return elementsToReply(rangeWithOption(sortedSet, opt), true)
+}
+
+// execZSetOperationFrom returns members with scores of the given sorted sets, used for cluster.execZSetOperation
+// args format: key [key ...]
+// returns key1 members1 key2 members2 ..., membersN is reply of `ZRANGE keyN 0 -1 WITHSCORES` encoded in redis serialization protocol
+func execZSetOperationFrom(db *DB, args [][]byte) redis.Reply {
+	result := make([][]byte, 0, len(args)*2)
+	for _, arg := range args {
+		sortedSet, errReply := db.getAsSortedSet(string(arg))
+		if errReply != nil {
+			return errReply
+		}
+		var members redis.Reply = &protocol.EmptyMultiBulkReply{}
+		if sortedSet != nil && sortedSet.Len() > 0 {
+			members = elementsToReply(sortedSet.Range(0, sortedSet.Len(), false), true)
+		}
+		result = append(result, arg, members.ToBytes())
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// DecodeSortedSets decodes reply of ZSetOperationFrom, nil set represents a not existed key
+func DecodeSortedSets(args [][]byte) (map[string]*SortedSet.SortedSet, error) {
+	if len(args)%2 != 0 {
+		return nil, errors.New("sorted sets should be key-members pairs")
+	}
+	sets := make(map[string]*SortedSet.SortedSet, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		raw, err := parser.ParseOne(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		key := string(args[i])
+		switch reply := raw.(type) {
+		case *protocol.EmptyMultiBulkReply:
+			sets[key] = nil
+		case *protocol.MultiBulkReply:
+			sortedSet := SortedSet.Make()
+			for j := 0; j+1 < len(reply.Args); j += 2 {
+				score, err := strconv.ParseFloat(string(reply.Args[j+1]), 64)
+				if err != nil {
+					return nil, errors.New("invalid score of " + key)
+				}
+				sortedSet.Add(string(reply.Args[j]), score)
+			}
+			sets[key] = sortedSet
+		default:
+			return nil, errors.New("members of " + key + " is not multi bulk reply")
+		}
+	}
+	return sets, nil
+}
+
+// execZSetOperationStoreTo executes ZUNIONSTORE, ZINTERSTORE or ZDIFFSTORE with sorted sets read from other nodes,
+// sorted sets of this node have been locked since tcc prepare. Used for cluster.execZSetOperation
+// args format: dest cmdName remoteSets numkeys key [key ...] [options], remoteSets is reply of ZSetOperationFrom of other nodes
+// encoded in redis serialization protocol
+func execZSetOperationStoreTo(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	cmdName := strings.ToLower(string(args[1]))
+	raw, err := parser.ParseOne(args[2])
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal remote sorted sets: " + err.Error())
+	}
+	var remote map[string]*SortedSet.SortedSet
+	if reply, ok := raw.(*protocol.MultiBulkReply); ok {
+		remote, err = DecodeSortedSets(reply.Args)
+		if err != nil {
+			return protocol.MakeErrReply("ERR illegal remote sorted sets: " + err.Error())
+		}
+	}
+	result, _, errReply := computeZSetOperation(db, cmdName, args[3:], false, remote)
+	if errReply != nil {
+		return errReply
+	}
+	db.Remove(dest) // clean ttl and old value
+	// remote keys are not in this node, so aof records result instead of the command
+	db.addAof(utils.ToCmdLine("DEL", dest))
+	if result.Len() > 0 {
+		entity := &database.DataEntity{
+			Data: result,
+		}
+		db.PutEntity(dest, entity)
+		db.addAof(aof.EntityToCmd(dest, entity).Args)
+	}
+	return protocol.MakeIntReply(result.Len())
+}
+
+// execZRangeStoreTo replaces destination by members read by ZRangeStoreFrom, used for cluster.ZRangeStore
+// args format: dest [score member ...]
+func execZRangeStoreTo(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	if len(args)%2 != 1 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	sortedSet := SortedSet.Make()
+	for i := 1; i < len(args); i += 2 {
+		score, err := strconv.ParseFloat(string(args[i]), 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not a valid float")
+		}
+		sortedSet.Add(string(args[i+1]), score)
+	}
+	db.Remove(dest)
+	if sortedSet.Len() > 0 {
+		db.PutEntity(dest, &database.DataEntity{
+			Data: sortedSet,
+		})
+	}
+	db.addAof(utils.ToCmdLine3("ZRangeStoreTo", args...))
+	return protocol.MakeIntReply(sortedSet.Len())
+}
+
+// execSetOperationFrom returns members of the given sets, used for cluster.execSetOperation and cluster.SInterCard
+// args format: key [key ...]
+// returns key1 members1 key2 members2 ..., membersN is reply of `SMEMBERS keyN` encoded in redis serialization protocol
+func execSetOperationFrom(db *DB, args [][]byte) redis.Reply {
+	result := make([][]byte, 0, len(args)*2)
+	for _, arg := range args {
+		set, errReply := db.getAsSet(string(arg))
+		if errReply != nil {
+			return errReply
+		}
+		var members redis.Reply = &protocol.EmptyMultiBulkReply{}
+		if set != nil && set.Len() > 0 {
+			members = protocol.MakeMultiBulkReply(utils.ToCmdLine(set.ToSlice()...))
+		}
+		result = append(result, arg, members.ToBytes())
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// DecodeSets decodes reply of SetOperationFrom, nil set represents a not existed key
+func DecodeSets(args [][]byte) (map[string]*HashSet.Set, error) {
+	if len(args)%2 != 0 {
+		return nil, errors.New("sets should be key-members pairs")
+	}
+	sets := make(map[string]*HashSet.Set, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		raw, err := parser.ParseOne(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		key := string(args[i])
+		switch reply := raw.(type) {
+		case *protocol.EmptyMultiBulkReply:
+			sets[key] = nil
+		case *protocol.MultiBulkReply:
+			set := HashSet.Make()
+			for _, member := range reply.Args {
+				set.Add(string(member))
+			}
+			sets[key] = set
+		default:
+			return nil, errors.New("members of " + key + " is not multi bulk reply")
+		}
+	}
+	return sets, nil
+}
+
+// SetOperation computes SINTER, SUNION or SDIFF of the given sets in order, nil set represents a not existed key
+func SetOperation(cmdName string, sets []*HashSet.Set) *HashSet.Set {
+	result := HashSet.Make()
+	for i, set := range sets {
+		if set == nil {
+			set = HashSet.Make()
+		}
+		if i == 0 {
+			result = HashSet.Make(set.ToSlice()...)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(cmdName, "sinter"):
+			result = result.Intersect(set)
+		case strings.HasPrefix(cmdName, "sunion"):
+			result = result.Union(set)
+		case strings.HasPrefix(cmdName, "sdiff"):
+			result = result.Diff(set)
+		}
+	}
+	return result
+}
+
+// execSetOperationStoreTo executes SINTERSTORE, SUNIONSTORE or SDIFFSTORE with sets read from other nodes,
+// sets of this node have been locked since tcc prepare. Used for cluster.execSetOperation
+// args format: dest cmdName remoteSets key [key ...], remoteSets is reply of SetOperationFrom of other nodes
+// encoded in redis serialization protocol
+func execSetOperationStoreTo(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	cmdName := strings.ToLower(string(args[1]))
+	raw, err := parser.ParseOne(args[2])
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal remote sets: " + err.Error())
+	}
+	var remote map[string]*HashSet.Set
+	if reply, ok := raw.(*protocol.MultiBulkReply); ok {
+		remote, err = DecodeSets(reply.Args)
+		if err != nil {
+			return protocol.MakeErrReply("ERR illegal remote sets: " + err.Error())
+		}
+	}
+	sets := make([]*HashSet.Set, len(args)-3)
+	for i, arg := range args[3:] {
+		set, ok := remote[string(arg)]
+		if !ok {
+			var errReply protocol.ErrorReply
+			set, errReply = db.getAsSet(string(arg))
+			if errReply != nil {
+				return errReply
+			}
+		}
+		sets[i] = set
+	}
+	result := SetOperation(cmdName, sets)
+	db.Remove(dest) // clean ttl and old value
+	// remote keys are not in this node, so aof records result instead of the command
+	db.addAof(utils.ToCmdLine("DEL", dest))
+	if result.Len() > 0 {
+		entity := &database.DataEntity{
+			Data: result,
+		}
+		db.PutEntity(dest, entity)
+		db.addAof(aof.EntityToCmd(dest, entity).Args)
+	}
+	return protocol.MakeIntReply(int64(result.Len()))
+}
+
+// execBitOpFrom returns values of the given strings, used for cluster.BitOp
+// args format: key [key ...]
+// returns key1 value1 key2 value2 ..., not existed keys and empty strings are omitted since they are empty bitmaps
+func execBitOpFrom(db *DB, args [][]byte) redis.Reply {
+	result := make([][]byte, 0, len(args)*2)
+	for _, arg := range args {
+		bs, errReply := db.getAsString(string(arg))
+		if errReply != nil {
+			return errReply
+		}
+		if len(bs) > 0 {
+			result = append(result, arg, bs)
+		}
+	}
+	if len(result) == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execBitOpTo executes BITOP with strings read from other nodes, strings of this node have been locked since tcc prepare.
+// Used for cluster.BitOp
+// args format: dest op remoteValues key [key ...], remoteValues is reply of BitOpFrom of other nodes
+// encoded in redis serialization protocol
+func execBitOpTo(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	op := strings.ToLower(string(args[1]))
+	raw, err := parser.ParseOne(args[2])
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal remote values: " + err.Error())
+	}
+	remote := make(map[string][]byte)
+	if reply, ok := raw.(*protocol.MultiBulkReply); ok {
+		for i := 0; i+1 < len(reply.Args); i += 2 {
+			remote[string(reply.Args[i])] = reply.Args[i+1]
+		}
+	}
+	maps := make([]*bitmap.BitMap, 0, len(args)-3)
+	for _, arg := range args[3:] {
+		bs, ok := remote[string(arg)]
+		if !ok {
+			var errReply protocol.ErrorReply
+			bs, errReply = db.getAsString(string(arg))
+			if errReply != nil {
+				return errReply
+			}
+		}
+		maps = append(maps, bitmap.FromBytes(bs))
+	}
+	result := bitmap.BitOp(op, maps...)
+	db.Remove(dest) // clean ttl and old value
+	db.addAof(utils.ToCmdLine("DEL", dest))
+	if len(*result) > 0 {
+		db.PutEntity(dest, &database.DataEntity{Data: result.ToBytes()})
+		db.addAof(utils.ToCmdLine3("SET", []byte(dest), result.ToBytes()))
+	}
+	return protocol.MakeIntReply(int64(len(*result)))
+}
+
+func undoMultiPart(db *DB, args [][]byte) []CmdLine {
+	writeKeys, _ := cmdTable["multipart"].prepare(args)
+	keySet := make(map[string]struct{})
+	keys := make([]string, 0, len(writeKeys))
+	for _, key := range writeKeys {
+		if _, ok := keySet[key]; ok {
+			continue
+		}
+		keySet[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	return rollbackGivenKeys(db, keys...)
+}
+
+// execMultiPart executes commands of a multi transaction which belongs to current node, used for cluster MULTI across nodes
+// args format see routing.ParseMultiPart, watching versions have been checked by coordinator during tcc prepare
+// returns replies of commands encoded in redis serialization protocol
+func execMultiPart(db *DB, args [][]byte) redis.Reply {
+	_, cmdLines, err := routing.ParseMultiPart(args)
+	if err != nil {
+		return protocol.MakeErrReply("ERR illegal multi part: " + err.Error())
+	}
+	results, aborted := db.execCmdLinesWithLock(cmdLines)
+	if aborted {
+		return protocol.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	writeKeys, _ := cmdTable["multipart"].prepare(args)
+	db.addVersion(writeKeys...)
+	encoded := make([][]byte, len(results))
+	for i, result := range results {
+		encoded[i] = result.ToBytes()
+	}
+	return protocol.MakeMultiBulkReply(encoded)
+}
+
 func init() {
-	RegisterCommand("DumpKey", execDumpKey, writeAllKeys, undoDel, 2)
-	RegisterCommand("ExistIn", execExistIn, readAllKeys, nil, -1)
-	RegisterCommand("RenameFrom", execRenameFrom, readFirstKey, nil, 2)
-	RegisterCommand("RenameTo", execRenameTo, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("RenameNxTo", execRenameTo, writeFirstKey, rollbackFirstKey, 4)
+	RegisterCommand("DumpKey", execDumpKey, undoDel, 2)
+	RegisterCommand("ExistIn", execExistIn, nil, -1)
+	RegisterCommand("RenameFrom", execRenameFrom, nil, 2)
+	RegisterCommand("RenameTo", execRenameTo, rollbackFirstKey, 4)
+	RegisterCommand("RenameNxTo", execRenameTo, rollbackFirstKey, 4)
+	RegisterCommand("RPopLPushFrom", execRPopLPushFrom, undoRPop, 2)
+	RegisterCommand("LMoveFrom", execLMoveFrom, undoLMoveFrom, 3)
+	RegisterCommand("SMoveFrom", execSMoveFrom, undoSetChange, 3)
+	RegisterCommand("ZRangeStoreFrom", execZRangeStoreFrom, nil, -4)
+	RegisterCommand("ZRangeStoreTo", execZRangeStoreTo, rollbackFirstKey, -2)
+	RegisterCommand("ZSetOperationFrom", execZSetOperationFrom, nil, -2)
+	RegisterCommand("ZSetOperationStoreTo", execZSetOperationStoreTo, rollbackFirstKey, -6)
+	RegisterCommand("SetOperationFrom", execSetOperationFrom, nil, -2)
+	RegisterCommand("SetOperationStoreTo", execSetOperationStoreTo, rollbackFirstKey, -5)
+	RegisterCommand("BitOpFrom", execBitOpFrom, nil, -2)
+	RegisterCommand("BitOpTo", execBitOpTo, rollbackFirstKey, -5)
+	RegisterCommand("MultiPart", execMultiPart, undoMultiPart, -2)
 
 }
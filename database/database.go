@@ -1,6 +1,7 @@
 package database
 
 import (
+	"errors"
 	"fmt"
 	"github.com/hdt3213/godis/aof"
 	"github.com/hdt3213/godis/config"
@@ -10,9 +11,12 @@ import (
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/pubsub"
 	"github.com/hdt3213/godis/redis/protocol"
+	"os"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -24,6 +28,18 @@ type MultiDB struct {
 	hub *pubsub.Hub
 	// handle aof persistence
 	aofHandler *aof.Handler
+
+	// rdb persistence, accessed atomically
+	dirty    int64 // count of changes since last successful saving
+	lastSave int64 // unix timestamp of last successful saving
+	saving   int32 // 1 means rdb saving is in progress
+	closed   int32
+	shutdown int32 // 1 means rdb has been handled by SHUTDOWN command
+
+	saveRules    []*saveRule
+	stopSaveCron chan struct{}
+
+	snapshotting int32 // 1 means a snapshot is being taken, only one snapshot is allowed at the same time
 }
 
 // NewStandaloneServer creates a standalone redis server, with multi database and all other funtions
@@ -39,27 +55,50 @@ func NewStandaloneServer() *MultiDB {
 		mdb.dbSet[i] = singleDB
 	}
 	mdb.hub = pubsub.MakeHub()
+	mdb.lastSave = time.Now().Unix()
+	for _, db := range mdb.dbSet {
+		// avoid closure
+		singleDB := db
+		singleDB.addAof = func(line CmdLine) {
+			atomic.AddInt64(&mdb.dirty, 1)
+			if mdb.aofHandler != nil {
+				mdb.aofHandler.AddAof(singleDB.index, line)
+			}
+		}
+	}
 	validAof := false
 	if config.Properties.AppendOnly {
-		aofHandler, err := aof.NewAOFHandler(mdb, func() database.EmbedDB {
-			return MakeBasicMultiDB()
-		})
+		aofHandler, err := aof.NewAOFHandler(mdb, mdb.TakeSnapshot)
 		if err != nil {
 			panic(err)
 		}
 		mdb.aofHandler = aofHandler
-		for _, db := range mdb.dbSet {
-			// avoid closure
-			singleDB := db
-			singleDB.addAof = func(line CmdLine) {
-				mdb.aofHandler.AddAof(singleDB.index, line)
-			}
-		}
 		validAof = true
 	}
 	if config.Properties.RDBFilename != "" && !validAof {
-		// load rdb
-		loadRdb(mdb)
+		// load rdb, refuse to start with partial data if rdb file is corrupted
+		err := loadRdb(mdb)
+		if os.IsNotExist(err) {
+			logger.Info("rdb file not found, start with empty database")
+		} else if err != nil {
+			panic("load rdb failed: " + err.Error())
+		}
+	}
+	if config.Properties.RestoreFrom != "" {
+		err := mdb.restoreFrom(config.Properties.RestoreFrom)
+		if err != nil {
+			panic("restore from backup failed: " + err.Error())
+		}
+		logger.Info("restored from backup " + config.Properties.RestoreFrom)
+	}
+	saveRules, err := parseSaveRules(config.Properties.Save)
+	if err != nil {
+		panic(err)
+	}
+	mdb.saveRules = saveRules
+	if len(saveRules) > 0 {
+		mdb.stopSaveCron = make(chan struct{})
+		mdb.startSaveCron()
 	}
 	return mdb
 }
@@ -114,6 +153,21 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 		return SaveRDB(mdb, cmdLine[1:])
 	} else if cmdName == "bgsave" {
 		return BGSaveRDB(mdb, cmdLine[1:])
+	} else if cmdName == "lastsave" {
+		return LastSave(mdb, cmdLine[1:])
+	} else if cmdName == "backup" {
+		return Backup(mdb, cmdLine[1:])
+	} else if cmdName == "restore-from" {
+		return RestoreFrom(mdb, cmdLine[1:])
+	} else if cmdName == "shutdown" {
+		return Shutdown(mdb, cmdLine[1:])
+	} else if cmdName == "info" {
+		return Info(mdb, cmdLine[1:])
+	} else if cmdName == "migrate" {
+		if c != nil && c.InMultiState() {
+			return protocol.MakeErrReply("ERR MIGRATE is not allowed within multi")
+		}
+		return Migrate(mdb, c, cmdLine[1:])
 	} else if cmdName == "select" {
 		if c != nil && c.InMultiState() {
 			return protocol.MakeErrReply("cannot select database within multi")
@@ -131,7 +185,30 @@ func (mdb *MultiDB) Exec(c redis.Connection, cmdLine [][]byte) (result redis.Rep
 		return protocol.MakeErrReply("ERR DB index is out of range")
 	}
 	selectedDB := mdb.dbSet[dbIndex]
-	return selectedDB.Exec(c, cmdLine)
+	if mdb.aofHandler == nil || !isWriteCommand(cmdName) {
+		return selectedDB.Exec(c, cmdLine)
+	}
+	// like redis, refuse writing if aof is broken, until aof has been fsynced successfully
+	err, errCount := mdb.aofHandler.WriteErr()
+	if err != nil {
+		return makeAofErrReply(err)
+	}
+	result = selectedDB.Exec(c, cmdLine)
+	if mdb.aofHandler.GetFsyncPolicy() == aof.FsyncAlways {
+		// the command has waited for fsync, tell client it is not durable if writing failed meanwhile
+		if err, count := mdb.aofHandler.WriteErr(); count != errCount {
+			if err == nil {
+				// aof has recovered, but the failed fsync may have dropped the command
+				err = errors.New("fsync failed")
+			}
+			return makeAofErrReply(err)
+		}
+	}
+	return result
+}
+
+func makeAofErrReply(err error) redis.Reply {
+	return protocol.MakeErrReply("MISCONF Errors writing to the AOF file: " + err.Error())
 }
 
 // AfterClientClose does some clean after client close connection
@@ -139,11 +216,25 @@ func (mdb *MultiDB) AfterClientClose(c redis.Connection) {
 	pubsub.UnsubscribeAll(mdb.hub, c)
 }
 
-// Close graceful shutdown database
+// Close graceful shutdown database, it saves rdb if save rules configured and SHUTDOWN command has not handled it
 func (mdb *MultiDB) Close() {
+	if !atomic.CompareAndSwapInt32(&mdb.closed, 0, 1) {
+		return
+	}
+	if mdb.stopSaveCron != nil {
+		close(mdb.stopSaveCron)
+	}
+	if len(mdb.saveRules) > 0 && atomic.LoadInt32(&mdb.shutdown) == 0 {
+		if err := mdb.saveRDBOnShutdown(); err != nil {
+			logger.Error("saving rdb on shutdown failed: " + err.Error())
+		}
+	}
 	if mdb.aofHandler != nil {
 		mdb.aofHandler.Close()
 	}
+	for _, db := range mdb.dbSet {
+		db.cancelExpireTasks()
+	}
 }
 
 func execSelect(c redis.Connection, mdb *MultiDB, args [][]byte) redis.Reply {
@@ -162,6 +253,7 @@ func (mdb *MultiDB) flushAll() redis.Reply {
 	for _, db := range mdb.dbSet {
 		db.Flush()
 	}
+	atomic.AddInt64(&mdb.dirty, 1)
 	if mdb.aofHandler != nil {
 		mdb.aofHandler.AddAof(0, utils.ToCmdLine("FlushAll"))
 	}
@@ -230,10 +322,7 @@ func RewriteAOF(db *MultiDB, args [][]byte) redis.Reply {
 
 // SaveRDB start RDB writing and blocked until it finished
 func SaveRDB(db *MultiDB, args [][]byte) redis.Reply {
-	if db.aofHandler == nil {
-		return protocol.MakeErrReply("please enable aof before using save")
-	}
-	err := db.aofHandler.Rewrite2RDB()
+	err := db.saveRDB()
 	if err != nil {
 		return protocol.MakeErrReply(err.Error())
 	}
@@ -242,23 +331,96 @@ func SaveRDB(db *MultiDB, args [][]byte) redis.Reply {
 
 // BGSaveRDB asynchronously save RDB
 func BGSaveRDB(db *MultiDB, args [][]byte) redis.Reply {
-	if db.aofHandler == nil {
-		return protocol.MakeErrReply("please enable aof before using save")
+	err := db.bgSaveRDB()
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
 	}
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				logger.Error(err)
-			}
-		}()
-		err := db.aofHandler.Rewrite2RDB()
-		if err != nil {
-			logger.Error(err)
-		}
-	}()
 	return protocol.MakeStatusReply("Background saving started")
 }
 
+// LastSave returns unix timestamp of last successful saving
+func LastSave(db *MultiDB, args [][]byte) redis.Reply {
+	if len(args) != 0 {
+		return protocol.MakeArgNumErrReply("lastsave")
+	}
+	return protocol.MakeIntReply(atomic.LoadInt64(&db.lastSave))
+}
+
+// shutdownHook stops the server after SHUTDOWN succeed, tcp server closes handler and database on SIGTERM
+var shutdownHook = func() {
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	_ = p.Signal(syscall.SIGTERM)
+}
+
+// Shutdown saves rdb if required then stops server
+// usage: SHUTDOWN [NOSAVE|SAVE]
+func Shutdown(db *MultiDB, args [][]byte) redis.Reply {
+	if len(args) > 1 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	save := len(db.saveRules) > 0
+	if len(args) == 1 {
+		switch strings.ToLower(string(args[0])) {
+		case "nosave":
+			save = false
+		case "save":
+			save = true
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	if save {
+		if err := db.saveRDBOnShutdown(); err != nil {
+			logger.Error("saving rdb on shutdown failed: " + err.Error())
+			return protocol.MakeErrReply("ERR Errors trying to SHUTDOWN. Check logs.")
+		}
+	}
+	atomic.StoreInt32(&db.shutdown, 1)
+	shutdownHook()
+	return protocol.MakeOkReply()
+}
+
+// Info returns information of server, only persistence section is supported now
+func Info(db *MultiDB, args [][]byte) redis.Reply {
+	if len(args) > 1 {
+		return protocol.MakeArgNumErrReply("info")
+	}
+	if len(args) == 1 {
+		section := strings.ToLower(string(args[0]))
+		if section != "persistence" && section != "all" && section != "default" {
+			return protocol.MakeBulkReply([]byte{})
+		}
+	}
+	var builder strings.Builder
+	builder.WriteString("# Persistence\r\n")
+	if db.aofHandler == nil {
+		builder.WriteString("aof_enabled:0\r\n")
+		return protocol.MakeBulkReply([]byte(builder.String()))
+	}
+	stats := db.aofHandler.GetFsyncStats()
+	var avgLatency time.Duration
+	if stats.Count > 0 {
+		avgLatency = stats.TotalLatency / time.Duration(stats.Count)
+	}
+	builder.WriteString("aof_enabled:1\r\n")
+	builder.WriteString("aof_fsync:" + db.aofHandler.GetFsyncPolicy() + "\r\n")
+	if err, _ := db.aofHandler.WriteErr(); err != nil {
+		builder.WriteString("aof_last_write_status:err\r\n")
+	} else {
+		builder.WriteString("aof_last_write_status:ok\r\n")
+	}
+	builder.WriteString("aof_fsync_count:" + strconv.FormatInt(stats.Count, 10) + "\r\n")
+	builder.WriteString("aof_delayed_fsync:" + strconv.FormatInt(stats.Delayed, 10) + "\r\n")
+	builder.WriteString("aof_last_fsync_latency_us:" + strconv.FormatInt(stats.LastLatency.Microseconds(), 10) + "\r\n")
+	builder.WriteString("aof_avg_fsync_latency_us:" + strconv.FormatInt(avgLatency.Microseconds(), 10) + "\r\n")
+	builder.WriteString("aof_max_fsync_latency_us:" + strconv.FormatInt(stats.MaxLatency.Microseconds(), 10) + "\r\n")
+	return protocol.MakeBulkReply([]byte(builder.String()))
+}
+
 // GetDBSize returns keys count and ttl key count
 func (mdb *MultiDB) GetDBSize(dbIndex int) (int, int) {
 	db := mdb.selectDB(dbIndex)
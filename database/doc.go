@@ -14,6 +14,6 @@ MultiDB.Exec is the main entry for MultiDB, it handles authentication, publish-s
 [RegisterCommand](https://github.com/HDT3213/godis/blob/master/database/router.go) is used for registering normal command. A normal command requires three functions：
 
 - ExecFunc: The function that actually executes the command, such as [execHSet](https://github.com/HDT3213/godis/blob/master/database/hash.go)
-- PrepareFunc executes before ExecFunc, it analysises command line and returns read/written keys for lock
+- KeyFunc executes before ExecFunc, it analysises command line and returns read/written keys for lock. It is registered in [routing](https://github.com/HDT3213/godis/blob/master/lib/routing/keys.go) which is shared with cluster and clients
 - UndoFunc invoked in transaction only, it generates undo log in case need rollback in transaction
 */
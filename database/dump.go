@@ -0,0 +1,416 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/datastruct/dict"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	rdbEncoder "github.com/hdt3213/rdb/encoder"
+	rdb "github.com/hdt3213/rdb/parser"
+	"hash/crc64"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Serialized value of DUMP is compatible with redis:
+ * [type][value encoded like rdb][rdb version: 2 bytes little endian][crc-64-jones of former parts: 8 bytes little endian]
+ * Rdb has no field-level ttl, so hash with expiring fields is dumped with a godis specific extension:
+ * [type][hash encoded like rdb][HMSETPXAT args in RESP][length of RESP: 4 bytes little endian][version | dumpFieldTTLFlag][crc]
+ * Redis refuses it because of the version.
+ */
+
+// dumpRDBVersion is rdb version of redis 6, every encoding written by godis exists in it
+const dumpRDBVersion = 9
+
+// dumpFieldTTLFlag in version means ttl of fields are appended after hash
+const dumpFieldTTLFlag = 0x8000
+
+var (
+	errDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+	errBadFormat   = errors.New("ERR Bad data format")
+)
+
+// dumpEntity serializes entity into DUMP payload
+func dumpEntity(entity *database.DataEntity) ([]byte, error) {
+	var fieldTTL []byte
+	if hash, ok := entity.Data.(*dict.TTLDict); ok {
+		if _, ok := hash.NextExpiration(); ok {
+			// ttl of fields are appended as args of HMSETPXAT, the hash is encoded without ttl
+			cmd := aof.EntityToCmd("", entity)
+			fieldTTL = protocol.MakeMultiBulkReply(cmd.Args[2:]).ToBytes()
+			plain := dict.MakeSimple()
+			hash.ForEach(func(field string, val interface{}) bool {
+				plain.Put(field, val)
+				return true
+			})
+			entity = &database.DataEntity{Data: plain}
+		}
+	}
+	buf := &bytes.Buffer{}
+	encoder := rdbEncoder.NewEncoder(buf)
+	err := encoder.WriteHeader()
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.WriteDBHeader(0, 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	start := buf.Len()
+	// write object with empty key, its encoding is a single zero byte after type
+	err = aof.EntityToRDB(encoder, "", entity, nil)
+	if err != nil {
+		return nil, err
+	}
+	obj := buf.Bytes()[start:]
+	if len(obj) < 2 {
+		return nil, errors.New("unsupported data type")
+	}
+	payload := make([]byte, 0, len(obj)+len(fieldTTL)+14)
+	payload = append(payload, obj[0])
+	payload = append(payload, obj[2:]...)
+	version := dumpRDBVersion
+	if fieldTTL != nil {
+		payload = append(payload, fieldTTL...)
+		size := make([]byte, 4)
+		binary.LittleEndian.PutUint32(size, uint32(len(fieldTTL)))
+		payload = append(payload, size...)
+		version |= dumpFieldTTLFlag
+	}
+	payload = append(payload, byte(version), byte(version>>8))
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, ^crc64.Update(^uint64(0), redisCRCTable, payload))
+	return append(payload, sum...), nil
+}
+
+// verifyDumpPayload checks footer of payload, zero checksum means checksum is disabled like redis does
+func verifyDumpPayload(payload []byte) error {
+	n := len(payload)
+	if n < 11 {
+		return errDumpPayload
+	}
+	sum := binary.LittleEndian.Uint64(payload[n-8:])
+	if sum != 0 && ^crc64.Update(^uint64(0), redisCRCTable, payload[:n-8]) != sum {
+		return errDumpPayload
+	}
+	return nil
+}
+
+// loadDumpPayload deserializes DUMP payload made by godis or redis
+func loadDumpPayload(payload []byte) (*database.DataEntity, error) {
+	err := verifyDumpPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	value := payload[1 : len(payload)-10]
+	var fieldTTL []byte
+	if binary.LittleEndian.Uint16(payload[len(payload)-10:])&dumpFieldTTLFlag != 0 {
+		if len(value) < 4 {
+			return nil, errBadFormat
+		}
+		size := int(binary.LittleEndian.Uint32(value[len(value)-4:]))
+		if size > len(value)-4 {
+			return nil, errBadFormat
+		}
+		fieldTTL = value[len(value)-4-size : len(value)-4]
+		value = value[:len(value)-4-size]
+	}
+	// wrap object into a rdb file, so it could be decoded by rdb parser
+	buf := make([]byte, 0, len(value)+16)
+	buf = append(buf, "REDIS0009"...)
+	buf = append(buf, 0xfe, 0x00, payload[0], 0x00) // select db 0, type, empty key
+	buf = append(buf, value...)
+	buf = append(buf, rdbOpCodeEOF)
+	var obj rdb.RedisObject
+	count := 0
+	err = rdb.NewDecoder(bytes.NewReader(buf)).Parse(func(o rdb.RedisObject) bool {
+		obj = o
+		count++
+		return true
+	})
+	// size of object including the empty key should equal to payload, or there is garbage after object
+	if err != nil || count != 1 || obj.GetSize() != len(value)+1 {
+		return nil, errBadFormat
+	}
+	entity, err := rdbObjectToEntity(obj)
+	if err != nil {
+		return nil, errBadFormat
+	}
+	if fieldTTL != nil {
+		entity, err = loadFieldTTL(entity, fieldTTL)
+		if err != nil {
+			return nil, errBadFormat
+		}
+	}
+	return entity, nil
+}
+
+// loadFieldTTL sets ttl of fields appended after hash by dumpEntity, expired fields are removed by the expire task
+func loadFieldTTL(entity *database.DataEntity, data []byte) (*database.DataEntity, error) {
+	reply, err := parser.ParseOne(data)
+	if err != nil {
+		return nil, err
+	}
+	mbr, ok := reply.(*protocol.MultiBulkReply)
+	if !ok || len(mbr.Args)%3 != 0 || !bytes.Equal(mbr.ToBytes(), data) {
+		return nil, errBadFormat
+	}
+	plain, ok := entity.Data.(dict.Dict)
+	if !ok {
+		return nil, errBadFormat
+	}
+	hash := dict.MakeTTL(plain)
+	for i := 0; i < len(mbr.Args); i += 3 {
+		ms, err := strconv.ParseInt(string(mbr.Args[i+2]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if ms > 0 {
+			hash.Expire(string(mbr.Args[i]), time.Unix(0, ms*int64(time.Millisecond)))
+		}
+	}
+	return &database.DataEntity{Data: hash}, nil
+}
+
+// execDump returns serialized value of key
+func execDump(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	entity, exists := db.GetEntity(key)
+	if !exists {
+		return protocol.MakeNullBulkReply()
+	}
+	payload, err := dumpEntity(entity)
+	if err != nil {
+		return protocol.MakeErrReply("ERR " + err.Error())
+	}
+	return protocol.MakeBulkReply(payload)
+}
+
+// execRestore creates a key using serialized value from DUMP
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func execRestore(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return protocol.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	replace := false
+	absTTL := false
+	idleTime := int64(-1)
+	freq := int64(-1)
+	for i := 3; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch {
+		case arg == "REPLACE":
+			replace = true
+		case arg == "ABSTTL":
+			absTTL = true
+		case arg == "IDLETIME" && i+1 < len(args) && freq == -1:
+			idleTime, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if idleTime < 0 {
+				return protocol.MakeErrReply("ERR Invalid IDLETIME value, must be >= 0")
+			}
+			i++
+		case arg == "FREQ" && i+1 < len(args) && idleTime == -1:
+			freq, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > 255 {
+				return protocol.MakeErrReply("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+			i++
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	// godis has no eviction policy, IDLETIME and FREQ are validated then ignored
+
+	if _, exists := db.GetEntity(key); exists && !replace {
+		return protocol.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	entity, err := loadDumpPayload(args[2])
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	var expireAt time.Time
+	if ttl > 0 {
+		if absTTL {
+			expireAt = time.Unix(0, ttl*int64(time.Millisecond))
+		} else {
+			expireAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+		if expireAt.Before(time.Now()) {
+			// key has been expired, remove old value like redis does
+			if db.Removes(key) > 0 {
+				db.addAof(utils.ToCmdLine("DEL", key))
+			}
+			return protocol.MakeOkReply()
+		}
+	}
+	db.Remove(key)
+	db.PutEntity(key, entity)
+	absTTLArg := "0"
+	if ttl > 0 {
+		db.Expire(key, expireAt)
+		absTTLArg = strconv.FormatInt(expireAt.UnixNano()/1e6, 10)
+	}
+	if hash, ok := entity.Data.(*dict.TTLDict); ok {
+		db.scheduleHashFieldExpire(key, hash)
+	}
+	// ttl in aof is absolute, so that replaying aof does not extend ttl
+	db.addAof(utils.ToCmdLine3("RESTORE", args[0], []byte(absTTLArg), args[2], []byte("REPLACE"), []byte("ABSTTL")))
+	return protocol.MakeOkReply()
+}
+
+// Migrate transfers keys to another redis instance, then removes them from current instance unless COPY is given
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [KEYS key [key ...]]
+func Migrate(mdb *MultiDB, c redis.Connection, args [][]byte) redis.Reply {
+	if len(args) < 5 {
+		return protocol.MakeArgNumErrReply("migrate")
+	}
+	addr := net.JoinHostPort(string(args[0]), string(args[1]))
+	destDB, err := strconv.Atoi(string(args[3]))
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeoutMs, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if timeoutMs <= 0 {
+		timeoutMs = 1000
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	copyKeys := false
+	replace := false
+	var password []byte
+	var keys []string
+	for i := 5; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		if arg == "COPY" {
+			copyKeys = true
+		} else if arg == "REPLACE" {
+			replace = true
+		} else if arg == "AUTH" && i+1 < len(args) {
+			password = args[i+1]
+			i++
+		} else if arg == "KEYS" {
+			if len(args[2]) != 0 {
+				return protocol.MakeErrReply("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, key := range args[i+1:] {
+				keys = append(keys, string(key))
+			}
+			break
+		} else {
+			return protocol.MakeSyntaxErrReply()
+		}
+	}
+	if len(keys) == 0 {
+		keys = []string{string(args[2])}
+	}
+	dbIndex := c.GetDBIndex()
+	if dbIndex >= len(mdb.dbSet) {
+		return protocol.MakeErrReply("ERR DB index is out of range")
+	}
+	db := mdb.dbSet[dbIndex]
+	// keys are locked during migrating, so they won't be modified before removed
+	db.addVersion(keys...)
+	db.RWLocks(keys, nil)
+	defer db.RWUnLocks(keys, nil)
+
+	var cmdLines []CmdLine
+	var migrated []string
+	for _, key := range keys {
+		entity, exists := db.GetEntity(key)
+		if !exists {
+			continue
+		}
+		payload, err := dumpEntity(entity)
+		if err != nil {
+			return protocol.MakeErrReply("ERR " + err.Error())
+		}
+		ttl := "0"
+		if expiration := db.getExpiration(key); expiration != nil {
+			ms := time.Until(*expiration).Milliseconds()
+			if ms <= 0 {
+				continue
+			}
+			ttl = strconv.FormatInt(ms, 10)
+		}
+		cmdLine := utils.ToCmdLine("RESTORE", key, ttl)
+		cmdLine = append(cmdLine, payload)
+		if replace {
+			cmdLine = append(cmdLine, []byte("REPLACE"))
+		}
+		cmdLines = append(cmdLines, cmdLine)
+		migrated = append(migrated, key)
+	}
+	if len(cmdLines) == 0 {
+		return protocol.MakeStatusReply("NOKEY")
+	}
+
+	target, err := client.MakeClientWithOptions(addr, client.Options{
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	})
+	if err != nil {
+		return protocol.MakeErrReply("IOERR error or timeout connecting to the client")
+	}
+	target.Start()
+	defer target.Close()
+	var prelude []CmdLine
+	if len(password) > 0 {
+		prelude = append(prelude, utils.ToCmdLine3("AUTH", password))
+	}
+	prelude = append(prelude, utils.ToCmdLine("SELECT", strconv.Itoa(destDB)))
+	for _, cmdLine := range prelude {
+		if _, err := target.SendContext(context.Background(), cmdLine); err != nil {
+			return toMigrateErrReply(err)
+		}
+	}
+	for i, cmdLine := range cmdLines {
+		if _, err := target.SendContext(context.Background(), cmdLine); err != nil {
+			// keys transferred before the error are still removed
+			if !copyKeys && i > 0 {
+				db.execWithLock(utils.ToCmdLine2("DEL", migrated[:i]...))
+			}
+			return toMigrateErrReply(err)
+		}
+	}
+	if !copyKeys {
+		db.execWithLock(utils.ToCmdLine2("DEL", migrated...))
+	}
+	return protocol.MakeOkReply()
+}
+
+func toMigrateErrReply(err error) redis.Reply {
+	if serverErr, ok := err.(*client.ServerError); ok {
+		return protocol.MakeErrReply("ERR Target instance replied with error: " + serverErr.Msg)
+	}
+	return protocol.MakeErrReply("IOERR error or timeout reading to target instance")
+}
+
+func init() {
+	RegisterCommand("Dump", execDump, nil, 2)
+	RegisterCommand("Restore", execRestore, rollbackFirstKey, -4)
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDumpCompatibility(t *testing.T) {
+	testDB.Flush()
+	// payload of `SET mykey 10` dumped by redis, see https://redis.io/commands/dump
+	payload := "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n"
+	testDB.Exec(nil, utils.ToCmdLine("SET", "mykey", "10"))
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("DUMP", "mykey")), payload)
+
+	result := testDB.Exec(nil, utils.ToCmdLine("RESTORE", "restored", "0", payload))
+	asserts.AssertStatusReply(t, result, "OK")
+	asserts.AssertBulkReply(t, testDB.Exec(nil, utils.ToCmdLine("GET", "restored")), "10")
+	asserts.AssertNullBulk(t, testDB.Exec(nil, utils.ToCmdLine("DUMP", "none")))
+}
+
+func TestDumpAndRestore(t *testing.T) {
+	testDB.Flush()
+	testDB.Exec(nil, utils.ToCmdLine("SET", "str", utils.RandString(100)))
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", "list", "a", "b", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("HMSET", "hash", "f", "a", "g", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("SADD", "set", "a", "b"))
+	testDB.Exec(nil, utils.ToCmdLine("SADD", "intset", "1", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("ZADD", "zset", "1", "a", "2.5", "b"))
+	checks := map[string][]string{
+		"str":    {"GET", "str"},
+		"list":   {"LRANGE", "list", "0", "-1"},
+		"hash":   {"HMGET", "hash", "f", "g"},
+		"set":    {"SISMEMBER", "set", "b"},
+		"intset": {"SISMEMBER", "intset", "2"},
+		"zset":   {"ZRANGE", "zset", "0", "-1", "WITHSCORES"},
+	}
+	for key, check := range checks {
+		payload := testDB.Exec(nil, utils.ToCmdLine("DUMP", key)).(*protocol.BulkReply).Arg
+		expected := testDB.Exec(nil, utils.ToCmdLine(check...)).ToBytes()
+		result := testDB.Exec(nil, utils.ToCmdLine("RESTORE", key, "0", string(payload)))
+		asserts.AssertErrReply(t, result, "BUSYKEY Target key name already exists.")
+		testDB.Remove(key)
+		result = testDB.Exec(nil, utils.ToCmdLine("RESTORE", key, "0", string(payload)))
+		asserts.AssertStatusReply(t, result, "OK")
+		if actual := testDB.Exec(nil, utils.ToCmdLine(check...)).ToBytes(); string(actual) != string(expected) {
+			t.Errorf("%s: expect %s, actually %s", key, expected, actual)
+		}
+	}
+
+	payload := testDB.Exec(nil, utils.ToCmdLine("DUMP", "str")).(*protocol.BulkReply).Arg
+	result := testDB.Exec(nil, utils.ToCmdLine("RESTORE", "str", "10000", string(payload), "REPLACE", "IDLETIME", "10"))
+	asserts.AssertStatusReply(t, result, "OK")
+	asserts.AssertIntReplyGreaterThan(t, testDB.Exec(nil, utils.ToCmdLine("PTTL", "str")), 9000)
+	expireAt := strconv.FormatInt(time.Now().Add(-time.Second).UnixNano()/1e6, 10)
+	result = testDB.Exec(nil, utils.ToCmdLine("RESTORE", "str", expireAt, string(payload), "REPLACE", "ABSTTL"))
+	asserts.AssertStatusReply(t, result, "OK")
+	asserts.AssertIntReply(t, testDB.Exec(nil, utils.ToCmdLine("EXISTS", "str")), 0)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("RESTORE", "str", "-1", string(payload)))
+	asserts.AssertErrReply(t, result, "ERR Invalid TTL value, must be >= 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("RESTORE", "str", "0", string(payload), "IDLETIME", "1", "FREQ", "1"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("RESTORE", "str", "0", string(payload), "FREQ", "256"))
+	asserts.AssertErrReply(t, result, "ERR Invalid FREQ value, must be >= 0 and <= 255")
+	corrupted := append([]byte{}, payload...)
+	corrupted[1] ^= 0xff
+	result = testDB.Exec(nil, utils.ToCmdLine("RESTORE", "str", "0", string(corrupted)))
+	asserts.AssertErrReply(t, result, "ERR DUMP payload version or checksum are wrong")
+	// checksum is disabled, but there is garbage after value
+	garbage := append([]byte{}, payload[:len(payload)-10]...)
+	garbage = append(garbage, 'x', 9, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("RESTORE", "str", "0", string(garbage)))
+	asserts.AssertErrReply(t, result, "ERR Bad data format")
+}
+
+// serveFakeRedis serves commands with mdb, it works like redis/server without importing it
+func serveFakeRedis(t *testing.T, mdb *MultiDB) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				client := &connection.FakeConn{}
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					cmdLine := payload.Data.(*protocol.MultiBulkReply).Args
+					_, _ = conn.Write(mdb.Exec(client, cmdLine).ToBytes())
+				}
+			}(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return listener.Addr().String()
+}
+
+func TestMigrate(t *testing.T) {
+	src := NewStandaloneServer()
+	dest := NewStandaloneServer()
+	defer src.Close()
+	defer dest.Close()
+	host, port, _ := net.SplitHostPort(serveFakeRedis(t, dest))
+	conn := &connection.FakeConn{}
+	destConn := &connection.FakeConn{}
+	destConn.SelectDB(1)
+	src.Exec(conn, utils.ToCmdLine("SET", "a", "1", "EX", "1000"))
+	src.Exec(conn, utils.ToCmdLine("RPUSH", "b", "1", "2"))
+	src.Exec(conn, utils.ToCmdLine("SET", "c", "1"))
+
+	result := src.Exec(conn, utils.ToCmdLine("MIGRATE", host, port, "a", "1", "1000"))
+	asserts.AssertStatusReply(t, result, "OK")
+	asserts.AssertIntReply(t, src.Exec(conn, utils.ToCmdLine("EXISTS", "a")), 0)
+	asserts.AssertBulkReply(t, dest.Exec(destConn, utils.ToCmdLine("GET", "a")), "1")
+	asserts.AssertIntReplyGreaterThan(t, dest.Exec(destConn, utils.ToCmdLine("TTL", "a")), 900)
+
+	result = src.Exec(conn, utils.ToCmdLine("MIGRATE", host, port, "", "1", "1000", "COPY", "KEYS", "b", "c", "none"))
+	asserts.AssertStatusReply(t, result, "OK")
+	asserts.AssertIntReply(t, src.Exec(conn, utils.ToCmdLine("EXISTS", "b", "c")), 2)
+	asserts.AssertIntReply(t, dest.Exec(destConn, utils.ToCmdLine("LLEN", "b")), 2)
+
+	result = src.Exec(conn, utils.ToCmdLine("MIGRATE", host, port, "b", "1", "1000"))
+	asserts.AssertErrReply(t, result, "ERR Target instance replied with error: BUSYKEY Target key name already exists.")
+	asserts.AssertIntReply(t, src.Exec(conn, utils.ToCmdLine("EXISTS", "b")), 1)
+	result = src.Exec(conn, utils.ToCmdLine("MIGRATE", host, port, "b", "1", "1000", "REPLACE"))
+	asserts.AssertStatusReply(t, result, "OK")
+	asserts.AssertIntReply(t, src.Exec(conn, utils.ToCmdLine("EXISTS", "b")), 0)
+
+	result = src.Exec(conn, utils.ToCmdLine("MIGRATE", host, port, "none", "1", "1000"))
+	asserts.AssertStatusReply(t, result, "NOKEY")
+}
@@ -4,11 +4,14 @@ import (
 	Dict "github.com/hdt3213/godis/datastruct/dict"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/timewheel"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/shopspring/decimal"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (db *DB) getAsDict(key string) (Dict.Dict, protocol.ErrorReply) {
@@ -20,6 +23,10 @@ func (db *DB) getAsDict(key string) (Dict.Dict, protocol.ErrorReply) {
 	if !ok {
 		return nil, &protocol.WrongTypeErrReply{}
 	}
+	if dict.Len() == 0 {
+		// all fields expired, the key will be removed by active expiration
+		return nil, nil
+	}
 	return dict, nil
 }
 
@@ -35,6 +42,8 @@ func (db *DB) getOrInitDict(key string) (dict Dict.Dict, inited bool, errReply p
 			Data: dict,
 		})
 		inited = true
+	} else if hash, ok := dict.(*Dict.TTLDict); ok {
+		hash.RemoveExpired()
 	}
 	return dict, inited, nil
 }
@@ -378,7 +387,7 @@ func execHIncrBy(db *DB, args [][]byte) redis.Reply {
 	}
 	val += delta
 	bytes := []byte(strconv.FormatInt(val, 10))
-	dict.Put(field, bytes)
+	dict.PutIfExists(field, bytes)
 	db.addAof(utils.ToCmdLine3("hincrby", args...))
 	return protocol.MakeBulkReply(bytes)
 }
@@ -416,7 +425,7 @@ func execHIncrByFloat(db *DB, args [][]byte) redis.Reply {
 	}
 	result := val.Add(delta)
 	resultBytes := []byte(result.String())
-	dict.Put(field, resultBytes)
+	dict.PutIfExists(field, resultBytes)
 	db.addAof(utils.ToCmdLine3("hincrbyfloat", args...))
 	return protocol.MakeBulkReply(resultBytes)
 }
@@ -497,21 +506,384 @@ func execHRandField(db *DB, args [][]byte) redis.Reply {
 	return &protocol.EmptyMultiBulkReply{}
 }
 
+/* ---- Field TTL ---- */
+
+func genHashFieldExpireTask(key string) string {
+	return "hexpire:" + key
+}
+
+// toTTLDict converts hash to TTLDict in place, so that its fields could have expiration
+func (db *DB) toTTLDict(key string, dict Dict.Dict) *Dict.TTLDict {
+	if hash, ok := dict.(*Dict.TTLDict); ok {
+		return hash
+	}
+	hash := Dict.MakeTTL(dict)
+	db.PutEntity(key, &database.DataEntity{
+		Data: hash,
+	})
+	return hash
+}
+
+// getHashFieldExpireTime returns expiration of field, ok is false if field has no expiration
+func getHashFieldExpireTime(dict Dict.Dict, field string) (expireAt time.Time, ok bool) {
+	hash, ok := dict.(*Dict.TTLDict)
+	if !ok {
+		return time.Time{}, false
+	}
+	return hash.ExpireTime(field)
+}
+
+// scheduleHashFieldExpire removes expired fields of hash at the earliest expiration of its fields,
+// the key is removed if all fields expired
+func (db *DB) scheduleHashFieldExpire(key string, hash *Dict.TTLDict) {
+	next, ok := hash.NextExpiration()
+	if !ok {
+		return
+	}
+	timewheel.At(next, genHashFieldExpireTask(key), func() {
+		keys := []string{key}
+		db.RWLocks(keys, nil)
+		defer db.RWUnLocks(keys, nil)
+		// check-lock-check, key may be removed or overwritten during waiting lock
+		entity, ok := db.GetEntity(key)
+		if !ok {
+			return
+		}
+		hash, ok := entity.Data.(*Dict.TTLDict)
+		if !ok {
+			return
+		}
+		hash.RemoveExpired()
+		if hash.Len() == 0 {
+			db.Remove(key)
+			return
+		}
+		db.scheduleHashFieldExpire(key, hash)
+	})
+}
+
+// parseHashFields parses `FIELDS numfields field [field ...]`
+func parseHashFields(args [][]byte) ([]string, protocol.ErrorReply) {
+	if len(args) < 2 || strings.ToUpper(string(args[0])) != "FIELDS" {
+		return nil, protocol.MakeErrReply("ERR Mandatory argument FIELDS is missing or not at the right position")
+	}
+	numFields, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || numFields <= 0 {
+		return nil, protocol.MakeErrReply("ERR Parameter `numFields` should be greater than 0")
+	}
+	if numFields != int64(len(args)-2) {
+		return nil, protocol.MakeErrReply("ERR The `numfields` parameter must match the number of arguments")
+	}
+	fields := make([]string, numFields)
+	for i := range fields {
+		fields[i] = string(args[i+2])
+	}
+	return fields, nil
+}
+
+// parseHExpireOption parses `[NX | XX | GT | LT] FIELDS numfields field [field ...]` of HEXPIRE family
+func parseHExpireOption(args [][]byte) (condition string, fields []string, errReply protocol.ErrorReply) {
+	if len(args) > 0 {
+		switch arg := strings.ToUpper(string(args[0])); arg {
+		case "NX", "XX", "GT", "LT":
+			condition = arg
+			args = args[1:]
+		}
+	}
+	fields, errReply = parseHashFields(args)
+	if errReply != nil {
+		return "", nil, errReply
+	}
+	return condition, fields, nil
+}
+
+// execHExpireCommon executes HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT, unit is unit of the time argument.
+// It replies an array, each element is -2 if field not exists, 0 if condition not met,
+// 1 if expiration is set or 2 if field is deleted because expiration is in the past
+func execHExpireCommon(db *DB, args [][]byte, cmdName string, unit time.Duration, absolute bool) redis.Reply {
+	key := string(args[0])
+	raw, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if raw < 0 {
+		return protocol.MakeErrReply("ERR invalid expire time, must be >= 0")
+	}
+	if raw > math.MaxInt64/int64(unit) {
+		return protocol.MakeErrReply("ERR invalid expire time in '" + cmdName + "' command")
+	}
+	condition, fields, errReply := parseHExpireOption(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	now := time.Now()
+	var expireAt time.Time
+	if absolute {
+		expireAt = time.Unix(0, raw*int64(unit))
+	} else {
+		expireAt = now.Add(time.Duration(raw) * unit)
+	}
+
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(fields))
+	if dict == nil {
+		for i := range result {
+			result[i] = protocol.MakeIntReply(-2)
+		}
+		return protocol.MakeMultiRawReply(result)
+	}
+	hash := db.toTTLDict(key, dict)
+	var updated, deleted []string
+	for i, field := range fields {
+		if _, exists := hash.Get(field); !exists {
+			result[i] = protocol.MakeIntReply(-2)
+			continue
+		}
+		current, hasTTL := hash.ExpireTime(field)
+		skip := false
+		switch condition {
+		case "NX":
+			skip = hasTTL
+		case "XX":
+			skip = !hasTTL
+		case "GT":
+			// no ttl means infinite ttl
+			skip = !hasTTL || !expireAt.After(current)
+		case "LT":
+			skip = hasTTL && !expireAt.Before(current)
+		}
+		if skip {
+			result[i] = protocol.MakeIntReply(0)
+			continue
+		}
+		if !expireAt.After(now) {
+			hash.Remove(field)
+			deleted = append(deleted, field)
+			result[i] = protocol.MakeIntReply(2)
+			continue
+		}
+		hash.Expire(field, expireAt)
+		updated = append(updated, field)
+		result[i] = protocol.MakeIntReply(1)
+	}
+	if len(deleted) > 0 {
+		db.addAof(utils.ToCmdLine2("hdel", append([]string{key}, deleted...)...))
+	}
+	if len(updated) > 0 {
+		timestamp := strconv.FormatInt(expireAt.UnixNano()/1e6, 10)
+		cmdLine := utils.ToCmdLine("hpexpireat", key, timestamp, "FIELDS", strconv.Itoa(len(updated)))
+		db.addAof(append(cmdLine, utils.ToCmdLine(updated...)...))
+		db.scheduleHashFieldExpire(key, hash)
+	}
+	if hash.Len() == 0 {
+		db.Remove(key)
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+// execHExpire sets expiration of hash fields in seconds
+// HEXPIRE key seconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+func execHExpire(db *DB, args [][]byte) redis.Reply {
+	return execHExpireCommon(db, args, "hexpire", time.Second, false)
+}
+
+// execHPExpire sets expiration of hash fields in milliseconds
+func execHPExpire(db *DB, args [][]byte) redis.Reply {
+	return execHExpireCommon(db, args, "hpexpire", time.Millisecond, false)
+}
+
+// execHExpireAt sets expiration of hash fields in unix timestamp
+func execHExpireAt(db *DB, args [][]byte) redis.Reply {
+	return execHExpireCommon(db, args, "hexpireat", time.Second, true)
+}
+
+// execHPExpireAt sets expiration of hash fields in unix timestamp in milliseconds
+func execHPExpireAt(db *DB, args [][]byte) redis.Reply {
+	return execHExpireCommon(db, args, "hpexpireat", time.Millisecond, true)
+}
+
+func undoHExpire(db *DB, args [][]byte) []CmdLine {
+	key := string(args[0])
+	_, fields, errReply := parseHExpireOption(args[2:])
+	if errReply != nil {
+		return nil
+	}
+	return rollbackHashFields(db, key, fields...)
+}
+
+// execHTTLCommon returns time to live of hash fields in given unit,
+// -2 if field not exists, -1 if field has no expiration
+func execHTTLCommon(db *DB, args [][]byte, unit time.Duration) redis.Reply {
+	key := string(args[0])
+	fields, errReply := parseHashFields(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(fields))
+	for i, field := range fields {
+		if dict == nil {
+			result[i] = protocol.MakeIntReply(-2)
+			continue
+		}
+		if _, exists := dict.Get(field); !exists {
+			result[i] = protocol.MakeIntReply(-2)
+			continue
+		}
+		expireAt, ok := getHashFieldExpireTime(dict, field)
+		if !ok {
+			result[i] = protocol.MakeIntReply(-1)
+			continue
+		}
+		ttl := expireAt.Sub(time.Now())
+		result[i] = protocol.MakeIntReply(int64(ttl / unit))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+// execHTTL returns time to live of hash fields in seconds
+// HTTL key FIELDS numfields field [field ...]
+func execHTTL(db *DB, args [][]byte) redis.Reply {
+	return execHTTLCommon(db, args, time.Second)
+}
+
+// execHPTTL returns time to live of hash fields in milliseconds
+func execHPTTL(db *DB, args [][]byte) redis.Reply {
+	return execHTTLCommon(db, args, time.Millisecond)
+}
+
+// execHPersist removes expiration of hash fields, each element of reply is -2 if field not exists,
+// -1 if field has no expiration or 1 if expiration is removed
+// HPERSIST key FIELDS numfields field [field ...]
+func execHPersist(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	fields, errReply := parseHashFields(args[1:])
+	if errReply != nil {
+		return errReply
+	}
+	dict, errReply := db.getAsDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(fields))
+	var persisted []string
+	for i, field := range fields {
+		if dict == nil {
+			result[i] = protocol.MakeIntReply(-2)
+			continue
+		}
+		if _, exists := dict.Get(field); !exists {
+			result[i] = protocol.MakeIntReply(-2)
+			continue
+		}
+		hash, ok := dict.(*Dict.TTLDict)
+		if !ok || hash.Persist(field) == 0 {
+			result[i] = protocol.MakeIntReply(-1)
+			continue
+		}
+		persisted = append(persisted, field)
+		result[i] = protocol.MakeIntReply(1)
+	}
+	if len(persisted) > 0 {
+		cmdLine := utils.ToCmdLine("hpersist", key, "FIELDS", strconv.Itoa(len(persisted)))
+		db.addAof(append(cmdLine, utils.ToCmdLine(persisted...)...))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+func undoHPersist(db *DB, args [][]byte) []CmdLine {
+	key := string(args[0])
+	fields, errReply := parseHashFields(args[1:])
+	if errReply != nil {
+		return nil
+	}
+	return rollbackHashFields(db, key, fields...)
+}
+
+// execHMSetPXAt sets fields with their expiration in unix timestamp in milliseconds, 0 means no expiration.
+// It is not a redis command, aof.EntityToCmd uses it to persist hash with field-level ttl
+// HMSETPXAT key field value unix-time-milliseconds [field value unix-time-milliseconds ...]
+func execHMSetPXAt(db *DB, args [][]byte) redis.Reply {
+	if len(args)%3 != 1 {
+		return protocol.MakeSyntaxErrReply()
+	}
+	key := string(args[0])
+	size := (len(args) - 1) / 3
+	expireAts := make([]int64, size)
+	for i := range expireAts {
+		var err error
+		expireAts[i], err = strconv.ParseInt(string(args[3*i+3]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+	}
+
+	dict, _, errReply := db.getOrInitDict(key)
+	if errReply != nil {
+		return errReply
+	}
+	hash := db.toTTLDict(key, dict)
+	now := time.Now()
+	for i, expireAtMs := range expireAts {
+		field := string(args[3*i+1])
+		expireAt := time.Unix(0, expireAtMs*int64(time.Millisecond))
+		if expireAtMs > 0 && !expireAt.After(now) {
+			hash.Remove(field)
+			continue
+		}
+		hash.Put(field, args[3*i+2])
+		if expireAtMs > 0 {
+			hash.Expire(field, expireAt)
+		}
+	}
+	if hash.Len() == 0 {
+		db.Remove(key)
+	} else {
+		db.scheduleHashFieldExpire(key, hash)
+	}
+	db.addAof(utils.ToCmdLine3("hmsetpxat", args...))
+	return &protocol.OkReply{}
+}
+
+func undoHMSetPXAt(db *DB, args [][]byte) []CmdLine {
+	key := string(args[0])
+	size := (len(args) - 1) / 3
+	fields := make([]string, size)
+	for i := 0; i < size; i++ {
+		fields[i] = string(args[3*i+1])
+	}
+	return rollbackHashFields(db, key, fields...)
+}
+
 func init() {
-	RegisterCommand("HSet", execHSet, writeFirstKey, undoHSet, 4)
-	RegisterCommand("HSetNX", execHSetNX, writeFirstKey, undoHSet, 4)
-	RegisterCommand("HGet", execHGet, readFirstKey, nil, 3)
-	RegisterCommand("HExists", execHExists, readFirstKey, nil, 3)
-	RegisterCommand("HDel", execHDel, writeFirstKey, undoHDel, -3)
-	RegisterCommand("HLen", execHLen, readFirstKey, nil, 2)
-	RegisterCommand("HStrlen", execHStrlen, readFirstKey, nil, 3)
-	RegisterCommand("HMSet", execHMSet, writeFirstKey, undoHMSet, -4)
-	RegisterCommand("HMGet", execHMGet, readFirstKey, nil, -3)
-	RegisterCommand("HGet", execHGet, readFirstKey, nil, -3)
-	RegisterCommand("HKeys", execHKeys, readFirstKey, nil, 2)
-	RegisterCommand("HVals", execHVals, readFirstKey, nil, 2)
-	RegisterCommand("HGetAll", execHGetAll, readFirstKey, nil, 2)
-	RegisterCommand("HIncrBy", execHIncrBy, writeFirstKey, undoHIncr, 4)
-	RegisterCommand("HIncrByFloat", execHIncrByFloat, writeFirstKey, undoHIncr, 4)
-	RegisterCommand("HRandField", execHRandField, readFirstKey, nil, -2)
+	RegisterCommand("HSet", execHSet, undoHSet, 4)
+	RegisterCommand("HSetNX", execHSetNX, undoHSet, 4)
+	RegisterCommand("HGet", execHGet, nil, 3)
+	RegisterCommand("HExists", execHExists, nil, 3)
+	RegisterCommand("HDel", execHDel, undoHDel, -3)
+	RegisterCommand("HLen", execHLen, nil, 2)
+	RegisterCommand("HStrlen", execHStrlen, nil, 3)
+	RegisterCommand("HMSet", execHMSet, undoHMSet, -4)
+	RegisterCommand("HMGet", execHMGet, nil, -3)
+	RegisterCommand("HGet", execHGet, nil, -3)
+	RegisterCommand("HKeys", execHKeys, nil, 2)
+	RegisterCommand("HVals", execHVals, nil, 2)
+	RegisterCommand("HGetAll", execHGetAll, nil, 2)
+	RegisterCommand("HIncrBy", execHIncrBy, undoHIncr, 4)
+	RegisterCommand("HIncrByFloat", execHIncrByFloat, undoHIncr, 4)
+	RegisterCommand("HRandField", execHRandField, nil, -2)
+	RegisterCommand("HExpire", execHExpire, undoHExpire, -6)
+	RegisterCommand("HPExpire", execHPExpire, undoHExpire, -6)
+	RegisterCommand("HExpireAt", execHExpireAt, undoHExpire, -6)
+	RegisterCommand("HPExpireAt", execHPExpireAt, undoHExpire, -6)
+	RegisterCommand("HTTL", execHTTL, nil, -5)
+	RegisterCommand("HPTTL", execHPTTL, nil, -5)
+	RegisterCommand("HPersist", execHPersist, undoHPersist, -5)
+	RegisterCommand("HMSetPXAt", execHMSetPXAt, undoHMSetPXAt, -5)
 }
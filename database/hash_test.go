@@ -7,6 +7,7 @@ import (
 	"github.com/hdt3213/godis/redis/protocol/asserts"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestHSet(t *testing.T) {
@@ -340,3 +341,152 @@ func TestUndoHIncr(t *testing.T) {
 	result := testDB.Exec(nil, utils.ToCmdLine("hget", key, field))
 	asserts.AssertBulkReply(t, result, "1")
 }
+
+func TestHExpire(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "a", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "b", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "c", "3"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "FIELDS", "2", "a", "d"))
+	assertIntsReply(t, result, 1, -2)
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "3", "a", "b", "d"))
+	assertIntsReply(t, result, 99, -1, -2)
+	result = testDB.Exec(nil, utils.ToCmdLine("hpttl", key, "FIELDS", "1", "a"))
+	if reply, ok := result.(*protocol.MultiRawReply); !ok || len(reply.Replies) != 1 {
+		t.Errorf("expected array, actually %s", result.ToBytes())
+	} else if ttl := reply.Replies[0].(*protocol.IntReply).Code; ttl <= 99000 || ttl > 100000 {
+		t.Errorf("wrong pttl %d", ttl)
+	}
+
+	// conditions
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "200", "NX", "FIELDS", "2", "a", "b"))
+	assertIntsReply(t, result, 0, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "300", "XX", "FIELDS", "2", "a", "c"))
+	assertIntsReply(t, result, 1, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "250", "GT", "FIELDS", "2", "a", "c"))
+	assertIntsReply(t, result, 0, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "250", "LT", "FIELDS", "2", "a", "c"))
+	assertIntsReply(t, result, 1, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "3", "a", "b", "c"))
+	assertIntsReply(t, result, 249, 199, 249)
+
+	// persist
+	result = testDB.Exec(nil, utils.ToCmdLine("hpersist", key, "FIELDS", "3", "a", "d", "a"))
+	assertIntsReply(t, result, 1, -2, -1)
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "1", "a"))
+	assertIntsReply(t, result, -1)
+
+	// hincrby keeps expiration
+	testDB.Exec(nil, utils.ToCmdLine("hincrby", key, "b", "1"))
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "1", "b"))
+	assertIntsReply(t, result, 199)
+
+	// hset cancels expiration
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "b", "4"))
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "1", "b"))
+	assertIntsReply(t, result, -1)
+
+	// expiration in the past deletes fields
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpireat", key, "1", "FIELDS", "1", "a"))
+	assertIntsReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "0", "FIELDS", "2", "b", "c"))
+	assertIntsReply(t, result, 2, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+
+	// not existed key
+	result = testDB.Exec(nil, utils.ToCmdLine("hpexpire", key, "100", "FIELDS", "1", "a"))
+	assertIntsReply(t, result, -2)
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "1", "a"))
+	assertIntsReply(t, result, -2)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+
+	// errors
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "a", "1"))
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "-1", "FIELDS", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR invalid expire time, must be >= 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "FIELDS", "2", "a"))
+	asserts.AssertErrReply(t, result, "ERR The `numfields` parameter must match the number of arguments")
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "FIELDS", "0", "a"))
+	asserts.AssertErrReply(t, result, "ERR Parameter `numFields` should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "XX", "NX", "FIELDS", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR Mandatory argument FIELDS is missing or not at the right position")
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELD", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR Mandatory argument FIELDS is missing or not at the right position")
+	wrongKey := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", wrongKey, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("hexpire", wrongKey, "100", "FIELDS", "1", "a"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestHashFieldExpiration(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("hmset", key, "a", "1", "b", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("hpexpire", key, "100", "FIELDS", "1", "a"))
+	time.Sleep(200 * time.Millisecond)
+
+	// expired field is invisible
+	result := testDB.Exec(nil, utils.ToCmdLine("hget", key, "a"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("hlen", key))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("hgetall", key))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "2"})
+	result = testDB.Exec(nil, utils.ToCmdLine("hsetnx", key, "a", "3"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "1", "a"))
+	assertIntsReply(t, result, -1)
+
+	// key is removed actively after all fields expired
+	testDB.Exec(nil, utils.ToCmdLine("hpexpire", key, "100", "FIELDS", "2", "a", "b"))
+	time.Sleep(200 * time.Millisecond)
+	result = testDB.Exec(nil, utils.ToCmdLine("hgetall", key))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	time.Sleep(2 * time.Second)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestUndoHExpire(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "a", "1"))
+	testDB.Exec(nil, utils.ToCmdLine("hset", key, "b", "2"))
+	testDB.Exec(nil, utils.ToCmdLine("hexpire", key, "100", "FIELDS", "1", "b"))
+
+	cmdLine := utils.ToCmdLine("hexpire", key, "0", "FIELDS", "2", "a", "b")
+	undoCmdLines := undoHExpire(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("hmget", key, "a", "b"))
+	asserts.AssertMultiBulkReply(t, result, []string{"1", "2"})
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "2", "a", "b"))
+	assertIntsReply(t, result, -1, 99)
+
+	cmdLine = utils.ToCmdLine("hpersist", key, "FIELDS", "1", "b")
+	undoCmdLines = undoHPersist(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "1", "b"))
+	assertIntsReply(t, result, 99)
+
+	// undo of hset keeps expiration of field
+	cmdLine = utils.ToCmdLine("hset", key, "b", "3")
+	undoCmdLines = undoHSet(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("hget", key, "b"))
+	asserts.AssertBulkReply(t, result, "2")
+	result = testDB.Exec(nil, utils.ToCmdLine("httl", key, "FIELDS", "1", "b"))
+	assertIntsReply(t, result, 99)
+}
@@ -66,7 +66,7 @@ func execType(db *DB, args [][]byte) redis.Reply {
 	switch entity.Data.(type) {
 	case []byte:
 		return protocol.MakeStatusReply("string")
-	case *list.LinkedList:
+	case list.List:
 		return protocol.MakeStatusReply("list")
 	case dict.Dict:
 		return protocol.MakeStatusReply("hash")
@@ -78,12 +78,6 @@ func execType(db *DB, args [][]byte) redis.Reply {
 	return &protocol.UnknownErrReply{}
 }
 
-func prepareRename(args [][]byte) ([]string, []string) {
-	src := string(args[0])
-	dest := string(args[1])
-	return []string{dest}, []string{src}
-}
-
 // execRename a key
 func execRename(db *DB, args [][]byte) redis.Reply {
 	if len(args) != 2 {
@@ -105,6 +99,10 @@ func execRename(db *DB, args [][]byte) redis.Reply {
 		expireTime, _ := rawTTL.(time.Time)
 		db.Expire(dest, expireTime)
 	}
+	if hash, ok := entity.Data.(*dict.TTLDict); ok {
+		// expiration task of fields is bound to key name
+		db.scheduleHashFieldExpire(dest, hash)
+	}
 	db.addAof(utils.ToCmdLine3("rename", args...))
 	return &protocol.OkReply{}
 }
@@ -138,6 +136,10 @@ func execRenameNx(db *DB, args [][]byte) redis.Reply {
 		expireTime, _ := rawTTL.(time.Time)
 		db.Expire(dest, expireTime)
 	}
+	if hash, ok := entity.Data.(*dict.TTLDict); ok {
+		// expiration task of fields is bound to key name
+		db.scheduleHashFieldExpire(dest, hash)
+	}
 	db.addAof(utils.ToCmdLine3("renamenx", args...))
 	return protocol.MakeIntReply(1)
 }
@@ -290,6 +292,11 @@ func execKeys(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(result)
 }
 
+// execDBSize returns the number of keys in current database
+func execDBSize(db *DB, args [][]byte) redis.Reply {
+	return protocol.MakeIntReply(int64(db.data.Len()))
+}
+
 func toTTLCmd(db *DB, key string) *protocol.MultiBulkReply {
 	raw, exists := db.ttlMap.Get(key)
 	if !exists {
@@ -310,29 +317,31 @@ func undoExpire(db *DB, args [][]byte) []CmdLine {
 
 func init() {
 	// 删除一个或多个key
-	RegisterCommand("Del", execDel, writeAllKeys, undoDel, -2)
+	RegisterCommand("Del", execDel, undoDel, -2)
 	// 设置一个key的过期时间，时间的格式为秒
-	RegisterCommand("Expire", execExpire, writeFirstKey, undoExpire, 3)
+	RegisterCommand("Expire", execExpire, undoExpire, 3)
 	// 设置一个key的过期时间，时间的格式是uinx时间戳并精确到秒
-	RegisterCommand("ExpireAt", execExpireAt, writeFirstKey, undoExpire, 3)
+	RegisterCommand("ExpireAt", execExpireAt, undoExpire, 3)
 	// 设置一个key的过期时间，时间的格式为毫秒
-	RegisterCommand("PExpire", execPExpire, writeFirstKey, undoExpire, 3)
+	RegisterCommand("PExpire", execPExpire, undoExpire, 3)
 	// 设置一个key的国企时间，时间的格式是uinx时间戳并精确到毫秒
-	RegisterCommand("PExpireAt", execPExpireAt, writeFirstKey, undoExpire, 3)
+	RegisterCommand("PExpireAt", execPExpireAt, undoExpire, 3)
 	// 以秒为单位返回key的剩余过期时间
-	RegisterCommand("TTL", execTTL, readFirstKey, nil, 2)
+	RegisterCommand("TTL", execTTL, nil, 2)
 	// 以毫秒为单位返回key的剩余过期时间
-	RegisterCommand("PTTL", execPTTL, readFirstKey, nil, 2)
+	RegisterCommand("PTTL", execPTTL, nil, 2)
 	// 删除key的过期时间，使得key永不过期
-	RegisterCommand("Persist", execPersist, writeFirstKey, undoExpire, 2)
+	RegisterCommand("Persist", execPersist, undoExpire, 2)
 	// 检查给定key是否存在
-	RegisterCommand("Exists", execExists, readAllKeys, nil, -2)
+	RegisterCommand("Exists", execExists, nil, -2)
 	// 以字符串的形式返回存在在key中的值的类型
-	RegisterCommand("Type", execType, readFirstKey, nil, 2)
+	RegisterCommand("Type", execType, nil, 2)
 	// 修改key的名字为 newkey，如果key不存在则返回错误
-	RegisterCommand("Rename", execRename, prepareRename, undoRename, 3)
+	RegisterCommand("Rename", execRename, undoRename, 3)
 	// 在新的key不存在时修改key的名称为newkey
-	RegisterCommand("RenameNx", execRenameNx, prepareRename, undoRename, 3)
+	RegisterCommand("RenameNx", execRenameNx, undoRename, 3)
 	// 用于查找所有匹配给定模式 pattern 的 key 。
-	RegisterCommand("Keys", execKeys, noPrepare, nil, 2)
+	RegisterCommand("Keys", execKeys, nil, 2)
+	// 返回当前数据库中key的数量
+	RegisterCommand("DBSize", execDBSize, nil, 1)
 }
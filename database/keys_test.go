@@ -204,4 +204,6 @@ func TestKeys(t *testing.T) {
 	asserts.AssertMultiBulkReplySize(t, result, 1)
 	result = testDB.Exec(nil, utils.ToCmdLine("keys", "?:*"))
 	asserts.AssertMultiBulkReplySize(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("dbsize"))
+	asserts.AssertIntReply(t, result, 3)
 }
@@ -7,28 +7,29 @@ import (
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"strconv"
+	"strings"
 )
 
-func (db *DB) getAsList(key string) (*List.LinkedList, protocol.ErrorReply) {
+func (db *DB) getAsList(key string) (List.List, protocol.ErrorReply) {
 	entity, ok := db.GetEntity(key)
 	if !ok {
 		return nil, nil
 	}
-	bytes, ok := entity.Data.(*List.LinkedList)
+	bytes, ok := entity.Data.(List.List)
 	if !ok {
 		return nil, &protocol.WrongTypeErrReply{}
 	}
 	return bytes, nil
 }
 
-func (db *DB) getOrInitList(key string) (list *List.LinkedList, isNew bool, errReply protocol.ErrorReply) {
+func (db *DB) getOrInitList(key string) (list List.List, isNew bool, errReply protocol.ErrorReply) {
 	list, errReply = db.getAsList(key)
 	if errReply != nil {
 		return nil, false, errReply
 	}
 	isNew = false
 	if list == nil {
-		list = &List.LinkedList{}
+		list = List.NewQuickList()
 		db.PutEntity(key, &database.DataEntity{
 			Data: list,
 		})
@@ -86,10 +87,54 @@ func execLLen(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(size)
 }
 
-// execLPop removes the first element of list, and return it
-func execLPop(db *DB, args [][]byte) redis.Reply {
+// parsePopCount parses optional count argument of LPOP/RPOP
+func parsePopCount(cmdName string, args [][]byte) (count int, withCount bool, errReply protocol.ErrorReply) {
+	if len(args) > 2 {
+		return 0, false, protocol.MakeArgNumErrReply(cmdName)
+	}
+	if len(args) == 1 {
+		return 1, false, nil
+	}
+	count64, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return 0, false, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if count64 < 0 {
+		return 0, false, protocol.MakeErrReply("ERR value is out of range, must be positive")
+	}
+	return int(count64), true, nil
+}
+
+// popList removes at most count elements from head(left) or tail of list
+func popList(list List.List, left bool, count int) [][]byte {
+	if count > list.Len() {
+		count = list.Len()
+	}
+	result := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		var val interface{}
+		if left {
+			val = list.Remove(0)
+		} else {
+			val = list.RemoveLast()
+		}
+		result[i], _ = val.([]byte)
+	}
+	return result
+}
+
+// execPop removes elements from head or tail of list, it returns a bulk reply without count or a multi bulk reply with count
+func execPop(db *DB, args [][]byte, left bool) redis.Reply {
+	cmdName := "rpop"
+	if left {
+		cmdName = "lpop"
+	}
 	// parse args
 	key := string(args[0])
+	count, withCount, errReply := parsePopCount(cmdName, args)
+	if errReply != nil {
+		return errReply
+	}
 
 	// get data
 	list, errReply := db.getAsList(key)
@@ -97,36 +142,71 @@ func execLPop(db *DB, args [][]byte) redis.Reply {
 		return errReply
 	}
 	if list == nil {
+		if withCount {
+			return protocol.MakeNullMultiBulkReply()
+		}
 		return &protocol.NullBulkReply{}
 	}
+	if count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
 
-	val, _ := list.Remove(0).([]byte)
+	vals := popList(list, left, count)
 	if list.Len() == 0 {
 		db.Remove(key)
 	}
-	db.addAof(utils.ToCmdLine3("lpop", args...))
-	return protocol.MakeBulkReply(val)
+	db.addAof(utils.ToCmdLine3(cmdName, args...))
+	if !withCount {
+		return protocol.MakeBulkReply(vals[0])
+	}
+	return protocol.MakeMultiBulkReply(vals)
+}
+
+// execLPop removes the first element of list, and return it
+// LPOP key [count]
+func execLPop(db *DB, args [][]byte) redis.Reply {
+	return execPop(db, args, true)
 }
 
 var lPushCmd = []byte("LPUSH")
 
-func undoLPop(db *DB, args [][]byte) []CmdLine {
+// undoPop pushes elements to be popped back to list
+func undoPop(db *DB, args [][]byte, left bool) []CmdLine {
 	key := string(args[0])
+	count, _, errReply := parsePopCount("", args)
+	if errReply != nil {
+		return nil
+	}
 	list, errReply := db.getAsList(key)
 	if errReply != nil {
 		return nil
 	}
-	if list == nil || list.Len() == 0 {
+	if list == nil || list.Len() == 0 || count == 0 {
 		return nil
 	}
-	element, _ := list.Get(0).([]byte)
-	return []CmdLine{
-		{
-			lPushCmd,
-			args[0],
-			element,
-		},
+	if count > list.Len() {
+		count = list.Len()
+	}
+	cmdLine := make(CmdLine, 0, count+2)
+	if left {
+		// LPUSH inserts elements one by one, so the first element should be pushed at last
+		cmdLine = append(cmdLine, lPushCmd, args[0])
+		for i := count - 1; i >= 0; i-- {
+			element, _ := list.Get(i).([]byte)
+			cmdLine = append(cmdLine, element)
+		}
+	} else {
+		cmdLine = append(cmdLine, rPushCmd, args[0])
+		for i := list.Len() - count; i < list.Len(); i++ {
+			element, _ := list.Get(i).([]byte)
+			cmdLine = append(cmdLine, element)
+		}
 	}
+	return []CmdLine{cmdLine}
+}
+
+func undoLPop(db *DB, args [][]byte) []CmdLine {
+	return undoPop(db, args, true)
 }
 
 // execLPush inserts element at head of list
@@ -344,53 +424,15 @@ func undoLSet(db *DB, args [][]byte) []CmdLine {
 }
 
 // execRPop removes last element of list then return it
+// RPOP key [count]
 func execRPop(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	key := string(args[0])
-
-	// get data
-	list, errReply := db.getAsList(key)
-	if errReply != nil {
-		return errReply
-	}
-	if list == nil {
-		return &protocol.NullBulkReply{}
-	}
-
-	val, _ := list.RemoveLast().([]byte)
-	if list.Len() == 0 {
-		db.Remove(key)
-	}
-	db.addAof(utils.ToCmdLine3("rpop", args...))
-	return protocol.MakeBulkReply(val)
+	return execPop(db, args, false)
 }
 
 var rPushCmd = []byte("RPUSH")
 
 func undoRPop(db *DB, args [][]byte) []CmdLine {
-	key := string(args[0])
-	list, errReply := db.getAsList(key)
-	if errReply != nil {
-		return nil
-	}
-	if list == nil || list.Len() == 0 {
-		return nil
-	}
-	element, _ := list.Get(list.Len() - 1).([]byte)
-	return []CmdLine{
-		{
-			rPushCmd,
-			args[0],
-			element,
-		},
-	}
-}
-
-func prepareRPopLPush(args [][]byte) ([]string, []string) {
-	return []string{
-		string(args[0]),
-		string(args[1]),
-	}, nil
+	return undoPop(db, args, false)
 }
 
 // execRPopLPush pops last element of list-A then insert it to the head of list-B
@@ -504,17 +546,356 @@ func execRPushX(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(int64(list.Len()))
 }
 
+// execLInsert inserts element before or after pivot, returns -1 if pivot not found
+// LINSERT key BEFORE|AFTER pivot element
+func execLInsert(db *DB, args [][]byte) redis.Reply {
+	// parse args
+	key := string(args[0])
+	var before bool
+	switch strings.ToUpper(string(args[1])) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+		before = false
+	default:
+		return protocol.MakeSyntaxErrReply()
+	}
+	pivot := args[2]
+	value := args[3]
+
+	// get data
+	list, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		return protocol.MakeIntReply(0)
+	}
+
+	index := -1
+	list.ForEach(func(i int, v interface{}) bool {
+		if utils.Equals(v, pivot) {
+			index = i
+			return false
+		}
+		return true
+	})
+	if index < 0 {
+		return protocol.MakeIntReply(-1)
+	}
+	if !before {
+		index++
+	}
+	list.Insert(index, value)
+	db.addAof(utils.ToCmdLine3("linsert", args...))
+	return protocol.MakeIntReply(int64(list.Len()))
+}
+
+// execLPos returns index of matching elements in list
+// LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+func execLPos(db *DB, args [][]byte) redis.Reply {
+	// parse args
+	key := string(args[0])
+	element := args[1]
+	rank := 1
+	count := 0
+	withCount := false
+	maxLen := 0
+	for i := 2; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return protocol.MakeSyntaxErrReply()
+		}
+		num, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "RANK":
+			if num == 0 {
+				return protocol.MakeErrReply("ERR RANK can't be zero: use 1 to start from the first match, " +
+					"2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = int(num)
+		case "COUNT":
+			if num < 0 {
+				return protocol.MakeErrReply("ERR COUNT can't be negative")
+			}
+			count = int(num)
+			withCount = true
+		case "MAXLEN":
+			if num < 0 {
+				return protocol.MakeErrReply("ERR MAXLEN can't be negative")
+			}
+			maxLen = int(num)
+		default:
+			return protocol.MakeSyntaxErrReply()
+		}
+		i++
+	}
+
+	// get data
+	list, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		if withCount {
+			return &protocol.EmptyMultiBulkReply{}
+		}
+		return &protocol.NullBulkReply{}
+	}
+
+	// skip the first rank-1 matches, then collect count matches, count 0 means all matches
+	skip := rank - 1
+	if rank < 0 {
+		skip = -rank - 1
+	}
+	limit := count
+	if !withCount {
+		limit = 1
+	}
+	var positions []int
+	compared := 0
+	consumer := func(i int, v interface{}) bool {
+		if maxLen > 0 && compared >= maxLen {
+			return false
+		}
+		compared++
+		if !utils.Equals(v, element) {
+			return true
+		}
+		if skip > 0 {
+			skip--
+			return true
+		}
+		positions = append(positions, i)
+		return limit == 0 || len(positions) < limit
+	}
+	if rank > 0 {
+		list.ForEach(consumer)
+	} else {
+		list.ReverseForEach(consumer)
+	}
+
+	if withCount {
+		if len(positions) == 0 {
+			return &protocol.EmptyMultiBulkReply{}
+		}
+		multi := make([]redis.Reply, len(positions))
+		for i, pos := range positions {
+			multi[i] = protocol.MakeIntReply(int64(pos))
+		}
+		return protocol.MakeMultiRawReply(multi)
+	}
+	if len(positions) == 0 {
+		return &protocol.NullBulkReply{}
+	}
+	return protocol.MakeIntReply(int64(positions[0]))
+}
+
+// execLTrim keeps elements in given range and removes others
+// LTRIM key start stop
+func execLTrim(db *DB, args [][]byte) redis.Reply {
+	// parse args
+	key := string(args[0])
+	start64, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	start := int(start64)
+	stop64, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	stop := int(stop64)
+
+	// get data
+	list, errReply := db.getAsList(key)
+	if errReply != nil {
+		return errReply
+	}
+	if list == nil {
+		return &protocol.OkReply{}
+	}
+
+	// compute index, keep elements within [start, stop]
+	size := list.Len()
+	if start < 0 {
+		start = size + start
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop < 0 {
+		stop = size + stop
+	}
+	if stop >= size {
+		stop = size - 1
+	}
+	if start > stop || start >= size {
+		db.Remove(key)
+		db.addAof(utils.ToCmdLine3("ltrim", args...))
+		return &protocol.OkReply{}
+	}
+	for i := 0; i < start; i++ {
+		list.Remove(0)
+	}
+	for i := stop + 1; i < size; i++ {
+		list.RemoveLast()
+	}
+	db.addAof(utils.ToCmdLine3("ltrim", args...))
+	return &protocol.OkReply{}
+}
+
+// parseListDirection parses LEFT|RIGHT argument, returns true for LEFT
+func parseListDirection(arg []byte) (left bool, errReply protocol.ErrorReply) {
+	switch strings.ToUpper(string(arg)) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	}
+	return false, protocol.MakeSyntaxErrReply()
+}
+
+// execLMove pops an element from one side of source list and pushes it to one side of destination list
+// LMOVE source destination LEFT|RIGHT LEFT|RIGHT
+func execLMove(db *DB, args [][]byte) redis.Reply {
+	sourceKey := string(args[0])
+	destKey := string(args[1])
+	fromLeft, errReply := parseListDirection(args[2])
+	if errReply != nil {
+		return errReply
+	}
+	toLeft, errReply := parseListDirection(args[3])
+	if errReply != nil {
+		return errReply
+	}
+
+	// get source entity
+	sourceList, errReply := db.getAsList(sourceKey)
+	if errReply != nil {
+		return errReply
+	}
+	if sourceList == nil {
+		return &protocol.NullBulkReply{}
+	}
+	// check type of destination before modifying source
+	if _, errReply = db.getAsList(destKey); errReply != nil {
+		return errReply
+	}
+
+	// pop and push
+	val := popList(sourceList, fromLeft, 1)[0]
+	if sourceList.Len() == 0 {
+		db.Remove(sourceKey)
+	}
+	destList, _, errReply := db.getOrInitList(destKey)
+	if errReply != nil {
+		return errReply
+	}
+	if toLeft {
+		destList.Insert(0, val)
+	} else {
+		destList.Add(val)
+	}
+
+	db.addAof(utils.ToCmdLine3("lmove", args...))
+	return protocol.MakeBulkReply(val)
+}
+
+func undoLMove(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[0]), string(args[1]))
+}
+
+// parseLMPop parses arguments of LMPOP, args format: numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func parseLMPop(args [][]byte) (keys []string, left bool, count int, errReply protocol.ErrorReply) {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, false, 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys <= 0 {
+		return nil, false, 0, protocol.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-2) {
+		return nil, false, 0, protocol.MakeSyntaxErrReply()
+	}
+	keys = make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	rest := args[numKeys+1:]
+	left, errReply = parseListDirection(rest[0])
+	if errReply != nil {
+		return nil, false, 0, errReply
+	}
+	count = 1
+	if len(rest) == 3 && strings.ToUpper(string(rest[1])) == "COUNT" {
+		count64, err := strconv.ParseInt(string(rest[2]), 10, 64)
+		if err != nil || count64 <= 0 {
+			return nil, false, 0, protocol.MakeErrReply("ERR count should be greater than 0")
+		}
+		count = int(count64)
+	} else if len(rest) != 1 {
+		return nil, false, 0, protocol.MakeSyntaxErrReply()
+	}
+	return keys, left, count, nil
+}
+
+// execLMPop pops elements from the first non-empty list in given keys
+// LMPOP numkeys key [key ...] LEFT|RIGHT [COUNT count]
+func execLMPop(db *DB, args [][]byte) redis.Reply {
+	keys, left, count, errReply := parseLMPop(args)
+	if errReply != nil {
+		return errReply
+	}
+	for _, key := range keys {
+		list, errReply := db.getAsList(key)
+		if errReply != nil {
+			return errReply
+		}
+		if list == nil {
+			continue
+		}
+		vals := popList(list, left, count)
+		if list.Len() == 0 {
+			db.Remove(key)
+		}
+		// propagate as LPOP/RPOP, so that replaying aof pops the same list
+		cmdName := "rpop"
+		if left {
+			cmdName = "lpop"
+		}
+		db.addAof(utils.ToCmdLine(cmdName, key, strconv.Itoa(len(vals))))
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte(key)),
+			protocol.MakeMultiBulkReply(vals),
+		})
+	}
+	return &protocol.NullBulkReply{}
+}
+
+func undoLMPop(db *DB, args [][]byte) []CmdLine {
+	keys, _ := cmdTable["lmpop"].prepare(args)
+	return rollbackGivenKeys(db, keys...)
+}
+
 func init() {
-	RegisterCommand("LPush", execLPush, writeFirstKey, undoLPush, -3)
-	RegisterCommand("LPushX", execLPushX, writeFirstKey, undoLPush, -3)
-	RegisterCommand("RPush", execRPush, writeFirstKey, undoRPush, -3)
-	RegisterCommand("RPushX", execRPushX, writeFirstKey, undoRPush, -3)
-	RegisterCommand("LPop", execLPop, writeFirstKey, undoLPop, 2)
-	RegisterCommand("RPop", execRPop, writeFirstKey, undoRPop, 2)
-	RegisterCommand("RPopLPush", execRPopLPush, prepareRPopLPush, undoRPopLPush, 3)
-	RegisterCommand("LRem", execLRem, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("LLen", execLLen, readFirstKey, nil, 2)
-	RegisterCommand("LIndex", execLIndex, readFirstKey, nil, 3)
-	RegisterCommand("LSet", execLSet, writeFirstKey, undoLSet, 4)
-	RegisterCommand("LRange", execLRange, readFirstKey, nil, 4)
+	RegisterCommand("LPush", execLPush, undoLPush, -3)
+	RegisterCommand("LPushX", execLPushX, undoLPush, -3)
+	RegisterCommand("RPush", execRPush, undoRPush, -3)
+	RegisterCommand("RPushX", execRPushX, undoRPush, -3)
+	RegisterCommand("LPop", execLPop, undoLPop, -2)
+	RegisterCommand("RPop", execRPop, undoRPop, -2)
+	RegisterCommand("RPopLPush", execRPopLPush, undoRPopLPush, 3)
+	RegisterCommand("LRem", execLRem, rollbackFirstKey, 4)
+	RegisterCommand("LLen", execLLen, nil, 2)
+	RegisterCommand("LIndex", execLIndex, nil, 3)
+	RegisterCommand("LSet", execLSet, undoLSet, 4)
+	RegisterCommand("LRange", execLRange, nil, 4)
+	RegisterCommand("LInsert", execLInsert, rollbackFirstKey, 5)
+	RegisterCommand("LPos", execLPos, nil, -3)
+	RegisterCommand("LTrim", execLTrim, rollbackFirstKey, 4)
+	RegisterCommand("LMove", execLMove, undoLMove, 5)
+	RegisterCommand("LMPop", execLMPop, undoLMPop, -4)
 }
@@ -2,6 +2,7 @@ package database
 
 import (
 	"fmt"
+	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
@@ -465,3 +466,214 @@ func TestUndoRPopLPush(t *testing.T) {
 	result = testDB.Exec(nil, utils.ToCmdLine("llen", key2))
 	asserts.AssertIntReply(t, result, 0)
 }
+
+func TestPopWithCount(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c", "d", "e"))
+	result := testDB.Exec(nil, utils.ToCmdLine("lpop", key, "2"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b"})
+	result = testDB.Exec(nil, utils.ToCmdLine("rpop", key, "2"))
+	asserts.AssertMultiBulkReply(t, result, []string{"e", "d"})
+	result = testDB.Exec(nil, utils.ToCmdLine("lpop", key, "0"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("rpop", key, "10"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c"})
+	result = testDB.Exec(nil, utils.ToCmdLine("lpop", key, "2"))
+	if !utils.BytesEquals(result.ToBytes(), protocol.MakeNullMultiBulkReply().ToBytes()) {
+		t.Errorf("expected null multi bulk, actually %s", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("rpop", key))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpop", key, "-1"))
+	asserts.AssertErrReply(t, result, "ERR value is out of range, must be positive")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpop", key, "1", "2"))
+	asserts.AssertErrReply(t, result, "ERR wrong number of arguments for 'lpop' command")
+}
+
+func TestUndoPopWithCount(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c", "d"))
+	for _, cmdLine := range []CmdLine{
+		utils.ToCmdLine("lpop", key, "3"),
+		utils.ToCmdLine("rpop", key, "3"),
+		utils.ToCmdLine("lpop", key, "10"),
+	} {
+		var undoCmdLines []CmdLine
+		if string(cmdLine[0]) == "lpop" {
+			undoCmdLines = undoLPop(testDB, cmdLine[1:])
+		} else {
+			undoCmdLines = undoRPop(testDB, cmdLine[1:])
+		}
+		testDB.Exec(nil, cmdLine)
+		for _, undoCmdLine := range undoCmdLines {
+			testDB.Exec(nil, undoCmdLine)
+		}
+		result := testDB.Exec(nil, utils.ToCmdLine("lrange", key, "0", "-1"))
+		asserts.AssertMultiBulkReply(t, result, []string{"a", "b", "c", "d"})
+	}
+}
+
+func TestLInsert(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("linsert", key, "before", "a", "x"))
+	asserts.AssertIntReply(t, result, 4)
+	result = testDB.Exec(nil, utils.ToCmdLine("linsert", key, "AFTER", "c", "y"))
+	asserts.AssertIntReply(t, result, 5)
+	result = testDB.Exec(nil, utils.ToCmdLine("linsert", key, "AFTER", "a", "z"))
+	asserts.AssertIntReply(t, result, 6)
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"x", "a", "z", "b", "c", "y"})
+	result = testDB.Exec(nil, utils.ToCmdLine("linsert", key, "AFTER", "none", "z"))
+	asserts.AssertIntReply(t, result, -1)
+	result = testDB.Exec(nil, utils.ToCmdLine("linsert", key+"1", "AFTER", "a", "z"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("linsert", key, "MIDDLE", "a", "z"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+}
+
+func assertIntsReply(t *testing.T, actual redis.Reply, expected ...int64) {
+	replies := make([]redis.Reply, len(expected))
+	for i, v := range expected {
+		replies[i] = protocol.MakeIntReply(v)
+	}
+	if !utils.BytesEquals(actual.ToBytes(), protocol.MakeMultiRawReply(replies).ToBytes()) {
+		t.Errorf("expected %v, actually %s", expected, actual.ToBytes())
+	}
+}
+
+func TestLPos(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c", "1", "2", "3", "c", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK", "2"))
+	asserts.AssertIntReply(t, result, 6)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK", "-1"))
+	asserts.AssertIntReply(t, result, 7)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "COUNT", "2"))
+	assertIntsReply(t, result, 2, 6)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK", "-1", "COUNT", "2"))
+	assertIntsReply(t, result, 7, 6)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "COUNT", "0"))
+	assertIntsReply(t, result, 2, 6, 7)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "COUNT", "0", "MAXLEN", "6"))
+	assertIntsReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "MAXLEN", "2"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "none", "COUNT", "1"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key+"1", "c"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "RANK", "0"))
+	asserts.AssertErrReply(t, result, "ERR RANK can't be zero: use 1 to start from the first match, "+
+		"2 from the second ... or use negative to start from the end of the list")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "COUNT", "-1"))
+	asserts.AssertErrReply(t, result, "ERR COUNT can't be negative")
+	result = testDB.Exec(nil, utils.ToCmdLine("lpos", key, "c", "MAXLEN"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+}
+
+func TestLTrim(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key, "a", "b", "c", "d", "e"))
+	result := testDB.Exec(nil, utils.ToCmdLine("ltrim", key, "1", "-2"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "c", "d"})
+	result = testDB.Exec(nil, utils.ToCmdLine("ltrim", key, "-100", "100"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("llen", key))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("ltrim", key, "2", "1"))
+	asserts.AssertStatusReply(t, result, "OK")
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestLMove(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key1, "a", "b", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "LEFT", "RIGHT"))
+	asserts.AssertBulkReply(t, result, "a")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "right", "left"))
+	asserts.AssertBulkReply(t, result, "c")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key2, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c", "a"})
+	// rotate list
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key2, key2, "LEFT", "RIGHT"))
+	asserts.AssertBulkReply(t, result, "c")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key2, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "c"})
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key1, "LEFT", "LEFT"))
+	asserts.AssertBulkReply(t, result, "b")
+	result = testDB.Exec(nil, utils.ToCmdLine("lrange", key1, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b"})
+
+	// wrong type of destination
+	key3 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", key3, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key3, "LEFT", "LEFT"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	result = testDB.Exec(nil, utils.ToCmdLine("llen", key1))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1, key2, "LEFT", "UP"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmove", key1+"1", key2, "LEFT", "LEFT"))
+	asserts.AssertNullBulk(t, result)
+}
+
+func TestUndoLMove(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key1, "a"))
+	cmdLine := utils.ToCmdLine("lmove", key1, key2, "LEFT", "LEFT")
+	undoCmdLines := undoLMove(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("lrange", key1, "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a"})
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key2))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func assertLMPopReply(t *testing.T, actual redis.Reply, key string, values ...string) {
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(key)),
+		protocol.MakeMultiBulkReply(utils.ToCmdLine(values...)),
+	})
+	if !utils.BytesEquals(actual.ToBytes(), expected.ToBytes()) {
+		t.Errorf("expected %s, actually %s", expected.ToBytes(), actual.ToBytes())
+	}
+}
+
+func TestLMPop(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key2, "a", "b", "c"))
+	result := testDB.Exec(nil, utils.ToCmdLine("lmpop", "2", key1, key2, "LEFT"))
+	assertLMPopReply(t, result, key2, "a")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "2", key1, key2, "RIGHT", "COUNT", "5"))
+	assertLMPopReply(t, result, key2, "c", "b")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "2", key1, key2, "RIGHT"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "0", key1, "RIGHT"))
+	asserts.AssertErrReply(t, result, "ERR numkeys should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "1", key1, "RIGHT", "COUNT", "0"))
+	asserts.AssertErrReply(t, result, "ERR count should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "3", key1, key2, "RIGHT"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("lmpop", "9223372036854775807", key1, "RIGHT"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+}
@@ -1,65 +1,482 @@
 package database
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hdt3213/godis/aof"
 	"github.com/hdt3213/godis/config"
 	"github.com/hdt3213/godis/datastruct/dict"
 	List "github.com/hdt3213/godis/datastruct/list"
+	"github.com/hdt3213/godis/datastruct/set"
 	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
 	"github.com/hdt3213/godis/interface/database"
 	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/pubsub"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"github.com/hdt3213/rdb/core"
 	rdb "github.com/hdt3213/rdb/parser"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-func loadRdb(mdb *MultiDB) {
-	rdbFile, err := os.Open(config.Properties.RDBFilename)
+const (
+	rdbOpCodeEOF = 0xff
+	// versions before 5 have no checksum
+	rdbChecksumVersion = 5
+)
+
+var (
+	// redis uses crc-64-jones, go package crc64 takes reversed polynomial
+	redisCRCTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+	isoCRCTable   = crc64.MakeTable(crc64.ISO)
+)
+
+// verifyRDBChecksum checks crc64 sum at the end of rdb file.
+// Redis writes crc-64-jones in little endian after EOF opcode, zero sum means checksum is disabled.
+// The encoder used by godis writes crc-64-iso in big endian followed by a LF.
+func verifyRDBChecksum(data []byte) error {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return errors.New("invalid rdb header")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
 	if err != nil {
-		logger.Error("open rdb file failed")
-		return
+		return errors.New("invalid rdb version: " + string(data[5:9]))
 	}
-	defer func() {
-		_ = rdbFile.Close()
-	}()
-	decoder := rdb.NewDecoder(rdbFile)
-	err = decoder.Parse(func(o rdb.RedisObject) bool {
-		db := mdb.selectDB(o.GetDBIndex())
-		switch o.GetType() {
-		case rdb.StringType:
-			str := o.(*rdb.StringObject)
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: str.Value,
-			})
-		case rdb.ListType:
-			listObj := o.(*rdb.ListObject)
-			list := &List.LinkedList{}
-			for _, v := range listObj.Values {
-				list.Add(v)
+	n := len(data)
+	// godis encoder declares version 3 but still writes checksum
+	if version < rdbChecksumVersion && data[n-1] == rdbOpCodeEOF {
+		return nil
+	}
+	found := false
+	if n >= 18 && data[n-9] == rdbOpCodeEOF {
+		found = true
+		sum := binary.LittleEndian.Uint64(data[n-8:])
+		if sum == 0 || ^crc64.Update(^uint64(0), redisCRCTable, data[:n-8]) == sum {
+			return nil
+		}
+	}
+	if n >= 19 && data[n-1] == '\n' && data[n-10] == rdbOpCodeEOF {
+		found = true
+		if crc64.Checksum(data[:n-9], isoCRCTable) == binary.BigEndian.Uint64(data[n-9:n-1]) {
+			return nil
+		}
+	}
+	if !found {
+		return errors.New("rdb file is truncated: EOF opcode not found")
+	}
+	return errors.New("rdb checksum mismatch")
+}
+
+// splitRDBFile splits rdb file into rdb and commands appended after it by godis, then verifies checksum of rdb
+func splitRDBFile(data []byte) ([]byte, []byte, error) {
+	rdbData, cmds := aof.SplitRDB(data)
+	err := verifyRDBChecksum(rdbData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rdbData, cmds, nil
+}
+
+// parseRDB verifies checksum then decodes all objects, cb returns false to stop decoding.
+// It returns commands appended after rdb.
+func parseRDB(data []byte, cb func(o rdb.RedisObject) bool) ([]CmdLine, error) {
+	rdbData, cmds, err := splitRDBFile(data)
+	if err != nil {
+		return nil, err
+	}
+	decoder := rdb.NewDecoder(bytes.NewReader(rdbData))
+	err = decoder.Parse(cb)
+	if err != nil {
+		return nil, errors.New("rdb file is corrupted: " + err.Error())
+	}
+	return parseRDBCmds(cmds)
+}
+
+// parseRDBCmds parses commands appended after rdb, they are SELECT, HMSETPXAT and PEXPIREAT, see aof.WriteRDB
+func parseRDBCmds(data []byte) ([]CmdLine, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	replies, err := parser.ParseBytes(data)
+	if err != nil {
+		return nil, errors.New("rdb file is corrupted: " + err.Error())
+	}
+	cmdLines := make([]CmdLine, 0, len(replies))
+	for _, reply := range replies {
+		mbr, ok := reply.(*protocol.MultiBulkReply)
+		if !ok || len(mbr.Args) < 2 {
+			return nil, errors.New("rdb file is corrupted: invalid command after rdb")
+		}
+		switch strings.ToLower(string(mbr.Args[0])) {
+		case "select", "hmsetpxat", "pexpireat":
+		default:
+			return nil, errors.New("rdb file is corrupted: unexpected command after rdb: " + string(mbr.Args[0]))
+		}
+		cmdLines = append(cmdLines, mbr.Args)
+	}
+	return cmdLines, nil
+}
+
+// rdbObjectToEntity converts object decoded from rdb, all encodings of a type have been converted to the same object by decoder
+func rdbObjectToEntity(o rdb.RedisObject) (*database.DataEntity, error) {
+	switch obj := o.(type) {
+	case *rdb.StringObject:
+		return &database.DataEntity{
+			Data: obj.Value,
+		}, nil
+	case *rdb.ListObject:
+		list := List.NewQuickList()
+		for _, v := range obj.Values {
+			list.Add(v)
+		}
+		return &database.DataEntity{
+			Data: list,
+		}, nil
+	case *rdb.HashObject:
+		hash := dict.MakeSimple()
+		for k, v := range obj.Hash {
+			hash.Put(k, v)
+		}
+		return &database.DataEntity{
+			Data: hash,
+		}, nil
+	case *rdb.SetObject:
+		members := make([]string, len(obj.Members))
+		for i, m := range obj.Members {
+			members[i] = string(m)
+		}
+		return &database.DataEntity{
+			Data: set.Make(members...),
+		}, nil
+	case *rdb.ZSetObject:
+		zSet := SortedSet.Make()
+		for _, e := range obj.Entries {
+			zSet.Add(e.Member, e.Score)
+		}
+		return &database.DataEntity{
+			Data: zSet,
+		}, nil
+	}
+	return nil, errors.New("unsupported rdb object type: " + o.GetType())
+}
+
+// loadRdb loads rdb file into mdb, it returns error of os package if rdb file not exists
+func loadRdb(mdb *MultiDB) error {
+	data, err := ioutil.ReadFile(config.Properties.RDBFilename)
+	if err != nil {
+		return err
+	}
+	rdbData, cmds, err := splitRDBFile(data)
+	if err != nil {
+		return err
+	}
+	return mdb.loadRDBData(rdbData, cmds)
+}
+
+// loadRDBData loads verified rdb and commands appended after it, invoker should make sure no command is executing
+func (mdb *MultiDB) loadRDBData(rdbData []byte, cmds []byte) error {
+	cmdLines, err := parseRDBCmds(cmds)
+	if err != nil {
+		return err
+	}
+	err = mdb.LoadRDB(rdb.NewDecoder(bytes.NewReader(rdbData)))
+	if err != nil {
+		return err
+	}
+	// hashes with field-level ttl
+	db := mdb.dbSet[0]
+	now := time.Now()
+	for _, cmdLine := range cmdLines {
+		switch strings.ToLower(string(cmdLine[0])) {
+		case "select":
+			index, err := strconv.Atoi(string(cmdLine[1]))
+			if err != nil || index < 0 || index >= len(mdb.dbSet) {
+				return fmt.Errorf("db index %s is out of range", cmdLine[1])
+			}
+			db = mdb.dbSet[index]
+		case "hmsetpxat":
+			if reply := execHMSetPXAt(db, cmdLine[1:]); protocol.IsErrorReply(reply) {
+				return errors.New("rdb file is corrupted: " + string(reply.ToBytes()))
 			}
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: list,
-			})
-		case rdb.HashType:
-			hashObj := o.(*rdb.HashObject)
-			hash := dict.MakeSimple()
-			for k, v := range hashObj.Hash {
-				hash.Put(k, v)
+		case "pexpireat":
+			if len(cmdLine) != 3 {
+				return errors.New("rdb file is corrupted: invalid pexpireat command")
 			}
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: hash,
-			})
-		case rdb.ZSetType:
-			zsetObj := o.(*rdb.ZSetObject)
-			zSet := SortedSet.Make()
-			for _, e := range zsetObj.Entries {
-				zSet.Add(e.Member, e.Score)
+			key := string(cmdLine[1])
+			ms, err := strconv.ParseInt(string(cmdLine[2]), 10, 64)
+			if err != nil {
+				return errors.New("rdb file is corrupted: invalid pexpireat command")
 			}
-			db.PutEntity(o.GetKey(), &database.DataEntity{
-				Data: zSet,
-			})
+			expireAt := time.Unix(0, ms*int64(time.Millisecond))
+			if expireAt.Before(now) {
+				// skip expired key like LoadRDB does
+				db.Remove(key)
+			} else {
+				db.Expire(key, expireAt)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadRDB loads all objects from decoder, it's used for loading rdb file and rdb preamble of aof
+func (mdb *MultiDB) LoadRDB(dec *core.Decoder) error {
+	var loadErr error
+	now := time.Now()
+	err := dec.Parse(func(o rdb.RedisObject) bool {
+		if o.GetDBIndex() >= len(mdb.dbSet) {
+			loadErr = fmt.Errorf("db index %d of key %s is out of range", o.GetDBIndex(), o.GetKey())
+			return false
 		}
-		if o.GetExpiration() != nil {
-			db.Expire(o.GetKey(), *o.GetExpiration())
+		expiration := o.GetExpiration()
+		if expiration != nil && expiration.Before(now) {
+			// skip expired key like redis does
+			return true
+		}
+		entity, err := rdbObjectToEntity(o)
+		if err != nil {
+			loadErr = err
+			return false
+		}
+		db := mdb.selectDB(o.GetDBIndex())
+		db.PutEntity(o.GetKey(), entity)
+		if expiration != nil {
+			db.Expire(o.GetKey(), *expiration)
 		}
 		return true
 	})
+	if err != nil {
+		return errors.New("rdb file is corrupted: " + err.Error())
+	}
+	return loadErr
+}
+
+// RDBCheckResult is summary of a valid rdb file
+type RDBCheckResult struct {
+	Keys           int
+	Expires        int
+	AlreadyExpired int
+	Types          map[string]int // key count of each type
+}
+
+// CheckRDB validates rdb file without loading it, used by `godis --check-rdb <file>`
+func CheckRDB(filename string) (*RDBCheckResult, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	result := &RDBCheckResult{
+		Types: make(map[string]int),
+	}
+	var checkErr error
+	now := time.Now()
+	cmdLines, err := parseRDB(data, func(o rdb.RedisObject) bool {
+		if _, err := rdbObjectToEntity(o); err != nil {
+			checkErr = fmt.Errorf("key %s: %v", o.GetKey(), err)
+			return false
+		}
+		result.Keys++
+		result.Types[o.GetType()]++
+		if expiration := o.GetExpiration(); expiration != nil {
+			result.Expires++
+			if expiration.Before(now) {
+				result.AlreadyExpired++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if checkErr != nil {
+		return nil, checkErr
+	}
+	// hashes with field-level ttl are appended after rdb
+	for _, cmdLine := range cmdLines {
+		switch strings.ToLower(string(cmdLine[0])) {
+		case "hmsetpxat":
+			result.Keys++
+			result.Types["hash"]++
+		case "pexpireat":
+			result.Expires++
+			if ms, err := strconv.ParseInt(string(cmdLine[len(cmdLine)-1]), 10, 64); err == nil && ms < now.UnixNano()/1e6 {
+				result.AlreadyExpired++
+			}
+		}
+	}
+	return result, nil
+}
+
+// TruncateAofToRDB saves dataset at the given unix timestamp into a new rdb file, used by `godis-check-aof --truncate-to-timestamp --rdb`.
+// It replays commands executed before timestamp in memory, filename could be a single aof file or a manifest of multi-part aof.
+func TruncateAofToRDB(filename string, timestamp int64, output string) (*aof.TruncateResult, error) {
+	// never overwrite existing file, it may be the rdb to recover
+	if _, err := os.Stat(output); err == nil {
+		return nil, errors.New(output + " already exists")
+	}
+	databases := config.Properties.Databases
+	if databases == 0 {
+		databases = 16
+	}
+	mdb := &MultiDB{
+		dbSet: make([]*DB, databases),
+		hub:   pubsub.MakeHub(),
+	}
+	for i := range mdb.dbSet {
+		mdb.dbSet[i] = makeDB()
+		mdb.dbSet[i].index = i
+	}
+	result, err := aof.LoadToTimestamp(mdb, filename, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := mdb.TakeSnapshot(func() {})
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+	err = writeFileAtomic(output, func(w io.Writer) error {
+		return aof.WriteRDB(w, snapshot, make([]int64, databases))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+var errSaveInProgress = errors.New("ERR Background save already in progress")
+
+// saveRule triggers background saving if at least `changes` writes happened in `seconds`
+type saveRule struct {
+	seconds int64
+	changes int64
+}
+
+func parseSaveRules(s string) ([]*saveRule, error) {
+	fields := strings.Fields(strings.Trim(s, "\""))
+	if len(fields)%2 != 0 {
+		return nil, errors.New("invalid save rules: " + s)
+	}
+	rules := make([]*saveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || seconds <= 0 {
+			return nil, errors.New("invalid save rules: " + s)
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes <= 0 {
+			return nil, errors.New("invalid save rules: " + s)
+		}
+		rules = append(rules, &saveRule{seconds: seconds, changes: changes})
+	}
+	return rules, nil
+}
+
+func getRDBFilename() string {
+	if config.Properties.RDBFilename == "" {
+		return "dump.rdb"
+	}
+	return config.Properties.RDBFilename
+}
+
+// saveRDB dumps a snapshot into rdb file, so the file is consistent at the point in time when the snapshot was taken.
+// Writers are not blocked during dumping, the snapshot copies old values before they are modified.
+func (mdb *MultiDB) saveRDB() error {
+	if !atomic.CompareAndSwapInt32(&mdb.saving, 0, 1) {
+		return errSaveInProgress
+	}
+	defer atomic.StoreInt32(&mdb.saving, 0)
+
+	var dirty int64
+	snapshot, err := mdb.TakeSnapshot(func() {
+		dirty = atomic.LoadInt64(&mdb.dirty)
+	})
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+
+	// tmp file must be in the same file system with rdb file, so that renaming is atomic
+	err = writeFileAtomic(getRDBFilename(), func(w io.Writer) error {
+		return aof.WriteRDB(w, snapshot, make([]int64, len(mdb.dbSet)))
+	})
+	if err != nil {
+		return err
+	}
+	// writes happened after snapshot taken are still dirty
+	atomic.AddInt64(&mdb.dirty, -dirty)
+	atomic.StoreInt64(&mdb.lastSave, time.Now().Unix())
+	return nil
+}
+
+// bgSaveRDB saves rdb in another goroutine
+func (mdb *MultiDB) bgSaveRDB() error {
+	if atomic.LoadInt32(&mdb.saving) == 1 {
+		return errSaveInProgress
+	}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error(err)
+			}
+		}()
+		err := mdb.saveRDB()
+		if err != nil {
+			logger.Error("background saving failed: " + err.Error())
+			return
+		}
+		logger.Info("background saving terminated with success")
+	}()
+	return nil
+}
+
+// startSaveCron checks save rules every second
+func (mdb *MultiDB) startSaveCron() {
+	ticker := time.NewTicker(time.Second)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mdb.checkSaveRules()
+			case <-mdb.stopSaveCron:
+				return
+			}
+		}
+	}()
+}
+
+func (mdb *MultiDB) checkSaveRules() {
+	if atomic.LoadInt32(&mdb.saving) == 1 {
+		return
+	}
+	dirty := atomic.LoadInt64(&mdb.dirty)
+	elapsed := time.Now().Unix() - atomic.LoadInt64(&mdb.lastSave)
+	for _, rule := range mdb.saveRules {
+		if dirty >= rule.changes && elapsed >= rule.seconds {
+			logger.Info(fmt.Sprintf("%d changes in %d seconds. Saving...", rule.changes, rule.seconds))
+			_ = mdb.bgSaveRDB()
+			return
+		}
+	}
+}
+
+// saveRDBOnShutdown waits for running background saving or snapshot then saves the final snapshot
+func (mdb *MultiDB) saveRDBOnShutdown() error {
+	for {
+		err := mdb.saveRDB()
+		if err != errSaveInProgress && err != errSnapshotInProgress {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 }
@@ -5,9 +5,14 @@ import (
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/connection"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestLoadRDB(t *testing.T) {
@@ -29,6 +34,8 @@ func TestLoadRDB(t *testing.T) {
 	asserts.AssertMultiBulkReply(t, result, []string{"1", "1"})
 	result = rdbDB.Exec(conn, utils.ToCmdLine("ZRange", "zset", "0", "1", "WITHSCORES"))
 	asserts.AssertMultiBulkReply(t, result, []string{"1", "1"})
+	result = rdbDB.Exec(conn, utils.ToCmdLine("SMembers", "set"))
+	asserts.AssertMultiBulkReply(t, result, []string{"1"})
 
 	config.Properties = &config.ServerProperties{
 		AppendOnly:  false,
@@ -38,3 +45,261 @@ func TestLoadRDB(t *testing.T) {
 	result = rdbDB.Exec(conn, utils.ToCmdLine("Get", "str"))
 	asserts.AssertNullBulk(t, result)
 }
+
+func TestSaveRDBWithoutAof(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:  false,
+		RDBFilename: filepath.Join(tmpDir, "dump.rdb"),
+	}
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	writeDB.Exec(conn, utils.ToCmdLine("SET", "str", "str", "EX", "1000"))
+	writeDB.Exec(conn, utils.ToCmdLine("SET", "expired", "expired", "PX", "1"))
+	writeDB.Exec(conn, utils.ToCmdLine("RPUSH", "list", "1", "2"))
+	writeDB.Exec(conn, utils.ToCmdLine("HSET", "hash", "f", "v"))
+	writeDB.Exec(conn, utils.ToCmdLine("ZADD", "zset", "1", "m"))
+	writeDB.Exec(conn, utils.ToCmdLine("SADD", "set", "a"))
+	if atomic.LoadInt64(&writeDB.dirty) == 0 {
+		t.Error("expect dirty after writing")
+	}
+	time.Sleep(10 * time.Millisecond)
+	result := writeDB.Exec(conn, utils.ToCmdLine("save"))
+	asserts.AssertStatusReply(t, result, "OK")
+	if dirty := atomic.LoadInt64(&writeDB.dirty); dirty != 0 {
+		t.Errorf("expect dirty 0, actual %d", dirty)
+	}
+	result = writeDB.Exec(conn, utils.ToCmdLine("lastsave"))
+	asserts.AssertIntReplyGreaterThan(t, result, int(time.Now().Unix()-10))
+	writeDB.Close()
+
+	readDB := NewStandaloneServer()
+	defer readDB.Close()
+	result = readDB.Exec(conn, utils.ToCmdLine("GET", "str"))
+	asserts.AssertBulkReply(t, result, "str")
+	result = readDB.Exec(conn, utils.ToCmdLine("TTL", "str"))
+	asserts.AssertIntReplyGreaterThan(t, result, 0)
+	result = readDB.Exec(conn, utils.ToCmdLine("EXISTS", "expired"))
+	asserts.AssertIntReply(t, result, 0)
+	result = readDB.Exec(conn, utils.ToCmdLine("LRANGE", "list", "0", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"1", "2"})
+	result = readDB.Exec(conn, utils.ToCmdLine("HGET", "hash", "f"))
+	asserts.AssertBulkReply(t, result, "v")
+	result = readDB.Exec(conn, utils.ToCmdLine("ZSCORE", "zset", "m"))
+	asserts.AssertBulkReply(t, result, "1")
+	result = readDB.Exec(conn, utils.ToCmdLine("SMEMBERS", "set"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a"})
+}
+
+func TestSaveRDBConsistent(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	config.Properties = &config.ServerProperties{
+		AppendOnly:  false,
+		RDBFilename: filepath.Join(tmpDir, "dump.rdb"),
+	}
+	conn := &connection.FakeConn{}
+	writeDB := NewStandaloneServer()
+	for i := 0; i < 10000; i++ {
+		writeDB.Exec(conn, utils.ToCmdLine("SET", "k"+strconv.Itoa(i), "0"))
+	}
+	// keys of group are always written together, rdb file should never see them different
+	group := make([]string, 100)
+	for i := range group {
+		group[i] = "g" + strconv.Itoa(i)
+	}
+	mset := func(value string) {
+		args := []string{"MSET"}
+		for _, key := range group {
+			args = append(args, key, value)
+		}
+		writeDB.Exec(conn, utils.ToCmdLine(args...))
+	}
+	mset("0")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; ; i++ {
+			if i == 2 {
+				close(started)
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mset(strconv.Itoa(i))
+		}
+	}()
+	<-started
+	result := writeDB.Exec(conn, utils.ToCmdLine("save"))
+	close(stop)
+	<-done
+	asserts.AssertStatusReply(t, result, "OK")
+	writeDB.Close()
+
+	readDB := NewStandaloneServer()
+	defer readDB.Close()
+	expected := readDB.Exec(conn, utils.ToCmdLine("GET", group[0]))
+	for _, key := range group[1:] {
+		result = readDB.Exec(conn, utils.ToCmdLine("GET", key))
+		if string(result.ToBytes()) != string(expected.ToBytes()) {
+			t.Errorf("inconsistent rdb: %s is %s, %s is %s", group[0], expected.ToBytes(), key, result.ToBytes())
+			return
+		}
+	}
+	result = readDB.Exec(conn, utils.ToCmdLine("DBSIZE"))
+	asserts.AssertIntReply(t, result, 10000+len(group))
+}
+
+func TestSaveRules(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	rdbFilename := filepath.Join(tmpDir, "dump.rdb")
+	config.Properties = &config.ServerProperties{
+		RDBFilename: rdbFilename,
+		Save:        "1 2",
+	}
+	conn := &connection.FakeConn{}
+	db := NewStandaloneServer()
+	db.Exec(conn, utils.ToCmdLine("SET", "a", "a"))
+	time.Sleep(2 * time.Second)
+	if _, err := os.Stat(rdbFilename); err == nil {
+		t.Error("expect no saving before changes reach threshold")
+	}
+	db.Exec(conn, utils.ToCmdLine("SET", "b", "b"))
+	time.Sleep(2 * time.Second)
+	if _, err := os.Stat(rdbFilename); err != nil {
+		t.Error("expect rdb saved by save rules")
+	}
+	if dirty := atomic.LoadInt64(&db.dirty); dirty != 0 {
+		t.Errorf("expect dirty 0, actual %d", dirty)
+	}
+
+	// SHUTDOWN saves rdb if save rules configured
+	var stopped int32
+	defaultHook := shutdownHook
+	defer func() {
+		shutdownHook = defaultHook
+	}()
+	shutdownHook = func() {
+		atomic.StoreInt32(&stopped, 1)
+	}
+	db.Exec(conn, utils.ToCmdLine("SET", "c", "c"))
+	result := db.Exec(conn, utils.ToCmdLine("SHUTDOWN", "NOW"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+	result = db.Exec(conn, utils.ToCmdLine("SHUTDOWN"))
+	asserts.AssertStatusReply(t, result, "OK")
+	if atomic.LoadInt32(&stopped) != 1 {
+		t.Error("expect shutdown hook called")
+	}
+	db.Close()
+
+	config.Properties = &config.ServerProperties{
+		RDBFilename: rdbFilename,
+	}
+	db = NewStandaloneServer()
+	defer db.Close()
+	result = db.Exec(conn, utils.ToCmdLine("GET", "c"))
+	asserts.AssertBulkReply(t, result, "c")
+
+	// NOSAVE skips saving
+	db.Exec(conn, utils.ToCmdLine("SET", "d", "d"))
+	result = db.Exec(conn, utils.ToCmdLine("SHUTDOWN", "NOSAVE"))
+	asserts.AssertStatusReply(t, result, "OK")
+	db2 := NewStandaloneServer()
+	defer db2.Close()
+	result = db2.Exec(conn, utils.ToCmdLine("GET", "d"))
+	asserts.AssertNullBulk(t, result)
+}
+
+func TestParseSaveRules(t *testing.T) {
+	rules, err := parseSaveRules("900 1 300 10")
+	if err != nil || len(rules) != 2 || rules[1].seconds != 300 || rules[1].changes != 10 {
+		t.Error("parse save rules failed")
+	}
+	rules, err = parseSaveRules("\"\"")
+	if err != nil || len(rules) != 0 {
+		t.Error("empty save rules should disable saving")
+	}
+	for _, s := range []string{"900", "a 1", "900 0"} {
+		_, err = parseSaveRules(s)
+		if err == nil {
+			t.Error("expect error for " + s)
+		}
+	}
+}
+
+func TestCheckRDB(t *testing.T) {
+	_, b, _, _ := runtime.Caller(0)
+	projectRoot := filepath.Dir(filepath.Dir(b))
+	rdbFilename := filepath.Join(projectRoot, "test.rdb")
+	result, err := CheckRDB(rdbFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Keys != 5 || result.Expires != 1 || result.Types["set"] != 1 {
+		t.Errorf("unexpected check result: %+v", result)
+	}
+
+	data, err := ioutil.ReadFile(rdbFilename)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tmpDir, err := ioutil.TempDir("", "godis")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	truncated := filepath.Join(tmpDir, "truncated.rdb")
+	_ = ioutil.WriteFile(truncated, data[:len(data)/2], 0644)
+	_, err = CheckRDB(truncated)
+	if err == nil {
+		t.Error("expect error for truncated rdb")
+	}
+	corrupted := filepath.Join(tmpDir, "corrupted.rdb")
+	broken := append([]byte{}, data...)
+	broken[len(broken)/2] ^= 1
+	_ = ioutil.WriteFile(corrupted, broken, 0644)
+	_, err = CheckRDB(corrupted)
+	if err == nil || err.Error() != "rdb checksum mismatch" {
+		t.Errorf("expect checksum mismatch, actual %v", err)
+	}
+
+	// refuse to start with partial data
+	config.Properties = &config.ServerProperties{
+		RDBFilename: corrupted,
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expect panic when loading corrupted rdb")
+		}
+	}()
+	NewStandaloneServer()
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"github.com/hdt3213/godis/lib/routing"
 	"strings"
 )
 
@@ -14,15 +15,25 @@ type command struct {
 	flags    int
 }
 
-// RegisterCommand registers a new command
+// RegisterCommand registers a new command, its related keys are analysed by the KeyFunc registered in package routing
 // arity means allowed number of cmdArgs, arity < 0 means len(args) >= -arity.
 // for example: the arity of `get` is 2, `mget` is -2
-func RegisterCommand(name string, executor ExecFunc, prepare PreFunc, rollback UndoFunc, arity int) {
+func RegisterCommand(name string, executor ExecFunc, rollback UndoFunc, arity int) {
 	name = strings.ToLower(name)
+	prepare, ok := routing.GetKeyFunc(name)
+	if !ok {
+		panic("no key func of command " + name)
+	}
 	cmdTable[name] = &command{
 		executor: executor,
-		prepare:  prepare,
+		prepare:  PreFunc(prepare),
 		undo:     rollback,
 		arity:    arity,
 	}
 }
+
+// isWriteCommand returns whether the command modifies data, commands modifying data have undo function
+func isWriteCommand(name string) bool {
+	cmd, ok := cmdTable[name]
+	return ok && cmd.undo != nil
+}
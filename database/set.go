@@ -6,7 +6,9 @@ import (
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
+	"math"
 	"strconv"
+	"strings"
 )
 
 func (db *DB) getAsSet(key string) (*HashSet.Set, protocol.ErrorReply) {
@@ -102,30 +104,31 @@ func execSRem(db *DB, args [][]byte) redis.Reply {
 }
 
 // execSPop removes one or more random members from set
+// SPOP key [count]
 func execSPop(db *DB, args [][]byte) redis.Reply {
 	if len(args) != 1 && len(args) != 2 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'spop' command")
 	}
 	key := string(args[0])
+	withCount := len(args) == 2
+	count := 1
+	if withCount {
+		count64, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || count64 < 0 {
+			return protocol.MakeErrReply("ERR value is out of range, must be positive")
+		}
+		count = int(count64)
+	}
 
 	set, errReply := db.getAsSet(key)
 	if errReply != nil {
 		return errReply
 	}
 	if set == nil {
-		return &protocol.NullBulkReply{}
-	}
-
-	count := 1
-	if len(args) == 2 {
-		count64, err := strconv.ParseInt(string(args[1]), 10, 64)
-		if err != nil || count64 <= 0 {
-			return protocol.MakeErrReply("ERR value is out of range, must be positive")
+		if withCount {
+			return &protocol.EmptyMultiBulkReply{}
 		}
-		count = int(count64)
-	}
-	if count > set.Len() {
-		count = set.Len()
+		return &protocol.NullBulkReply{}
 	}
 
 	members := set.RandomDistinctMembers(count)
@@ -134,9 +137,16 @@ func execSPop(db *DB, args [][]byte) redis.Reply {
 		set.Remove(v)
 		result[i] = []byte(v)
 	}
+	if set.Len() == 0 {
+		db.Remove(key)
+	}
 
-	if count > 0 {
-		db.addAof(utils.ToCmdLine3("spop", args...))
+	if len(members) > 0 {
+		// propagate as SREM, so that replaying aof removes the same members
+		db.addAof(utils.ToCmdLine3("srem", append([][]byte{args[0]}, result...)...))
+	}
+	if !withCount {
+		return protocol.MakeBulkReply(result[0])
 	}
 	return protocol.MakeMultiBulkReply(result)
 }
@@ -436,60 +446,192 @@ func execSDiffStore(db *DB, args [][]byte) redis.Reply {
 }
 
 // execSRandMember gets random members from set
+// SRANDMEMBER key [count], negative count allows the same member to be returned multiple times
 func execSRandMember(db *DB, args [][]byte) redis.Reply {
 	if len(args) != 1 && len(args) != 2 {
 		return protocol.MakeErrReply("ERR wrong number of arguments for 'srandmember' command")
 	}
 	key := string(args[0])
+	var count int64
+	if len(args) == 2 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		if count < -math.MaxInt64/2 {
+			return protocol.MakeErrReply("ERR value is out of range")
+		}
+	}
 
-	// get or init entity
 	set, errReply := db.getAsSet(key)
 	if errReply != nil {
 		return errReply
 	}
-	if set == nil {
-		return &protocol.NullBulkReply{}
-	}
 	if len(args) == 1 {
+		if set == nil {
+			return &protocol.NullBulkReply{}
+		}
 		// get a random member
 		members := set.RandomMembers(1)
 		return protocol.MakeBulkReply([]byte(members[0]))
 	}
-	count64, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
+	if set == nil || count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
 	}
-	count := int(count64)
+	var members []string
 	if count > 0 {
-		members := set.RandomDistinctMembers(count)
-		result := make([][]byte, len(members))
-		for i, v := range members {
-			result[i] = []byte(v)
+		members = set.RandomDistinctMembers(int(count))
+	} else {
+		members = set.RandomMembers(int(-count))
+	}
+	return protocol.MakeMultiBulkReply(utils.ToCmdLine(members...))
+}
+
+// execSMove moves member from source set to destination set
+// SMOVE source destination member
+func execSMove(db *DB, args [][]byte) redis.Reply {
+	src := string(args[0])
+	dest := string(args[1])
+	member := string(args[2])
+
+	srcSet, errReply := db.getAsSet(src)
+	if errReply != nil {
+		return errReply
+	}
+	destSet, errReply := db.getAsSet(dest)
+	if errReply != nil {
+		return errReply
+	}
+	if srcSet == nil || !srcSet.Has(member) {
+		return protocol.MakeIntReply(0)
+	}
+	if src == dest {
+		return protocol.MakeIntReply(1)
+	}
+
+	srcSet.Remove(member)
+	if srcSet.Len() == 0 {
+		db.Remove(src)
+	}
+	if destSet == nil {
+		destSet = HashSet.Make()
+		db.PutEntity(dest, &database.DataEntity{
+			Data: destSet,
+		})
+	}
+	destSet.Add(member)
+	db.addAof(utils.ToCmdLine3("smove", args...))
+	return protocol.MakeIntReply(1)
+}
+
+func undoSMove(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[0]), string(args[1]))
+}
+
+// execSMIsMember checks whether each member is in the set
+// SMISMEMBER key member [member ...]
+func execSMIsMember(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	set, errReply := db.getAsSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(args)-1)
+	for i, member := range args[1:] {
+		if set != nil && set.Has(string(member)) {
+			result[i] = protocol.MakeIntReply(1)
+		} else {
+			result[i] = protocol.MakeIntReply(0)
 		}
-		return protocol.MakeMultiBulkReply(result)
-	} else if count < 0 {
-		members := set.RandomMembers(-count)
-		result := make([][]byte, len(members))
-		for i, v := range members {
-			result[i] = []byte(v)
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
+// parseSInterCard parses `numkeys key [key ...] [LIMIT limit]`, limit 0 means no limit
+func parseSInterCard(args [][]byte) (keys []string, limit int, errReply protocol.ErrorReply) {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys <= 0 {
+		return nil, 0, protocol.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-1) {
+		return nil, 0, protocol.MakeErrReply("ERR Number of keys can't be greater than number of args")
+	}
+	keys = make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	rest := args[numKeys+1:]
+	if len(rest) == 0 {
+		return keys, 0, nil
+	}
+	if len(rest) != 2 || strings.ToUpper(string(rest[0])) != "LIMIT" {
+		return nil, 0, protocol.MakeSyntaxErrReply()
+	}
+	limit64, err := strconv.ParseInt(string(rest[1]), 10, 64)
+	if err != nil {
+		return nil, 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if limit64 < 0 {
+		return nil, 0, protocol.MakeErrReply("ERR LIMIT can't be negative")
+	}
+	return keys, int(limit64), nil
+}
+
+// execSInterCard returns the number of members in the intersection of sets
+// SINTERCARD numkeys key [key ...] [LIMIT limit]
+func execSInterCard(db *DB, args [][]byte) redis.Reply {
+	keys, limit, errReply := parseSInterCard(args)
+	if errReply != nil {
+		return errReply
+	}
+	sets := make([]*HashSet.Set, len(keys))
+	smallest := 0
+	for i, key := range keys {
+		set, errReply := db.getAsSet(key)
+		if errReply != nil {
+			return errReply
+		}
+		if set == nil {
+			return protocol.MakeIntReply(0)
+		}
+		sets[i] = set
+		if set.Len() < sets[smallest].Len() {
+			smallest = i
 		}
-		return protocol.MakeMultiBulkReply(result)
 	}
-	return &protocol.EmptyMultiBulkReply{}
+	count := 0
+	sets[smallest].ForEach(func(member string) bool {
+		for _, set := range sets {
+			if !set.Has(member) {
+				return true
+			}
+		}
+		count++
+		// stop early once limit is reached
+		return limit == 0 || count < limit
+	})
+	return protocol.MakeIntReply(int64(count))
 }
 
 func init() {
-	RegisterCommand("SAdd", execSAdd, writeFirstKey, undoSetChange, -3)
-	RegisterCommand("SIsMember", execSIsMember, readFirstKey, nil, 3)
-	RegisterCommand("SRem", execSRem, writeFirstKey, undoSetChange, -3)
-	RegisterCommand("SPop", execSPop, writeFirstKey, undoSetChange, -2)
-	RegisterCommand("SCard", execSCard, readFirstKey, nil, 2)
-	RegisterCommand("SMembers", execSMembers, readFirstKey, nil, 2)
-	RegisterCommand("SInter", execSInter, prepareSetCalculate, nil, -2)
-	RegisterCommand("SInterStore", execSInterStore, prepareSetCalculateStore, rollbackFirstKey, -3)
-	RegisterCommand("SUnion", execSUnion, prepareSetCalculate, nil, -2)
-	RegisterCommand("SUnionStore", execSUnionStore, prepareSetCalculateStore, rollbackFirstKey, -3)
-	RegisterCommand("SDiff", execSDiff, prepareSetCalculate, nil, -2)
-	RegisterCommand("SDiffStore", execSDiffStore, prepareSetCalculateStore, rollbackFirstKey, -3)
-	RegisterCommand("SRandMember", execSRandMember, readFirstKey, nil, -2)
+	RegisterCommand("SAdd", execSAdd, undoSetChange, -3)
+	RegisterCommand("SIsMember", execSIsMember, nil, 3)
+	RegisterCommand("SRem", execSRem, undoSetChange, -3)
+	RegisterCommand("SPop", execSPop, rollbackFirstKey, -2)
+	RegisterCommand("SCard", execSCard, nil, 2)
+	RegisterCommand("SMembers", execSMembers, nil, 2)
+	RegisterCommand("SInter", execSInter, nil, -2)
+	RegisterCommand("SInterStore", execSInterStore, rollbackFirstKey, -3)
+	RegisterCommand("SUnion", execSUnion, nil, -2)
+	RegisterCommand("SUnionStore", execSUnionStore, rollbackFirstKey, -3)
+	RegisterCommand("SDiff", execSDiff, nil, -2)
+	RegisterCommand("SDiffStore", execSDiffStore, rollbackFirstKey, -3)
+	RegisterCommand("SRandMember", execSRandMember, nil, -2)
+	RegisterCommand("SMove", execSMove, undoSMove, 4)
+	RegisterCommand("SMIsMember", execSMIsMember, nil, -3)
+	RegisterCommand("SInterCard", execSInterCard, nil, -3)
 }
@@ -2,6 +2,7 @@ package database
 
 import (
 	"fmt"
+	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
@@ -76,7 +77,10 @@ func TestSPop(t *testing.T) {
 	}
 
 	result := testDB.Exec(nil, utils.ToCmdLine("spop", key))
-	asserts.AssertMultiBulkReplySize(t, result, 1)
+	if _, ok := result.(*protocol.BulkReply); !ok {
+		t.Error(fmt.Sprintf("expected bulk protocol, actually %s", result.ToBytes()))
+		return
+	}
 
 	currentSize := size - 1
 	for currentSize > 0 {
@@ -249,3 +253,111 @@ func TestSRandMember(t *testing.T) {
 	result = testDB.Exec(nil, utils.ToCmdLine("SRandMember", key, "-110"))
 	asserts.AssertMultiBulkReplySize(t, result, 110)
 }
+
+func TestSPopEdge(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("spop", key))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("spop", key, "2"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key, "a", "b"))
+	result = testDB.Exec(nil, utils.ToCmdLine("spop", key, "0"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("spop", key, "-1"))
+	asserts.AssertErrReply(t, result, "ERR value is out of range, must be positive")
+	result = testDB.Exec(nil, utils.ToCmdLine("spop", key, "10"))
+	asserts.AssertMultiBulkReplySize(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("srandmember", key))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("srandmember", key, "-5"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key, "1"))
+	result = testDB.Exec(nil, utils.ToCmdLine("srandmember", key, "-3"))
+	asserts.AssertMultiBulkReply(t, result, []string{"1", "1", "1"})
+	result = testDB.Exec(nil, utils.ToCmdLine("srandmember", key, "-9223372036854775808"))
+	asserts.AssertErrReply(t, result, "ERR value is out of range")
+}
+
+func TestSMove(t *testing.T) {
+	testDB.Flush()
+	src := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", src, "a", "b"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("smove", src, dest, "a"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("smove", src, dest, "a"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("smembers", dest))
+	asserts.AssertMultiBulkReply(t, result, []string{"a"})
+	result = testDB.Exec(nil, utils.ToCmdLine("smove", src, src, "b"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("smove", src, dest, "b"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", src))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("scard", dest))
+	asserts.AssertIntReply(t, result, 2)
+
+	wrongKey := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", wrongKey, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("smove", dest, wrongKey, "a"))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	result = testDB.Exec(nil, utils.ToCmdLine("sismember", dest, "a"))
+	asserts.AssertIntReply(t, result, 1)
+
+	// rollback
+	cmdLine := utils.ToCmdLine("smove", dest, src, "a")
+	undoCmdLines := undoSMove(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("scard", dest))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", src))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestSMIsMember(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key, "a", "1"))
+	result := testDB.Exec(nil, utils.ToCmdLine("smismember", key, "a", "b", "1"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeIntReply(1),
+		protocol.MakeIntReply(0),
+		protocol.MakeIntReply(1),
+	})
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("expected %s, actually %s", expected.ToBytes(), result.ToBytes())
+	}
+}
+
+func TestSInterCard(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key1, "a", "b", "c", "d"))
+	testDB.Exec(nil, utils.ToCmdLine("sadd", key2, "b", "c", "d", "e"))
+	result := testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2, "LIMIT", "2"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2, "LIMIT", "0"))
+	asserts.AssertIntReply(t, result, 3)
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2+"1"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "3", key1, key2))
+	asserts.AssertErrReply(t, result, "ERR Number of keys can't be greater than number of args")
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "0", key1))
+	asserts.AssertErrReply(t, result, "ERR numkeys should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "2", key1, key2, "LIMIT", "-1"))
+	asserts.AssertErrReply(t, result, "ERR LIMIT can't be negative")
+	result = testDB.Exec(nil, utils.ToCmdLine("sintercard", "1", key1, "COUNT", "1"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+}
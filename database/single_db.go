@@ -36,6 +36,14 @@ type DB struct {
 	// stop all data access for execFlushDB
 	stopWorld sync.WaitGroup
 	addAof    func(CmdLine)
+
+	// commands hold read lock during execution, taking snapshot holds write lock to wait for executing commands
+	snapshotMu sync.RWMutex
+	// not nil if snapshot is being taken, protected by snapshotMu
+	snapshot *dbSnapshot
+
+	// clients waiting for keys by blocking commands
+	blockedClients keyWaiters
 }
 
 // ExecFunc is interface for command executor
@@ -115,6 +123,9 @@ func (db *DB) Exec(c redis.Connection, cmdLine [][]byte) redis.Reply {
 		EnqueueCmd(c, cmdLine)
 		return protocol.MakeQueuedReply()
 	}
+	if parseTimeout, ok := blockingTable[cmdName]; ok {
+		return db.execBlocking(c, cmdLine, parseTimeout)
+	}
 
 	return db.execNormalCommand(cmdLine)
 }
@@ -134,8 +145,7 @@ func (db *DB) execNormalCommand(cmdLine [][]byte) redis.Reply {
 	db.addVersion(write...)
 	db.RWLocks(write, read)
 	defer db.RWUnLocks(write, read)
-	fun := cmd.executor
-	return fun(db, cmdLine[1:])
+	return db.execute(cmd, write, cmdLine[1:])
 }
 
 // execWithLock executes normal commands, invoker should provide locks
@@ -148,8 +158,37 @@ func (db *DB) execWithLock(cmdLine [][]byte) redis.Reply {
 	if !validateArity(cmd.arity, cmdLine) {
 		return protocol.MakeArgNumErrReply(cmdName)
 	}
-	fun := cmd.executor
-	return fun(db, cmdLine[1:])
+	var write []string
+	if cmd.prepare != nil {
+		write, _ = cmd.prepare(cmdLine[1:])
+	}
+	return db.execute(cmd, write, cmdLine[1:])
+}
+
+// execNested executes command within executor of another command, which has provided locks and saved old values
+func (db *DB) execNested(cmdLine [][]byte) redis.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd, ok := cmdTable[cmdName]
+	if !ok {
+		return protocol.MakeErrReply("ERR unknown command '" + cmdName + "'")
+	}
+	if !validateArity(cmd.arity, cmdLine) {
+		return protocol.MakeArgNumErrReply(cmdName)
+	}
+	return cmd.executor(db, cmdLine[1:])
+}
+
+// execute runs executor of command, old values of write keys are saved if snapshot is being taken.
+// Clients blocked on write keys are woken up after execution
+func (db *DB) execute(cmd *command, writeKeys []string, args [][]byte) redis.Reply {
+	db.snapshotMu.RLock()
+	defer db.snapshotMu.RUnlock()
+	if db.snapshot != nil {
+		db.snapshot.save(db, writeKeys)
+	}
+	result := cmd.executor(db, args)
+	db.blockedClients.notify(writeKeys)
+	return result
 }
 
 func validateArity(arity int, cmdArgs [][]byte) bool {
@@ -220,6 +259,11 @@ func (db *DB) Removes(keys ...string) (deleted int) {
 
 // Flush clean database
 func (db *DB) Flush() {
+	db.snapshotMu.RLock()
+	defer db.snapshotMu.RUnlock()
+	if db.snapshot != nil {
+		db.snapshot.saveAll(db)
+	}
 	db.stopWorld.Add(1)
 	defer db.stopWorld.Done()
 
@@ -278,6 +322,31 @@ func (db *DB) Persist(key string) {
 	timewheel.Cancel(taskKey)
 }
 
+// cancelExpireTasks removes pending expiration tasks of db from the time wheel,
+// so that a closed db won't be retained by them
+func (db *DB) cancelExpireTasks() {
+	db.ttlMap.ForEach(func(key string, val interface{}) bool {
+		timewheel.Cancel(genExpireTask(key))
+		return true
+	})
+	db.data.ForEach(func(key string, val interface{}) bool {
+		entity, _ := val.(*database.DataEntity)
+		if _, ok := entity.Data.(*dict.TTLDict); ok {
+			timewheel.Cancel(genHashFieldExpireTask(key))
+		}
+		return true
+	})
+}
+
+func (db *DB) getExpiration(key string) *time.Time {
+	rawExpireTime, ok := db.ttlMap.Get(key)
+	if !ok {
+		return nil
+	}
+	expireTime, _ := rawExpireTime.(time.Time)
+	return &expireTime
+}
+
 // IsExpired check whether a key is expired
 func (db *DB) IsExpired(key string) bool {
 	rawExpireTime, ok := db.ttlMap.Get(key)
@@ -314,12 +383,6 @@ func (db *DB) GetVersion(key string) uint32 {
 func (db *DB) ForEach(cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
 	db.data.ForEach(func(key string, raw interface{}) bool {
 		entity, _ := raw.(*database.DataEntity)
-		var expiration *time.Time
-		rawExpireTime, ok := db.ttlMap.Get(key)
-		if ok {
-			expireTime, _ := rawExpireTime.(time.Time)
-			expiration = &expireTime
-		}
-		return cb(key, entity, expiration)
+		return cb(key, entity, db.getExpiration(key))
 	})
 }
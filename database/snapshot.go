@@ -0,0 +1,228 @@
+package database
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/datastruct/dict"
+	List "github.com/hdt3213/godis/datastruct/list"
+	"github.com/hdt3213/godis/datastruct/set"
+	SortedSet "github.com/hdt3213/godis/datastruct/sortedset"
+	"github.com/hdt3213/godis/interface/database"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * Snapshot provides a consistent view of dataset without stopping the world, it works like copy-on-write:
+ * after snapshot taken, the first write to a key saves a copy of its old value before executing.
+ * Reader of snapshot marks keys it has read, so writes to them do not need to copy anymore.
+ */
+
+type snapshotEntry struct {
+	entity     *database.DataEntity // nil if the key did not exist when snapshot taken
+	expiration *time.Time
+}
+
+// dbSnapshot holds old values of keys in a DB
+type dbSnapshot struct {
+	mu    sync.Mutex
+	saved map[string]*snapshotEntry
+	read  map[string]struct{} // keys read by snapshot reader
+}
+
+// save copies old values of keys before writing them, invoker should hold write locks of keys
+func (s *dbSnapshot) save(db *DB, keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := s.read[key]; ok {
+			continue
+		}
+		if _, ok := s.saved[key]; ok {
+			continue
+		}
+		entry := &snapshotEntry{}
+		raw, ok := db.data.Get(key)
+		if ok {
+			entity, _ := raw.(*database.DataEntity)
+			entry.entity = copyEntity(entity)
+			entry.expiration = db.getExpiration(key)
+		}
+		s.saved[key] = entry
+	}
+}
+
+// saveAll saves all keys before flushing db, entities are not copied because they are unreachable after flushing
+func (s *dbSnapshot) saveAll(db *DB) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db.data.ForEach(func(key string, raw interface{}) bool {
+		if _, ok := s.read[key]; ok {
+			return true
+		}
+		if _, ok := s.saved[key]; ok {
+			return true
+		}
+		entity, _ := raw.(*database.DataEntity)
+		s.saved[key] = &snapshotEntry{
+			entity:     entity,
+			expiration: db.getExpiration(key),
+		}
+		return true
+	})
+}
+
+// get returns value of key when snapshot taken, invoker should hold read lock of key
+func (s *dbSnapshot) get(db *DB, key string) (*snapshotEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.read[key]; ok {
+		return nil, false
+	}
+	s.read[key] = struct{}{}
+	if entry, ok := s.saved[key]; ok {
+		return entry, entry.entity != nil
+	}
+	raw, ok := db.data.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entity, _ := raw.(*database.DataEntity)
+	return &snapshotEntry{
+		entity:     entity,
+		expiration: db.getExpiration(key),
+	}, true
+}
+
+// unread returns saved keys which have not been read, they were removed from db after snapshot taken
+func (s *dbSnapshot) unread() map[string]*snapshotEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string]*snapshotEntry)
+	for key, entry := range s.saved {
+		if _, ok := s.read[key]; ok {
+			continue
+		}
+		s.read[key] = struct{}{}
+		if entry.entity != nil {
+			result[key] = entry
+		}
+	}
+	return result
+}
+
+var errSnapshotInProgress = errors.New("another snapshot is in progress")
+
+// Snapshot is a consistent view of MultiDB
+type Snapshot struct {
+	mdb *MultiDB
+	dbs []*dbSnapshot
+}
+
+// TakeSnapshot takes snapshot of all databases, it waits for executing commands and blocks new commands until cut returns.
+// So commands executed before cut are visible to snapshot, commands executed after it are not.
+func (mdb *MultiDB) TakeSnapshot(cut func()) (database.Snapshot, error) {
+	if !atomic.CompareAndSwapInt32(&mdb.snapshotting, 0, 1) {
+		return nil, errSnapshotInProgress
+	}
+	for _, db := range mdb.dbSet {
+		db.snapshotMu.Lock()
+	}
+	snapshot := &Snapshot{
+		mdb: mdb,
+		dbs: make([]*dbSnapshot, len(mdb.dbSet)),
+	}
+	for i, db := range mdb.dbSet {
+		snapshot.dbs[i] = &dbSnapshot{
+			saved: make(map[string]*snapshotEntry),
+			read:  make(map[string]struct{}),
+		}
+		db.snapshot = snapshot.dbs[i]
+	}
+	cut()
+	for _, db := range mdb.dbSet {
+		db.snapshotMu.Unlock()
+	}
+	return snapshot, nil
+}
+
+// ForEach traverses all the keys of given database in snapshot, every key could be traversed only once
+func (snapshot *Snapshot) ForEach(dbIndex int, cb func(key string, data *database.DataEntity, expiration *time.Time) bool) {
+	db := snapshot.mdb.selectDB(dbIndex)
+	s := snapshot.dbs[dbIndex]
+	for _, key := range db.data.Keys() {
+		keys := []string{key}
+		db.RWLocks(nil, keys)
+		entry, ok := s.get(db, key)
+		goOn := true
+		if ok {
+			goOn = cb(key, entry.entity, entry.expiration)
+		}
+		db.RWUnLocks(nil, keys)
+		if !goOn {
+			return
+		}
+	}
+	for key, entry := range s.unread() {
+		if !cb(key, entry.entity, entry.expiration) {
+			return
+		}
+	}
+}
+
+// GetDBSize returns keys count and ttl key count of live database
+func (snapshot *Snapshot) GetDBSize(dbIndex int) (int, int) {
+	return snapshot.mdb.GetDBSize(dbIndex)
+}
+
+// Release stops copy-on-write
+func (snapshot *Snapshot) Release() {
+	for _, db := range snapshot.mdb.dbSet {
+		db.snapshotMu.Lock()
+		db.snapshot = nil
+		db.snapshotMu.Unlock()
+	}
+	atomic.StoreInt32(&snapshot.mdb.snapshotting, 0)
+}
+
+func copyEntity(entity *database.DataEntity) *database.DataEntity {
+	switch val := entity.Data.(type) {
+	case []byte:
+		// string could be modified in place, e.g. setrange
+		return &database.DataEntity{Data: append([]byte{}, val...)}
+	case List.List:
+		list := List.NewQuickList()
+		val.ForEach(func(i int, v interface{}) bool {
+			list.Add(v)
+			return true
+		})
+		return &database.DataEntity{Data: list}
+	case *dict.TTLDict:
+		hash := dict.MakeTTL(dict.MakeSimple())
+		val.ForEach(func(field string, v interface{}) bool {
+			hash.Put(field, v)
+			if expireAt, ok := val.ExpireTime(field); ok {
+				hash.Expire(field, expireAt)
+			}
+			return true
+		})
+		return &database.DataEntity{Data: hash}
+	case dict.Dict:
+		hash := dict.MakeSimple()
+		val.ForEach(func(field string, v interface{}) bool {
+			hash.Put(field, v)
+			return true
+		})
+		return &database.DataEntity{Data: hash}
+	case *set.Set:
+		return &database.DataEntity{Data: set.Make(val.ToSlice()...)}
+	case *SortedSet.SortedSet:
+		zSet := SortedSet.Make()
+		val.ForEach(0, val.Len(), false, func(element *SortedSet.Element) bool {
+			zSet.Add(element.Member, element.Score)
+			return true
+		})
+		return &database.DataEntity{Data: zSet}
+	}
+	return entity
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"bytes"
+	"github.com/hdt3213/godis/aof"
+	"github.com/hdt3213/godis/interface/database"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	mdb := NewStandaloneServer()
+	defer mdb.Close()
+	conn := &connection.FakeConn{}
+	mdb.Exec(conn, utils.ToCmdLine("SET", "str", "a"))
+	mdb.Exec(conn, utils.ToCmdLine("RPUSH", "list", "a", "b"))
+	mdb.Exec(conn, utils.ToCmdLine("HSET", "hash", "f", "a"))
+	mdb.Exec(conn, utils.ToCmdLine("SADD", "set", "a"))
+	mdb.Exec(conn, utils.ToCmdLine("ZADD", "zset", "1", "a"))
+	mdb.Exec(conn, utils.ToCmdLine("SET", "ttl", "a", "EX", "1000"))
+	mdb.Exec(conn, utils.ToCmdLine("SET", "unchanged", "a"))
+	conn1 := &connection.FakeConn{}
+	conn1.SelectDB(1)
+	mdb.Exec(conn1, utils.ToCmdLine("SET", "flushed", "a"))
+
+	cutCalled := false
+	snapshot, err := mdb.TakeSnapshot(func() {
+		cutCalled = true
+	})
+	if err != nil || !cutCalled {
+		t.Errorf("take snapshot failed: %v", err)
+		return
+	}
+	if _, err := mdb.TakeSnapshot(func() {}); err == nil {
+		t.Error("expect error when taking another snapshot")
+	}
+
+	// modify in place after snapshot taken
+	mdb.Exec(conn, utils.ToCmdLine("APPEND", "str", "b"))
+	mdb.Exec(conn, utils.ToCmdLine("RPUSH", "list", "c"))
+	mdb.Exec(conn, utils.ToCmdLine("HSET", "hash", "f", "b"))
+	mdb.Exec(conn, utils.ToCmdLine("SADD", "set", "b"))
+	mdb.Exec(conn, utils.ToCmdLine("ZADD", "zset", "2", "b"))
+	mdb.Exec(conn, utils.ToCmdLine("PERSIST", "ttl"))
+	mdb.Exec(conn, utils.ToCmdLine("SET", "new", "a"))
+	mdb.Exec(conn1, utils.ToCmdLine("FLUSHDB"))
+	mdb.Exec(conn1, utils.ToCmdLine("SET", "new", "a"))
+
+	dump := func(dbIndex int) map[string]string {
+		result := make(map[string]string)
+		snapshot.ForEach(dbIndex, func(key string, data *database.DataEntity, expiration *time.Time) bool {
+			value := string(bytes.Join(aof.EntityToCmd(key, data).Args, []byte(" ")))
+			if expiration != nil {
+				value += " ttl"
+			}
+			result[key] = value
+			return true
+		})
+		return result
+	}
+	db0 := dump(0)
+	expected := map[string]string{
+		"str":       "SET str a",
+		"list":      "RPUSH list a b",
+		"hash":      "HMSET hash f a",
+		"set":       "SADD set a",
+		"zset":      "ZADD zset 1 a",
+		"ttl":       "SET ttl a ttl",
+		"unchanged": "SET unchanged a",
+	}
+	if len(db0) != len(expected) {
+		t.Errorf("unexpected snapshot: %v", db0)
+	}
+	for key, value := range expected {
+		if db0[key] != value {
+			t.Errorf("expect %s of key %s, got %s", value, key, db0[key])
+		}
+	}
+	db1 := dump(1)
+	if len(db1) != 1 || db1["flushed"] != "SET flushed a" {
+		t.Errorf("unexpected snapshot: %v", db1)
+	}
+	snapshot.Release()
+
+	// live data is not affected
+	asserts.AssertBulkReply(t, mdb.Exec(conn, utils.ToCmdLine("GET", "str")), "ab")
+	asserts.AssertIntReply(t, mdb.Exec(conn, utils.ToCmdLine("LLEN", "list")), 3)
+	snapshot, err = mdb.TakeSnapshot(func() {})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	snapshot.Release()
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -38,51 +39,148 @@ func (db *DB) getOrInitSortedSet(key string) (sortedSet *SortedSet.SortedSet, in
 	return sortedSet, inited, nil
 }
 
-// execZAdd adds member into sorted set
-func execZAdd(db *DB, args [][]byte) redis.Reply {
-	if len(args)%2 != 1 {
-		return protocol.MakeSyntaxErrReply()
+// zAddOption is flags of ZADD
+type zAddOption struct {
+	nx   bool // only add new members
+	xx   bool // only update existing members
+	gt   bool // only update existing members if new score is greater
+	lt   bool // only update existing members if new score is less
+	ch   bool // return number of added and updated members
+	incr bool // increase score like ZINCRBY
+}
+
+// parseZAdd parses `key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]`
+func parseZAdd(args [][]byte) (*zAddOption, []*SortedSet.Element, protocol.ErrorReply) {
+	opt := &zAddOption{}
+	i := 1
+parseFlags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			opt.nx = true
+		case "XX":
+			opt.xx = true
+		case "GT":
+			opt.gt = true
+		case "LT":
+			opt.lt = true
+		case "CH":
+			opt.ch = true
+		case "INCR":
+			opt.incr = true
+		default:
+			break parseFlags
+		}
 	}
-	key := string(args[0])
-	size := (len(args) - 1) / 2
+	if opt.nx && opt.xx {
+		return nil, nil, protocol.MakeErrReply("ERR XX and NX options at the same time are not compatible")
+	}
+	if (opt.gt && opt.lt) || (opt.nx && (opt.gt || opt.lt)) {
+		return nil, nil, protocol.MakeErrReply("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, nil, protocol.MakeSyntaxErrReply()
+	}
+	if opt.incr && len(pairs) != 2 {
+		return nil, nil, protocol.MakeErrReply("ERR INCR option supports a single increment-element pair")
+	}
+	size := len(pairs) / 2
 	elements := make([]*SortedSet.Element, size)
 	for i := 0; i < size; i++ {
-		scoreValue := args[2*i+1]
-		member := string(args[2*i+2])
+		scoreValue := pairs[2*i]
+		member := string(pairs[2*i+1])
 		score, err := strconv.ParseFloat(string(scoreValue), 64)
-		if err != nil {
-			return protocol.MakeErrReply("ERR value is not a valid float")
+		if err != nil || math.IsNaN(score) {
+			return nil, nil, protocol.MakeErrReply("ERR value is not a valid float")
 		}
 		elements[i] = &SortedSet.Element{
 			Member: member,
 			Score:  score,
 		}
 	}
+	return opt, elements, nil
+}
 
-	// get or init entity
-	sortedSet, _, errReply := db.getOrInitSortedSet(key)
+// execZAdd adds member into sorted set
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func execZAdd(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	opt, elements, errReply := parseZAdd(args)
 	if errReply != nil {
 		return errReply
 	}
 
-	i := 0
+	// get entity, it won't be created if no member is added
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+
+	var added, updated int64
+	var incrResult *float64
 	for _, e := range elements {
-		if sortedSet.Add(e.Member, e.Score) {
-			i++
+		var current *SortedSet.Element
+		exists := false
+		if sortedSet != nil {
+			current, exists = sortedSet.Get(e.Member)
+		}
+		if (exists && opt.nx) || (!exists && opt.xx) {
+			continue
+		}
+		score := e.Score
+		if opt.incr && exists {
+			score += current.Score
+			if math.IsNaN(score) {
+				return protocol.MakeErrReply("ERR resulting score is not a number (NaN)")
+			}
 		}
+		if exists {
+			if (opt.gt && score <= current.Score) || (opt.lt && score >= current.Score) {
+				continue
+			}
+			if score != current.Score {
+				sortedSet.Add(e.Member, score)
+				updated++
+			}
+		} else {
+			if sortedSet == nil {
+				sortedSet = SortedSet.Make()
+				db.PutEntity(key, &database.DataEntity{
+					Data: sortedSet,
+				})
+			}
+			sortedSet.Add(e.Member, score)
+			added++
+		}
+		incrResult = &score
 	}
 
-	db.addAof(utils.ToCmdLine3("zadd", args...))
-
-	return protocol.MakeIntReply(int64(i))
+	if added+updated > 0 {
+		db.addAof(utils.ToCmdLine3("zadd", args...))
+	}
+	if opt.incr {
+		if incrResult == nil {
+			// the member is skipped by NX, XX, GT or LT
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply([]byte(strconv.FormatFloat(*incrResult, 'f', -1, 64)))
+	}
+	if opt.ch {
+		return protocol.MakeIntReply(added + updated)
+	}
+	return protocol.MakeIntReply(added)
 }
 
 func undoZAdd(db *DB, args [][]byte) []CmdLine {
 	key := string(args[0])
-	size := (len(args) - 1) / 2
-	fields := make([]string, size)
-	for i := 0; i < size; i++ {
-		fields[i] = string(args[2*i+2])
+	_, elements, errReply := parseZAdd(args)
+	if errReply != nil {
+		return nil
+	}
+	fields := make([]string, len(elements))
+	for i, e := range elements {
+		fields[i] = e.Member
 	}
 	return rollbackZSetFields(db, key, fields...)
 }
@@ -170,31 +268,6 @@ func execZCard(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(sortedSet.Len())
 }
 
-// execZRange gets members in range, sort by score in ascending order
-func execZRange(db *DB, args [][]byte) redis.Reply {
-	// parse args
-	if len(args) != 3 && len(args) != 4 {
-		return protocol.MakeErrReply("ERR wrong number of arguments for 'zrange' command")
-	}
-	withScores := false
-	if len(args) == 4 {
-		if strings.ToUpper(string(args[3])) != "WITHSCORES" {
-			return protocol.MakeErrReply("syntax error")
-		}
-		withScores = true
-	}
-	key := string(args[0])
-	start, err := strconv.ParseInt(string(args[1]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
-	}
-	stop, err := strconv.ParseInt(string(args[2]), 10, 64)
-	if err != nil {
-		return protocol.MakeErrReply("ERR value is not an integer or out of range")
-	}
-	return range0(db, key, start, stop, withScores, false)
-}
-
 // execZRevRange gets members in range, sort by score in descending order
 func execZRevRange(db *DB, args [][]byte) redis.Reply {
 	// parse args
@@ -590,19 +663,710 @@ func undoZIncr(db *DB, args [][]byte) []CmdLine {
 	return rollbackZSetFields(db, key, field)
 }
 
+// zRangeOption is parsed arguments of ZRANGE and ZRANGESTORE
+type zRangeOption struct {
+	byScore    bool
+	byLex      bool
+	rev        bool
+	withScores bool
+	start      int64 // start and stop are used for range by rank
+	stop       int64
+	min        SortedSet.Border // min and max are used for range by score or lex
+	max        SortedSet.Border
+	offset     int64
+	limit      int64 // limit < 0 means no limit
+	hasLimit   bool
+}
+
+// parseZRangeOption parses `start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]`
+func parseZRangeOption(args [][]byte, allowWithScores bool) (*zRangeOption, protocol.ErrorReply) {
+	opt := &zRangeOption{
+		limit: -1,
+	}
+	var err error
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "BYSCORE":
+			opt.byScore = true
+		case "BYLEX":
+			opt.byLex = true
+		case "REV":
+			opt.rev = true
+		case "WITHSCORES":
+			if !allowWithScores {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			opt.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return nil, protocol.MakeSyntaxErrReply()
+			}
+			opt.offset, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			opt.limit, err = strconv.ParseInt(string(args[i+2]), 10, 64)
+			if err != nil {
+				return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			opt.hasLimit = true
+			i += 2
+		default:
+			return nil, protocol.MakeSyntaxErrReply()
+		}
+	}
+	if opt.byScore && opt.byLex {
+		return nil, protocol.MakeSyntaxErrReply()
+	}
+	if opt.hasLimit && !opt.byScore && !opt.byLex {
+		return nil, protocol.MakeErrReply("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if opt.withScores && opt.byLex {
+		return nil, protocol.MakeErrReply("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	// borders are given in reversed order if REV is set
+	minArg, maxArg := string(args[0]), string(args[1])
+	if opt.rev {
+		minArg, maxArg = maxArg, minArg
+	}
+	if opt.byScore {
+		opt.min, err = SortedSet.ParseScoreBorder(minArg)
+		if err != nil {
+			return nil, protocol.MakeErrReply(err.Error())
+		}
+		opt.max, err = SortedSet.ParseScoreBorder(maxArg)
+		if err != nil {
+			return nil, protocol.MakeErrReply(err.Error())
+		}
+	} else if opt.byLex {
+		opt.min, err = SortedSet.ParseLexBorder(minArg)
+		if err != nil {
+			return nil, protocol.MakeErrReply(err.Error())
+		}
+		opt.max, err = SortedSet.ParseLexBorder(maxArg)
+		if err != nil {
+			return nil, protocol.MakeErrReply(err.Error())
+		}
+	} else {
+		opt.start, err = strconv.ParseInt(string(args[0]), 10, 64)
+		if err != nil {
+			return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		opt.stop, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+	}
+	return opt, nil
+}
+
+// rangeWithOption returns elements of sorted set selected by opt
+func rangeWithOption(sortedSet *SortedSet.SortedSet, opt *zRangeOption) []*SortedSet.Element {
+	if opt.byScore || opt.byLex {
+		return sortedSet.RangeByBorder(opt.min, opt.max, opt.offset, opt.limit, opt.rev)
+	}
+	// compute index
+	start, stop := opt.start, opt.stop
+	size := sortedSet.Len() // assert: size > 0
+	if start < -1*size {
+		start = 0
+	} else if start < 0 {
+		start = size + start
+	} else if start >= size {
+		return nil
+	}
+	if stop < -1*size {
+		stop = 0
+	} else if stop < 0 {
+		stop = size + stop + 1
+	} else if stop < size {
+		stop = stop + 1
+	} else {
+		stop = size
+	}
+	if stop < start {
+		stop = start
+	}
+	return sortedSet.Range(start, stop, opt.rev)
+}
+
+// elementsToReply converts elements to multi bulk reply, scores are placed after members if withScores is set
+func elementsToReply(slice []*SortedSet.Element, withScores bool) redis.Reply {
+	result := make([][]byte, 0, len(slice)*2)
+	for _, element := range slice {
+		result = append(result, []byte(element.Member))
+		if withScores {
+			result = append(result, []byte(strconv.FormatFloat(element.Score, 'f', -1, 64)))
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// execZRange gets members in range
+// ZRANGE key start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func execZRange(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	opt, errReply := parseZRangeOption(args[1:], true)
+	if errReply != nil {
+		return errReply
+	}
+
+	// get data
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	return elementsToReply(rangeWithOption(sortedSet, opt), opt.withScores)
+}
+
+// execZRangeStore stores members in range into destination
+// ZRANGESTORE dst src min max [BYSCORE|BYLEX] [REV] [LIMIT offset count]
+func execZRangeStore(db *DB, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	key := string(args[1])
+	opt, errReply := parseZRangeOption(args[2:], false)
+	if errReply != nil {
+		return errReply
+	}
+
+	// get data
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	var slice []*SortedSet.Element
+	if sortedSet != nil {
+		slice = rangeWithOption(sortedSet, opt)
+	}
+
+	db.Remove(dest) // clean ttl and old value
+	if len(slice) > 0 {
+		result := SortedSet.Make()
+		for _, element := range slice {
+			result.Add(element.Member, element.Score)
+		}
+		db.PutEntity(dest, &database.DataEntity{
+			Data: result,
+		})
+	}
+	db.addAof(utils.ToCmdLine3("zrangestore", args...))
+	return protocol.MakeIntReply(int64(len(slice)))
+}
+
+// parseLexRange parses `min max` of lex commands
+func parseLexRange(minArg []byte, maxArg []byte) (min *SortedSet.LexBorder, max *SortedSet.LexBorder, errReply protocol.ErrorReply) {
+	min, err := SortedSet.ParseLexBorder(string(minArg))
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply(err.Error())
+	}
+	max, err = SortedSet.ParseLexBorder(string(maxArg))
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply(err.Error())
+	}
+	return min, max, nil
+}
+
+// rangeByLex0 implements ZRANGEBYLEX and ZREVRANGEBYLEX, args format: key first last [LIMIT offset count]
+func rangeByLex0(db *DB, args [][]byte, desc bool) redis.Reply {
+	key := string(args[0])
+	var min, max *SortedSet.LexBorder
+	var errReply protocol.ErrorReply
+	if desc {
+		min, max, errReply = parseLexRange(args[2], args[1])
+	} else {
+		min, max, errReply = parseLexRange(args[1], args[2])
+	}
+	if errReply != nil {
+		return errReply
+	}
+	var offset int64 = 0
+	var limit int64 = -1
+	if len(args) > 3 {
+		if len(args) != 6 || strings.ToUpper(string(args[3])) != "LIMIT" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		var err error
+		offset, err = strconv.ParseInt(string(args[4]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		limit, err = strconv.ParseInt(string(args[5]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+	}
+
+	// get data
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	return elementsToReply(sortedSet.RangeByBorder(min, max, offset, limit, desc), false)
+}
+
+// execZRangeByLex gets members within given lex range, in ascending order
+// ZRANGEBYLEX key min max [LIMIT offset count]
+func execZRangeByLex(db *DB, args [][]byte) redis.Reply {
+	return rangeByLex0(db, args, false)
+}
+
+// execZRevRangeByLex gets members within given lex range, in descending order
+// ZREVRANGEBYLEX key max min [LIMIT offset count]
+func execZRevRangeByLex(db *DB, args [][]byte) redis.Reply {
+	return rangeByLex0(db, args, true)
+}
+
+// execZLexCount gets number of members within given lex range
+func execZLexCount(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	min, max, errReply := parseLexRange(args[1], args[2])
+	if errReply != nil {
+		return errReply
+	}
+
+	// get data
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return protocol.MakeIntReply(0)
+	}
+	return protocol.MakeIntReply(sortedSet.RangeCount(min, max))
+}
+
+// execZRemRangeByLex removes members within given lex range
+func execZRemRangeByLex(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	min, max, errReply := parseLexRange(args[1], args[2])
+	if errReply != nil {
+		return errReply
+	}
+
+	// get data
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil {
+		return protocol.MakeIntReply(0)
+	}
+
+	removed := sortedSet.RemoveByBorder(min, max)
+	if sortedSet.Len() == 0 {
+		db.Remove(key)
+	}
+	if removed > 0 {
+		db.addAof(utils.ToCmdLine3("zremrangebylex", args...))
+	}
+	return protocol.MakeIntReply(removed)
+}
+
+// computeZSetOperation computes union, intersection or difference of sorted sets, cmdName decides the operation
+// args: numkeys key [key ...] [options]
+// sorted sets of keys in remote are given by other nodes in cluster mode, nil set represents a not existed key
+func computeZSetOperation(db *DB, cmdName string, args [][]byte, allowWithScores bool,
+	remote map[string]*SortedSet.SortedSet) (*SortedSet.SortedSet, *SortedSet.OperationOption, protocol.ErrorReply) {
+	isDiff := strings.HasPrefix(cmdName, "zdiff")
+	opt, err := SortedSet.ParseOperationOption(cmdName, args, !isDiff, allowWithScores, false)
+	if err != nil {
+		return nil, nil, protocol.MakeErrReply(err.Error())
+	}
+	sets := make([]*SortedSet.SortedSet, len(opt.Keys))
+	for i, key := range opt.Keys {
+		if sortedSet, ok := remote[key]; ok {
+			sets[i] = sortedSet
+			continue
+		}
+		sortedSet, errReply := db.getAsSortedSet(key)
+		if errReply != nil {
+			return nil, nil, errReply
+		}
+		sets[i] = sortedSet
+	}
+	switch {
+	case strings.HasPrefix(cmdName, "zunion"):
+		return SortedSet.Union(sets, opt.Weights, opt.Aggregate), opt, nil
+	case strings.HasPrefix(cmdName, "zinter"):
+		return SortedSet.Intersect(sets, opt.Weights, opt.Aggregate), opt, nil
+	default:
+		return SortedSet.Diff(sets), opt, nil
+	}
+}
+
+func zSetOperation0(db *DB, cmdName string, args [][]byte) redis.Reply {
+	result, opt, errReply := computeZSetOperation(db, cmdName, args, true, nil)
+	if errReply != nil {
+		return errReply
+	}
+	if result.Len() == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	return elementsToReply(result.Range(0, result.Len(), false), opt.WithScores)
+}
+
+func zSetOperationStore0(db *DB, cmdName string, args [][]byte) redis.Reply {
+	dest := string(args[0])
+	result, _, errReply := computeZSetOperation(db, cmdName, args[1:], false, nil)
+	if errReply != nil {
+		return errReply
+	}
+	db.Remove(dest) // clean ttl and old value
+	if result.Len() > 0 {
+		db.PutEntity(dest, &database.DataEntity{
+			Data: result,
+		})
+	}
+	db.addAof(utils.ToCmdLine3(cmdName, args...))
+	return protocol.MakeIntReply(result.Len())
+}
+
+// execZUnion returns union of sorted sets
+// ZUNION numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+func execZUnion(db *DB, args [][]byte) redis.Reply {
+	return zSetOperation0(db, "zunion", args)
+}
+
+// execZInter returns intersection of sorted sets
+// ZINTER numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+func execZInter(db *DB, args [][]byte) redis.Reply {
+	return zSetOperation0(db, "zinter", args)
+}
+
+// execZDiff returns members of the first sorted set which not exist in the others
+// ZDIFF numkeys key [key ...] [WITHSCORES]
+func execZDiff(db *DB, args [][]byte) redis.Reply {
+	return zSetOperation0(db, "zdiff", args)
+}
+
+// execZUnionStore stores union of sorted sets into destination
+// ZUNIONSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+func execZUnionStore(db *DB, args [][]byte) redis.Reply {
+	return zSetOperationStore0(db, "zunionstore", args)
+}
+
+// execZInterStore stores intersection of sorted sets into destination
+// ZINTERSTORE destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+func execZInterStore(db *DB, args [][]byte) redis.Reply {
+	return zSetOperationStore0(db, "zinterstore", args)
+}
+
+// execZDiffStore stores difference of sorted sets into destination
+// ZDIFFSTORE destination numkeys key [key ...]
+func execZDiffStore(db *DB, args [][]byte) redis.Reply {
+	return zSetOperationStore0(db, "zdiffstore", args)
+}
+
+// execZInterCard returns size of intersection of sorted sets
+// ZINTERCARD numkeys key [key ...] [LIMIT limit]
+func execZInterCard(db *DB, args [][]byte) redis.Reply {
+	opt, err := SortedSet.ParseOperationOption("zintercard", args, false, false, true)
+	if err != nil {
+		return protocol.MakeErrReply(err.Error())
+	}
+	sets := make([]*SortedSet.SortedSet, len(opt.Keys))
+	for i, key := range opt.Keys {
+		sortedSet, errReply := db.getAsSortedSet(key)
+		if errReply != nil {
+			return errReply
+		}
+		sets[i] = sortedSet
+	}
+	card := SortedSet.Intersect(sets, nil, SortedSet.AggregateSum).Len()
+	if opt.Limit > 0 && card > opt.Limit {
+		card = opt.Limit
+	}
+	return protocol.MakeIntReply(card)
+}
+
+// zPop0 pops at most count members with the lowest or highest scores, it removes the key if it becomes empty
+func zPop0(db *DB, key string, sortedSet *SortedSet.SortedSet, count int, max bool) []*SortedSet.Element {
+	var popped []*SortedSet.Element
+	cmdName := "zpopmin"
+	if max {
+		popped = sortedSet.PopMax(count)
+		cmdName = "zpopmax"
+	} else {
+		popped = sortedSet.PopMin(count)
+	}
+	if sortedSet.Len() == 0 {
+		db.Remove(key)
+	}
+	if len(popped) > 0 {
+		db.addAof(utils.ToCmdLine(cmdName, key, strconv.Itoa(len(popped))))
+	}
+	return popped
+}
+
+func execZPop(db *DB, args [][]byte, max bool) redis.Reply {
+	cmdName := "zpopmin"
+	if max {
+		cmdName = "zpopmax"
+	}
+	count, _, errReply := parsePopCount(cmdName, args)
+	if errReply != nil {
+		return errReply
+	}
+	key := string(args[0])
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if sortedSet == nil || count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	return elementsToReply(zPop0(db, key, sortedSet, count, max), true)
+}
+
+// execZPopMin removes and returns members with the lowest scores
+// ZPOPMIN key [count]
+func execZPopMin(db *DB, args [][]byte) redis.Reply {
+	return execZPop(db, args, false)
+}
+
+// execZPopMax removes and returns members with the highest scores
+// ZPOPMAX key [count]
+func execZPopMax(db *DB, args [][]byte) redis.Reply {
+	return execZPop(db, args, true)
+}
+
+// parseZMPop parses `numkeys key [key ...] MIN|MAX [COUNT count]`
+func parseZMPop(args [][]byte) (keys []string, max bool, count int, errReply protocol.ErrorReply) {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, false, 0, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if numKeys <= 0 {
+		return nil, false, 0, protocol.MakeErrReply("ERR numkeys should be greater than 0")
+	}
+	if numKeys > int64(len(args)-2) {
+		return nil, false, 0, protocol.MakeSyntaxErrReply()
+	}
+	keys = make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	rest := args[numKeys+1:]
+	switch strings.ToUpper(string(rest[0])) {
+	case "MIN":
+		max = false
+	case "MAX":
+		max = true
+	default:
+		return nil, false, 0, protocol.MakeSyntaxErrReply()
+	}
+	count = 1
+	if len(rest) == 3 && strings.ToUpper(string(rest[1])) == "COUNT" {
+		count64, err := strconv.ParseInt(string(rest[2]), 10, 64)
+		if err != nil || count64 <= 0 {
+			return nil, false, 0, protocol.MakeErrReply("ERR count should be greater than 0")
+		}
+		count = int(count64)
+	} else if len(rest) != 1 {
+		return nil, false, 0, protocol.MakeSyntaxErrReply()
+	}
+	return keys, max, count, nil
+}
+
+// zMPop0 pops from the first non-empty sorted set in keys, returns nil if all of them are empty
+func zMPop0(db *DB, keys []string, max bool, count int) (string, []*SortedSet.Element, protocol.ErrorReply) {
+	for _, key := range keys {
+		sortedSet, errReply := db.getAsSortedSet(key)
+		if errReply != nil {
+			return "", nil, errReply
+		}
+		if sortedSet == nil {
+			continue
+		}
+		return key, zPop0(db, key, sortedSet, count, max), nil
+	}
+	return "", nil, nil
+}
+
+// execZMPop pops members from the first non-empty sorted set in given keys
+// ZMPOP numkeys key [key ...] MIN|MAX [COUNT count]
+func execZMPop(db *DB, args [][]byte) redis.Reply {
+	keys, max, count, errReply := parseZMPop(args)
+	if errReply != nil {
+		return errReply
+	}
+	key, popped, errReply := zMPop0(db, keys, max, count)
+	if errReply != nil {
+		return errReply
+	}
+	if popped == nil {
+		return &protocol.NullBulkReply{}
+	}
+	elements := make([]redis.Reply, len(popped))
+	for i, element := range popped {
+		elements[i] = protocol.MakeMultiBulkReply([][]byte{
+			[]byte(element.Member),
+			[]byte(strconv.FormatFloat(element.Score, 'f', -1, 64)),
+		})
+	}
+	return protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(key)),
+		protocol.MakeMultiRawReply(elements),
+	})
+}
+
+func undoZMPop(db *DB, args [][]byte) []CmdLine {
+	keys, _ := cmdTable["zmpop"].prepare(args)
+	return rollbackGivenKeys(db, keys...)
+}
+
+func execBZPop(db *DB, args [][]byte, max bool) redis.Reply {
+	keys, _ := cmdTable["bzpopmin"].prepare(args)
+	key, popped, errReply := zMPop0(db, keys, max, 1)
+	if errReply != nil {
+		return errReply
+	}
+	if popped == nil {
+		return &protocol.NullBulkReply{}
+	}
+	return protocol.MakeMultiBulkReply([][]byte{
+		[]byte(key),
+		[]byte(popped[0].Member),
+		[]byte(strconv.FormatFloat(popped[0].Score, 'f', -1, 64)),
+	})
+}
+
+// execBZPopMin pops member with the lowest score from the first non-empty sorted set, it blocks until timeout if all sets are empty
+// BZPOPMIN key [key ...] timeout
+func execBZPopMin(db *DB, args [][]byte) redis.Reply {
+	return execBZPop(db, args, false)
+}
+
+// execBZPopMax pops member with the highest score from the first non-empty sorted set, it blocks until timeout if all sets are empty
+// BZPOPMAX key [key ...] timeout
+func execBZPopMax(db *DB, args [][]byte) redis.Reply {
+	return execBZPop(db, args, true)
+}
+
+func undoBZPop(db *DB, args [][]byte) []CmdLine {
+	keys, _ := cmdTable["bzpopmin"].prepare(args)
+	return rollbackGivenKeys(db, keys...)
+}
+
+// execBZMPop is the blocking version of ZMPOP
+// BZMPOP timeout numkeys key [key ...] MIN|MAX [COUNT count]
+func execBZMPop(db *DB, args [][]byte) redis.Reply {
+	return execZMPop(db, args[1:])
+}
+
+func undoBZMPop(db *DB, args [][]byte) []CmdLine {
+	return undoZMPop(db, args[1:])
+}
+
+// execZRandMember returns random members of sorted set
+// ZRANDMEMBER key [count [WITHSCORES]]
+func execZRandMember(db *DB, args [][]byte) redis.Reply {
+	if len(args) > 3 {
+		return protocol.MakeArgNumErrReply("zrandmember")
+	}
+	key := string(args[0])
+	withScores := false
+	if len(args) == 3 {
+		if strings.ToUpper(string(args[2])) != "WITHSCORES" {
+			return protocol.MakeSyntaxErrReply()
+		}
+		withScores = true
+	}
+	count := 0
+	if len(args) >= 2 {
+		count64, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return protocol.MakeErrReply("ERR value is not an integer or out of range")
+		}
+		count = int(count64)
+	}
+
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	if len(args) == 1 {
+		if sortedSet == nil {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply([]byte(sortedSet.RandomMembers(1)[0].Member))
+	}
+	if sortedSet == nil || count == 0 {
+		return &protocol.EmptyMultiBulkReply{}
+	}
+	if count > 0 {
+		return elementsToReply(sortedSet.RandomDistinctMembers(count), withScores)
+	}
+	return elementsToReply(sortedSet.RandomMembers(-count), withScores)
+}
+
+// execZMScore returns scores of members, nil for members not existed
+// ZMSCORE key member [member ...]
+func execZMScore(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	sortedSet, errReply := db.getAsSortedSet(key)
+	if errReply != nil {
+		return errReply
+	}
+	result := make([]redis.Reply, len(args)-1)
+	for i, member := range args[1:] {
+		var element *SortedSet.Element
+		exists := false
+		if sortedSet != nil {
+			element, exists = sortedSet.Get(string(member))
+		}
+		if !exists {
+			result[i] = &protocol.NullBulkReply{}
+			continue
+		}
+		result[i] = protocol.MakeBulkReply([]byte(strconv.FormatFloat(element.Score, 'f', -1, 64)))
+	}
+	return protocol.MakeMultiRawReply(result)
+}
+
 func init() {
-	RegisterCommand("ZAdd", execZAdd, writeFirstKey, undoZAdd, -4)
-	RegisterCommand("ZScore", execZScore, readFirstKey, nil, 3)
-	RegisterCommand("ZIncrBy", execZIncrBy, writeFirstKey, undoZIncr, 4)
-	RegisterCommand("ZRank", execZRank, readFirstKey, nil, 3)
-	RegisterCommand("ZCount", execZCount, readFirstKey, nil, 4)
-	RegisterCommand("ZRevRank", execZRevRank, readFirstKey, nil, 3)
-	RegisterCommand("ZCard", execZCard, readFirstKey, nil, 2)
-	RegisterCommand("ZRange", execZRange, readFirstKey, nil, -4)
-	RegisterCommand("ZRangeByScore", execZRangeByScore, readFirstKey, nil, -4)
-	RegisterCommand("ZRevRange", execZRevRange, readFirstKey, nil, -4)
-	RegisterCommand("ZRevRangeByScore", execZRevRangeByScore, readFirstKey, nil, -4)
-	RegisterCommand("ZRem", execZRem, writeFirstKey, undoZRem, -3)
-	RegisterCommand("ZRemRangeByScore", execZRemRangeByScore, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("ZRemRangeByRank", execZRemRangeByRank, writeFirstKey, rollbackFirstKey, 4)
+	RegisterCommand("ZAdd", execZAdd, undoZAdd, -4)
+	RegisterCommand("ZScore", execZScore, nil, 3)
+	RegisterCommand("ZIncrBy", execZIncrBy, undoZIncr, 4)
+	RegisterCommand("ZRank", execZRank, nil, 3)
+	RegisterCommand("ZCount", execZCount, nil, 4)
+	RegisterCommand("ZRevRank", execZRevRank, nil, 3)
+	RegisterCommand("ZCard", execZCard, nil, 2)
+	RegisterCommand("ZRange", execZRange, nil, -4)
+	RegisterCommand("ZRangeByScore", execZRangeByScore, nil, -4)
+	RegisterCommand("ZRevRange", execZRevRange, nil, -4)
+	RegisterCommand("ZRevRangeByScore", execZRevRangeByScore, nil, -4)
+	RegisterCommand("ZRem", execZRem, undoZRem, -3)
+	RegisterCommand("ZRemRangeByScore", execZRemRangeByScore, rollbackFirstKey, 4)
+	RegisterCommand("ZRemRangeByRank", execZRemRangeByRank, rollbackFirstKey, 4)
+	RegisterCommand("ZRangeByLex", execZRangeByLex, nil, -4)
+	RegisterCommand("ZRevRangeByLex", execZRevRangeByLex, nil, -4)
+	RegisterCommand("ZLexCount", execZLexCount, nil, 4)
+	RegisterCommand("ZRemRangeByLex", execZRemRangeByLex, rollbackFirstKey, 4)
+	RegisterCommand("ZRangeStore", execZRangeStore, rollbackFirstKey, -5)
+	RegisterCommand("ZUnion", execZUnion, nil, -3)
+	RegisterCommand("ZInter", execZInter, nil, -3)
+	RegisterCommand("ZDiff", execZDiff, nil, -3)
+	RegisterCommand("ZUnionStore", execZUnionStore, rollbackFirstKey, -4)
+	RegisterCommand("ZInterStore", execZInterStore, rollbackFirstKey, -4)
+	RegisterCommand("ZDiffStore", execZDiffStore, rollbackFirstKey, -4)
+	RegisterCommand("ZInterCard", execZInterCard, nil, -3)
+	RegisterCommand("ZPopMin", execZPopMin, rollbackFirstKey, -2)
+	RegisterCommand("ZPopMax", execZPopMax, rollbackFirstKey, -2)
+	RegisterCommand("ZMPop", execZMPop, undoZMPop, -4)
+	RegisterCommand("BZPopMin", execBZPopMin, undoBZPop, -3)
+	RegisterCommand("BZPopMax", execBZPopMax, undoBZPop, -3)
+	RegisterCommand("BZMPop", execBZMPop, undoBZMPop, -5)
+	RegisterBlockingCommand("BZPopMin", lastArgTimeout)
+	RegisterBlockingCommand("BZPopMax", lastArgTimeout)
+	RegisterBlockingCommand("BZMPop", firstArgTimeout)
+	RegisterCommand("ZRandMember", execZRandMember, nil, -2)
+	RegisterCommand("ZMScore", execZMScore, nil, -3)
 }
@@ -1,11 +1,15 @@
 package database
 
 import (
+	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/connection"
+	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
 	"math/rand"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestZAdd(t *testing.T) {
@@ -303,3 +307,361 @@ func TestZIncrBy(t *testing.T) {
 	result = testDB.Exec(nil, utils.ToCmdLine("ZScore", key, "a"))
 	asserts.AssertBulkReply(t, result, "20")
 }
+
+func TestZRangeByLex(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "0", "a", "0", "b", "0", "c", "0", "d", "0", "e", "0", "f", "0", "g"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "-", "[c"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b", "c"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "-", "(c"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "[aaa", "(g"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "c", "d", "e", "f"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "-", "+", "LIMIT", "2", "3"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c", "d", "e"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrevrangebylex", key, "[c", "-"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c", "b", "a"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrevrangebylex", key, "+", "(e", "LIMIT", "1", "-1"))
+	asserts.AssertMultiBulkReply(t, result, []string{"f"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "(c", "[c"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "+", "-"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "a", "[c"))
+	asserts.AssertErrReply(t, result, "ERR min or max not valid string range item")
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "-", "+", "LIMIT", "1"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zlexcount", key, "-", "+"))
+	asserts.AssertIntReply(t, result, 7)
+	result = testDB.Exec(nil, utils.ToCmdLine("zlexcount", key, "[b", "(f"))
+	asserts.AssertIntReply(t, result, 4)
+	result = testDB.Exec(nil, utils.ToCmdLine("zlexcount", key, "[x", "+"))
+	asserts.AssertIntReply(t, result, 0)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zremrangebylex", key, "(b", "[d"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangebylex", key, "-", "+"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b", "e", "f", "g"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zremrangebylex", key, "-", "+"))
+	asserts.AssertIntReply(t, result, 5)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+}
+
+func TestZRangeUnified(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a", "2", "b", "3", "c", "4", "d"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "1", "REV", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"d", "4", "c", "3"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "(1", "3", "BYSCORE"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "c"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "+inf", "-inf", "BYSCORE", "REV", "LIMIT", "1", "2", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"c", "3", "b", "2"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "-inf", "(1", "BYSCORE"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "-", "[b", "BYLEX"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "b"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "1", "LIMIT", "0", "1"))
+	asserts.AssertErrReply(t, result, "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "-", "+", "BYLEX", "WITHSCORES"))
+	asserts.AssertErrReply(t, result, "ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "1", "BYSCORE", "BYLEX"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", dest, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangestore", dest, key, "2", "+inf", "BYSCORE", "LIMIT", "0", "2"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", dest, "0", "-1", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "2", "c", "3"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangestore", dest, key, "10", "20"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", dest))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrangestore", dest, key, "0", "-1", "WITHSCORES"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+}
+
+func TestZSetOperation(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key1, "1", "a", "2", "b", "3", "c"))
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key2, "1", "b", "2", "c", "3", "d"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zunion", "2", key1, key2, "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "1", "b", "3", "d", "3", "c", "5"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zunion", "2", key1, key2, "WEIGHTS", "2", "1", "AGGREGATE", "MAX", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "2", "d", "3", "b", "4", "c", "6"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zinter", "2", key1, key2, "AGGREGATE", "min", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "1", "c", "2"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zinter", "2", key1, key2+"1"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zdiff", "2", key1, key2, "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "1"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zintercard", "2", key1, key2))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zintercard", "2", key1, key2, "LIMIT", "1"))
+	asserts.AssertIntReply(t, result, 1)
+
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("set", dest, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("zunionstore", dest, "2", key1, key2, "WEIGHTS", "1", "-1"))
+	asserts.AssertIntReply(t, result, 4)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", dest, "0", "-1", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"d", "-3", "a", "1", "b", "1", "c", "1"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zinterstore", dest, "2", key1, key2))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", dest, "0", "-1", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "3", "c", "5"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zdiffstore", dest, "2", key1, key1))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", dest))
+	asserts.AssertIntReply(t, result, 0)
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zunion", "3", key1, key2))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zunion", "9223372036854775807", key1))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zunion", "0", key1))
+	asserts.AssertErrReply(t, result, "ERR at least 1 input key is needed for 'zunion' command")
+	result = testDB.Exec(nil, utils.ToCmdLine("zunion", "2", key1, key2, "WEIGHTS", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR weight value is not a float")
+	result = testDB.Exec(nil, utils.ToCmdLine("zdiff", "2", key1, key2, "WEIGHTS", "1", "1"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zunionstore", dest, "2", key1, key2, "WITHSCORES"))
+	asserts.AssertErrReply(t, result, "ERR syntax error")
+	testDB.Exec(nil, utils.ToCmdLine("set", dest, "a"))
+	result = testDB.Exec(nil, utils.ToCmdLine("zinter", "2", key1, dest))
+	asserts.AssertErrReply(t, result, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestZPop(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a", "2", "b", "3", "c", "4", "d"))
+
+	result := testDB.Exec(nil, utils.ToCmdLine("zpopmin", key))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "1"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zpopmax", key, "2"))
+	asserts.AssertMultiBulkReply(t, result, []string{"d", "4", "c", "3"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zpopmin", key, "0"))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zpopmin", key, "-1"))
+	asserts.AssertErrReply(t, result, "ERR value is out of range, must be positive")
+	result = testDB.Exec(nil, utils.ToCmdLine("zpopmin", key, "10"))
+	asserts.AssertMultiBulkReply(t, result, []string{"b", "2"})
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("zpopmax", key))
+	asserts.AssertMultiBulkReplySize(t, result, 0)
+
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key2, "1", "a", "2", "b", "3", "c"))
+	result = testDB.Exec(nil, utils.ToCmdLine("zmpop", "2", key, key2, "MAX", "COUNT", "2"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(key2)),
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeMultiBulkReply(utils.ToCmdLine("c", "3")),
+			protocol.MakeMultiBulkReply(utils.ToCmdLine("b", "2")),
+		}),
+	})
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("expected %s, actually %s", expected.ToBytes(), result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("zmpop", "1", key, "MIN"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("zmpop", "1", key2, "LEFT"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zmpop", "1", key2, "MIN", "COUNT", "0"))
+	asserts.AssertErrReply(t, result, "ERR count should be greater than 0")
+	result = testDB.Exec(nil, utils.ToCmdLine("zmpop", "9223372036854775807", key2, "MIN"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("bzmpop", "1", "9223372036854775807", key2, "MIN"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+}
+
+func TestBZPop(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key2, "1", "a", "2", "b"))
+	result := testDB.Exec(nil, utils.ToCmdLine("bzpopmax", key1, key2, "0"))
+	asserts.AssertMultiBulkReply(t, result, []string{key2, "b", "2"})
+
+	// timeout
+	start := time.Now()
+	result = testDB.Exec(nil, utils.ToCmdLine("bzpopmin", key1, "0.1"))
+	asserts.AssertNullBulk(t, result)
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("expect blocking until timeout")
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("bzpopmin", key1, "-1"))
+	asserts.AssertErrReply(t, result, "ERR timeout is negative")
+	result = testDB.Exec(nil, utils.ToCmdLine("bzpopmin", key1, "a"))
+	asserts.AssertErrReply(t, result, "ERR timeout is not a float or out of range")
+
+	// wake up by zadd
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		testDB.Exec(nil, utils.ToCmdLine("zadd", key1, "3", "c"))
+	}()
+	result = testDB.Exec(nil, utils.ToCmdLine("bzpopmin", key1, "5"))
+	asserts.AssertMultiBulkReply(t, result, []string{key1, "c", "3"})
+
+	// wake up by zincrby
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		testDB.Exec(nil, utils.ToCmdLine("zincrby", key1, "2", "d"))
+	}()
+	result = testDB.Exec(nil, utils.ToCmdLine("bzmpop", "0", "2", key1, key2+"1", "MAX", "COUNT", "3"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte(key1)),
+		protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeMultiBulkReply(utils.ToCmdLine("d", "2")),
+		}),
+	})
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("expected %s, actually %s", expected.ToBytes(), result.ToBytes())
+	}
+
+	// disconnected client stops waiting and takes nothing
+	conn := &connection.FakeConn{}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = conn.Close()
+	}()
+	start = time.Now()
+	result = testDB.Exec(conn, utils.ToCmdLine("bzpopmin", key1, "5"))
+	asserts.AssertNullBulk(t, result)
+	if time.Since(start) > time.Second {
+		t.Error("expect returning once client disconnected")
+	}
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key1, "1", "e"))
+	result = testDB.Exec(nil, utils.ToCmdLine("zcard", key1))
+	asserts.AssertIntReply(t, result, 1)
+}
+
+func TestZRandMember(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("zrandmember", key))
+	asserts.AssertNullBulk(t, result)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a", "2", "b", "3", "c"))
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key))
+	if bulk, ok := result.(*protocol.BulkReply); !ok || (string(bulk.Arg) != "a" && string(bulk.Arg) != "b" && string(bulk.Arg) != "c") {
+		t.Errorf("unexpected reply %s", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "2"))
+	asserts.AssertMultiBulkReplySize(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "10", "WITHSCORES"))
+	asserts.AssertMultiBulkReplySize(t, result, 6)
+	members := make(map[string]string)
+	args := result.(*protocol.MultiBulkReply).Args
+	for i := 0; i < len(args); i += 2 {
+		members[string(args[i])] = string(args[i+1])
+	}
+	if len(members) != 3 || members["a"] != "1" || members["c"] != "3" {
+		t.Errorf("unexpected reply %s", result.ToBytes())
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "-10"))
+	asserts.AssertMultiBulkReplySize(t, result, 10)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrandmember", key, "1", "SCORES"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+}
+
+func TestZMScore(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "1", "a", "2.5", "b"))
+	result := testDB.Exec(nil, utils.ToCmdLine("zmscore", key, "a", "x", "b"))
+	expected := protocol.MakeMultiRawReply([]redis.Reply{
+		protocol.MakeBulkReply([]byte("1")),
+		protocol.MakeNullBulkReply(),
+		protocol.MakeBulkReply([]byte("2.5")),
+	})
+	if !utils.BytesEquals(result.ToBytes(), expected.ToBytes()) {
+		t.Errorf("expected %s, actually %s", expected.ToBytes(), result.ToBytes())
+	}
+}
+
+func TestZAddFlags(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	result := testDB.Exec(nil, utils.ToCmdLine("zadd", key, "XX", "1", "a"))
+	asserts.AssertIntReply(t, result, 0)
+	result = testDB.Exec(nil, utils.ToCmdLine("exists", key))
+	asserts.AssertIntReply(t, result, 0)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "10", "a", "20", "b"))
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "NX", "1", "a", "30", "c"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("zscore", key, "a"))
+	asserts.AssertBulkReply(t, result, "10")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "XX", "CH", "1", "a", "40", "d"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("zscore", key, "d"))
+	asserts.AssertNullBulk(t, result)
+
+	// keep the best score
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "GT", "CH", "5", "a", "15", "b", "50", "e"))
+	asserts.AssertIntReply(t, result, 2)
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "-1", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "5", "b", "20", "c", "30", "e", "50"})
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "LT", "CH", "0", "a", "25", "b"))
+	asserts.AssertIntReply(t, result, 1)
+	result = testDB.Exec(nil, utils.ToCmdLine("zscore", key, "a"))
+	asserts.AssertBulkReply(t, result, "0")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "INCR", "5", "a"))
+	asserts.AssertBulkReply(t, result, "5")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "INCR", "2", "f"))
+	asserts.AssertBulkReply(t, result, "2")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "GT", "INCR", "-1", "a"))
+	asserts.AssertNullBulk(t, result)
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "NX", "INCR", "1", "a"))
+	asserts.AssertNullBulk(t, result)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "+inf", "g"))
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "INCR", "-inf", "g"))
+	asserts.AssertErrReply(t, result, "ERR resulting score is not a number (NaN)")
+
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "NX", "XX", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR XX and NX options at the same time are not compatible")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "NX", "GT", "1", "a"))
+	asserts.AssertErrReply(t, result, "ERR GT, LT, and/or NX options at the same time are not compatible")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "INCR", "1", "a", "2", "b"))
+	asserts.AssertErrReply(t, result, "ERR INCR option supports a single increment-element pair")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "CH", "1"))
+	asserts.AssertErrReply(t, result, "Err syntax error")
+	result = testDB.Exec(nil, utils.ToCmdLine("zadd", key, "x", "a"))
+	asserts.AssertErrReply(t, result, "ERR value is not a valid float")
+}
+
+func TestUndoZAddFlags(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("zadd", key, "10", "a"))
+	cmdLine := utils.ToCmdLine("zadd", key, "GT", "CH", "INCR", "5", "a")
+	undoCmdLines := undoZAdd(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	result := testDB.Exec(nil, utils.ToCmdLine("zscore", key, "a"))
+	asserts.AssertBulkReply(t, result, "10")
+
+	cmdLine = utils.ToCmdLine("zadd", key, "NX", "1", "a", "2", "b")
+	undoCmdLines = undoZAdd(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, line := range undoCmdLines {
+		testDB.Exec(nil, line)
+	}
+	result = testDB.Exec(nil, utils.ToCmdLine("zrange", key, "0", "-1", "WITHSCORES"))
+	asserts.AssertMultiBulkReply(t, result, []string{"a", "10"})
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/shopspring/decimal"
+	"math"
 	"math/bits"
 	"strconv"
 	"strings"
@@ -45,99 +46,134 @@ const (
 	updatePolicy        // set ex
 )
 
-const unlimitedTTL int64 = 0
+// setOption is parsed options of SET command
+type setOption struct {
+	policy  int
+	get     bool
+	keepTTL bool
+	// zero value means no expiration
+	expireAt time.Time
+}
+
+// parseExpireTime converts argument of EX, PX, EXAT or PXAT option to absolute expiration
+func parseExpireTime(option string, arg []byte, cmdName string) (time.Time, protocol.ErrorReply) {
+	raw, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return time.Time{}, protocol.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	unit := time.Millisecond
+	if option == "EX" || option == "EXAT" {
+		unit = time.Second
+	}
+	if raw <= 0 || raw > math.MaxInt64/int64(unit) {
+		return time.Time{}, protocol.MakeErrReply("ERR invalid expire time in " + cmdName)
+	}
+	if option == "EXAT" || option == "PXAT" {
+		return time.Unix(0, raw*int64(unit)), nil
+	}
+	return time.Now().Add(time.Duration(raw) * unit), nil
+}
+
+// parseSetOption parses [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+func parseSetOption(args [][]byte) (*setOption, protocol.ErrorReply) {
+	opt := &setOption{
+		policy: upsertPolicy,
+	}
+	hasTTL := false
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch arg {
+		case "NX": // insert
+			if opt.policy == updatePolicy {
+				return nil, &protocol.SyntaxErrReply{}
+			}
+			opt.policy = insertPolicy
+		case "XX": // update policy
+			if opt.policy == insertPolicy {
+				return nil, &protocol.SyntaxErrReply{}
+			}
+			opt.policy = updatePolicy
+		case "GET":
+			opt.get = true
+		case "KEEPTTL":
+			if hasTTL {
+				return nil, &protocol.SyntaxErrReply{}
+			}
+			hasTTL = true
+			opt.keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasTTL || i+1 >= len(args) {
+				// ttl has been set
+				return nil, &protocol.SyntaxErrReply{}
+			}
+			hasTTL = true
+			expireAt, errReply := parseExpireTime(arg, args[i+1], "set")
+			if errReply != nil {
+				return nil, errReply
+			}
+			opt.expireAt = expireAt
+			i++ // skip next arg
+		default:
+			return nil, &protocol.SyntaxErrReply{}
+		}
+	}
+	return opt, nil
+}
 
 // execSet sets string value and time to live to the given key
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
 func execSet(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
 	value := args[1]
-	policy := upsertPolicy
-	ttl := unlimitedTTL
-
-	// parse options
-	if len(args) > 2 {
-		for i := 2; i < len(args); i++ {
-			arg := strings.ToUpper(string(args[i]))
-			if arg == "NX" { // insert
-				if policy == updatePolicy {
-					return &protocol.SyntaxErrReply{}
-				}
-				policy = insertPolicy
-			} else if arg == "XX" { // update policy
-				if policy == insertPolicy {
-					return &protocol.SyntaxErrReply{}
-				}
-				policy = updatePolicy
-			} else if arg == "EX" { // ttl in seconds
-				if ttl != unlimitedTTL {
-					// ttl has been set
-					return &protocol.SyntaxErrReply{}
-				}
-				if i+1 >= len(args) {
-					return &protocol.SyntaxErrReply{}
-				}
-				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-				if err != nil {
-					return &protocol.SyntaxErrReply{}
-				}
-				if ttlArg <= 0 {
-					return protocol.MakeErrReply("ERR invalid expire time in set")
-				}
-				ttl = ttlArg * 1000
-				i++ // skip next arg
-			} else if arg == "PX" { // ttl in milliseconds
-				if ttl != unlimitedTTL {
-					return &protocol.SyntaxErrReply{}
-				}
-				if i+1 >= len(args) {
-					return &protocol.SyntaxErrReply{}
-				}
-				ttlArg, err := strconv.ParseInt(string(args[i+1]), 10, 64)
-				if err != nil {
-					return &protocol.SyntaxErrReply{}
-				}
-				if ttlArg <= 0 {
-					return protocol.MakeErrReply("ERR invalid expire time in set")
-				}
-				ttl = ttlArg
-				i++ // skip next arg
-			} else {
-				return &protocol.SyntaxErrReply{}
-			}
-		}
+	opt, errReply := parseSetOption(args[2:])
+	if errReply != nil {
+		return errReply
 	}
 
-	entity := &database.DataEntity{
-		Data: value,
+	// GetEntity removes expired key, so that NX and XX won't see it
+	oldEntity, exists := db.GetEntity(key)
+	var old []byte
+	if opt.get && exists {
+		var ok bool
+		old, ok = oldEntity.Data.([]byte)
+		if !ok {
+			return &protocol.WrongTypeErrReply{}
+		}
 	}
 
-	var result int
-	switch policy {
+	updated := false
+	switch opt.policy {
 	case upsertPolicy:
-		db.PutEntity(key, entity)
-		result = 1
+		updated = true
 	case insertPolicy:
-		result = db.PutIfAbsent(key, entity)
+		updated = !exists
 	case updatePolicy:
-		result = db.PutIfExists(key, entity)
-	}
-	if result > 0 {
-		if ttl != unlimitedTTL {
-			expireTime := time.Now().Add(time.Duration(ttl) * time.Millisecond)
-			db.Expire(key, expireTime)
-			db.addAof(CmdLine{
-				[]byte("SET"),
-				args[0],
-				args[1],
-			})
-			db.addAof(aof.MakeExpireCmd(key, expireTime).Args)
+		updated = exists
+	}
+	if updated {
+		db.PutEntity(key, &database.DataEntity{
+			Data: value,
+		})
+		// aof records absolute expiration, so that replaying aof gets the same result
+		if !opt.expireAt.IsZero() {
+			db.Expire(key, opt.expireAt)
+			timestamp := strconv.FormatInt(opt.expireAt.UnixNano()/1e6, 10)
+			db.addAof(utils.ToCmdLine3("set", args[0], args[1], []byte("PXAT"), []byte(timestamp)))
+		} else if opt.keepTTL {
+			db.addAof(utils.ToCmdLine3("set", args[0], args[1], []byte("KEEPTTL")))
 		} else {
 			db.Persist(key) // override ttl
-			db.addAof(utils.ToCmdLine3("set", args...))
+			db.addAof(utils.ToCmdLine3("set", args[0], args[1]))
 		}
 	}
 
-	if result > 0 {
+	if opt.get {
+		if old == nil {
+			return &protocol.NullBulkReply{}
+		}
+		return protocol.MakeBulkReply(old)
+	}
+	if updated {
 		return &protocol.OkReply{}
 	}
 	return &protocol.NullBulkReply{}
@@ -150,9 +186,13 @@ func execSetNX(db *DB, args [][]byte) redis.Reply {
 	entity := &database.DataEntity{
 		Data: value,
 	}
-	result := db.PutIfAbsent(key, entity)
+	// GetEntity removes expired key, so that it could be set again
+	if _, exists := db.GetEntity(key); exists {
+		return protocol.MakeIntReply(0)
+	}
+	db.PutEntity(key, entity)
 	db.addAof(utils.ToCmdLine3("setnx", args...))
-	return protocol.MakeIntReply(int64(result))
+	return protocol.MakeIntReply(1)
 }
 
 // execSetEX sets string and its ttl
@@ -207,24 +247,15 @@ func execPSetEX(db *DB, args [][]byte) redis.Reply {
 	return &protocol.OkReply{}
 }
 
-func prepareMSet(args [][]byte) ([]string, []string) {
-	size := len(args) / 2
-	keys := make([]string, size)
-	for i := 0; i < size; i++ {
-		keys[i] = string(args[2*i])
-	}
-	return keys, nil
-}
-
 func undoMSet(db *DB, args [][]byte) []CmdLine {
-	writeKeys, _ := prepareMSet(args)
+	writeKeys, _ := cmdTable["mset"].prepare(args)
 	return rollbackGivenKeys(db, writeKeys...)
 }
 
 // execMSet sets multi key-value in database
 func execMSet(db *DB, args [][]byte) redis.Reply {
 	if len(args)%2 != 0 {
-		return protocol.MakeSyntaxErrReply()
+		return protocol.MakeArgNumErrReply("mset")
 	}
 
 	size := len(args) / 2
@@ -238,19 +269,12 @@ func execMSet(db *DB, args [][]byte) redis.Reply {
 	for i, key := range keys {
 		value := values[i]
 		db.PutEntity(key, &database.DataEntity{Data: value})
+		db.Persist(key) // override ttl
 	}
 	db.addAof(utils.ToCmdLine3("mset", args...))
 	return &protocol.OkReply{}
 }
 
-func prepareMGet(args [][]byte) ([]string, []string) {
-	keys := make([]string, len(args))
-	for i, v := range args {
-		keys[i] = string(v)
-	}
-	return nil, keys
-}
-
 // execMGet get multi key-value from database
 func execMGet(db *DB, args [][]byte) redis.Reply {
 	keys := make([]string, len(args))
@@ -276,11 +300,12 @@ func execMGet(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeMultiBulkReply(result)
 }
 
-// execMSetNX sets multi key-value in database, only if none of the given keys exist
+// execMSetNX sets multi key-value in database, only if none of the given keys exist.
+// Like SETNX, expired keys are treated as not existed, and the same key could be given multiple times, the last value wins
 func execMSetNX(db *DB, args [][]byte) redis.Reply {
 	// parse args
 	if len(args)%2 != 0 {
-		return protocol.MakeSyntaxErrReply()
+		return protocol.MakeArgNumErrReply("msetnx")
 	}
 	size := len(args) / 2
 	values := make([][]byte, size)
@@ -324,6 +349,67 @@ func execGetSet(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeBulkReply(old)
 }
 
+// execGetEx returns string value of key and sets or removes its expiration
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+func execGetEx(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	var expireAt time.Time
+	persist := false
+	for i := 1; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		switch arg {
+		case "PERSIST":
+			if persist || !expireAt.IsZero() {
+				return &protocol.SyntaxErrReply{}
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if persist || !expireAt.IsZero() || i+1 >= len(args) {
+				return &protocol.SyntaxErrReply{}
+			}
+			var errReply protocol.ErrorReply
+			expireAt, errReply = parseExpireTime(arg, args[i+1], "getex")
+			if errReply != nil {
+				return errReply
+			}
+			i++ // skip next arg
+		default:
+			return &protocol.SyntaxErrReply{}
+		}
+	}
+
+	bytes, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	if bytes == nil {
+		return &protocol.NullBulkReply{}
+	}
+	if !expireAt.IsZero() {
+		db.Expire(key, expireAt)
+		db.addAof(aof.MakeExpireCmd(key, expireAt).Args)
+	} else if persist && db.getExpiration(key) != nil {
+		db.Persist(key)
+		db.addAof(utils.ToCmdLine("persist", key))
+	}
+	return protocol.MakeBulkReply(bytes)
+}
+
+// execGetDel returns string value of key and deletes the key
+func execGetDel(db *DB, args [][]byte) redis.Reply {
+	key := string(args[0])
+	bytes, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	if bytes == nil {
+		return &protocol.NullBulkReply{}
+	}
+	db.Remove(key)
+	db.addAof(utils.ToCmdLine("del", key))
+	return protocol.MakeBulkReply(bytes)
+}
+
 // execIncr increments the integer value of a key by one
 func execIncr(db *DB, args [][]byte) redis.Reply {
 	key := string(args[0])
@@ -734,28 +820,460 @@ func execBitPos(db *DB, args [][]byte) redis.Reply {
 	return protocol.MakeIntReply(offset)
 }
 
+// execBitOp performs bitwise operation between source keys and stores the result in destination key
+func execBitOp(db *DB, args [][]byte) redis.Reply {
+	op := strings.ToLower(string(args[0]))
+	if op != "and" && op != "or" && op != "xor" && op != "not" {
+		return protocol.MakeErrReply("ERR syntax error")
+	}
+	if op == "not" && len(args) != 3 {
+		return protocol.MakeErrReply("ERR BITOP NOT must be called with a single source key.")
+	}
+	destKey := string(args[1])
+	maps := make([]*bitmap.BitMap, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		bs, errReply := db.getAsString(string(arg))
+		if errReply != nil {
+			return errReply
+		}
+		maps = append(maps, bitmap.FromBytes(bs))
+	}
+	result := bitmap.BitOp(op, maps...)
+	if len(*result) == 0 {
+		db.Remove(destKey)
+		db.addAof(utils.ToCmdLine3("del", args[1]))
+		return protocol.MakeIntReply(0)
+	}
+	db.PutEntity(destKey, &database.DataEntity{Data: result.ToBytes()})
+	db.Persist(destKey)
+	db.addAof(utils.ToCmdLine3("bitop", args...))
+	return protocol.MakeIntReply(int64(len(*result)))
+}
+
+func undoBitOp(db *DB, args [][]byte) []CmdLine {
+	return rollbackGivenKeys(db, string(args[1]))
+}
+
+// maxBitOffset limits size of bitmap modified by BITFIELD to 512MB, like proto-max-bulk-len of redis
+const maxBitOffset = 512 * 1024 * 1024 * 8
+
+const (
+	overflowWrap = "wrap"
+	overflowSat  = "sat"
+	overflowFail = "fail"
+)
+
+// bitFieldOp is a GET, SET or INCRBY sub command of BITFIELD
+type bitFieldOp struct {
+	op       string // get, set or incrby
+	signed   bool
+	width    int
+	offset   int64
+	value    int64 // value to set or increment
+	overflow string
+}
+
+// parseBitFieldType parses type like i16 and u8, signed integer supports up to 64 bits and unsigned supports up to 63 bits
+func parseBitFieldType(arg []byte) (signed bool, width int, errReply protocol.ErrorReply) {
+	errReply = protocol.MakeErrReply("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	if len(arg) < 2 {
+		return false, 0, errReply
+	}
+	switch arg[0] {
+	case 'i', 'I':
+		signed = true
+	case 'u', 'U':
+		signed = false
+	default:
+		return false, 0, errReply
+	}
+	width, err := strconv.Atoi(string(arg[1:]))
+	if err != nil || width < 1 || (signed && width > 64) || (!signed && width > 63) {
+		return false, 0, errReply
+	}
+	return signed, width, nil
+}
+
+// parseBitFieldOffset parses offset in bits, offset prefixed with # is multiplied by width
+func parseBitFieldOffset(arg []byte, width int) (int64, protocol.ErrorReply) {
+	errReply := protocol.MakeErrReply("ERR bit offset is not an integer or out of range")
+	multiply := len(arg) > 0 && arg[0] == '#'
+	if multiply {
+		arg = arg[1:]
+	}
+	offset, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errReply
+	}
+	if multiply {
+		if offset > maxBitOffset/int64(width) {
+			return 0, errReply
+		}
+		offset *= int64(width)
+	}
+	if offset+int64(width) > maxBitOffset {
+		return 0, errReply
+	}
+	return offset, nil
+}
+
+// parseBitField parses sub commands of BITFIELD, OVERFLOW affects sub commands after it
+func parseBitField(args [][]byte, readOnly bool) ([]*bitFieldOp, protocol.ErrorReply) {
+	var ops []*bitFieldOp
+	overflow := overflowWrap
+	for i := 0; i < len(args); i++ {
+		subCmd := strings.ToLower(string(args[i]))
+		switch subCmd {
+		case "get", "set", "incrby":
+			if readOnly && subCmd != "get" {
+				return nil, protocol.MakeErrReply("ERR BITFIELD_RO only supports the GET subcommand")
+			}
+			argNum := 2
+			if subCmd != "get" {
+				argNum = 3
+			}
+			if i+argNum >= len(args) {
+				return nil, &protocol.SyntaxErrReply{}
+			}
+			signed, width, errReply := parseBitFieldType(args[i+1])
+			if errReply != nil {
+				return nil, errReply
+			}
+			offset, errReply := parseBitFieldOffset(args[i+2], width)
+			if errReply != nil {
+				return nil, errReply
+			}
+			op := &bitFieldOp{
+				op:       subCmd,
+				signed:   signed,
+				width:    width,
+				offset:   offset,
+				overflow: overflow,
+			}
+			if subCmd != "get" {
+				value, err := strconv.ParseInt(string(args[i+3]), 10, 64)
+				if err != nil {
+					return nil, protocol.MakeErrReply("ERR value is not an integer or out of range")
+				}
+				op.value = value
+			}
+			ops = append(ops, op)
+			i += argNum
+		case "overflow":
+			if readOnly {
+				return nil, protocol.MakeErrReply("ERR BITFIELD_RO only supports the GET subcommand")
+			}
+			if i+1 >= len(args) {
+				return nil, &protocol.SyntaxErrReply{}
+			}
+			overflow = strings.ToLower(string(args[i+1]))
+			if overflow != overflowWrap && overflow != overflowSat && overflow != overflowFail {
+				return nil, protocol.MakeErrReply("ERR Invalid OVERFLOW type specified")
+			}
+			i++
+		default:
+			return nil, &protocol.SyntaxErrReply{}
+		}
+	}
+	return ops, nil
+}
+
+// unsignedBitFieldAdd returns value+incr in the given width, overflowed is true if the result is out of range,
+// in which case the result is wrapped around or saturated according to overflow
+func unsignedBitFieldAdd(value uint64, incr int64, width int, overflow string) (result uint64, overflowed bool) {
+	max := uint64(1)<<width - 1
+	if value > max || (incr > 0 && uint64(incr) > max-value) {
+		if overflow == overflowSat {
+			return max, true
+		}
+		return (value + uint64(incr)) & max, true
+	}
+	if incr < 0 && uint64(-incr) > value {
+		if overflow == overflowSat {
+			return 0, true
+		}
+		return (value + uint64(incr)) & max, true
+	}
+	return value + uint64(incr), false
+}
+
+// signedBitFieldAdd is signed version of unsignedBitFieldAdd
+func signedBitFieldAdd(value int64, incr int64, width int, overflow string) (result int64, overflowed bool) {
+	max := int64(uint64(1)<<(width-1) - 1)
+	min := -max - 1
+	wrap := func() int64 {
+		// sign-extend the lowest width bits
+		shift := uint(64 - width)
+		return int64((uint64(value)+uint64(incr))<<shift) >> shift
+	}
+	if value > max || (incr > 0 && value > max-incr) {
+		if overflow == overflowSat {
+			return max, true
+		}
+		return wrap(), true
+	}
+	if value < min || (incr < 0 && value < min-incr) {
+		if overflow == overflowSat {
+			return min, true
+		}
+		return wrap(), true
+	}
+	return value + incr, false
+}
+
+func (op *bitFieldOp) get(bm *bitmap.BitMap) int64 {
+	val := bm.GetBits(op.offset, op.width)
+	if op.signed {
+		shift := uint(64 - op.width)
+		return int64(val<<shift) >> shift
+	}
+	return int64(val)
+}
+
+// exec executes the sub command on bitmap, reply is NullBulkReply if it overflowed with OVERFLOW FAIL
+func (op *bitFieldOp) exec(bm *bitmap.BitMap) (reply redis.Reply, changed bool) {
+	old := op.get(bm)
+	if op.op == "get" {
+		return protocol.MakeIntReply(old), false
+	}
+	var base, incr int64
+	if op.op == "set" {
+		base = op.value
+	} else {
+		base, incr = old, op.value
+	}
+	var result int64
+	var overflowed bool
+	if op.signed {
+		result, overflowed = signedBitFieldAdd(base, incr, op.width, op.overflow)
+	} else {
+		var r uint64
+		r, overflowed = unsignedBitFieldAdd(uint64(base), incr, op.width, op.overflow)
+		result = int64(r)
+	}
+	if overflowed && op.overflow == overflowFail {
+		return &protocol.NullBulkReply{}, false
+	}
+	bm.SetBits(op.offset, op.width, uint64(result))
+	if op.op == "set" {
+		return protocol.MakeIntReply(old), true
+	}
+	return protocol.MakeIntReply(result), true
+}
+
+func execBitFieldCommon(db *DB, args [][]byte, readOnly bool) redis.Reply {
+	key := string(args[0])
+	ops, errReply := parseBitField(args[1:], readOnly)
+	if errReply != nil {
+		return errReply
+	}
+	bs, errReply := db.getAsString(key)
+	if errReply != nil {
+		return errReply
+	}
+	// modify in place like setbit, snapshot has saved a copy before executing and undo logs copy strings
+	bm := bitmap.FromBytes(bs)
+	results := make([]redis.Reply, len(ops))
+	modified := false
+	for i, op := range ops {
+		reply, changed := op.exec(bm)
+		results[i] = reply
+		modified = modified || changed
+	}
+	if modified {
+		db.PutEntity(key, &database.DataEntity{Data: bm.ToBytes()})
+		db.addAof(utils.ToCmdLine3("bitfield", args...))
+	}
+	return protocol.MakeMultiRawReply(results)
+}
+
+// execBitField treats string as an array of integers with arbitrary width
+// BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL] ...
+func execBitField(db *DB, args [][]byte) redis.Reply {
+	return execBitFieldCommon(db, args, false)
+}
+
+// undoBitField rollbacks the key only if there is SET or INCRBY sub command
+func undoBitField(db *DB, args [][]byte) []CmdLine {
+	ops, errReply := parseBitField(args[1:], false)
+	if errReply != nil {
+		return nil
+	}
+	for _, op := range ops {
+		if op.op != "get" {
+			return rollbackFirstKey(db, args)
+		}
+	}
+	return nil
+}
+
+// execBitFieldRO is read-only variant of BITFIELD which only supports GET
+func execBitFieldRO(db *DB, args [][]byte) redis.Reply {
+	return execBitFieldCommon(db, args, true)
+}
+
+// maxLCSTableSize is the max bytes of dynamic programming table of LCS, like proto-max-bulk-len of redis
+const maxLCSTableSize = 512 * 1024 * 1024
+
+// execLCS finds the longest common subsequence of two strings
+// LCS key1 key2 [LEN] [IDX] [MINMATCHLEN min-match-len] [WITHMATCHLEN]
+func execLCS(db *DB, args [][]byte) redis.Reply {
+	var getLen, getIdx, withMatchLen bool
+	var minMatchLen int64
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "LEN":
+			getLen = true
+		case "IDX":
+			getIdx = true
+		case "WITHMATCHLEN":
+			withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 >= len(args) {
+				return &protocol.SyntaxErrReply{}
+			}
+			var err error
+			minMatchLen, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				return protocol.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if minMatchLen < 0 {
+				minMatchLen = 0
+			}
+			i++ // skip next arg
+		default:
+			return &protocol.SyntaxErrReply{}
+		}
+	}
+	if getLen && getIdx {
+		return protocol.MakeErrReply("ERR If you want both the length and indexes, please just use IDX.")
+	}
+	a, errReply := db.getAsString(string(args[0]))
+	if errReply != nil {
+		return errReply
+	}
+	b, errReply := db.getAsString(string(args[1]))
+	if errReply != nil {
+		return errReply
+	}
+	aLen, bLen := len(a), len(b)
+	if uint64(aLen+1)*uint64(bLen+1)*4 > maxLCSTableSize {
+		return protocol.MakeErrReply("ERR Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len")
+	}
+
+	// table[i*(bLen+1)+j] is length of LCS between a[:i] and b[:j]
+	table := make([]uint32, (aLen+1)*(bLen+1))
+	lcs := func(i, j int) uint32 {
+		return table[i*(bLen+1)+j]
+	}
+	for i := 1; i <= aLen; i++ {
+		for j := 1; j <= bLen; j++ {
+			if a[i-1] == b[j-1] {
+				table[i*(bLen+1)+j] = lcs(i-1, j-1) + 1
+			} else if lcs(i-1, j) > lcs(i, j-1) {
+				table[i*(bLen+1)+j] = lcs(i-1, j)
+			} else {
+				table[i*(bLen+1)+j] = lcs(i, j-1)
+			}
+		}
+	}
+	length := lcs(aLen, bLen)
+	if getLen {
+		return protocol.MakeIntReply(int64(length))
+	}
+
+	// walk back from the end of strings to collect LCS and ranges of matches
+	result := make([]byte, length)
+	idx := len(result)
+	var matches []redis.Reply
+	aStart, aEnd, bStart, bEnd := -1, -1, -1, -1 // aStart is -1 if no range is tracked
+	i, j := aLen, bLen
+	for i > 0 && j > 0 {
+		emitRange := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if aStart < 0 {
+				aStart, aEnd, bStart, bEnd = i-1, i-1, j-1, j-1
+			} else {
+				// extend the range backward since it is contiguous
+				aStart--
+				bStart--
+			}
+			// emit the range if it reaches the beginning of one of strings
+			if aStart == 0 || bStart == 0 {
+				emitRange = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if lcs(i-1, j) > lcs(i, j-1) {
+				i--
+			} else {
+				j--
+			}
+			emitRange = aStart >= 0
+		}
+		if emitRange {
+			matchLen := aEnd - aStart + 1
+			if getIdx && int64(matchLen) >= minMatchLen {
+				match := []redis.Reply{
+					protocol.MakeMultiRawReply([]redis.Reply{
+						protocol.MakeIntReply(int64(aStart)),
+						protocol.MakeIntReply(int64(aEnd)),
+					}),
+					protocol.MakeMultiRawReply([]redis.Reply{
+						protocol.MakeIntReply(int64(bStart)),
+						protocol.MakeIntReply(int64(bEnd)),
+					}),
+				}
+				if withMatchLen {
+					match = append(match, protocol.MakeIntReply(int64(matchLen)))
+				}
+				matches = append(matches, protocol.MakeMultiRawReply(match))
+			}
+			aStart = -1 // restart at the next match
+		}
+	}
+	if getIdx {
+		return protocol.MakeMultiRawReply([]redis.Reply{
+			protocol.MakeBulkReply([]byte("matches")),
+			protocol.MakeMultiRawReply(matches),
+			protocol.MakeBulkReply([]byte("len")),
+			protocol.MakeIntReply(int64(length)),
+		})
+	}
+	return protocol.MakeBulkReply(result)
+}
+
 func init() {
-	RegisterCommand("Set", execSet, writeFirstKey, rollbackFirstKey, -3)
-	RegisterCommand("SetNx", execSetNX, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand("SetEX", execSetEX, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("PSetEX", execPSetEX, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("MSet", execMSet, prepareMSet, undoMSet, -3)
-	RegisterCommand("MGet", execMGet, prepareMGet, nil, -2)
-	RegisterCommand("MSetNX", execMSetNX, prepareMSet, undoMSet, -3)
-	RegisterCommand("Get", execGet, readFirstKey, nil, 2)
-	RegisterCommand("GetSet", execGetSet, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand("Incr", execIncr, writeFirstKey, rollbackFirstKey, 2)
-	RegisterCommand("IncrBy", execIncrBy, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand("IncrByFloat", execIncrByFloat, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand("Decr", execDecr, writeFirstKey, rollbackFirstKey, 2)
-	RegisterCommand("DecrBy", execDecrBy, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand("StrLen", execStrLen, readFirstKey, nil, 2)
-	RegisterCommand("Append", execAppend, writeFirstKey, rollbackFirstKey, 3)
-	RegisterCommand("SetRange", execSetRange, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("GetRange", execGetRange, readFirstKey, nil, 4)
-	RegisterCommand("SetBit", execSetBit, writeFirstKey, rollbackFirstKey, 4)
-	RegisterCommand("GetBit", execGetBit, readFirstKey, nil, 3)
-	RegisterCommand("BitCount", execBitCount, readFirstKey, nil, -2)
-	RegisterCommand("BitPos", execBitPos, readFirstKey, nil, -3)
+	RegisterCommand("Set", execSet, rollbackFirstKey, -3)
+	RegisterCommand("SetNx", execSetNX, rollbackFirstKey, 3)
+	RegisterCommand("SetEX", execSetEX, rollbackFirstKey, 4)
+	RegisterCommand("PSetEX", execPSetEX, rollbackFirstKey, 4)
+	RegisterCommand("MSet", execMSet, undoMSet, -3)
+	RegisterCommand("MGet", execMGet, nil, -2)
+	RegisterCommand("MSetNX", execMSetNX, undoMSet, -3)
+	RegisterCommand("Get", execGet, nil, 2)
+	RegisterCommand("GetSet", execGetSet, rollbackFirstKey, 3)
+	RegisterCommand("GetEx", execGetEx, undoExpire, -2)
+	RegisterCommand("GetDel", execGetDel, rollbackFirstKey, 2)
+	RegisterCommand("Incr", execIncr, rollbackFirstKey, 2)
+	RegisterCommand("IncrBy", execIncrBy, rollbackFirstKey, 3)
+	RegisterCommand("IncrByFloat", execIncrByFloat, rollbackFirstKey, 3)
+	RegisterCommand("Decr", execDecr, rollbackFirstKey, 2)
+	RegisterCommand("DecrBy", execDecrBy, rollbackFirstKey, 3)
+	RegisterCommand("StrLen", execStrLen, nil, 2)
+	RegisterCommand("Append", execAppend, rollbackFirstKey, 3)
+	RegisterCommand("SetRange", execSetRange, rollbackFirstKey, 4)
+	RegisterCommand("GetRange", execGetRange, nil, 4)
+	RegisterCommand("SetBit", execSetBit, rollbackFirstKey, 4)
+	RegisterCommand("GetBit", execGetBit, nil, 3)
+	RegisterCommand("BitCount", execBitCount, nil, -2)
+	RegisterCommand("BitPos", execBitPos, nil, -3)
+	RegisterCommand("BitOp", execBitOp, undoBitOp, -4)
+	RegisterCommand("BitField", execBitField, undoBitField, -2)
+	RegisterCommand("BitField_RO", execBitFieldRO, nil, -2)
+	RegisterCommand("LCS", execLCS, nil, -3)
 
 }
@@ -1,12 +1,16 @@
 package database
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/hdt3213/godis/lib/utils"
 	"github.com/hdt3213/godis/redis/protocol"
 	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"math"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var testDB = makeTestDB()
@@ -721,3 +725,353 @@ func TestBitPos(t *testing.T) {
 	actual = testDB.Exec(nil, utils.ToCmdLine("BitPos", key, "-1"))
 	asserts.AssertErrReply(t, actual, "ERR bit is not an integer or out of range")
 }
+
+func TestBitOp(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	dest := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("Set", key1, "\x0f\xff"))
+	testDB.Exec(nil, utils.ToCmdLine("Set", key2, "\xf1"))
+	actual := testDB.Exec(nil, utils.ToCmdLine("BitOp", "AND", dest, key1, key2))
+	asserts.AssertIntReply(t, actual, 2)
+	actual = testDB.Exec(nil, utils.ToCmdLine("Get", dest))
+	asserts.AssertBulkReply(t, actual, "\x01\x00")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "OR", dest, key1, key2))
+	asserts.AssertIntReply(t, actual, 2)
+	actual = testDB.Exec(nil, utils.ToCmdLine("Get", dest))
+	asserts.AssertBulkReply(t, actual, "\xff\xff")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "XOR", dest, key1, key2))
+	asserts.AssertIntReply(t, actual, 2)
+	actual = testDB.Exec(nil, utils.ToCmdLine("Get", dest))
+	asserts.AssertBulkReply(t, actual, "\xfe\xff")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "NOT", dest, key2))
+	asserts.AssertIntReply(t, actual, 1)
+	actual = testDB.Exec(nil, utils.ToCmdLine("Get", dest))
+	asserts.AssertBulkReply(t, actual, "\x0e")
+
+	// empty result removes destination
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "OR", dest, key1+"a"))
+	asserts.AssertIntReply(t, actual, 0)
+	actual = testDB.Exec(nil, utils.ToCmdLine("Exists", dest))
+	asserts.AssertIntReply(t, actual, 0)
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "NOT", dest, key1, key2))
+	asserts.AssertErrReply(t, actual, "ERR BITOP NOT must be called with a single source key.")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "NAND", dest, key1, key2))
+	asserts.AssertErrReply(t, actual, "ERR syntax error")
+	key3 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("rpush", key3, "1"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("BitOp", "AND", dest, key1, key3))
+	asserts.AssertErrReply(t, actual, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestSetOptions(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+
+	// GET
+	actual := testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "GET"))
+	asserts.AssertNullBulk(t, actual)
+	actual = testDB.Exec(nil, utils.ToCmdLine("SET", key, "b", "GET"))
+	asserts.AssertBulkReply(t, actual, "a")
+	actual = testDB.Exec(nil, utils.ToCmdLine("SET", key, "c", "NX", "GET"))
+	asserts.AssertBulkReply(t, actual, "b")
+	actual = testDB.Exec(nil, utils.ToCmdLine("GET", key))
+	asserts.AssertBulkReply(t, actual, "b")
+
+	// KEEPTTL
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "EX", "1000"))
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "b", "KEEPTTL"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, 999)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "c"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, -1)
+
+	// EXAT and PXAT
+	expireAt := time.Now().Add(1000 * time.Second)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "EXAT", strconv.FormatInt(expireAt.Unix(), 10)))
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, 999)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "PXAT", strconv.FormatInt(expireAt.UnixNano()/1e6, 10)))
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, 999)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "PXAT", "1"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("EXISTS", key))
+	asserts.AssertIntReply(t, actual, 0)
+
+	// errors
+	actual = testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "EX", "10", "KEEPTTL"))
+	asserts.AssertErrReply(t, actual, "Err syntax error")
+	actual = testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "EXAT", "0"))
+	asserts.AssertErrReply(t, actual, "ERR invalid expire time in set")
+	actual = testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "PX", "a"))
+	asserts.AssertErrReply(t, actual, "ERR value is not an integer or out of range")
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", key, "a"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "GET"))
+	asserts.AssertErrReply(t, actual, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	actual = testDB.Exec(nil, utils.ToCmdLine("TYPE", key))
+	asserts.AssertStatusReply(t, actual, "list")
+}
+
+func TestSetAof(t *testing.T) {
+	var lines []CmdLine
+	db := makeTestDB()
+	db.addAof = func(line CmdLine) {
+		lines = append(lines, line)
+	}
+	key := utils.RandString(10)
+	db.Exec(nil, utils.ToCmdLine("SET", key, "a", "EX", "1000", "GET"))
+	db.Exec(nil, utils.ToCmdLine("SET", key, "b", "NX"))
+	db.Exec(nil, utils.ToCmdLine("SET", key, "c", "XX", "KEEPTTL"))
+	db.Exec(nil, utils.ToCmdLine("GETEX", key, "PX", "1000"))
+	db.Exec(nil, utils.ToCmdLine("GETEX", key, "PERSIST"))
+	db.Exec(nil, utils.ToCmdLine("GETDEL", key))
+	if len(lines) != 5 {
+		t.Errorf("expected 5 aof lines, actually %d", len(lines))
+		return
+	}
+	expireAt := time.Now().Add(1000*time.Second).UnixNano() / 1e6
+	ms, _ := strconv.ParseInt(string(lines[0][4]), 10, 64)
+	if string(lines[0][3]) != "PXAT" || ms > expireAt || ms < expireAt-1000 {
+		t.Errorf("expected absolute expiration, actually %s", protocol.MakeMultiBulkReply(lines[0]).ToBytes())
+	}
+	expected := []string{"set " + key + " c KEEPTTL", "PEXPIREAT " + key, "persist " + key, "del " + key}
+	for i, prefix := range expected {
+		line := string(bytes.Join(lines[i+1], []byte(" ")))
+		if !strings.HasPrefix(line, prefix) {
+			t.Errorf("expected %s, actually %s", prefix, line)
+		}
+	}
+}
+
+func TestGetEx(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	actual := testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "EX", "100"))
+	asserts.AssertNullBulk(t, actual)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "a"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key))
+	asserts.AssertBulkReply(t, actual, "a")
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, -1)
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "EX", "100"))
+	asserts.AssertBulkReply(t, actual, "a")
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, 99)
+	testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "EXAT", strconv.FormatInt(time.Now().Unix()+200, 10)))
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, 199)
+	testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "PERSIST"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, -1)
+
+	// undo
+	testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100"))
+	cmdLine := utils.ToCmdLine("GETEX", key, "PERSIST")
+	undoCmdLines := undoExpire(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, 99)
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "EX", "100", "PERSIST"))
+	asserts.AssertErrReply(t, actual, "Err syntax error")
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key, "PX", "0"))
+	asserts.AssertErrReply(t, actual, "ERR invalid expire time in getex")
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", key+"1", "a"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETEX", key+"1"))
+	asserts.AssertErrReply(t, actual, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestGetDel(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	actual := testDB.Exec(nil, utils.ToCmdLine("GETDEL", key))
+	asserts.AssertNullBulk(t, actual)
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "a", "EX", "100"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETDEL", key))
+	asserts.AssertBulkReply(t, actual, "a")
+	actual = testDB.Exec(nil, utils.ToCmdLine("EXISTS", key))
+	asserts.AssertIntReply(t, actual, 0)
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", key, "a"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("GETDEL", key))
+	asserts.AssertErrReply(t, actual, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestMSetNXEdge(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	actual := testDB.Exec(nil, utils.ToCmdLine("MSETNX", key, "a", key))
+	asserts.AssertErrReply(t, actual, "ERR wrong number of arguments for 'msetnx' command")
+	actual = testDB.Exec(nil, utils.ToCmdLine("MSETNX", key, "a", key, "b"))
+	asserts.AssertIntReply(t, actual, 1)
+	actual = testDB.Exec(nil, utils.ToCmdLine("GET", key))
+	asserts.AssertBulkReply(t, actual, "b")
+
+	// expired key is treated as not existed
+	testDB.Exec(nil, utils.ToCmdLine("PEXPIREAT", key, "1"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("MSETNX", key, "c"))
+	asserts.AssertIntReply(t, actual, 1)
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, -1)
+
+	// mset overrides ttl
+	testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100"))
+	testDB.Exec(nil, utils.ToCmdLine("MSET", key, "d"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, -1)
+}
+
+func TestLCS(t *testing.T) {
+	testDB.Flush()
+	key1 := utils.RandString(10)
+	key2 := utils.RandString(10)
+	testDB.Exec(nil, utils.ToCmdLine("MSET", key1, "ohmytext", key2, "mynewtext"))
+
+	actual := testDB.Exec(nil, utils.ToCmdLine("LCS", key1, key2))
+	asserts.AssertBulkReply(t, actual, "mytext")
+	actual = testDB.Exec(nil, utils.ToCmdLine("LCS", key1, key2, "LEN"))
+	asserts.AssertIntReply(t, actual, 6)
+	actual = testDB.Exec(nil, utils.ToCmdLine("LCS", key1, key2+"1"))
+	asserts.AssertBulkReply(t, actual, "")
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("LCS", key1, key2, "IDX"))
+	expected := "*4\r\n$7\r\nmatches\r\n*2\r\n" +
+		"*2\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n" +
+		"*2\r\n*2\r\n:2\r\n:3\r\n*2\r\n:0\r\n:1\r\n" +
+		"$3\r\nlen\r\n:6\r\n"
+	if string(actual.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, actual.ToBytes())
+	}
+	actual = testDB.Exec(nil, utils.ToCmdLine("LCS", key1, key2, "IDX", "MINMATCHLEN", "4", "WITHMATCHLEN"))
+	expected = "*4\r\n$7\r\nmatches\r\n*1\r\n" +
+		"*3\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n:4\r\n" +
+		"$3\r\nlen\r\n:6\r\n"
+	if string(actual.ToBytes()) != expected {
+		t.Errorf("expected %q, actually %q", expected, actual.ToBytes())
+	}
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("LCS", key1, key2, "LEN", "IDX"))
+	asserts.AssertErrReply(t, actual, "ERR If you want both the length and indexes, please just use IDX.")
+	actual = testDB.Exec(nil, utils.ToCmdLine("LCS", key1, key2, "MINMATCHLEN", "a"))
+	asserts.AssertErrReply(t, actual, "ERR value is not an integer or out of range")
+	actual = testDB.Exec(nil, utils.ToCmdLine("LCS", key1, key2, "FOO"))
+	asserts.AssertErrReply(t, actual, "Err syntax error")
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", key2+"2", "a"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("LCS", key1, key2+"2"))
+	asserts.AssertErrReply(t, actual, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestBitField(t *testing.T) {
+	testDB.Flush()
+	key := utils.RandString(10)
+	actual := testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "GET", "u8", "0"))
+	assertIntsReply(t, actual, 0)
+	actual = testDB.Exec(nil, utils.ToCmdLine("EXISTS", key))
+	asserts.AssertIntReply(t, actual, 0)
+
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "SET", "i8", "#1", "-100", "GET", "i8", "8", "GET", "u8", "8"))
+	assertIntsReply(t, actual, 0, -100, 156)
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "SET", "u4", "3", "11", "GET", "u4", "3", "GET", "u10", "1"))
+	assertIntsReply(t, actual, 0, 11, 180)
+	// bits are numbered as SETBIT does, the bit at offset is the most significant bit of integer
+	for i, bit := range []int{1, 0, 1, 1} {
+		actual = testDB.Exec(nil, utils.ToCmdLine("GETBIT", key, strconv.Itoa(3+i)))
+		asserts.AssertIntReply(t, actual, bit)
+	}
+	testDB.Exec(nil, utils.ToCmdLine("SETBIT", key, "100", "1"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD_RO", key, "GET", "u1", "100", "GET", "i64", "#1"))
+	assertIntsReply(t, actual, 1, 1<<(63-(100-64)))
+
+	// overflow
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key,
+		"SET", "u8", "0", "250", "INCRBY", "u8", "0", "10",
+		"OVERFLOW", "SAT", "INCRBY", "u8", "0", "300", "INCRBY", "u8", "0", "-1000",
+		"OVERFLOW", "FAIL", "INCRBY", "u8", "0", "-1", "INCRBY", "u8", "0", "7", "GET", "u8", "0"))
+	expected := ":4\r\n:255\r\n:0\r\n$-1\r\n:7\r\n:7\r\n"
+	if !strings.HasSuffix(string(actual.ToBytes()), expected) {
+		t.Errorf("expected %q, actually %q", expected, actual.ToBytes())
+	}
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key,
+		"SET", "i8", "0", "127", "INCRBY", "i8", "0", "1",
+		"OVERFLOW", "SAT", "INCRBY", "i8", "0", "-1000", "SET", "i8", "0", "1000",
+		"OVERFLOW", "FAIL", "INCRBY", "i8", "0", "1", "SET", "i8", "0", "-129", "GET", "i8", "0"))
+	expected = "$-1\r\n$-1\r\n:127\r\n"
+	if !strings.HasSuffix(string(actual.ToBytes()), expected) ||
+		!strings.HasPrefix(string(actual.ToBytes()), "*7\r\n:7\r\n:-128\r\n:-128\r\n:-128\r\n") {
+		t.Errorf("unexpected reply %q", actual.ToBytes())
+	}
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key+"2", "SET", "i64", "0", "9223372036854775807", "INCRBY", "i64", "0", "1"))
+	assertIntsReply(t, actual, 0, math.MinInt64)
+
+	// keep ttl
+	testDB.Exec(nil, utils.ToCmdLine("EXPIRE", key, "100"))
+	testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "INCRBY", "u2", "0", "1"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("TTL", key))
+	asserts.AssertIntReply(t, actual, 99)
+
+	// undo
+	testDB.Exec(nil, utils.ToCmdLine("SET", key, "a"))
+	if undoCmdLines := undoBitField(testDB, utils.ToCmdLine(key, "GET", "u8", "0")); len(undoCmdLines) != 0 {
+		t.Errorf("expect no undo log for GET, actually %d", len(undoCmdLines))
+	}
+	cmdLine := utils.ToCmdLine("BITFIELD", key, "SET", "u8", "0", "98")
+	undoCmdLines := undoBitField(testDB, cmdLine[1:])
+	testDB.Exec(nil, cmdLine)
+	actual = testDB.Exec(nil, utils.ToCmdLine("GET", key))
+	asserts.AssertBulkReply(t, actual, "F")
+	for _, cmdLine := range undoCmdLines {
+		testDB.Exec(nil, cmdLine)
+	}
+	actual = testDB.Exec(nil, utils.ToCmdLine("GET", key))
+	asserts.AssertBulkReply(t, actual, "a")
+
+	// errors
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "GET", "u64", "0"))
+	asserts.AssertErrReply(t, actual, "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "GET", "i0", "0"))
+	asserts.AssertErrReply(t, actual, "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "GET", "u8", "-1"))
+	asserts.AssertErrReply(t, actual, "ERR bit offset is not an integer or out of range")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "GET", "u8", "#a"))
+	asserts.AssertErrReply(t, actual, "ERR bit offset is not an integer or out of range")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "GET", "u8", "4294967290"))
+	asserts.AssertErrReply(t, actual, "ERR bit offset is not an integer or out of range")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "SET", "u8", "0", "a"))
+	asserts.AssertErrReply(t, actual, "ERR value is not an integer or out of range")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "OVERFLOW", "FOO"))
+	asserts.AssertErrReply(t, actual, "ERR Invalid OVERFLOW type specified")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "INCRBY", "u8", "0"))
+	asserts.AssertErrReply(t, actual, "Err syntax error")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key, "FOO"))
+	asserts.AssertErrReply(t, actual, "Err syntax error")
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD_RO", key, "SET", "u8", "0", "1"))
+	asserts.AssertErrReply(t, actual, "ERR BITFIELD_RO only supports the GET subcommand")
+	testDB.Exec(nil, utils.ToCmdLine("RPUSH", key+"1", "a"))
+	actual = testDB.Exec(nil, utils.ToCmdLine("BITFIELD", key+"1", "GET", "u8", "0"))
+	asserts.AssertErrReply(t, actual, "WRONGTYPE Operation against a key holding the wrong kind of value")
+}
+
+func TestBitFieldAof(t *testing.T) {
+	var lines []CmdLine
+	db := makeTestDB()
+	db.addAof = func(line CmdLine) {
+		lines = append(lines, line)
+	}
+	key := utils.RandString(10)
+	db.Exec(nil, utils.ToCmdLine("BITFIELD", key, "GET", "u8", "0"))
+	db.Exec(nil, utils.ToCmdLine("BITFIELD", key, "OVERFLOW", "FAIL", "SET", "u8", "0", "256"))
+	db.Exec(nil, utils.ToCmdLine("BITFIELD", key, "INCRBY", "u8", "0", "1"))
+	if len(lines) != 1 {
+		t.Errorf("expected 1 aof line, actually %d", len(lines))
+		return
+	}
+	line := string(bytes.Join(lines[0], []byte(" ")))
+	if line != "bitfield "+key+" INCRBY u8 0 1" {
+		t.Errorf("unexpected aof line %s", line)
+	}
+}
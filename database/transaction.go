@@ -29,7 +29,7 @@ func execGetVersion(db *DB, args [][]byte) redis.Reply {
 }
 
 func init() {
-	RegisterCommand("GetVer", execGetVersion, readAllKeys, nil, 2)
+	RegisterCommand("GetVer", execGetVersion, nil, 2)
 }
 
 // invoker should lock watching keys
@@ -107,9 +107,18 @@ func (db *DB) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLi
 	if isWatchingChanged(db, watching) { // watching keys changed, abort
 		return protocol.MakeEmptyMultiBulkReply()
 	}
-	// execute
-	results := make([]redis.Reply, 0, len(cmdLines))
-	aborted := false
+	results, aborted := db.execCmdLinesWithLock(cmdLines)
+	if !aborted { //success
+		db.addVersion(writeKeys...)
+		return protocol.MakeMultiRawReply(results)
+	}
+	return protocol.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+}
+
+// execCmdLinesWithLock executes command lines in order, if any command fails it undoes executed commands
+// invoker should provide locks
+func (db *DB) execCmdLinesWithLock(cmdLines []CmdLine) (results []redis.Reply, aborted bool) {
+	results = make([]redis.Reply, 0, len(cmdLines))
 	undoCmdLines := make([][]CmdLine, 0, len(cmdLines))
 	for _, cmdLine := range cmdLines {
 		undoCmdLines = append(undoCmdLines, db.GetUndoLogs(cmdLine))
@@ -122,9 +131,8 @@ func (db *DB) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLi
 		}
 		results = append(results, result)
 	}
-	if !aborted { //success
-		db.addVersion(writeKeys...)
-		return protocol.MakeMultiRawReply(results)
+	if !aborted {
+		return results, false
 	}
 	// undo if aborted
 	size := len(undoCmdLines)
@@ -137,7 +145,7 @@ func (db *DB) ExecMulti(conn redis.Connection, watching map[string]uint32, cmdLi
 			db.execWithLock(cmdLine)
 		}
 	}
-	return protocol.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	return nil, true
 }
 
 // DiscardMulti drops MULTI pending commands
@@ -163,17 +171,3 @@ func (db *DB) GetUndoLogs(cmdLine [][]byte) []CmdLine {
 	}
 	return undo(db, cmdLine[1:])
 }
-
-// GetRelatedKeys analysis related keys
-func GetRelatedKeys(cmdLine [][]byte) ([]string, []string) {
-	cmdName := strings.ToLower(string(cmdLine[0]))
-	cmd, ok := cmdTable[cmdName]
-	if !ok {
-		return nil, nil
-	}
-	prepare := cmd.prepare
-	if prepare == nil {
-		return nil, nil
-	}
-	return prepare(cmdLine[1:])
-}
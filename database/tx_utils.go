@@ -6,37 +6,6 @@ import (
 	"strconv"
 )
 
-func readFirstKey(args [][]byte) ([]string, []string) {
-	// assert len(args) > 0
-	key := string(args[0])
-	return nil, []string{key}
-}
-
-func writeFirstKey(args [][]byte) ([]string, []string) {
-	key := string(args[0])
-	return []string{key}, nil
-}
-
-func writeAllKeys(args [][]byte) ([]string, []string) {
-	keys := make([]string, len(args))
-	for i, v := range args {
-		keys[i] = string(v)
-	}
-	return keys, nil
-}
-
-func readAllKeys(args [][]byte) ([]string, []string) {
-	keys := make([]string, len(args))
-	for i, v := range args {
-		keys[i] = string(v)
-	}
-	return nil, keys
-}
-
-func noPrepare(args [][]byte) ([]string, []string) {
-	return nil, nil
-}
-
 func rollbackFirstKey(db *DB, args [][]byte) []CmdLine {
 	key := string(args[0])
 	return rollbackGivenKeys(db, key)
@@ -51,9 +20,14 @@ func rollbackGivenKeys(db *DB, keys ...string) []CmdLine {
 				utils.ToCmdLine("DEL", key),
 			)
 		} else {
+			cmdLine := aof.EntityToCmd(key, entity).Args
+			if _, ok := entity.Data.([]byte); ok {
+				// string may be modified in place later, e.g. setrange, setbit and bitfield
+				cmdLine[2] = append([]byte(nil), cmdLine[2]...)
+			}
 			undoCmdLines = append(undoCmdLines,
 				utils.ToCmdLine("DEL", key), // clean existed first
-				aof.EntityToCmd(key, entity).Args,
+				cmdLine,
 				toTTLCmd(db, key).Args,
 			)
 		}
@@ -79,6 +53,13 @@ func rollbackHashFields(db *DB, key string, fields ...string) []CmdLine {
 			undoCmdLines = append(undoCmdLines,
 				utils.ToCmdLine("HDEL", key, field),
 			)
+		} else if expireAt, ok := getHashFieldExpireTime(dict, field); ok {
+			// HSET would cancel expiration of field
+			value, _ := entity.([]byte)
+			timestamp := strconv.FormatInt(expireAt.UnixNano()/1e6, 10)
+			undoCmdLines = append(undoCmdLines,
+				utils.ToCmdLine("HMSETPXAT", key, field, string(value), timestamp),
+			)
 		} else {
 			value, _ := entity.([]byte)
 			undoCmdLines = append(undoCmdLines,
@@ -89,24 +70,6 @@ func rollbackHashFields(db *DB, key string, fields ...string) []CmdLine {
 	return undoCmdLines
 }
 
-func prepareSetCalculate(args [][]byte) ([]string, []string) {
-	keys := make([]string, len(args))
-	for i, arg := range args {
-		keys[i] = string(arg)
-	}
-	return nil, keys
-}
-
-func prepareSetCalculateStore(args [][]byte) ([]string, []string) {
-	dest := string(args[0])
-	keys := make([]string, len(args)-1)
-	keyArgs := args[1:]
-	for i, arg := range keyArgs {
-		keys[i] = string(arg)
-	}
-	return []string{dest}, keys
-}
-
 func rollbackSetMembers(db *DB, key string, members ...string) []CmdLine {
 	var undoCmdLines [][][]byte
 	set, errReply := db.getAsSet(key)
@@ -1,5 +1,7 @@
 package bitmap
 
+import "math/bits"
+
 type BitMap []byte
 
 func New() *BitMap {
@@ -95,3 +97,88 @@ func (b *BitMap) ForEachByte(begin int, end int, cb Callback) {
 		}
 	}
 }
+
+// BitOp performs bitwise operation between given bitmaps byte by byte, op could be "and", "or", "xor" or "not".
+// Shorter bitmaps are treated as zero-padded, "not" accepts only one bitmap
+func BitOp(op string, maps ...*BitMap) *BitMap {
+	maxLen := 0
+	for _, m := range maps {
+		if len(*m) > maxLen {
+			maxLen = len(*m)
+		}
+	}
+	result := BitMap(make([]byte, maxLen))
+	if len(maps) == 0 {
+		return &result
+	}
+	if op == "not" {
+		for i, b := range *maps[0] {
+			result[i] = ^b
+		}
+		return &result
+	}
+	copy(result, *maps[0])
+	for _, m := range maps[1:] {
+		for i := 0; i < maxLen; i++ {
+			var b byte
+			if i < len(*m) {
+				b = (*m)[i]
+			}
+			switch op {
+			case "and":
+				result[i] &= b
+			case "or":
+				result[i] |= b
+			case "xor":
+				result[i] ^= b
+			}
+		}
+	}
+	return &result
+}
+
+// GetBits reads width bits begin at offset as an unsigned integer, width should be in [1, 64].
+// The bit at offset is the most significant bit of result, bits beyond the bitmap are zero.
+// It reads bitmap byte by byte, each byte is reversed first so that its bits are ordered as they are in the integer
+func (b *BitMap) GetBits(offset int64, width int) uint64 {
+	var val uint64
+	for width > 0 {
+		byteIndex := offset / 8
+		bitOffset := int(offset % 8)
+		n := 8 - bitOffset
+		if n > width {
+			n = width
+		}
+		var reversed byte
+		if byteIndex < int64(len(*b)) {
+			reversed = bits.Reverse8((*b)[byteIndex])
+		}
+		chunk := (reversed >> (8 - bitOffset - n)) & byte(1<<n-1)
+		val = val<<n | uint64(chunk)
+		offset += int64(n)
+		width -= n
+	}
+	return val
+}
+
+// SetBits writes the lowest width bits of val begin at offset, width should be in [1, 64].
+// The most significant one of written bits is put at offset, bitmap grows if necessary
+func (b *BitMap) SetBits(offset int64, width int, val uint64) {
+	b.grow(offset + int64(width))
+	for width > 0 {
+		byteIndex := offset / 8
+		bitOffset := int(offset % 8)
+		n := 8 - bitOffset
+		if n > width {
+			n = width
+		}
+		shift := 8 - bitOffset - n
+		mask := byte(1<<n-1) << shift
+		chunk := byte(val>>(width-n)) << shift
+		reversed := bits.Reverse8((*b)[byteIndex])
+		reversed = reversed&^mask | chunk&mask
+		(*b)[byteIndex] = bits.Reverse8(reversed)
+		offset += int64(n)
+		width -= n
+	}
+}
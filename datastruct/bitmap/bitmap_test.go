@@ -166,3 +166,49 @@ func TestBitMap_ForEachByte(t *testing.T) {
 		t.Error("break failed")
 	}
 }
+
+func TestBits(t *testing.T) {
+	bm := New()
+	bm.SetBits(3, 10, 0x2b5)
+	// the bit at offset is the most significant bit
+	for i := 0; i < 10; i++ {
+		expect := byte(uint64(0x2b5) >> (9 - i) & 1)
+		if bm.GetBit(int64(3+i)) != expect {
+			t.Errorf("wrong bit at %d", 3+i)
+		}
+	}
+	if bm.GetBit(2) != 0 || bm.GetBit(13) != 0 {
+		t.Error("neighbour bits should be untouched")
+	}
+	if v := bm.GetBits(3, 10); v != 0x2b5 {
+		t.Errorf("expect 0x2b5, actually %#x", v)
+	}
+	if v := bm.GetBits(100, 8); v != 0 {
+		t.Errorf("expect 0, actually %#x", v)
+	}
+
+	// random round trip
+	for i := 0; i < 1000; i++ {
+		bm := FromBytes(make([]byte, 16))
+		for j := range *bm {
+			(*bm)[j] = byte(rand.Intn(256))
+		}
+		before := make([]byte, 16)
+		copy(before, *bm)
+		offset := int64(rand.Intn(64))
+		width := rand.Intn(64) + 1
+		val := rand.Uint64() & (1<<width - 1)
+		bm.SetBits(offset, width, val)
+		if v := bm.GetBits(offset, width); v != val {
+			t.Errorf("expect %#x, actually %#x", val, v)
+		}
+		for k := int64(0); k < 128; k++ {
+			if k >= offset && k < offset+int64(width) {
+				continue
+			}
+			if bm.GetBit(k) != FromBytes(before).GetBit(k) {
+				t.Errorf("bit %d should be untouched", k)
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package dict
+
+import (
+	"math/rand"
+	"time"
+)
+
+// TTLDict wraps a Dict and allows each key to expire, it is used by hash with field-level ttl.
+// Expired keys are invisible to reading methods, they are removed by writing methods or RemoveExpired,
+// so reading never modifies the dict. It is not thread safe.
+type TTLDict struct {
+	Dict
+	expireAt map[string]time.Time
+	// next is the earliest expiration in expireAt, it is kept by writing methods so that reading methods never modify dict
+	next time.Time
+}
+
+// MakeTTL wraps the given dict, keys of it have no expiration initially
+func MakeTTL(d Dict) *TTLDict {
+	return &TTLDict{
+		Dict:     d,
+		expireAt: make(map[string]time.Time),
+	}
+}
+
+func (dict *TTLDict) isExpired(key string, now time.Time) bool {
+	expireAt, ok := dict.expireAt[key]
+	return ok && now.After(expireAt)
+}
+
+// setExpire sets expiration of the key and keeps the earliest expiration
+func (dict *TTLDict) setExpire(key string, expireAt time.Time) {
+	old, ok := dict.expireAt[key]
+	dict.expireAt[key] = expireAt
+	if ok && old.Equal(dict.next) {
+		dict.resetNext()
+	} else if len(dict.expireAt) == 1 || expireAt.Before(dict.next) {
+		dict.next = expireAt
+	}
+}
+
+// deleteExpire removes expiration of the key and keeps the earliest expiration
+func (dict *TTLDict) deleteExpire(key string) {
+	old, ok := dict.expireAt[key]
+	if !ok {
+		return
+	}
+	delete(dict.expireAt, key)
+	if old.Equal(dict.next) {
+		dict.resetNext()
+	}
+}
+
+// resetNext finds the earliest expiration, it is called only if the key of former earliest expiration changed
+func (dict *TTLDict) resetNext() {
+	dict.next = time.Time{}
+	first := true
+	for _, expireAt := range dict.expireAt {
+		if first || expireAt.Before(dict.next) {
+			dict.next = expireAt
+			first = false
+		}
+	}
+}
+
+// removeIfExpired removes the key if it is expired, returns whether it was removed
+func (dict *TTLDict) removeIfExpired(key string) bool {
+	if !dict.isExpired(key, time.Now()) {
+		return false
+	}
+	dict.deleteExpire(key)
+	dict.Dict.Remove(key)
+	return true
+}
+
+// Get returns the binding value and whether the key is exist, expired key is treated as not exist
+func (dict *TTLDict) Get(key string) (val interface{}, exists bool) {
+	if dict.isExpired(key, time.Now()) {
+		return nil, false
+	}
+	return dict.Dict.Get(key)
+}
+
+// Len returns the number of keys not expired, it counts expired keys only if the earliest expiration has passed
+func (dict *TTLDict) Len() int {
+	now := time.Now()
+	if next, ok := dict.NextExpiration(); !ok || !now.After(next) {
+		return dict.Dict.Len()
+	}
+	expired := 0
+	for key := range dict.expireAt {
+		if dict.isExpired(key, now) {
+			expired++
+		}
+	}
+	return dict.Dict.Len() - expired
+}
+
+// Put puts key value into dict and cancels expiration of the key, like HSET overwrites a field
+func (dict *TTLDict) Put(key string, val interface{}) (result int) {
+	dict.removeIfExpired(key)
+	dict.deleteExpire(key)
+	return dict.Dict.Put(key, val)
+}
+
+// PutIfAbsent puts value if the key is not exists or expired
+func (dict *TTLDict) PutIfAbsent(key string, val interface{}) (result int) {
+	dict.removeIfExpired(key)
+	return dict.Dict.PutIfAbsent(key, val)
+}
+
+// PutIfExists updates value if the key is exists and not expired, expiration of the key is kept, like HINCRBY
+func (dict *TTLDict) PutIfExists(key string, val interface{}) (result int) {
+	if dict.removeIfExpired(key) {
+		return 0
+	}
+	return dict.Dict.PutIfExists(key, val)
+}
+
+// Remove removes the key and returns the number of deleted key-value, expired key is not counted
+func (dict *TTLDict) Remove(key string) (result int) {
+	if dict.removeIfExpired(key) {
+		return 0
+	}
+	dict.deleteExpire(key)
+	return dict.Dict.Remove(key)
+}
+
+// ForEach traversal the dict, expired keys are skipped
+func (dict *TTLDict) ForEach(consumer Consumer) {
+	now := time.Now()
+	dict.Dict.ForEach(func(key string, val interface{}) bool {
+		if dict.isExpired(key, now) {
+			return true
+		}
+		return consumer(key, val)
+	})
+}
+
+// Keys returns all keys not expired
+func (dict *TTLDict) Keys() []string {
+	keys := make([]string, 0, dict.Dict.Len())
+	dict.ForEach(func(key string, val interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// RandomKeys randomly returns keys of the given number, may contain duplicated key
+func (dict *TTLDict) RandomKeys(limit int) []string {
+	keys := dict.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	result := make([]string, limit)
+	for i := range result {
+		result[i] = keys[rand.Intn(len(keys))]
+	}
+	return result
+}
+
+// RandomDistinctKeys randomly returns keys of the given number, won't contain duplicated key
+func (dict *TTLDict) RandomDistinctKeys(limit int) []string {
+	keys := dict.Keys()
+	if limit > len(keys) {
+		limit = len(keys)
+	}
+	result := make([]string, limit)
+	for i, index := range rand.Perm(len(keys))[:limit] {
+		result[i] = keys[index]
+	}
+	return result
+}
+
+// Clear removes all keys and their expiration
+func (dict *TTLDict) Clear() {
+	dict.Dict.Clear()
+	dict.expireAt = make(map[string]time.Time)
+	dict.next = time.Time{}
+}
+
+// Expire sets expiration of an existing key, returns 0 if the key not exists
+func (dict *TTLDict) Expire(key string, expireAt time.Time) int {
+	if _, ok := dict.Get(key); !ok {
+		return 0
+	}
+	dict.setExpire(key, expireAt)
+	return 1
+}
+
+// Persist removes expiration of the key, returns 0 if the key has no expiration
+func (dict *TTLDict) Persist(key string) int {
+	if _, ok := dict.Get(key); !ok {
+		return 0
+	}
+	if _, ok := dict.expireAt[key]; !ok {
+		return 0
+	}
+	dict.deleteExpire(key)
+	return 1
+}
+
+// ExpireTime returns expiration of the key, ok is false if the key has no expiration or not exists
+func (dict *TTLDict) ExpireTime(key string) (expireAt time.Time, ok bool) {
+	if _, exists := dict.Get(key); !exists {
+		return time.Time{}, false
+	}
+	expireAt, ok = dict.expireAt[key]
+	return expireAt, ok
+}
+
+// NextExpiration returns the earliest expiration of keys, ok is false if no key has expiration
+func (dict *TTLDict) NextExpiration() (next time.Time, ok bool) {
+	if len(dict.expireAt) == 0 {
+		return time.Time{}, false
+	}
+	return dict.next, true
+}
+
+// RemoveExpired removes all expired keys and returns the number of them
+func (dict *TTLDict) RemoveExpired() int {
+	now := time.Now()
+	removed := 0
+	for key := range dict.expireAt {
+		if dict.isExpired(key, now) {
+			delete(dict.expireAt, key)
+			dict.Dict.Remove(key)
+			removed++
+		}
+	}
+	if removed > 0 {
+		dict.resetNext()
+	}
+	return removed
+}
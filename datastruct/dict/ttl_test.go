@@ -0,0 +1,103 @@
+package dict
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLDict(t *testing.T) {
+	d := MakeTTL(MakeSimple())
+	d.Put("a", 1)
+	d.Put("b", 2)
+	d.Put("c", 3)
+	if d.Expire("d", time.Now().Add(time.Hour)) != 0 {
+		t.Error("expect 0 for not existed key")
+	}
+	d.Expire("a", time.Now().Add(-time.Second))
+	d.Expire("b", time.Now().Add(time.Hour))
+
+	if _, ok := d.Get("a"); ok {
+		t.Error("expired key should be invisible")
+	}
+	if d.Len() != 2 {
+		t.Errorf("expect 2 keys, actual: %d", d.Len())
+	}
+	if len(d.Keys()) != 2 || len(d.RandomDistinctKeys(10)) != 2 {
+		t.Error("expired key should be skipped")
+	}
+	for _, key := range d.RandomKeys(10) {
+		if key == "a" {
+			t.Error("expired key should be skipped")
+		}
+	}
+	if next, ok := d.NextExpiration(); !ok || next.After(time.Now()) {
+		t.Error("wrong next expiration")
+	}
+	if d.RemoveExpired() != 1 {
+		t.Error("expect 1 key removed")
+	}
+	if _, ok := d.NextExpiration(); !ok {
+		t.Error("expect next expiration")
+	}
+
+	if _, ok := d.ExpireTime("b"); !ok {
+		t.Error("expect expiration of b")
+	}
+	d.Put("b", 4)
+	if _, ok := d.ExpireTime("b"); ok {
+		t.Error("put should cancel expiration")
+	}
+	d.Expire("c", time.Now().Add(time.Hour))
+	if d.Persist("c") != 1 || d.Persist("c") != 0 {
+		t.Error("wrong persist result")
+	}
+	d.Expire("c", time.Now().Add(-time.Second))
+	if d.PutIfAbsent("c", 5) != 1 {
+		t.Error("expired key should be treated as absent")
+	}
+	if d.Remove("c") != 1 || d.Len() != 1 {
+		t.Error("wrong remove result")
+	}
+}
+
+func TestTTLDictNextExpiration(t *testing.T) {
+	d := MakeTTL(MakeSimple())
+	now := time.Now()
+	for i, key := range []string{"a", "b", "c"} {
+		d.Put(key, i)
+		d.Expire(key, now.Add(time.Duration(i+1)*time.Hour))
+	}
+	assertNext := func(expected time.Time) {
+		if next, ok := d.NextExpiration(); !ok || !next.Equal(expected) {
+			t.Errorf("expect next expiration %s, actually %s", expected, next)
+		}
+	}
+	assertNext(now.Add(time.Hour))
+	d.Expire("a", now.Add(4*time.Hour)) // the earliest one is postponed
+	assertNext(now.Add(2 * time.Hour))
+	d.Expire("c", now.Add(time.Minute))
+	assertNext(now.Add(time.Minute))
+	d.Persist("c")
+	assertNext(now.Add(2 * time.Hour))
+	d.Remove("b")
+	assertNext(now.Add(4 * time.Hour))
+	d.Put("a", 0)
+	if _, ok := d.NextExpiration(); ok {
+		t.Error("expect no expiration")
+	}
+
+	// expired keys are counted after the earliest expiration passed
+	d.Put("b", 1)
+	d.Expire("a", now.Add(-time.Second))
+	d.Expire("b", now.Add(time.Hour))
+	if d.Len() != 2 {
+		t.Errorf("expect 2 keys, actually %d", d.Len())
+	}
+	if d.RemoveExpired() != 1 {
+		t.Error("expect 1 key removed")
+	}
+	assertNext(now.Add(time.Hour))
+	if d.Len() != 2 {
+		t.Errorf("expect 2 keys, actually %d", d.Len())
+	}
+}
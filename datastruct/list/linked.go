@@ -240,6 +240,24 @@ func (list *LinkedList) ForEach(consumer func(int, interface{}) bool) {
 	}
 }
 
+// ReverseForEach visits each element in the list from tail to head, index passed to consumer is counted from head
+// if the consumer returns false, the loop will be break
+func (list *LinkedList) ReverseForEach(consumer func(int, interface{}) bool) {
+	if list == nil {
+		panic("list is nil")
+	}
+	n := list.last
+	i := list.size - 1
+	for n != nil {
+		goNext := consumer(i, n.val)
+		if !goNext {
+			break
+		}
+		i--
+		n = n.prev
+	}
+}
+
 // Contains returns whether the given value exist in the list
 func (list *LinkedList) Contains(val interface{}) bool {
 	contains := false
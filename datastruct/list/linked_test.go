@@ -30,6 +30,22 @@ func TestAdd(t *testing.T) {
 	})
 }
 
+func TestReverseForEach(t *testing.T) {
+	list := Make(0, 1, 2, 3, 4)
+	expected := 4
+	list.ReverseForEach(func(i int, v interface{}) bool {
+		intVal, _ := v.(int)
+		if i != expected || intVal != expected {
+			t.Errorf("reverse for each fail: expected %d, actual index %d value %d", expected, i, intVal)
+		}
+		expected--
+		return expected >= 2
+	})
+	if expected != 1 {
+		t.Errorf("reverse for each should stop at index 2")
+	}
+}
+
 func TestLinkedList_Contains(t *testing.T) {
 	list := Make(1, 2, 3, 4)
 	if !list.Contains(1) {
@@ -0,0 +1,21 @@
+package list
+
+// List is interface of list data structure, index of elements starts from 0
+type List interface {
+	Add(val interface{})
+	Get(index int) (val interface{})
+	Set(index int, val interface{})
+	Insert(index int, val interface{})
+	Remove(index int) (val interface{})
+	RemoveLast() (val interface{})
+	RemoveAllByVal(val interface{}) int
+	RemoveByVal(val interface{}, count int) int
+	ReverseRemoveByVal(val interface{}, count int) int
+	Len() int
+	// ForEach visits elements from head to tail, the traversal will be break if consumer returns false
+	ForEach(consumer func(int, interface{}) bool)
+	// ReverseForEach visits elements from tail to head, index passed to consumer is counted from head
+	ReverseForEach(consumer func(int, interface{}) bool)
+	Contains(val interface{}) bool
+	Range(start int, stop int) []interface{}
+}
@@ -0,0 +1,580 @@
+package list
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	// pageSize is the max number of elements in a page
+	pageSize = 1024
+	// pageBytes is the max size of encoded elements in a page, a page holding a single large element may exceed it
+	pageBytes = 8 * 1024
+	// minPageCap is the initial capacity of page buffer, buffer grows on demand
+	minPageCap = 16
+)
+
+// QuickList is a linked list of pages, each page packs its elements into a byte buffer like listpack of redis.
+// It needs much less pointers and memory than LinkedList, and index seeks skip whole pages.
+// QuickList only holds []byte values, values are copied when putting into or getting from list.
+type QuickList struct {
+	first *page
+	last  *page
+	size  int
+}
+
+/*
+ * page buffer is a sequence of entries: <uvarint len><data><backlen>
+ * backlen is the size of <uvarint len><data> encoded as uvarint in reversed byte order,
+ * so it can be decoded from its last byte when traversing backwards.
+ */
+type page struct {
+	buf   []byte
+	count int
+	prev  *page
+	next  *page
+}
+
+// iterator of QuickList, it points to an element in a page, or the position after the last element if offset equals page count
+type iterator struct {
+	page   *page
+	offset int // index of element in page
+	pos    int // position of element in page buffer
+	ql     *QuickList
+}
+
+func toBytes(val interface{}) []byte {
+	bs, ok := val.([]byte)
+	if !ok {
+		panic("quick list only supports []byte values")
+	}
+	return bs
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for x >= 0x80 {
+		x >>= 7
+		n++
+	}
+	return n
+}
+
+// entrySize returns size of encoded val
+func entrySize(val []byte) int {
+	n := uvarintLen(uint64(len(val))) + len(val)
+	return n + uvarintLen(uint64(n))
+}
+
+// putEntry encodes val into buf, buf should have at least entrySize(val) bytes
+func putEntry(buf []byte, val []byte) {
+	n := binary.PutUvarint(buf, uint64(len(val)))
+	n += copy(buf[n:], val)
+	var backlen [binary.MaxVarintLen64]byte
+	m := binary.PutUvarint(backlen[:], uint64(n))
+	for i := 0; i < m; i++ {
+		buf[n+i] = backlen[m-1-i]
+	}
+}
+
+// entryAt decodes the element at pos, returned value shares memory with page buffer
+func (p *page) entryAt(pos int) (val []byte, size int) {
+	l, n := binary.Uvarint(p.buf[pos:])
+	val = p.buf[pos+n : pos+n+int(l)]
+	return val, n + int(l) + uvarintLen(uint64(n)+l)
+}
+
+// prevPos returns position of the element before the element at pos
+func (p *page) prevPos(pos int) int {
+	var size uint64
+	i := pos - 1
+	for shift := uint(0); ; shift += 7 {
+		b := p.buf[i]
+		size |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			break
+		}
+		i--
+	}
+	return i - int(size)
+}
+
+// seek returns position of the element at offset, it scans from the nearer end of page
+func (p *page) seek(offset int) int {
+	if offset < p.count/2 {
+		pos := 0
+		for i := 0; i < offset; i++ {
+			_, size := p.entryAt(pos)
+			pos += size
+		}
+		return pos
+	}
+	pos := len(p.buf)
+	for i := p.count; i > offset; i-- {
+		pos = p.prevPos(pos)
+	}
+	return pos
+}
+
+// isFull returns whether page has no room for an entry of given size, an empty page always has room
+func (p *page) isFull(size int) bool {
+	return p.count >= pageSize || (p.count > 0 && len(p.buf)+size > pageBytes)
+}
+
+// grow makes sure there is room for size bytes, buffer grows on demand so small lists take little memory
+func (p *page) grow(size int) {
+	n := len(p.buf)
+	if n+size <= cap(p.buf) {
+		return
+	}
+	newCap := cap(p.buf) * 2
+	if newCap > pageBytes {
+		newCap = pageBytes
+	}
+	if newCap < minPageCap {
+		newCap = minPageCap
+	}
+	if newCap < n+size {
+		newCap = n + size
+	}
+	buf := make([]byte, n, newCap)
+	copy(buf, p.buf)
+	p.buf = buf
+}
+
+// shrink releases memory if most of buffer is free
+func (p *page) shrink() {
+	if cap(p.buf) > minPageCap && len(p.buf) < cap(p.buf)/4 {
+		buf := make([]byte, len(p.buf), cap(p.buf)/2)
+		copy(buf, p.buf)
+		p.buf = buf
+	}
+}
+
+// insert puts val at pos of page buffer, following elements are moved backward
+func (p *page) insert(pos int, val []byte) {
+	size := entrySize(val)
+	n := len(p.buf)
+	p.grow(size)
+	p.buf = p.buf[:n+size]
+	copy(p.buf[pos+size:], p.buf[pos:n])
+	putEntry(p.buf[pos:], val)
+	p.count++
+}
+
+// remove deletes the element at pos of page buffer and returns a copy of it
+func (p *page) remove(pos int) []byte {
+	entry, size := p.entryAt(pos)
+	val := append([]byte{}, entry...)
+	copy(p.buf[pos:], p.buf[pos+size:])
+	p.buf = p.buf[:len(p.buf)-size]
+	p.count--
+	p.shrink()
+	return val
+}
+
+// split moves elements from offset to the end into a new page, pos is position of the element at offset
+func (p *page) split(pos int, offset int) *page {
+	rest := &page{
+		buf:   make([]byte, len(p.buf)-pos),
+		count: p.count - offset,
+	}
+	copy(rest.buf, p.buf[pos:])
+	p.buf = p.buf[:pos]
+	p.count = offset
+	p.shrink()
+	return rest
+}
+
+// NewQuickList creates an empty QuickList
+func NewQuickList() *QuickList {
+	return &QuickList{}
+}
+
+// MakeQuickList creates a QuickList holding given values
+func MakeQuickList(vals ...interface{}) *QuickList {
+	ql := NewQuickList()
+	for _, v := range vals {
+		ql.Add(v)
+	}
+	return ql
+}
+
+func (ql *QuickList) insertPageBefore(p *page, mark *page) {
+	p.next = mark
+	if mark == nil {
+		// append at tail
+		p.prev = ql.last
+		if ql.last == nil {
+			ql.first = p
+		} else {
+			ql.last.next = p
+		}
+		ql.last = p
+		return
+	}
+	p.prev = mark.prev
+	if mark.prev == nil {
+		ql.first = p
+	} else {
+		mark.prev.next = p
+	}
+	mark.prev = p
+}
+
+func (ql *QuickList) removePage(p *page) {
+	if p.prev == nil {
+		ql.first = p.next
+	} else {
+		p.prev.next = p.next
+	}
+	if p.next == nil {
+		ql.last = p.prev
+	} else {
+		p.next.prev = p.prev
+	}
+	p.prev = nil
+	p.next = nil
+}
+
+// Add adds value to the tail
+func (ql *QuickList) Add(val interface{}) {
+	if ql == nil {
+		panic("list is nil")
+	}
+	bs := toBytes(val)
+	if ql.last == nil || ql.last.isFull(entrySize(bs)) {
+		ql.insertPageBefore(&page{}, nil)
+	}
+	ql.last.insert(len(ql.last.buf), bs)
+	ql.size++
+}
+
+// find returns an iterator pointing to the element at given index
+func (ql *QuickList) find(index int) *iterator {
+	if ql == nil {
+		panic("list is nil")
+	}
+	if index < 0 || index >= ql.size {
+		panic("index out of bound")
+	}
+	var p *page
+	var pageBeg int
+	if index < ql.size/2 {
+		// search from front
+		p = ql.first
+		pageBeg = 0
+		for pageBeg+p.count <= index {
+			pageBeg += p.count
+			p = p.next
+		}
+	} else {
+		// search from back
+		p = ql.last
+		pageBeg = ql.size - p.count
+		for pageBeg > index {
+			p = p.prev
+			pageBeg -= p.count
+		}
+	}
+	return &iterator{
+		page:   p,
+		offset: index - pageBeg,
+		pos:    p.seek(index - pageBeg),
+		ql:     ql,
+	}
+}
+
+func (iter *iterator) get() []byte {
+	val, _ := iter.page.entryAt(iter.pos)
+	return append([]byte{}, val...)
+}
+
+func (iter *iterator) equals(val []byte) bool {
+	actual, _ := iter.page.entryAt(iter.pos)
+	return bytes.Equal(actual, val)
+}
+
+// next moves iterator to the next element, returns false if there is no more element
+func (iter *iterator) next() bool {
+	if iter.offset < iter.page.count-1 {
+		_, size := iter.page.entryAt(iter.pos)
+		iter.pos += size
+		iter.offset++
+		return true
+	}
+	if iter.page.next == nil {
+		// move to the position after the last element
+		iter.offset = iter.page.count
+		iter.pos = len(iter.page.buf)
+		return false
+	}
+	iter.page = iter.page.next
+	iter.offset = 0
+	iter.pos = 0
+	return true
+}
+
+// prev moves iterator to the previous element, returns false if there is no more element
+func (iter *iterator) prev() bool {
+	if iter.offset > 0 {
+		iter.pos = iter.page.prevPos(iter.pos)
+		iter.offset--
+		return true
+	}
+	if iter.page.prev == nil {
+		return false
+	}
+	iter.page = iter.page.prev
+	iter.offset = iter.page.count - 1
+	iter.pos = iter.page.prevPos(len(iter.page.buf))
+	return true
+}
+
+// atEnd returns whether iterator has moved out of the list
+func (iter *iterator) atEnd() bool {
+	return iter.page == nil || (iter.page.next == nil && iter.offset >= iter.page.count)
+}
+
+// remove removes the element pointed by iterator, then iterator points to the element after it
+func (iter *iterator) remove() []byte {
+	p := iter.page
+	val := p.remove(iter.pos)
+	iter.ql.size--
+	if p.count == 0 {
+		// page is empty, remove it
+		if p.next == nil {
+			iter.page = p.prev
+			if iter.page != nil {
+				iter.offset = iter.page.count
+				iter.pos = len(iter.page.buf)
+			}
+		} else {
+			iter.page = p.next
+			iter.offset = 0
+			iter.pos = 0
+		}
+		iter.ql.removePage(p)
+		return val
+	}
+	if iter.offset == p.count && p.next != nil {
+		iter.page = p.next
+		iter.offset = 0
+		iter.pos = 0
+	}
+	return val
+}
+
+// Get returns value at the given index
+func (ql *QuickList) Get(index int) (val interface{}) {
+	return ql.find(index).get()
+}
+
+// Set updates value at the given index, the index should between [0, list.size)
+func (ql *QuickList) Set(index int, val interface{}) {
+	bs := toBytes(val)
+	iter := ql.find(index)
+	old, size := iter.page.entryAt(iter.pos)
+	if entrySize(bs) != size || iter.page.count == 1 {
+		// re-insert it, so that page is split if new value is larger
+		ql.Remove(index)
+		ql.Insert(index, bs)
+		return
+	}
+	copy(old, bs)
+}
+
+// Insert inserts value at the given index, the original element at the given index will move backward
+func (ql *QuickList) Insert(index int, val interface{}) {
+	if ql == nil {
+		panic("list is nil")
+	}
+	if index < 0 || index > ql.size {
+		panic("index out of bound")
+	}
+	if index == ql.size {
+		ql.Add(val)
+		return
+	}
+	bs := toBytes(val)
+	size := entrySize(bs)
+	iter := ql.find(index)
+	p := iter.page
+	ql.size++
+	if !p.isFull(size) {
+		p.insert(iter.pos, bs)
+		return
+	}
+	// put val at the tail of previous page, split the full page at the inserting position if val is in the middle of it
+	prev, mark := p.prev, p
+	if iter.offset > 0 {
+		mark = p.split(iter.pos, iter.offset)
+		ql.insertPageBefore(mark, p.next)
+		prev = p
+	}
+	if prev == nil || prev.isFull(size) {
+		prev = &page{}
+		ql.insertPageBefore(prev, mark)
+	}
+	prev.insert(len(prev.buf), bs)
+}
+
+// Remove removes value at the given index
+func (ql *QuickList) Remove(index int) (val interface{}) {
+	return ql.find(index).remove()
+}
+
+// RemoveLast removes the last element and returns its value
+func (ql *QuickList) RemoveLast() (val interface{}) {
+	if ql.size == 0 {
+		return nil
+	}
+	return ql.find(ql.size - 1).remove()
+}
+
+// RemoveAllByVal removes all elements with the given val
+func (ql *QuickList) RemoveAllByVal(val interface{}) int {
+	return ql.RemoveByVal(val, 0)
+}
+
+// RemoveByVal removes at most `count` values of the specified value in this list, `count` 0 means removing all
+// scan from left to right
+func (ql *QuickList) RemoveByVal(val interface{}, count int) int {
+	if ql.size == 0 {
+		return 0
+	}
+	bs := toBytes(val)
+	iter := &iterator{page: ql.first, ql: ql}
+	removed := 0
+	for !iter.atEnd() {
+		if iter.equals(bs) {
+			iter.remove()
+			removed++
+			if removed == count {
+				break
+			}
+		} else {
+			iter.next()
+		}
+	}
+	return removed
+}
+
+// ReverseRemoveByVal removes at most `count` values of the specified value in this list, `count` 0 means removing all
+// scan from right to left
+func (ql *QuickList) ReverseRemoveByVal(val interface{}, count int) int {
+	if ql.size == 0 {
+		return 0
+	}
+	bs := toBytes(val)
+	iter := ql.find(ql.size - 1)
+	removed := 0
+	for {
+		if !iter.equals(bs) {
+			if !iter.prev() {
+				break
+			}
+			continue
+		}
+		// elements before iterator are not affected by removing
+		prev := *iter
+		hasPrev := prev.prev()
+		iter.remove()
+		removed++
+		if removed == count || !hasPrev {
+			break
+		}
+		*iter = prev
+	}
+	return removed
+}
+
+// Len returns the number of elements in list
+func (ql *QuickList) Len() int {
+	if ql == nil {
+		panic("list is nil")
+	}
+	return ql.size
+}
+
+// forEachEntry visits each element in the list, value passed to consumer shares memory with page buffer
+func (ql *QuickList) forEachEntry(consumer func(int, []byte) bool) {
+	if ql == nil {
+		panic("list is nil")
+	}
+	i := 0
+	for p := ql.first; p != nil; p = p.next {
+		pos := 0
+		for j := 0; j < p.count; j++ {
+			val, size := p.entryAt(pos)
+			if !consumer(i, val) {
+				return
+			}
+			pos += size
+			i++
+		}
+	}
+}
+
+// ForEach visits each element in the list
+// if the consumer returns false, the loop will be break
+func (ql *QuickList) ForEach(consumer func(int, interface{}) bool) {
+	ql.forEachEntry(func(i int, val []byte) bool {
+		return consumer(i, append([]byte{}, val...))
+	})
+}
+
+// ReverseForEach visits each element in the list from tail to head, index passed to consumer is counted from head
+// if the consumer returns false, the loop will be break
+func (ql *QuickList) ReverseForEach(consumer func(int, interface{}) bool) {
+	if ql == nil {
+		panic("list is nil")
+	}
+	i := ql.size - 1
+	for p := ql.last; p != nil; p = p.prev {
+		pos := len(p.buf)
+		for j := p.count - 1; j >= 0; j-- {
+			pos = p.prevPos(pos)
+			val, _ := p.entryAt(pos)
+			if !consumer(i, append([]byte{}, val...)) {
+				return
+			}
+			i--
+		}
+	}
+}
+
+// Contains returns whether the given value exist in the list
+func (ql *QuickList) Contains(val interface{}) bool {
+	bs := toBytes(val)
+	contains := false
+	ql.forEachEntry(func(i int, actual []byte) bool {
+		if bytes.Equal(actual, bs) {
+			contains = true
+			return false
+		}
+		return true
+	})
+	return contains
+}
+
+// Range returns elements which index within [start, stop)
+func (ql *QuickList) Range(start int, stop int) []interface{} {
+	if ql == nil {
+		panic("list is nil")
+	}
+	if start < 0 || start >= ql.size {
+		panic("`start` out of range")
+	}
+	if stop < start || stop > ql.size {
+		panic("`stop` out of range")
+	}
+	sliceSize := stop - start
+	slice := make([]interface{}, 0, sliceSize)
+	iter := ql.find(start)
+	for len(slice) < sliceSize {
+		slice = append(slice, iter.get())
+		iter.next()
+	}
+	return slice
+}
@@ -0,0 +1,358 @@
+package list
+
+import (
+	"math/rand"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// intVal encodes i as list element, QuickList only holds []byte values
+func intVal(i int) []byte {
+	return []byte(strconv.Itoa(i))
+}
+
+func toInt(v interface{}) int {
+	i, _ := strconv.Atoi(string(v.([]byte)))
+	return i
+}
+
+// assertListEquals checks elements of list by ForEach, ReverseForEach, Get and Range
+func assertListEquals(t *testing.T, list List, expected []int) {
+	t.Helper()
+	if list.Len() != len(expected) {
+		t.Fatalf("expected len %d, actual %d", len(expected), list.Len())
+	}
+	list.ForEach(func(i int, v interface{}) bool {
+		if toInt(v) != expected[i] {
+			t.Fatalf("for each: expected %d at %d, actual %d", expected[i], i, toInt(v))
+		}
+		return true
+	})
+	list.ReverseForEach(func(i int, v interface{}) bool {
+		if toInt(v) != expected[i] {
+			t.Fatalf("reverse for each: expected %d at %d, actual %d", expected[i], i, toInt(v))
+		}
+		return true
+	})
+	for i := 0; i < len(expected); i += 97 {
+		if v := toInt(list.Get(i)); v != expected[i] {
+			t.Fatalf("get: expected %d at %d, actual %d", expected[i], i, v)
+		}
+	}
+	if len(expected) > 0 {
+		start := len(expected) / 3
+		for i, v := range list.Range(start, len(expected)) {
+			if toInt(v) != expected[start+i] {
+				t.Fatalf("range: expected %d at %d, actual %d", expected[start+i], start+i, toInt(v))
+			}
+		}
+	}
+}
+
+func TestQuickListAddAndRemove(t *testing.T) {
+	ql := NewQuickList()
+	var expected []int
+	size := pageSize*3 + 10
+	for i := 0; i < size; i++ {
+		ql.Add(intVal(i))
+		expected = append(expected, i)
+	}
+	assertListEquals(t, ql, expected)
+	for i := 0; i < pageSize+5; i++ {
+		if v := toInt(ql.Remove(0)); v != expected[0] {
+			t.Fatalf("remove: expected %d, actual %d", expected[0], v)
+		}
+		expected = expected[1:]
+	}
+	for i := 0; i < pageSize+5; i++ {
+		if v := toInt(ql.RemoveLast()); v != expected[len(expected)-1] {
+			t.Fatalf("remove last: expected %d, actual %d", expected[len(expected)-1], v)
+		}
+		expected = expected[:len(expected)-1]
+	}
+	assertListEquals(t, ql, expected)
+	for ql.Len() > 0 {
+		ql.RemoveLast()
+	}
+	if ql.RemoveLast() != nil {
+		t.Error("expect nil from empty list")
+	}
+	ql.Add(intVal(1))
+	assertListEquals(t, ql, []int{1})
+}
+
+func TestQuickListInsert(t *testing.T) {
+	ql := NewQuickList()
+	var expected []int
+	// push at head
+	for i := 0; i < pageSize*2+3; i++ {
+		ql.Insert(0, intVal(i))
+		expected = append([]int{i}, expected...)
+	}
+	assertListEquals(t, ql, expected)
+	// insert at random position, full pages should be split
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < pageSize*3; i++ {
+		index := r.Intn(len(expected) + 1)
+		ql.Insert(index, intVal(-i))
+		expected = append(expected[:index], append([]int{-i}, expected[index:]...)...)
+	}
+	assertListEquals(t, ql, expected)
+	for i := 0; i < pageSize; i++ {
+		index := r.Intn(len(expected))
+		ql.Set(index, intVal(i))
+		expected[index] = i
+		index = r.Intn(len(expected))
+		if v := toInt(ql.Remove(index)); v != expected[index] {
+			t.Fatalf("remove: expected %d, actual %d", expected[index], v)
+		}
+		expected = append(expected[:index], expected[index+1:]...)
+	}
+	assertListEquals(t, ql, expected)
+}
+
+func TestQuickListRandomOps(t *testing.T) {
+	ql := NewQuickList()
+	var expected []int
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < pageSize*20; i++ {
+		switch op := r.Intn(10); {
+		case op < 3:
+			ql.Insert(0, intVal(i))
+			expected = append([]int{i}, expected...)
+		case op < 6:
+			ql.Add(intVal(i))
+			expected = append(expected, i)
+		case op < 7 && len(expected) > 0:
+			ql.Remove(0)
+			expected = expected[1:]
+		case op < 8 && len(expected) > 0:
+			ql.RemoveLast()
+			expected = expected[:len(expected)-1]
+		case op < 9:
+			index := r.Intn(len(expected) + 1)
+			ql.Insert(index, intVal(i))
+			expected = append(expected[:index], append([]int{i}, expected[index:]...)...)
+		case len(expected) > 0:
+			index := r.Intn(len(expected))
+			ql.Remove(index)
+			expected = append(expected[:index], expected[index+1:]...)
+		}
+	}
+	assertListEquals(t, ql, expected)
+}
+
+func TestQuickListRemoveByVal(t *testing.T) {
+	ql := NewQuickList()
+	var expected []int
+	for i := 0; i < pageSize*4; i++ {
+		ql.Add(intVal(i % 3))
+		expected = append(expected, i%3)
+	}
+	removeByVal := func(val int, count int, reverse bool) []int {
+		result := make([]int, 0, len(expected))
+		removed := 0
+		if reverse {
+			for i := len(expected) - 1; i >= 0; i-- {
+				if expected[i] == val && (count == 0 || removed < count) {
+					removed++
+					continue
+				}
+				result = append([]int{expected[i]}, result...)
+			}
+			return result
+		}
+		for _, v := range expected {
+			if v == val && (count == 0 || removed < count) {
+				removed++
+				continue
+			}
+			result = append(result, v)
+		}
+		return result
+	}
+
+	if removed := ql.RemoveByVal(intVal(1), 10); removed != 10 {
+		t.Errorf("expected 10, actual %d", removed)
+	}
+	expected = removeByVal(1, 10, false)
+	assertListEquals(t, ql, expected)
+	if removed := ql.ReverseRemoveByVal(intVal(1), pageSize+1); removed != pageSize+1 {
+		t.Errorf("expected %d, actual %d", pageSize+1, removed)
+	}
+	expected = removeByVal(1, pageSize+1, true)
+	assertListEquals(t, ql, expected)
+	if !ql.Contains(intVal(1)) {
+		t.Error("expect true actual false")
+	}
+	ql.RemoveAllByVal(intVal(1))
+	expected = removeByVal(1, 0, false)
+	assertListEquals(t, ql, expected)
+	if ql.Contains(intVal(1)) {
+		t.Error("expect false actual true")
+	}
+	if removed := ql.ReverseRemoveByVal(intVal(0), 0); removed != pageSize*4/3+1 {
+		t.Errorf("expected %d, actual %d", pageSize*4/3+1, removed)
+	}
+	expected = removeByVal(0, 0, true)
+	assertListEquals(t, ql, expected)
+	ql.RemoveAllByVal(intVal(2))
+	assertListEquals(t, ql, nil)
+}
+
+func TestQuickListElementSize(t *testing.T) {
+	ql := NewQuickList()
+	var expected [][]byte
+	r := rand.New(rand.NewSource(3))
+	sizes := []int{0, 1, 127, 128, 300, pageBytes, pageBytes * 3}
+	for i := 0; i < 2000; i++ {
+		val := make([]byte, sizes[r.Intn(len(sizes))])
+		r.Read(val)
+		index := r.Intn(len(expected) + 1)
+		ql.Insert(index, val)
+		expected = append(expected[:index], append([][]byte{val}, expected[index:]...)...)
+		if i%3 == 0 {
+			index = r.Intn(len(expected))
+			if v := ql.Remove(index).([]byte); string(v) != string(expected[index]) {
+				t.Fatalf("remove: unexpected value at %d", index)
+			}
+			expected = append(expected[:index], expected[index+1:]...)
+		}
+	}
+	for p := ql.first; p != nil; p = p.next {
+		if p.count > 1 && len(p.buf) > pageBytes {
+			t.Errorf("page holding %d elements exceeds %d bytes: %d", p.count, pageBytes, len(p.buf))
+		}
+	}
+	ql.ReverseForEach(func(i int, v interface{}) bool {
+		if string(v.([]byte)) != string(expected[i]) {
+			t.Fatalf("reverse for each: unexpected value at %d", i)
+		}
+		return true
+	})
+	for i, v := range ql.Range(0, len(expected)) {
+		if string(v.([]byte)) != string(expected[i]) {
+			t.Fatalf("range: unexpected value at %d", i)
+		}
+	}
+	// value got from list is a copy
+	v := ql.Get(0).([]byte)
+	if len(v) > 0 {
+		v[0]++
+		if string(ql.Get(0).([]byte)) != string(expected[0]) {
+			t.Error("modifying returned value should not affect list")
+		}
+	}
+}
+
+func TestQuickListImplementsList(t *testing.T) {
+	var list List = NewQuickList()
+	for i := 0; i < 10; i++ {
+		list.Add([]byte(strconv.Itoa(i)))
+	}
+	if !list.Contains([]byte("5")) {
+		t.Error("expect true actual false")
+	}
+}
+
+func benchmarkAdd(b *testing.B, list List) {
+	for i := 0; i < b.N; i++ {
+		list.Add(intVal(i))
+	}
+}
+
+func BenchmarkLinkedListAdd(b *testing.B) {
+	benchmarkAdd(b, Make())
+}
+
+func BenchmarkQuickListAdd(b *testing.B) {
+	benchmarkAdd(b, NewQuickList())
+}
+
+func benchmarkGet(b *testing.B, list List) {
+	size := 1000000
+	for i := 0; i < size; i++ {
+		list.Add(intVal(i))
+	}
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list.Get(r.Intn(size))
+	}
+}
+
+func BenchmarkLinkedListGet(b *testing.B) {
+	benchmarkGet(b, Make())
+}
+
+func BenchmarkQuickListGet(b *testing.B) {
+	benchmarkGet(b, NewQuickList())
+}
+
+func benchmarkRange(b *testing.B, list List) {
+	size := 1000000
+	for i := 0; i < size; i++ {
+		list.Add(intVal(i))
+	}
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := r.Intn(size - 100)
+		list.Range(start, start+100)
+	}
+}
+
+func BenchmarkLinkedListRange(b *testing.B) {
+	benchmarkRange(b, Make())
+}
+
+func BenchmarkQuickListRange(b *testing.B) {
+	benchmarkRange(b, NewQuickList())
+}
+
+func benchmarkPushPop(b *testing.B, list List) {
+	for i := 0; i < b.N; i++ {
+		list.Insert(0, intVal(i))
+		if i%3 == 0 {
+			list.Remove(0)
+		}
+	}
+}
+
+func BenchmarkLinkedListPushPop(b *testing.B) {
+	benchmarkPushPop(b, Make())
+}
+
+func BenchmarkQuickListPushPop(b *testing.B) {
+	benchmarkPushPop(b, NewQuickList())
+}
+
+// benchmarkSmallListMemory reports heap bytes taken by a list holding a few small elements
+func benchmarkSmallListMemory(b *testing.B, makeList func() List) {
+	lists := make([]List, b.N)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list := makeList()
+		for j := 0; j < 5; j++ {
+			list.Add(intVal(j))
+		}
+		lists[i] = list
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "heap-bytes/op")
+	runtime.KeepAlive(lists)
+}
+
+func BenchmarkLinkedListSmallMemory(b *testing.B) {
+	benchmarkSmallListMemory(b, func() List { return Make() })
+}
+
+func BenchmarkQuickListSmallMemory(b *testing.B) {
+	benchmarkSmallListMemory(b, func() List { return NewQuickList() })
+}
@@ -0,0 +1,95 @@
+package set
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// maxIntSetSize is the max number of members in intset encoding, like set-max-intset-entries of redis
+const maxIntSetSize = 512
+
+// intSet is a sorted array of integers, it takes much less memory than hash table for small integer sets
+type intSet struct {
+	vals []int64
+}
+
+// parseIntMember returns the integer form of member, ok is false if member cannot be converted back to the same string
+func parseIntMember(member string) (val int64, ok bool) {
+	val, err := strconv.ParseInt(member, 10, 64)
+	if err != nil || strconv.FormatInt(val, 10) != member {
+		// such as "+1" and "01"
+		return 0, false
+	}
+	return val, true
+}
+
+func (set *intSet) search(val int64) (int, bool) {
+	i := sort.Search(len(set.vals), func(i int) bool {
+		return set.vals[i] >= val
+	})
+	return i, i < len(set.vals) && set.vals[i] == val
+}
+
+func (set *intSet) has(val int64) bool {
+	_, ok := set.search(val)
+	return ok
+}
+
+func (set *intSet) add(val int64) int {
+	i, ok := set.search(val)
+	if ok {
+		return 0
+	}
+	set.vals = append(set.vals, 0)
+	copy(set.vals[i+1:], set.vals[i:])
+	set.vals[i] = val
+	return 1
+}
+
+func (set *intSet) remove(val int64) int {
+	i, ok := set.search(val)
+	if !ok {
+		return 0
+	}
+	set.vals = append(set.vals[:i], set.vals[i+1:]...)
+	return 1
+}
+
+func (set *intSet) len() int {
+	return len(set.vals)
+}
+
+func (set *intSet) get(i int) string {
+	return strconv.FormatInt(set.vals[i], 10)
+}
+
+func (set *intSet) forEach(consumer func(member string) bool) {
+	for i := range set.vals {
+		if !consumer(set.get(i)) {
+			return
+		}
+	}
+}
+
+func (set *intSet) randomMembers(limit int) []string {
+	if len(set.vals) == 0 {
+		return nil
+	}
+	result := make([]string, limit)
+	for i := range result {
+		result[i] = set.get(rand.Intn(len(set.vals)))
+	}
+	return result
+}
+
+func (set *intSet) randomDistinctMembers(limit int) []string {
+	if limit > len(set.vals) {
+		limit = len(set.vals)
+	}
+	result := make([]string, limit)
+	for i, index := range rand.Perm(len(set.vals))[:limit] {
+		result[i] = set.get(index)
+	}
+	return result
+}
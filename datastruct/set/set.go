@@ -2,15 +2,18 @@ package set
 
 import "github.com/hdt3213/godis/datastruct/dict"
 
-// Set is a set of elements based on hash table
+// Set is a set of elements based on hash table.
+// Small set of integers is stored as a sorted array, it is converted to hash table automatically
 type Set struct {
 	dict dict.Dict
+	// not nil if the set is in intset encoding, dict is nil then
+	intset *intSet
 }
 
 // Make creates a new set
 func Make(members ...string) *Set {
 	set := &Set{
-		dict: dict.MakeSimple(),
+		intset: &intSet{},
 	}
 	for _, member := range members {
 		set.Add(member)
@@ -18,24 +21,62 @@ func Make(members ...string) *Set {
 	return set
 }
 
+// toDict converts intset encoding to hash table
+func (set *Set) toDict() {
+	d := dict.MakeSimple()
+	set.intset.forEach(func(member string) bool {
+		d.Put(member, nil)
+		return true
+	})
+	set.dict = d
+	set.intset = nil
+}
+
+// IsIntSet returns whether the set is in intset encoding
+func (set *Set) IsIntSet() bool {
+	return set.intset != nil
+}
+
 // Add adds member into set
 func (set *Set) Add(val string) int {
+	if set.intset != nil {
+		if intVal, ok := parseIntMember(val); ok {
+			if set.intset.len() < maxIntSetSize || set.intset.has(intVal) {
+				return set.intset.add(intVal)
+			}
+		}
+		set.toDict()
+	}
 	return set.dict.Put(val, nil)
 }
 
 // Remove removes member from set
 func (set *Set) Remove(val string) int {
+	if set.intset != nil {
+		intVal, ok := parseIntMember(val)
+		if !ok {
+			return 0
+		}
+		return set.intset.remove(intVal)
+	}
 	return set.dict.Remove(val)
 }
 
 // Has returns true if the val exists in the set
 func (set *Set) Has(val string) bool {
+	if set.intset != nil {
+		intVal, ok := parseIntMember(val)
+		return ok && set.intset.has(intVal)
+	}
 	_, exists := set.dict.Get(val)
 	return exists
 }
 
 // Len returns number of members in the set
 func (set *Set) Len() int {
+	if set.intset != nil {
+		return set.intset.len()
+	}
 	return set.dict.Len()
 }
 
@@ -43,12 +84,12 @@ func (set *Set) Len() int {
 func (set *Set) ToSlice() []string {
 	slice := make([]string, set.Len())
 	i := 0
-	set.dict.ForEach(func(key string, val interface{}) bool {
+	set.ForEach(func(member string) bool {
 		if i < len(slice) {
-			slice[i] = key
+			slice[i] = member
 		} else {
 			// set extended during traversal
-			slice = append(slice, key)
+			slice = append(slice, member)
 		}
 		i++
 		return true
@@ -58,6 +99,10 @@ func (set *Set) ToSlice() []string {
 
 // ForEach visits each member in the set
 func (set *Set) ForEach(consumer func(member string) bool) {
+	if set.intset != nil {
+		set.intset.forEach(consumer)
+		return
+	}
 	set.dict.ForEach(func(key string, val interface{}) bool {
 		return consumer(key)
 	})
@@ -114,10 +159,16 @@ func (set *Set) Diff(another *Set) *Set {
 
 // RandomMembers randomly returns keys of the given number, may contain duplicated key
 func (set *Set) RandomMembers(limit int) []string {
+	if set.intset != nil {
+		return set.intset.randomMembers(limit)
+	}
 	return set.dict.RandomKeys(limit)
 }
 
 // RandomDistinctMembers randomly returns keys of the given number, won't contain duplicated key
 func (set *Set) RandomDistinctMembers(limit int) []string {
+	if set.intset != nil {
+		return set.intset.randomDistinctMembers(limit)
+	}
 	return set.dict.RandomDistinctKeys(limit)
 }
@@ -30,3 +30,56 @@ func TestSet(t *testing.T) {
 		}
 	}
 }
+
+func TestIntSet(t *testing.T) {
+	set := Make("3", "1", "2", "1")
+	if !set.IsIntSet() {
+		t.Error("expect intset encoding")
+	}
+	if set.Len() != 3 {
+		t.Errorf("expect 3 members, actual %d", set.Len())
+	}
+	expected := []string{"1", "2", "3"}
+	for i, member := range set.ToSlice() {
+		if member != expected[i] {
+			t.Errorf("expect %s at %d, actual %s", expected[i], i, member)
+		}
+	}
+	// strings which cannot be converted back are not integers
+	set.Add("+4")
+	if set.IsIntSet() {
+		t.Error("expect hash table encoding")
+	}
+	if !set.Has("+4") || !set.Has("1") || set.Has("4") {
+		t.Error("wrong members after conversion")
+	}
+
+	set = Make()
+	for i := 0; i < maxIntSetSize; i++ {
+		set.Add(strconv.Itoa(-i))
+	}
+	set.Add("0")
+	if !set.IsIntSet() {
+		t.Error("expect intset encoding")
+	}
+	if set.Remove("1") != 0 || set.Remove("x") != 0 || set.Remove("-1") != 1 {
+		t.Error("wrong result of remove")
+	}
+	set.Add("-1")
+	set.Add(strconv.Itoa(maxIntSetSize))
+	if set.IsIntSet() {
+		t.Error("expect hash table encoding")
+	}
+	if set.Len() != maxIntSetSize+1 || !set.Has("-1") {
+		t.Error("wrong members after conversion")
+	}
+
+	set = Make("1", "2", "3")
+	if len(set.RandomMembers(10)) != 10 {
+		t.Error("expect 10 members")
+	}
+	distinct := set.RandomDistinctMembers(10)
+	if len(distinct) != 3 || Make(distinct...).Len() != 3 {
+		t.Error("expect 3 distinct members")
+	}
+}
@@ -5,6 +5,16 @@ import (
 	"strconv"
 )
 
+// Border represents `min` or `max` parameter of range commands, such as ScoreBorder and LexBorder
+type Border interface {
+	// greater returns whether element is within the upper border, it should be called by `max`
+	greater(element *Element) bool
+	// less returns whether element is within the lower border, it should be called by `min`
+	less(element *Element) bool
+	// isIntersected returns whether there may be elements between min(the receiver) and max
+	isIntersected(max Border) bool
+}
+
 /*
  * ScoreBorder is a struct represents `min` `max` parameter of redis command `ZRANGEBYSCORE`
  * can accept:
@@ -27,28 +37,42 @@ type ScoreBorder struct {
 
 // if max.greater(score) then the score is within the upper border
 // do not use min.greater()
-func (border *ScoreBorder) greater(value float64) bool {
+func (border *ScoreBorder) greater(element *Element) bool {
 	if border.Inf == negativeInf {
 		return false
 	} else if border.Inf == positiveInf {
 		return true
 	}
 	if border.Exclude {
-		return border.Value > value
+		return border.Value > element.Score
 	}
-	return border.Value >= value
+	return border.Value >= element.Score
 }
 
-func (border *ScoreBorder) less(value float64) bool {
+func (border *ScoreBorder) less(element *Element) bool {
 	if border.Inf == negativeInf {
 		return true
 	} else if border.Inf == positiveInf {
 		return false
 	}
 	if border.Exclude {
-		return border.Value < value
+		return border.Value < element.Score
 	}
-	return border.Value <= value
+	return border.Value <= element.Score
+}
+
+func (border *ScoreBorder) isIntersected(max Border) bool {
+	maxBorder, ok := max.(*ScoreBorder)
+	if !ok {
+		return false
+	}
+	if border.Inf == positiveInf || maxBorder.Inf == negativeInf {
+		return false
+	}
+	if border.Inf == negativeInf || maxBorder.Inf == positiveInf {
+		return true
+	}
+	return border.Value < maxBorder.Value || (border.Value == maxBorder.Value && !border.Exclude && !maxBorder.Exclude)
 }
 
 var positiveInfBorder = &ScoreBorder{
@@ -67,7 +91,7 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 	if s == "-inf" {
 		return negativeInfBorder, nil
 	}
-	if s[0] == '(' {
+	if len(s) > 0 && s[0] == '(' {
 		value, err := strconv.ParseFloat(s[1:], 64)
 		if err != nil {
 			return nil, errors.New("ERR min or max is not a float")
@@ -88,3 +112,88 @@ func ParseScoreBorder(s string) (*ScoreBorder, error) {
 		Exclude: false,
 	}, nil
 }
+
+/*
+ * LexBorder is a struct represents `min` `max` parameter of redis command `ZRANGEBYLEX`
+ * can accept:
+ *   inclusive member, such as [a
+ *   exclusive member, such as (a
+ *   infinity: +, -
+ * lex borders are meaningful only if all members have the same score
+ */
+
+// LexBorder represents range of a member, including: <, <=, >, >=, +, -
+type LexBorder struct {
+	Inf     int8
+	Value   string
+	Exclude bool
+}
+
+func (border *LexBorder) greater(element *Element) bool {
+	if border.Inf == negativeInf {
+		return false
+	} else if border.Inf == positiveInf {
+		return true
+	}
+	if border.Exclude {
+		return border.Value > element.Member
+	}
+	return border.Value >= element.Member
+}
+
+func (border *LexBorder) less(element *Element) bool {
+	if border.Inf == negativeInf {
+		return true
+	} else if border.Inf == positiveInf {
+		return false
+	}
+	if border.Exclude {
+		return border.Value < element.Member
+	}
+	return border.Value <= element.Member
+}
+
+func (border *LexBorder) isIntersected(max Border) bool {
+	maxBorder, ok := max.(*LexBorder)
+	if !ok {
+		return false
+	}
+	if border.Inf == positiveInf || maxBorder.Inf == negativeInf {
+		return false
+	}
+	if border.Inf == negativeInf || maxBorder.Inf == positiveInf {
+		return true
+	}
+	return border.Value < maxBorder.Value || (border.Value == maxBorder.Value && !border.Exclude && !maxBorder.Exclude)
+}
+
+var positiveInfLexBorder = &LexBorder{
+	Inf: positiveInf,
+}
+
+var negativeInfLexBorder = &LexBorder{
+	Inf: negativeInf,
+}
+
+// ParseLexBorder creates LexBorder from redis arguments
+func ParseLexBorder(s string) (*LexBorder, error) {
+	if s == "+" {
+		return positiveInfLexBorder, nil
+	}
+	if s == "-" {
+		return negativeInfLexBorder, nil
+	}
+	if len(s) > 0 && s[0] == '(' {
+		return &LexBorder{
+			Value:   s[1:],
+			Exclude: true,
+		}, nil
+	}
+	if len(s) > 0 && s[0] == '[' {
+		return &LexBorder{
+			Value:   s[1:],
+			Exclude: false,
+		}, nil
+	}
+	return nil, errors.New("ERR min or max not valid string range item")
+}
@@ -0,0 +1,197 @@
+package sortedset
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Aggregate combines scores of the same member in different sorted sets
+type Aggregate func(a float64, b float64) float64
+
+// AggregateSum adds up scores, nan is treated as 0 like redis
+func AggregateSum(a float64, b float64) float64 {
+	sum := a + b
+	if math.IsNaN(sum) {
+		return 0
+	}
+	return sum
+}
+
+// AggregateMin takes the minimum score
+func AggregateMin(a float64, b float64) float64 {
+	return math.Min(a, b)
+}
+
+// AggregateMax takes the maximum score
+func AggregateMax(a float64, b float64) float64 {
+	return math.Max(a, b)
+}
+
+// OperationOption is parsed arguments of ZUNION, ZINTER, ZDIFF, ZINTERCARD and their STORE forms
+type OperationOption struct {
+	Keys       []string
+	Weights    []float64
+	Aggregate  Aggregate
+	WithScores bool
+	Limit      int64 // Limit of ZINTERCARD, 0 means no limit
+}
+
+// ParseOperationOption parses `numkeys key [key ...]` and following options, options not allowed are syntax error:
+//
+//	allowWeights: [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+//	allowWithScores: [WITHSCORES]
+//	allowLimit: [LIMIT limit]
+func ParseOperationOption(cmdName string, args [][]byte, allowWeights bool, allowWithScores bool, allowLimit bool) (*OperationOption, error) {
+	if len(args) == 0 {
+		return nil, errors.New("ERR syntax error")
+	}
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if numKeys <= 0 {
+		return nil, errors.New("ERR at least 1 input key is needed for '" + cmdName + "' command")
+	}
+	if numKeys > int64(len(args)-1) {
+		return nil, errors.New("ERR syntax error")
+	}
+	opt := &OperationOption{
+		Keys:      make([]string, numKeys),
+		Aggregate: AggregateSum,
+	}
+	for i := range opt.Keys {
+		opt.Keys[i] = string(args[i+1])
+	}
+	for i := int(numKeys) + 1; i < len(args); i++ {
+		arg := strings.ToUpper(string(args[i]))
+		remain := len(args) - i - 1
+		switch {
+		case arg == "WEIGHTS" && allowWeights && remain >= len(opt.Keys):
+			opt.Weights = make([]float64, len(opt.Keys))
+			for j := range opt.Weights {
+				opt.Weights[j], err = strconv.ParseFloat(string(args[i+j+1]), 64)
+				if err != nil || math.IsNaN(opt.Weights[j]) {
+					return nil, errors.New("ERR weight value is not a float")
+				}
+			}
+			i += len(opt.Keys)
+		case arg == "AGGREGATE" && allowWeights && remain >= 1:
+			switch strings.ToUpper(string(args[i+1])) {
+			case "SUM":
+				opt.Aggregate = AggregateSum
+			case "MIN":
+				opt.Aggregate = AggregateMin
+			case "MAX":
+				opt.Aggregate = AggregateMax
+			default:
+				return nil, errors.New("ERR syntax error")
+			}
+			i++
+		case arg == "WITHSCORES" && allowWithScores:
+			opt.WithScores = true
+		case arg == "LIMIT" && allowLimit && remain >= 1:
+			opt.Limit, err = strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || opt.Limit < 0 {
+				return nil, errors.New("ERR LIMIT can't be negative")
+			}
+			i++
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+	return opt, nil
+}
+
+// weightedScore returns score of the i-th set multiplied by its weight, weights is nil means all weights are 1
+func weightedScore(score float64, weights []float64, i int) float64 {
+	if weights == nil {
+		return score
+	}
+	score *= weights[i]
+	if math.IsNaN(score) {
+		// such as 0 * inf
+		return 0
+	}
+	return score
+}
+
+// Union returns a sorted set contains members in any of the given sets, nil represents an empty set
+func Union(sets []*SortedSet, weights []float64, aggregate Aggregate) *SortedSet {
+	result := Make()
+	for i, set := range sets {
+		if set == nil {
+			continue
+		}
+		for member, element := range set.dict {
+			score := weightedScore(element.Score, weights, i)
+			if existed, ok := result.dict[member]; ok {
+				score = aggregate(existed.Score, score)
+			}
+			result.Add(member, score)
+		}
+	}
+	return result
+}
+
+// Intersect returns a sorted set contains members in all of the given sets, nil represents an empty set
+func Intersect(sets []*SortedSet, weights []float64, aggregate Aggregate) *SortedSet {
+	result := Make()
+	smallest := -1
+	for i, set := range sets {
+		if set == nil || set.Len() == 0 {
+			return result
+		}
+		if smallest < 0 || set.Len() < sets[smallest].Len() {
+			smallest = i
+		}
+	}
+	if smallest < 0 {
+		return result
+	}
+	for member := range sets[smallest].dict {
+		var score float64
+		found := true
+		for i, set := range sets {
+			element, ok := set.dict[member]
+			if !ok {
+				found = false
+				break
+			}
+			if i == 0 {
+				score = weightedScore(element.Score, weights, i)
+			} else {
+				score = aggregate(score, weightedScore(element.Score, weights, i))
+			}
+		}
+		if found {
+			result.Add(member, score)
+		}
+	}
+	return result
+}
+
+// Diff returns a sorted set contains members in the first set but not in the others, nil represents an empty set
+func Diff(sets []*SortedSet) *SortedSet {
+	result := Make()
+	if len(sets) == 0 || sets[0] == nil {
+		return result
+	}
+	for member, element := range sets[0].dict {
+		found := false
+		for _, set := range sets[1:] {
+			if set == nil {
+				continue
+			}
+			if _, ok := set.dict[member]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result.Add(member, element.Score)
+		}
+	}
+	return result
+}
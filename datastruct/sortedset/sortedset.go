@@ -1,6 +1,7 @@
 package sortedset
 
 import (
+	"math/rand"
 	"strconv"
 )
 
@@ -128,34 +129,33 @@ func (sortedSet *SortedSet) Range(start int64, stop int64, desc bool) []*Element
 
 // Count returns the number of  members which score within the given border
 func (sortedSet *SortedSet) Count(min *ScoreBorder, max *ScoreBorder) int64 {
-	var i int64 = 0
-	// ascending order
-	sortedSet.ForEach(0, sortedSet.Len(), false, func(element *Element) bool {
-		gtMin := min.less(element.Score) // greater than min
-		if !gtMin {
-			// has not into range, continue foreach
-			return true
-		}
-		ltMax := max.greater(element.Score) // less than max
-		if !ltMax {
-			// break through score border, break foreach
-			return false
-		}
-		// gtMin && ltMax
-		i++
-		return true
-	})
-	return i
+	return sortedSet.RangeCount(min, max)
+}
+
+// RangeCount returns the number of members within the given border
+func (sortedSet *SortedSet) RangeCount(min Border, max Border) int64 {
+	first := sortedSet.skiplist.getFirstInRange(min, max)
+	if first == nil {
+		return 0
+	}
+	last := sortedSet.skiplist.getLastInRange(min, max)
+	return sortedSet.skiplist.getRank(last.Member, last.Score) - sortedSet.skiplist.getRank(first.Member, first.Score) + 1
 }
 
 // ForEachByScore visits members which score within the given border
 func (sortedSet *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
+	sortedSet.ForEachByBorder(min, max, offset, limit, desc, consumer)
+}
+
+// ForEachByBorder visits members within the given border, border could be ScoreBorder or LexBorder
+// param limit: <0 means no limit
+func (sortedSet *SortedSet) ForEachByBorder(min Border, max Border, offset int64, limit int64, desc bool, consumer func(element *Element) bool) {
 	// find start node
 	var node *node
 	if desc {
-		node = sortedSet.skiplist.getLastInScoreRange(min, max)
+		node = sortedSet.skiplist.getLastInRange(min, max)
 	} else {
-		node = sortedSet.skiplist.getFirstInScoreRange(min, max)
+		node = sortedSet.skiplist.getFirstInRange(min, max)
 	}
 
 	for node != nil && offset > 0 {
@@ -180,10 +180,10 @@ func (sortedSet *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, o
 		if node == nil {
 			break
 		}
-		gtMin := min.less(node.Element.Score) // greater than min
-		ltMax := max.greater(node.Element.Score)
+		gtMin := min.less(&node.Element) // greater than min
+		ltMax := max.greater(&node.Element)
 		if !gtMin || !ltMax {
-			break // break through score border
+			break // break through border
 		}
 	}
 }
@@ -191,11 +191,17 @@ func (sortedSet *SortedSet) ForEachByScore(min *ScoreBorder, max *ScoreBorder, o
 // RangeByScore returns members which score within the given border
 // param limit: <0 means no limit
 func (sortedSet *SortedSet) RangeByScore(min *ScoreBorder, max *ScoreBorder, offset int64, limit int64, desc bool) []*Element {
+	return sortedSet.RangeByBorder(min, max, offset, limit, desc)
+}
+
+// RangeByBorder returns members within the given border, border could be ScoreBorder or LexBorder
+// param limit: <0 means no limit
+func (sortedSet *SortedSet) RangeByBorder(min Border, max Border, offset int64, limit int64, desc bool) []*Element {
 	if limit == 0 || offset < 0 {
 		return make([]*Element, 0)
 	}
 	slice := make([]*Element, 0)
-	sortedSet.ForEachByScore(min, max, offset, limit, desc, func(element *Element) bool {
+	sortedSet.ForEachByBorder(min, max, offset, limit, desc, func(element *Element) bool {
 		slice = append(slice, element)
 		return true
 	})
@@ -204,7 +210,15 @@ func (sortedSet *SortedSet) RangeByScore(min *ScoreBorder, max *ScoreBorder, off
 
 // RemoveByScore removes members which score within the given border
 func (sortedSet *SortedSet) RemoveByScore(min *ScoreBorder, max *ScoreBorder) int64 {
-	removed := sortedSet.skiplist.RemoveRangeByScore(min, max)
+	return sortedSet.RemoveByBorder(min, max)
+}
+
+// RemoveByBorder removes members within the given border, border could be ScoreBorder or LexBorder
+func (sortedSet *SortedSet) RemoveByBorder(min Border, max Border) int64 {
+	if !sortedSet.skiplist.hasInRange(min, max) {
+		return 0
+	}
+	removed := sortedSet.skiplist.RemoveRange(min, max)
 	for _, element := range removed {
 		delete(sortedSet.dict, element.Member)
 	}
@@ -220,3 +234,70 @@ func (sortedSet *SortedSet) RemoveByRank(start int64, stop int64) int64 {
 	}
 	return int64(len(removed))
 }
+
+// PopMin removes and returns at most count members with the lowest scores
+func (sortedSet *SortedSet) PopMin(count int) []*Element {
+	return sortedSet.pop(count, false)
+}
+
+// PopMax removes and returns at most count members with the highest scores, sort by descending order
+func (sortedSet *SortedSet) PopMax(count int) []*Element {
+	return sortedSet.pop(count, true)
+}
+
+func (sortedSet *SortedSet) pop(count int, desc bool) []*Element {
+	size := sortedSet.Len()
+	if int64(count) < size {
+		size = int64(count)
+	}
+	if size <= 0 {
+		return nil
+	}
+	popped := sortedSet.Range(0, size, desc)
+	for _, element := range popped {
+		sortedSet.Remove(element.Member)
+	}
+	return popped
+}
+
+// RandomMembers randomly returns members of the given number, may contain duplicated member
+func (sortedSet *SortedSet) RandomMembers(limit int) []*Element {
+	size := sortedSet.Len()
+	if size == 0 || limit <= 0 {
+		return nil
+	}
+	result := make([]*Element, limit)
+	for i := range result {
+		result[i] = &sortedSet.skiplist.getByRank(rand.Int63n(size) + 1).Element
+	}
+	return result
+}
+
+// RandomDistinctMembers randomly returns members of the given number, won't contain duplicated member
+func (sortedSet *SortedSet) RandomDistinctMembers(limit int) []*Element {
+	size := sortedSet.Len()
+	if int64(limit) >= size {
+		if size == 0 {
+			return nil
+		}
+		result := sortedSet.Range(0, size, false)
+		rand.Shuffle(len(result), func(i, j int) {
+			result[i], result[j] = result[j], result[i]
+		})
+		return result
+	}
+	if limit <= 0 {
+		return nil
+	}
+	picked := make(map[int64]struct{}, limit)
+	result := make([]*Element, 0, limit)
+	for len(result) < limit {
+		rank := rand.Int63n(size) + 1
+		if _, ok := picked[rank]; ok {
+			continue
+		}
+		picked[rank] = struct{}{}
+		result = append(result, &sortedSet.skiplist.getByRank(rank).Element)
+	}
+	return result
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/rdb/core"
 	"time"
 )
 
@@ -25,6 +26,15 @@ type EmbedDB interface {
 	RWLocks(dbIndex int, writeKeys []string, readKeys []string)
 	RWUnLocks(dbIndex int, writeKeys []string, readKeys []string)
 	GetDBSize(dbIndex int) (int, int)
+	LoadRDB(dec *core.Decoder) error
+}
+
+// Snapshot is a consistent view of dataset at the moment it was taken, changes after that are invisible to it
+type Snapshot interface {
+	ForEach(dbIndex int, cb func(key string, data *DataEntity, expiration *time.Time) bool)
+	// GetDBSize returns keys count and ttl key count of live dataset, it is only a hint of snapshot size
+	GetDBSize(dbIndex int) (int, int)
+	Release()
 }
 
 // DataEntity stores data bound to a key, including a string, list, hash, set and so on
@@ -23,4 +23,7 @@ type Connection interface {
 	// used for multi database
 	GetDBIndex() int
 	SelectDB(int)
+
+	// closed when client disconnected, used for blocking commands
+	Done() <-chan struct{}
 }
@@ -0,0 +1,412 @@
+package routing
+
+import (
+	"errors"
+	"github.com/hdt3213/godis/redis/parser"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strconv"
+)
+
+func readFirstKey(args [][]byte) ([]string, []string) {
+	// assert len(args) > 0
+	key := string(args[0])
+	return nil, []string{key}
+}
+
+func writeFirstKey(args [][]byte) ([]string, []string) {
+	key := string(args[0])
+	return []string{key}, nil
+}
+
+func writeAllKeys(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args))
+	for i, v := range args {
+		keys[i] = string(v)
+	}
+	return keys, nil
+}
+
+func readAllKeys(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args))
+	for i, v := range args {
+		keys[i] = string(v)
+	}
+	return nil, keys
+}
+
+func noPrepare(args [][]byte) ([]string, []string) {
+	return nil, nil
+}
+
+// numKeysArgs returns keys of `numkeys key [key ...]` followed by at least minRest arguments, or nil if numkeys is illegal
+func numKeysArgs(args [][]byte, minRest int) []string {
+	numKeys, err := strconv.ParseInt(string(args[0]), 10, 64)
+	if err != nil || numKeys <= 0 || numKeys > int64(len(args)-1-minRest) {
+		return nil
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[i+1])
+	}
+	return keys
+}
+
+func prepareRename(args [][]byte) ([]string, []string) {
+	src := string(args[0])
+	dest := string(args[1])
+	return []string{dest}, []string{src}
+}
+
+func prepareMSet(args [][]byte) ([]string, []string) {
+	size := len(args) / 2
+	keys := make([]string, size)
+	for i := 0; i < size; i++ {
+		keys[i] = string(args[2*i])
+	}
+	return keys, nil
+}
+
+func prepareMGet(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args))
+	for i, v := range args {
+		keys[i] = string(v)
+	}
+	return nil, keys
+}
+
+func prepareBitOp(args [][]byte) ([]string, []string) {
+	destKey := string(args[1])
+	srcKeys := make([]string, len(args)-2)
+	for i, arg := range args[2:] {
+		srcKeys[i] = string(arg)
+	}
+	return []string{destKey}, srcKeys
+}
+
+func prepareLCS(args [][]byte) ([]string, []string) {
+	return nil, []string{string(args[0]), string(args[1])}
+}
+
+func prepareRPopLPush(args [][]byte) ([]string, []string) {
+	return []string{
+		string(args[0]),
+		string(args[1]),
+	}, nil
+}
+
+func prepareLMove(args [][]byte) ([]string, []string) {
+	return []string{
+		string(args[0]),
+		string(args[1]),
+	}, nil
+}
+
+// prepareLMPop returns keys of `numkeys key [key ...] LEFT|RIGHT [COUNT count]`
+func prepareLMPop(args [][]byte) ([]string, []string) {
+	return numKeysArgs(args, 1), nil
+}
+
+func prepareSetCalculate(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	return nil, keys
+}
+
+func prepareSetCalculateStore(args [][]byte) ([]string, []string) {
+	dest := string(args[0])
+	keys := make([]string, len(args)-1)
+	keyArgs := args[1:]
+	for i, arg := range keyArgs {
+		keys[i] = string(arg)
+	}
+	return []string{dest}, keys
+}
+
+func prepareSMove(args [][]byte) ([]string, []string) {
+	return []string{string(args[0]), string(args[1])}, nil
+}
+
+// prepareSInterCard returns keys of `numkeys key [key ...] [LIMIT limit]`
+func prepareSInterCard(args [][]byte) ([]string, []string) {
+	return nil, numKeysArgs(args, 0)
+}
+
+// prepareZSetOperation returns source keys of `numkeys key [key ...] [options]`
+func prepareZSetOperation(args [][]byte) ([]string, []string) {
+	return nil, numKeysArgs(args, 0)
+}
+
+// prepareZSetOperationStore returns destination and source keys of `destination numkeys key [key ...] [options]`
+func prepareZSetOperationStore(args [][]byte) ([]string, []string) {
+	_, keys := prepareZSetOperation(args[1:])
+	return []string{string(args[0])}, keys
+}
+
+func prepareZRangeStore(args [][]byte) ([]string, []string) {
+	return []string{string(args[0])}, []string{string(args[1])}
+}
+
+// prepareZMPop returns keys of `numkeys key [key ...] MIN|MAX [COUNT count]`
+func prepareZMPop(args [][]byte) ([]string, []string) {
+	return numKeysArgs(args, 1), nil
+}
+
+// prepareBZPop returns keys of `key [key ...] timeout`
+func prepareBZPop(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args)-1)
+	for i := range keys {
+		keys[i] = string(args[i])
+	}
+	return keys, nil
+}
+
+func prepareBZMPop(args [][]byte) ([]string, []string) {
+	return prepareZMPop(args[1:])
+}
+
+// prepareZSetOperationStoreTo returns destination and source keys, sources not in this node are locked too, it's harmless
+func prepareZSetOperationStoreTo(args [][]byte) ([]string, []string) {
+	_, keys := prepareZSetOperation(args[3:])
+	return []string{string(args[0])}, keys
+}
+
+// prepareSetOperationStoreTo returns destination and source keys, sources not in this node are locked too, it's harmless
+func prepareSetOperationStoreTo(args [][]byte) ([]string, []string) {
+	keys := make([]string, len(args)-3)
+	for i, arg := range args[3:] {
+		keys[i] = string(arg)
+	}
+	return []string{string(args[0])}, keys
+}
+
+// prepareBitOpTo returns destination and source keys, sources not in this node are locked too, it's harmless
+func prepareBitOpTo(args [][]byte) ([]string, []string) {
+	return prepareSetOperationStoreTo(args)
+}
+
+// ParseMultiPart decodes arguments of MultiPart command
+// args format: watchCmdLine cmdLine1 cmdLine2 ..., each argument is a command line encoded in redis serialization protocol
+// watchCmdLine format: _watch key1 ver1 key2 ver2 ...
+func ParseMultiPart(args [][]byte) (watchingKeys []string, cmdLines [][][]byte, err error) {
+	for i, arg := range args {
+		raw, err := parser.ParseOne(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		mbr, ok := raw.(*protocol.MultiBulkReply)
+		if !ok {
+			if _, ok := raw.(*protocol.EmptyMultiBulkReply); ok && i == 0 {
+				continue
+			}
+			return nil, nil, errors.New("command line is not multi bulk reply")
+		}
+		if i == 0 {
+			for j := 1; j+1 < len(mbr.Args); j += 2 {
+				watchingKeys = append(watchingKeys, string(mbr.Args[j]))
+			}
+			continue
+		}
+		cmdLines = append(cmdLines, mbr.Args)
+	}
+	return watchingKeys, cmdLines, nil
+}
+
+func prepareMultiPart(args [][]byte) ([]string, []string) {
+	watchingKeys, cmdLines, err := ParseMultiPart(args)
+	if err != nil {
+		return nil, nil
+	}
+	writeKeys := make([]string, 0)
+	readKeys := watchingKeys
+	for _, cmdLine := range cmdLines {
+		write, read := GetRelatedKeys(cmdLine)
+		writeKeys = append(writeKeys, write...)
+		readKeys = append(readKeys, read...)
+	}
+	return writeKeys, readKeys
+}
+
+func init() {
+	// keys
+	register("Del", writeAllKeys)
+	register("Expire", writeFirstKey)
+	register("ExpireAt", writeFirstKey)
+	register("PExpire", writeFirstKey)
+	register("PExpireAt", writeFirstKey)
+	register("TTL", readFirstKey)
+	register("PTTL", readFirstKey)
+	register("Persist", writeFirstKey)
+	register("Exists", readAllKeys)
+	register("Type", readFirstKey)
+	register("Rename", prepareRename)
+	register("RenameNx", prepareRename)
+	register("Keys", noPrepare)
+	register("DBSize", noPrepare)
+
+	// string
+	register("Set", writeFirstKey)
+	register("SetNx", writeFirstKey)
+	register("SetEX", writeFirstKey)
+	register("PSetEX", writeFirstKey)
+	register("MSet", prepareMSet)
+	register("MGet", prepareMGet)
+	register("MSetNX", prepareMSet)
+	register("Get", readFirstKey)
+	register("GetSet", writeFirstKey)
+	register("GetEx", writeFirstKey)
+	register("GetDel", writeFirstKey)
+	register("Incr", writeFirstKey)
+	register("IncrBy", writeFirstKey)
+	register("IncrByFloat", writeFirstKey)
+	register("Decr", writeFirstKey)
+	register("DecrBy", writeFirstKey)
+	register("StrLen", readFirstKey)
+	register("Append", writeFirstKey)
+	register("SetRange", writeFirstKey)
+	register("GetRange", readFirstKey)
+	register("SetBit", writeFirstKey)
+	register("GetBit", readFirstKey)
+	register("BitCount", readFirstKey)
+	register("BitPos", readFirstKey)
+	register("BitOp", prepareBitOp)
+	register("BitField", writeFirstKey)
+	register("BitField_RO", readFirstKey)
+	register("LCS", prepareLCS)
+
+	// list
+	register("LPush", writeFirstKey)
+	register("LPushX", writeFirstKey)
+	register("RPush", writeFirstKey)
+	register("RPushX", writeFirstKey)
+	register("LPop", writeFirstKey)
+	register("RPop", writeFirstKey)
+	register("RPopLPush", prepareRPopLPush)
+	register("LRem", writeFirstKey)
+	register("LLen", readFirstKey)
+	register("LIndex", readFirstKey)
+	register("LSet", writeFirstKey)
+	register("LRange", readFirstKey)
+	register("LInsert", writeFirstKey)
+	register("LPos", readFirstKey)
+	register("LTrim", writeFirstKey)
+	register("LMove", prepareLMove)
+	register("LMPop", prepareLMPop)
+
+	// hash
+	register("HSet", writeFirstKey)
+	register("HSetNX", writeFirstKey)
+	register("HGet", readFirstKey)
+	register("HExists", readFirstKey)
+	register("HDel", writeFirstKey)
+	register("HLen", readFirstKey)
+	register("HStrlen", readFirstKey)
+	register("HMSet", writeFirstKey)
+	register("HMGet", readFirstKey)
+	register("HKeys", readFirstKey)
+	register("HVals", readFirstKey)
+	register("HGetAll", readFirstKey)
+	register("HIncrBy", writeFirstKey)
+	register("HIncrByFloat", writeFirstKey)
+	register("HRandField", readFirstKey)
+	register("HExpire", writeFirstKey)
+	register("HPExpire", writeFirstKey)
+	register("HExpireAt", writeFirstKey)
+	register("HPExpireAt", writeFirstKey)
+	register("HTTL", readFirstKey)
+	register("HPTTL", readFirstKey)
+	register("HPersist", writeFirstKey)
+	register("HMSetPXAt", writeFirstKey)
+
+	// set
+	register("SAdd", writeFirstKey)
+	register("SIsMember", readFirstKey)
+	register("SRem", writeFirstKey)
+	register("SPop", writeFirstKey)
+	register("SCard", readFirstKey)
+	register("SMembers", readFirstKey)
+	register("SInter", prepareSetCalculate)
+	register("SInterStore", prepareSetCalculateStore)
+	register("SUnion", prepareSetCalculate)
+	register("SUnionStore", prepareSetCalculateStore)
+	register("SDiff", prepareSetCalculate)
+	register("SDiffStore", prepareSetCalculateStore)
+	register("SRandMember", readFirstKey)
+	register("SMove", prepareSMove)
+	register("SMIsMember", readFirstKey)
+	register("SInterCard", prepareSInterCard)
+
+	// sorted set
+	register("ZAdd", writeFirstKey)
+	register("ZScore", readFirstKey)
+	register("ZIncrBy", writeFirstKey)
+	register("ZRank", readFirstKey)
+	register("ZCount", readFirstKey)
+	register("ZRevRank", readFirstKey)
+	register("ZCard", readFirstKey)
+	register("ZRange", readFirstKey)
+	register("ZRangeByScore", readFirstKey)
+	register("ZRevRange", readFirstKey)
+	register("ZRevRangeByScore", readFirstKey)
+	register("ZRem", writeFirstKey)
+	register("ZRemRangeByScore", writeFirstKey)
+	register("ZRemRangeByRank", writeFirstKey)
+	register("ZRangeByLex", readFirstKey)
+	register("ZRevRangeByLex", readFirstKey)
+	register("ZLexCount", readFirstKey)
+	register("ZRemRangeByLex", writeFirstKey)
+	register("ZRangeStore", prepareZRangeStore)
+	register("ZUnion", prepareZSetOperation)
+	register("ZInter", prepareZSetOperation)
+	register("ZDiff", prepareZSetOperation)
+	register("ZUnionStore", prepareZSetOperationStore)
+	register("ZInterStore", prepareZSetOperationStore)
+	register("ZDiffStore", prepareZSetOperationStore)
+	register("ZInterCard", prepareZSetOperation)
+	register("ZPopMin", writeFirstKey)
+	register("ZPopMax", writeFirstKey)
+	register("ZMPop", prepareZMPop)
+	register("BZPopMin", prepareBZPop)
+	register("BZPopMax", prepareBZPop)
+	register("BZMPop", prepareBZMPop)
+	register("ZRandMember", readFirstKey)
+	register("ZMScore", readFirstKey)
+
+	// geo
+	register("GeoAdd", writeFirstKey)
+	register("GeoPos", readFirstKey)
+	register("GeoDist", readFirstKey)
+	register("GeoHash", readFirstKey)
+	register("GeoRadius", readFirstKey)
+	register("GeoRadiusByMember", readFirstKey)
+
+	// dump
+	register("Dump", readFirstKey)
+	register("Restore", writeFirstKey)
+
+	// transaction
+	register("GetVer", readAllKeys)
+
+	// system
+	register("ping", noPrepare)
+
+	// internal commands of cluster
+	register("DumpKey", writeAllKeys)
+	register("ExistIn", readAllKeys)
+	register("RenameFrom", readFirstKey)
+	register("RenameTo", writeFirstKey)
+	register("RenameNxTo", writeFirstKey)
+	register("RPopLPushFrom", writeFirstKey)
+	register("LMoveFrom", writeFirstKey)
+	register("SMoveFrom", writeFirstKey)
+	register("ZRangeStoreFrom", readFirstKey)
+	register("ZRangeStoreTo", writeFirstKey)
+	register("ZSetOperationFrom", readAllKeys)
+	register("ZSetOperationStoreTo", prepareZSetOperationStoreTo)
+	register("SetOperationFrom", readAllKeys)
+	register("SetOperationStoreTo", prepareSetOperationStoreTo)
+	register("BitOpFrom", readAllKeys)
+	register("BitOpTo", prepareBitOpTo)
+	register("MultiPart", prepareMultiPart)
+}
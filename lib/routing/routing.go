@@ -0,0 +1,36 @@
+// Package routing tells which keys a command reads or writes,
+// it is shared by the storage engine for locking and by cluster nodes and clients for routing commands to the owner node of keys
+package routing
+
+import (
+	"strings"
+)
+
+// Replicas is the number of virtual nodes of each node in consistent hash,
+// clients which route keys to their owner node must use the same value
+const Replicas = 4
+
+// KeyFunc analyses arguments of command line (command name excluded)
+// returns related write keys and read keys
+type KeyFunc func(args [][]byte) ([]string, []string)
+
+var keyFuncTable = make(map[string]KeyFunc)
+
+func register(name string, keyFunc KeyFunc) {
+	keyFuncTable[strings.ToLower(name)] = keyFunc
+}
+
+// GetKeyFunc returns KeyFunc of the given command
+func GetKeyFunc(name string) (KeyFunc, bool) {
+	keyFunc, ok := keyFuncTable[strings.ToLower(name)]
+	return keyFunc, ok
+}
+
+// GetRelatedKeys analysis related keys
+func GetRelatedKeys(cmdLine [][]byte) ([]string, []string) {
+	keyFunc, ok := GetKeyFunc(string(cmdLine[0]))
+	if !ok {
+		return nil, nil
+	}
+	return keyFunc(cmdLine[1:])
+}
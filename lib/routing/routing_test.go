@@ -0,0 +1,34 @@
+package routing
+
+import (
+	"github.com/hdt3213/godis/lib/utils"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGetRelatedKeys(t *testing.T) {
+	assertKeys := func(cmdLine [][]byte, expectedWrite, expectedRead []string) {
+		write, read := GetRelatedKeys(cmdLine)
+		if strings.Join(write, " ") != strings.Join(expectedWrite, " ") {
+			t.Errorf("%s: expect write keys %v, actually %v", cmdLine[0], expectedWrite, write)
+		}
+		if strings.Join(read, " ") != strings.Join(expectedRead, " ") {
+			t.Errorf("%s: expect read keys %v, actually %v", cmdLine[0], expectedRead, read)
+		}
+	}
+	assertKeys(utils.ToCmdLine("get", "a"), nil, []string{"a"})
+	assertKeys(utils.ToCmdLine("MSET", "a", "1", "b", "2"), []string{"a", "b"}, nil)
+	assertKeys(utils.ToCmdLine("rename", "a", "b"), []string{"b"}, []string{"a"})
+	assertKeys(utils.ToCmdLine("zunionstore", "dest", "2", "a", "b", "WEIGHTS", "1", "2"), []string{"dest"}, []string{"a", "b"})
+	assertKeys(utils.ToCmdLine("lmpop", "2", "a", "b", "LEFT"), []string{"a", "b"}, nil)
+	assertKeys(utils.ToCmdLine("bzmpop", "0", "1", "a", "MIN"), []string{"a"}, nil)
+	assertKeys(utils.ToCmdLine("ping"), nil, nil)
+	assertKeys(utils.ToCmdLine("unknown", "a"), nil, nil)
+
+	// illegal numkeys
+	maxInt := strconv.FormatInt(1<<63-1, 10)
+	assertKeys(utils.ToCmdLine("zmpop", maxInt, "a", "MIN"), nil, nil)
+	assertKeys(utils.ToCmdLine("sintercard", "3", "a", "b"), nil, nil)
+	assertKeys(utils.ToCmdLine("lmpop", "2", "a", "b"), nil, nil)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/hdt3213/godis/config"
+	"github.com/hdt3213/godis/database"
 	"github.com/hdt3213/godis/lib/logger"
 	RedisServer "github.com/hdt3213/godis/redis/server"
 	"github.com/hdt3213/godis/tcp"
@@ -32,7 +33,32 @@ func fileExists(filename string) bool {
 	return err == nil && !info.IsDir()
 }
 
+// 校验 rdb 文件, 用法: godis --check-rdb <file>
+func checkRDB(args []string) int {
+	if len(args) != 1 {
+		fmt.Println("usage: godis --check-rdb <file>")
+		return 1
+	}
+	result, err := database.CheckRDB(args[0])
+	if err != nil {
+		fmt.Println("[error] " + err.Error())
+		fmt.Println("RDB check failed")
+		return 1
+	}
+	fmt.Printf("[info] %d keys read\n", result.Keys)
+	fmt.Printf("[info] %d expires\n", result.Expires)
+	fmt.Printf("[info] %d already expired\n", result.AlreadyExpired)
+	for t, count := range result.Types {
+		fmt.Printf("[info] %d keys of type %s\n", count, t)
+	}
+	fmt.Println("RDB looks OK!")
+	return 0
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "--check-rdb" {
+		os.Exit(checkRDB(os.Args[2:]))
+	}
 	print(banner)
 	logger.Setup(&logger.Settings{
 		Path:       "logs",
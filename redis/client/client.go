@@ -1,26 +1,54 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"github.com/hdt3213/godis/interface/redis"
 	"github.com/hdt3213/godis/lib/logger"
-	"github.com/hdt3213/godis/lib/sync/wait"
 	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
+	"math/rand"
 	"net"
-	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 )
 
+var (
+	// ErrTimeout is returned if reply has not been received before deadline
+	ErrTimeout = errors.New("redis client: request timeout")
+	// ErrConnClosed is returned if connection is closed before reply received
+	ErrConnClosed = errors.New("redis client: connection closed")
+)
+
+// ServerError is returned if server replies an error
+type ServerError struct {
+	Msg string
+}
+
+func (e *ServerError) Error() string {
+	return e.Msg
+}
+
+// Options is timeouts of Client, zero value means no timeout
+type Options struct {
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration // max time to wait for reply if caller does not set deadline
+	WriteTimeout time.Duration
+}
+
 // Client is a pipeline mode redis client
 type Client struct {
-	conn        net.Conn
+	pipe        *pipe         // current connection, only replaced by handleWrite goroutine
+	pipeMu      sync.RWMutex  // protects pipe
 	pendingReqs chan *request // wait to send
-	waitingReqs chan *request // waiting response
 	ticker      *time.Ticker
 	addr        string
+	opts        Options
 
 	working *sync.WaitGroup // its counter presents unfinished requests(pending and waiting)
+
+	failures int // count of consecutive failures of reconnecting, only accessed by handleWrite goroutine
 }
 
 // request is a message sends to redis server
@@ -29,26 +57,159 @@ type request struct {
 	args      [][]byte
 	reply     redis.Reply
 	heartbeat bool
-	waiting   *wait.Wait
+	done      chan struct{} // closed after reply received or request failed
 	err       error
+	deadline  time.Time // caller gives up waiting after deadline, zero value means no deadline
+}
+
+func makeRequest(ctx context.Context, args [][]byte, heartbeat bool) *request {
+	deadline, _ := ctx.Deadline()
+	return &request{
+		args:      args,
+		heartbeat: heartbeat,
+		done:      make(chan struct{}),
+		deadline:  deadline,
+	}
+}
+
+// finish must be called only once for each request
+func (req *request) finish(reply redis.Reply, err error) {
+	req.reply = reply
+	req.err = err
+	close(req.done)
+}
+
+// pipe is a connection and the requests waiting for reply on it
+// Requests are queued before written, so replies always match requests in order even if some callers have given up waiting
+type pipe struct {
+	conn net.Conn
+	mu   sync.Mutex
+	// readDeadline is the earliest deadline of waiting requests, it is set to conn so that a half-open connection
+	// is detected and reset. Zero value means no deadline
+	readDeadline time.Time
+	waiting      []*request
+	closed       bool
+}
+
+// push queues request waiting for reply, returns false if connection has been closed
+func (p *pipe) push(req *request) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	if !req.deadline.IsZero() && (p.readDeadline.IsZero() || req.deadline.Before(p.readDeadline)) {
+		p.readDeadline = req.deadline
+		_ = p.conn.SetReadDeadline(p.readDeadline)
+	}
+	p.waiting = append(p.waiting, req)
+	return true
+}
+
+func (p *pipe) pop() *request {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.waiting) == 0 {
+		return nil
+	}
+	req := p.waiting[0]
+	p.waiting[0] = nil
+	p.waiting = p.waiting[1:]
+	if !req.deadline.IsZero() && req.deadline.Equal(p.readDeadline) {
+		p.resetReadDeadline()
+	}
+	return req
+}
+
+// resetReadDeadline sets read deadline to the earliest deadline of waiting requests, invoker should hold p.mu
+func (p *pipe) resetReadDeadline() {
+	var earliest time.Time
+	for _, req := range p.waiting {
+		if req.deadline.IsZero() {
+			continue
+		}
+		if req.deadline.Equal(p.readDeadline) {
+			// no request waits with earlier deadline than the former one
+			earliest = req.deadline
+			break
+		}
+		if earliest.IsZero() || req.deadline.Before(earliest) {
+			earliest = req.deadline
+		}
+	}
+	if !earliest.Equal(p.readDeadline) {
+		p.readDeadline = earliest
+		_ = p.conn.SetReadDeadline(earliest)
+	}
+}
+
+// close closes connection and fails all waiting requests with ErrConnClosed
+func (p *pipe) close() {
+	p.closeWithErr(ErrConnClosed)
+}
+
+// closeWithErr closes connection and fails all waiting requests with err
+func (p *pipe) closeWithErr(err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	waiting := p.waiting
+	p.waiting = nil
+	p.mu.Unlock()
+	_ = p.conn.Close()
+	for _, req := range waiting {
+		req.finish(nil, err)
+	}
+}
+
+func (p *pipe) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
 }
 
 const (
 	chanSize = 256
 	maxWait  = 3 * time.Second
+
+	minBackoff = 50 * time.Millisecond
+	maxBackoff = 2 * time.Second
+	maxRetry   = 3
 )
 
-// MakeClient creates a new client
+// backoff returns exponential delay with jitter before reconnecting, attempt is count of consecutive failures
+func backoff(attempt int) time.Duration {
+	d := maxBackoff
+	if attempt < 16 && minBackoff<<uint(attempt) < maxBackoff {
+		d = minBackoff << uint(attempt)
+	}
+	// jitter in [d/2, d) avoids all clients reconnecting at the same time
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// MakeClient creates a new client, it waits up to 3 seconds for each reply
 func MakeClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+	return MakeClientWithOptions(addr, Options{
+		DialTimeout:  maxWait,
+		ReadTimeout:  maxWait,
+		WriteTimeout: maxWait,
+	})
+}
+
+// MakeClientWithOptions creates a new client with given timeouts
+func MakeClientWithOptions(addr string, opts Options) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, opts.DialTimeout)
 	if err != nil {
 		return nil, err
 	}
 	return &Client{
 		addr:        addr,
-		conn:        conn,
+		opts:        opts,
+		pipe:        &pipe{conn: conn},
 		pendingReqs: make(chan *request, chanSize),
-		waitingReqs: make(chan *request, chanSize),
 		working:     &sync.WaitGroup{},
 	}, nil
 }
@@ -57,18 +218,16 @@ func MakeClient(addr string) (*Client, error) {
 func (client *Client) Start() {
 	client.ticker = time.NewTicker(10 * time.Second)
 	go client.handleWrite()
-	go func() {
-		err := client.handleRead()
-		if err != nil {
-			logger.Error(err)
-		}
-	}()
+	go client.handleRead(client.getPipe())
 	go client.heartbeat()
 }
 
 // Close stops asynchronous goroutines and close connection
 func (client *Client) Close() {
-	client.ticker.Stop()
+	if client.ticker != nil {
+		// client may be closed before started
+		client.ticker.Stop()
+	}
 	// stop new request
 	close(client.pendingReqs)
 
@@ -76,30 +235,31 @@ func (client *Client) Close() {
 	client.working.Wait()
 
 	// clean
-	_ = client.conn.Close()
-	close(client.waitingReqs)
+	client.getPipe().close()
 }
 
-func (client *Client) handleConnectionError(err error) error {
-	err1 := client.conn.Close()
-	if err1 != nil {
-		if opErr, ok := err1.(*net.OpError); ok {
-			if opErr.Err.Error() != "use of closed network connection" {
-				return err1
-			}
-		} else {
-			return err1
-		}
-	}
-	conn, err1 := net.Dial("tcp", client.addr)
-	if err1 != nil {
-		logger.Error(err1)
-		return err1
+func (client *Client) getPipe() *pipe {
+	client.pipeMu.RLock()
+	defer client.pipeMu.RUnlock()
+	return client.pipe
+}
+
+// reconnect closes broken connection and dials a new one after backoff
+func (client *Client) reconnect() error {
+	client.getPipe().close()
+	time.Sleep(backoff(client.failures))
+	conn, err := net.DialTimeout("tcp", client.addr, client.opts.DialTimeout)
+	if err != nil {
+		client.failures++
+		logger.Error(err)
+		return err
 	}
-	client.conn = conn
-	go func() {
-		_ = client.handleRead()
-	}()
+	client.failures = 0
+	p := &pipe{conn: conn}
+	client.pipeMu.Lock()
+	client.pipe = p
+	client.pipeMu.Unlock()
+	go client.handleRead(p)
 	return nil
 }
 
@@ -115,38 +275,96 @@ func (client *Client) handleWrite() {
 	}
 }
 
+// SendContext sends a request to redis server and waits until reply received or ctx done.
+// It returns ErrTimeout if deadline exceeded, ErrConnClosed if connection broken and *ServerError if server replies an error.
+// If ctx has no deadline, ReadTimeout of client is used.
+func (client *Client) SendContext(ctx context.Context, args [][]byte) (redis.Reply, error) {
+	client.working.Add(1)
+	defer client.working.Done()
+	if _, ok := ctx.Deadline(); !ok && client.opts.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.opts.ReadTimeout)
+		defer cancel()
+	}
+	request := makeRequest(ctx, args, false)
+	select {
+	case client.pendingReqs <- request:
+	case <-ctx.Done():
+		return nil, toClientErr(ctx.Err())
+	}
+	return waitReply(ctx, request)
+}
+
+// waitReply waits reply of request, the request is still waiting in pipe after ctx done so that later replies won't be disordered
+func waitReply(ctx context.Context, request *request) (redis.Reply, error) {
+	select {
+	case <-request.done:
+	case <-ctx.Done():
+		return nil, toClientErr(ctx.Err())
+	}
+	if request.err != nil {
+		return nil, request.err
+	}
+	if errReply, ok := request.reply.(protocol.ErrorReply); ok {
+		return request.reply, &ServerError{Msg: errReply.Error()}
+	}
+	return request.reply, nil
+}
+
+func toClientErr(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return err
+}
+
+// toReply converts result of SendContext to redis.Reply
+func toReply(reply redis.Reply, err error) redis.Reply {
+	switch err.(type) {
+	case nil, *ServerError:
+		return reply
+	}
+	if err == ErrTimeout {
+		return protocol.MakeErrReply("server time out")
+	}
+	return protocol.MakeErrReply("request failed")
+}
+
 // Send sends a request to redis server
 func (client *Client) Send(args [][]byte) redis.Reply {
-	request := &request{
-		args:      args,
-		heartbeat: false,
-		waiting:   &wait.Wait{},
+	return toReply(client.SendContext(context.Background(), args))
+}
+
+// Pipeline sends requests without waiting for the reply of previous one, replies are in the same order as cmdLines
+func (client *Client) Pipeline(cmdLines [][][]byte) []redis.Reply {
+	ctx := context.Background()
+	if client.opts.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.opts.ReadTimeout)
+		defer cancel()
 	}
-	request.waiting.Add(1)
+	requests := make([]*request, len(cmdLines))
 	client.working.Add(1)
 	defer client.working.Done()
-	client.pendingReqs <- request
-	timeout := request.waiting.WaitWithTimeout(maxWait)
-	if timeout {
-		return protocol.MakeErrReply("server time out")
+	for i, args := range cmdLines {
+		requests[i] = makeRequest(ctx, args, false)
+		client.pendingReqs <- requests[i]
 	}
-	if request.err != nil {
-		return protocol.MakeErrReply("request failed")
+	replies := make([]redis.Reply, len(requests))
+	for i, request := range requests {
+		replies[i] = toReply(waitReply(ctx, request))
 	}
-	return request.reply
+	return replies
 }
 
 func (client *Client) doHeartbeat() {
-	request := &request{
-		args:      [][]byte{[]byte("PING")},
-		heartbeat: true,
-		waiting:   &wait.Wait{},
-	}
-	request.waiting.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), maxWait)
+	defer cancel()
+	request := makeRequest(ctx, [][]byte{[]byte("PING")}, true)
 	client.working.Add(1)
 	defer client.working.Done()
 	client.pendingReqs <- request
-	request.waiting.WaitWithTimeout(maxWait)
+	_, _ = waitReply(ctx, request)
 }
 
 func (client *Client) doRequest(req *request) {
@@ -155,48 +373,61 @@ func (client *Client) doRequest(req *request) {
 	}
 	re := protocol.MakeMultiBulkReply(req.args)
 	bytes := re.ToBytes()
-	_, err := client.conn.Write(bytes)
-	i := 0
-	for err != nil && i < 3 {
-		err = client.handleConnectionError(err)
-		if err == nil {
-			_, err = client.conn.Write(bytes)
+	p := client.getPipe()
+	// reconnect if connection has been closed by reader
+	for i := 0; p.isClosed() && i < maxRetry; i++ {
+		if client.reconnect() == nil {
+			p = client.getPipe()
 		}
-		i++
 	}
-	if err == nil {
-		client.waitingReqs <- req
-	} else {
-		req.err = err
-		req.waiting.Done()
+	if !req.deadline.IsZero() && !time.Now().Before(req.deadline) {
+		// caller has given up, an expired read deadline would reset the connection of other requests
+		req.finish(nil, ErrTimeout)
+		return
 	}
-}
-
-func (client *Client) finishRequest(reply redis.Reply) {
-	defer func() {
-		if err := recover(); err != nil {
-			debug.PrintStack()
-			logger.Error(err)
-		}
-	}()
-	request := <-client.waitingReqs
-	if request == nil {
+	// queue before writing, so that reader always finds the request of reply
+	if !p.push(req) {
+		req.finish(nil, ErrConnClosed)
 		return
 	}
-	request.reply = reply
-	if request.waiting != nil {
-		request.waiting.Done()
+	if client.opts.WriteTimeout > 0 {
+		_ = p.conn.SetWriteDeadline(time.Now().Add(client.opts.WriteTimeout))
+	}
+	_, err := p.conn.Write(bytes)
+	if err != nil {
+		// request is failed by closing pipe, it's unsafe to resend a request which may have been partially written
+		logger.Error(err)
+		_ = client.reconnect()
 	}
 }
 
-func (client *Client) handleRead() error {
-	ch := parser.ParseStream(client.conn)
+func (client *Client) handleRead(p *pipe) {
+	ch := parser.ParseStream(p.conn)
 	for payload := range ch {
 		if payload.Err != nil {
-			client.finishRequest(protocol.MakeErrReply(payload.Err.Error()))
+			if !strings.HasPrefix(payload.Err.Error(), "protocol error") {
+				// io error, parser stops reading
+				if netErr, ok := payload.Err.(net.Error); ok && netErr.Timeout() {
+					// no reply before the earliest deadline of waiting requests, the connection will be reset by next request
+					logger.Warn("redis client: read timeout from " + client.addr)
+					p.closeWithErr(ErrTimeout)
+					return
+				}
+				break
+			}
+			client.finishRequest(p, protocol.MakeErrReply(payload.Err.Error()))
 			continue
 		}
-		client.finishRequest(payload.Data)
+		client.finishRequest(p, payload.Data)
 	}
-	return nil
+	p.close()
+}
+
+func (client *Client) finishRequest(p *pipe, reply redis.Reply) {
+	request := p.pop()
+	if request == nil {
+		logger.Warn("redis client: receive unexpected reply from " + client.addr)
+		return
+	}
+	request.finish(reply, nil)
 }
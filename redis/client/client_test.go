@@ -1,10 +1,16 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"github.com/hdt3213/godis/lib/logger"
+	"github.com/hdt3213/godis/redis/parser"
 	"github.com/hdt3213/godis/redis/protocol"
+	"net"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestClient(t *testing.T) {
@@ -104,3 +110,188 @@ func TestClient(t *testing.T) {
 
 	client.Close()
 }
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		d := backoff(attempt)
+		expected := maxBackoff
+		if attempt < 16 && minBackoff<<uint(attempt) < maxBackoff {
+			expected = minBackoff << uint(attempt)
+		}
+		if d < expected/2 || d >= expected {
+			t.Errorf("backoff of attempt %d out of range: %s", attempt, d)
+		}
+	}
+}
+
+// startFakeServer starts a server which supports: ECHO msg, SLEEP milliseconds, ERR msg, CLOSE and PING
+func startFakeServer(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for payload := range parser.ParseStream(conn) {
+					if payload.Err != nil {
+						return
+					}
+					args := payload.Data.(*protocol.MultiBulkReply).Args
+					var reply []byte
+					switch strings.ToLower(string(args[0])) {
+					case "echo":
+						reply = protocol.MakeBulkReply(args[1]).ToBytes()
+					case "sleep":
+						ms, _ := strconv.Atoi(string(args[1]))
+						time.Sleep(time.Duration(ms) * time.Millisecond)
+						reply = protocol.MakeOkReply().ToBytes()
+					case "err":
+						reply = protocol.MakeErrReply(string(args[1])).ToBytes()
+					case "close":
+						return
+					default:
+						reply = protocol.MakeStatusReply("PONG").ToBytes()
+					}
+					_, _ = conn.Write(reply)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() {
+		_ = listener.Close()
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	addr, stop := startFakeServer(t)
+	defer stop()
+	client, err := MakeClientWithOptions(addr, Options{
+		DialTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	defer client.Close()
+
+	// timeout
+	p := client.getPipe()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = client.SendContext(ctx, [][]byte{[]byte("SLEEP"), []byte("200")})
+	cancel()
+	if err != ErrTimeout {
+		t.Errorf("expect ErrTimeout, actually %v", err)
+	}
+	// connection is reset at deadline, reply of timed out request should not be taken by later request
+	waitPipeClosed(t, p)
+	reply, err := client.SendContext(context.Background(), [][]byte{[]byte("ECHO"), []byte("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bulk, ok := reply.(*protocol.BulkReply); !ok || string(bulk.Arg) != "a" {
+		t.Errorf("expect a, actually %s", reply.ToBytes())
+	}
+
+	// canceled
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = client.SendContext(ctx, [][]byte{[]byte("PING")})
+	if err != context.Canceled {
+		t.Errorf("expect context.Canceled, actually %v", err)
+	}
+
+	// server error
+	_, err = client.SendContext(context.Background(), [][]byte{[]byte("ERR"), []byte("ERR boom")})
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Msg != "ERR boom" {
+		t.Errorf("expect server error, actually %v", err)
+	}
+
+	// connection closed by server
+	_, err = client.SendContext(context.Background(), [][]byte{[]byte("CLOSE")})
+	if err != ErrConnClosed {
+		t.Errorf("expect ErrConnClosed, actually %v", err)
+	}
+	// reconnect
+	reply = client.Send([][]byte{[]byte("ECHO"), []byte("b")})
+	if bulk, ok := reply.(*protocol.BulkReply); !ok || string(bulk.Arg) != "b" {
+		t.Errorf("expect b, actually %s", reply.ToBytes())
+	}
+
+	// default read timeout
+	reply = client.Send([][]byte{[]byte("SLEEP"), []byte("1500")})
+	expected := protocol.MakeErrReply("server time out")
+	if string(reply.ToBytes()) != string(expected.ToBytes()) {
+		t.Errorf("expect timeout, actually %s", reply.ToBytes())
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	addr, stop := startFakeServer(t)
+	defer stop()
+	client, err := MakeClientWithOptions(addr, Options{
+		DialTimeout:  time.Second,
+		ReadTimeout:  200 * time.Millisecond,
+		WriteTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start()
+	defer client.Close()
+
+	// read deadline follows the caller's deadline even if it is longer than read timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := client.SendContext(ctx, [][]byte{[]byte("SLEEP"), []byte("500")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reply.(*protocol.StatusReply); !ok {
+		t.Errorf("expect reply of sleep, actually %s", reply.ToBytes())
+	}
+
+	// server never replies in time like a half-open connection, read timeout is used if caller has no deadline
+	p := client.getPipe()
+	begin := time.Now()
+	_, err = client.SendContext(context.Background(), [][]byte{[]byte("SLEEP"), []byte("3000")})
+	if err != ErrTimeout {
+		t.Errorf("expect ErrTimeout, actually %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("connection should be reset after read timeout, actually waited %s", elapsed)
+	}
+	// reconnect instead of waiting behind the stuck read
+	waitPipeClosed(t, p)
+	reply, err = client.SendContext(ctx, [][]byte{[]byte("ECHO"), []byte("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bulk, ok := reply.(*protocol.BulkReply); !ok || string(bulk.Arg) != "a" {
+		t.Errorf("expect a, actually %s", reply.ToBytes())
+	}
+	// idle connection is not closed by read deadline
+	time.Sleep(400 * time.Millisecond)
+	if client.getPipe().isClosed() {
+		t.Error("idle connection should not be closed")
+	}
+}
+
+// waitPipeClosed waits until the connection is reset by read deadline
+func waitPipeClosed(t *testing.T, p *pipe) {
+	deadline := time.Now().Add(time.Second)
+	for !p.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection should be reset after read deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
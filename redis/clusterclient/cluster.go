@@ -0,0 +1,204 @@
+// Package clusterclient is a client of godis cluster which routes commands to the node owning their keys
+package clusterclient
+
+import (
+	"github.com/hdt3213/godis/interface/redis"
+	"github.com/hdt3213/godis/lib/consistenthash"
+	"github.com/hdt3213/godis/lib/routing"
+	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/redis/protocol"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ClusterClient is a client of godis cluster.
+// It picks node by consistent hash in the same way as cluster.MakeCluster, so commands are sent to the node owning their keys directly
+// without being relayed by another node. Commands which cannot be routed are sent to any node of cluster.
+type ClusterClient struct {
+	nodes      []string
+	peerPicker *consistenthash.Map
+	clients    map[string]*client.Client
+	counter    uint32 // used to choose fallback node
+}
+
+// MakeClusterClient creates a client of godis cluster,
+// nodes should be the addresses of all nodes exactly as `self` and `peers` in configuration of cluster
+func MakeClusterClient(nodes []string) (*ClusterClient, error) {
+	cc := &ClusterClient{
+		peerPicker: consistenthash.New(routing.Replicas, nil),
+		clients:    make(map[string]*client.Client),
+	}
+	for _, node := range nodes {
+		if _, ok := cc.clients[node]; ok {
+			continue
+		}
+		c, err := client.MakeClient(node)
+		if err != nil {
+			for _, c := range cc.clients {
+				c.Close()
+			}
+			return nil, err
+		}
+		cc.clients[node] = c
+		cc.nodes = append(cc.nodes, node)
+	}
+	cc.peerPicker.AddNode(cc.nodes...)
+	return cc, nil
+}
+
+// Start starts clients of all nodes
+func (cc *ClusterClient) Start() {
+	for _, c := range cc.clients {
+		c.Start()
+	}
+}
+
+// Close closes clients of all nodes
+func (cc *ClusterClient) Close() {
+	for _, c := range cc.clients {
+		c.Close()
+	}
+}
+
+// fallbackNode chooses nodes in turn for commands which cannot be routed
+func (cc *ClusterClient) fallbackNode() string {
+	i := atomic.AddUint32(&cc.counter, 1)
+	return cc.nodes[int(i)%len(cc.nodes)]
+}
+
+// pickNode returns the node owning all keys of cmdLine, or a fallback node if keys are distributed on several nodes
+func (cc *ClusterClient) pickNode(cmdLine [][]byte) (node string) {
+	defer func() {
+		if err := recover(); err != nil {
+			// malformed command line, let server reports the error
+			node = cc.fallbackNode()
+		}
+	}()
+	if len(cmdLine) < 2 {
+		return cc.fallbackNode()
+	}
+	writeKeys, readKeys := routing.GetRelatedKeys(cmdLine)
+	keys := append(writeKeys, readKeys...)
+	if len(keys) == 0 {
+		return cc.fallbackNode()
+	}
+	node = cc.peerPicker.PickNode(keys[0])
+	for _, key := range keys[1:] {
+		if cc.peerPicker.PickNode(key) != node {
+			return cc.fallbackNode()
+		}
+	}
+	return node
+}
+
+// groupBy returns node -> keys and node -> index of keys
+func (cc *ClusterClient) groupBy(keys [][]byte) (map[string][][]byte, map[string][]int) {
+	groupKeys := make(map[string][][]byte)
+	groupIndexes := make(map[string][]int)
+	for i, key := range keys {
+		node := cc.peerPicker.PickNode(string(key))
+		groupKeys[node] = append(groupKeys[node], key)
+		groupIndexes[node] = append(groupIndexes[node], i)
+	}
+	return groupKeys, groupIndexes
+}
+
+// Send sends a request to the node owning its keys, MGET and MSET are split by node
+func (cc *ClusterClient) Send(args [][]byte) redis.Reply {
+	if len(args) == 0 {
+		return protocol.MakeErrReply("ERR command required")
+	}
+	cmdName := strings.ToLower(string(args[0]))
+	if cmdName == "mget" && len(args) > 1 {
+		return cc.mGet(args)
+	}
+	if cmdName == "mset" && len(args) > 1 && len(args)%2 == 1 {
+		return cc.mSet(args)
+	}
+	if cmdName == "select" || cmdName == "auth" {
+		return cc.sendToAll(args)
+	}
+	return cc.clients[cc.pickNode(args)].Send(args)
+}
+
+// sendToAll sends commands which changes connection state such as SELECT to all nodes
+func (cc *ClusterClient) sendToAll(args [][]byte) redis.Reply {
+	var result redis.Reply
+	for _, node := range cc.nodes {
+		result = cc.clients[node].Send(args)
+		if protocol.IsErrorReply(result) {
+			return result
+		}
+	}
+	return result
+}
+
+// mGet gets values from their nodes then reassembles them in order of keys
+func (cc *ClusterClient) mGet(args [][]byte) redis.Reply {
+	keys := args[1:]
+	groupKeys, groupIndexes := cc.groupBy(keys)
+	result := make([][]byte, len(keys))
+	for node, group := range groupKeys {
+		cmdLine := append([][]byte{[]byte("MGET")}, group...)
+		resp := cc.clients[node].Send(cmdLine)
+		if protocol.IsErrorReply(resp) {
+			return resp
+		}
+		values, ok := resp.(*protocol.MultiBulkReply)
+		if !ok || len(values.Args) != len(group) {
+			return protocol.MakeErrReply("ERR invalid reply of mget from " + node)
+		}
+		for i, value := range values.Args {
+			result[groupIndexes[node][i]] = value
+		}
+	}
+	return protocol.MakeMultiBulkReply(result)
+}
+
+// mSet sets key-values on their nodes, it is not atomic if keys are distributed on several nodes
+func (cc *ClusterClient) mSet(args [][]byte) redis.Reply {
+	size := (len(args) - 1) / 2
+	keys := make([][]byte, size)
+	for i := 0; i < size; i++ {
+		keys[i] = args[2*i+1]
+	}
+	_, groupIndexes := cc.groupBy(keys)
+	for node, indexes := range groupIndexes {
+		cmdLine := [][]byte{[]byte("MSET")}
+		for _, i := range indexes {
+			cmdLine = append(cmdLine, args[2*i+1], args[2*i+2])
+		}
+		resp := cc.clients[node].Send(cmdLine)
+		if protocol.IsErrorReply(resp) {
+			return resp
+		}
+	}
+	return protocol.MakeOkReply()
+}
+
+// Pipeline splits requests by node and sends them in pipeline mode, replies are in the same order as cmdLines.
+// Order of requests sent to different nodes is not guaranteed.
+func (cc *ClusterClient) Pipeline(cmdLines [][][]byte) []redis.Reply {
+	groupCmdLines := make(map[string][][][]byte)
+	groupIndexes := make(map[string][]int)
+	for i, cmdLine := range cmdLines {
+		node := cc.pickNode(cmdLine)
+		groupCmdLines[node] = append(groupCmdLines[node], cmdLine)
+		groupIndexes[node] = append(groupIndexes[node], i)
+	}
+	replies := make([]redis.Reply, len(cmdLines))
+	var wg sync.WaitGroup
+	for node, group := range groupCmdLines {
+		wg.Add(1)
+		go func(node string, group [][][]byte) {
+			defer wg.Done()
+			nodeReplies := cc.clients[node].Pipeline(group)
+			for i, reply := range nodeReplies {
+				replies[groupIndexes[node][i]] = reply
+			}
+		}(node, group)
+	}
+	wg.Wait()
+	return replies
+}
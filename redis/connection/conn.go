@@ -31,6 +31,10 @@ type Connection struct {
 
 	// selected db
 	selectedDB int
+
+	// closed when client disconnected, blocking commands stop waiting on it
+	doneMu sync.Mutex
+	done   chan struct{}
 }
 
 // RemoteAddr returns the remote network address
@@ -40,6 +44,7 @@ func (c *Connection) RemoteAddr() net.Addr {
 
 // Close disconnect with the client
 func (c *Connection) Close() error {
+	c.setClosed()
 	c.waitingReply.WaitWithTimeout(10 * time.Second)
 	_ = c.conn.Close()
 	return nil
@@ -52,6 +57,38 @@ func NewConn(conn net.Conn) *Connection {
 	}
 }
 
+// Read reads requests from tcp connection, the connection is marked closed once reading failed
+func (c *Connection) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	if err != nil {
+		c.setClosed()
+	}
+	return n, err
+}
+
+// Done returns a channel which is closed when client disconnected
+func (c *Connection) Done() <-chan struct{} {
+	c.doneMu.Lock()
+	defer c.doneMu.Unlock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	return c.done
+}
+
+func (c *Connection) setClosed() {
+	c.doneMu.Lock()
+	defer c.doneMu.Unlock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	select {
+	case <-c.done: // already closed
+	default:
+		close(c.done)
+	}
+}
+
 // Write sends response to client over tcp connection
 func (c *Connection) Write(b []byte) error {
 	if len(b) == 0 {
@@ -178,6 +215,12 @@ func (c *FakeConn) Write(b []byte) error {
 	return nil
 }
 
+// Close marks the fake connection disconnected
+func (c *FakeConn) Close() error {
+	c.setClosed()
+	return nil
+}
+
 // Clean resets the buffer
 func (c *FakeConn) Clean() {
 	c.buf.Reset()
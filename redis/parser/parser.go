@@ -136,6 +136,13 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 					state = readState{} // reset state
 					continue
 				}
+				if state.expectedArgsCount == -1 { // null multi bulk protocol
+					ch <- &Payload{
+						Data: &protocol.NullMultiBulkReply{},
+					}
+					state = readState{} // reset state
+					continue
+				}
 			} else if msg[0] == '$' { // bulk protocol
 				err = parseBulkHeader(msg, &state)
 				if err != nil {
@@ -240,16 +247,16 @@ func readLine(bufReader *bufio.Reader, state *readState) ([]byte, bool, error) {
 func parseMultiBulkHeader(msg []byte, state *readState) error {
 	var err error
 	// 用户输入命令参数的个数
-	var expectedLine uint64
+	var expectedLine int64
 	// 将msg切片去头和倒数2位byte，并转成int32赋值给expectedLine
 	// 去除 * 号和结尾的 /r和/n，使用切片表达式 [1:2],拿到*号跟的数值
 	// 闭区间之所以是2是因为使用了len()函数，msg的长度是4,分别是 *2\r\n，4-2=2
-	expectedLine, err = strconv.ParseUint(string(msg[1:len(msg)-2]), 10, 32)
+	expectedLine, err = strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 32)
 	if err != nil {
 		return errors.New("protocol error: " + string(msg))
 	}
-	if expectedLine == 0 {
-		state.expectedArgsCount = 0
+	if expectedLine == 0 || expectedLine == -1 { // empty or null multi bulk
+		state.expectedArgsCount = int(expectedLine)
 		return nil
 	} else if expectedLine > 0 {
 		// first line of multi bulk protocol
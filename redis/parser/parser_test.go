@@ -21,6 +21,7 @@ func TestParseStream(t *testing.T) {
 			[]byte("\r\n"),
 		}),
 		protocol.MakeEmptyMultiBulkReply(),
+		protocol.MakeNullMultiBulkReply(),
 	}
 	reqs := bytes.Buffer{}
 	for _, re := range replies {
@@ -67,6 +68,7 @@ func TestParseOne(t *testing.T) {
 			[]byte("\r\n"),
 		}),
 		protocol.MakeEmptyMultiBulkReply(),
+		protocol.MakeNullMultiBulkReply(),
 	}
 	for _, re := range replies {
 		result, err := ParseOne(re.ToBytes())
@@ -7,7 +7,7 @@ import (
 )
 
 var (
-	nullBulkReplyBytes = []byte("$-1")
+	nullBulkReplyBytes = []byte("$-1\r\n")
 
 	// CRLF is the line separator of redis serialization protocol
 	CRLF = "\r\n"
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"github.com/hdt3213/godis/lib/consistenthash"
+	"github.com/hdt3213/godis/lib/routing"
+	"github.com/hdt3213/godis/lib/utils"
+	"github.com/hdt3213/godis/redis/client"
+	"github.com/hdt3213/godis/redis/clusterclient"
+	"github.com/hdt3213/godis/redis/protocol/asserts"
+	"github.com/hdt3213/godis/tcp"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestClusterClient(t *testing.T) {
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+	var nodes []string
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		nodes = append(nodes, listener.Addr().String())
+		go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	}
+	cc, err := clusterclient.MakeClusterClient(nodes)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cc.Start()
+	defer cc.Close()
+	nodeClients := make(map[string]*client.Client)
+	for _, node := range nodes {
+		c, err := client.MakeClient(node)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.Start()
+		defer c.Close()
+		nodeClients[node] = c
+	}
+	picker := consistenthash.New(routing.Replicas, nil)
+	picker.AddNode(nodes...)
+
+	// keys should be stored on their owner node
+	size := 20
+	keys := make([]string, size)
+	msetArgs := []string{"MSET"}
+	for i := 0; i < size; i++ {
+		keys[i] = "key" + strconv.Itoa(i)
+		msetArgs = append(msetArgs, keys[i], strconv.Itoa(i))
+	}
+	ret := cc.Send(utils.ToCmdLine(msetArgs...))
+	asserts.AssertStatusReply(t, ret, "OK")
+	for i, key := range keys {
+		ret = nodeClients[picker.PickNode(key)].Send(utils.ToCmdLine("GET", key))
+		asserts.AssertBulkReply(t, ret, strconv.Itoa(i))
+		ret = cc.Send(utils.ToCmdLine("GET", key))
+		asserts.AssertBulkReply(t, ret, strconv.Itoa(i))
+	}
+	ret = cc.Send(utils.ToCmdLine2("MGET", append(keys, "none")...))
+	expected := make([]string, size+1)
+	for i := 0; i < size; i++ {
+		expected[i] = strconv.Itoa(i)
+	}
+	asserts.AssertMultiBulkReply(t, ret, expected)
+
+	// pipeline
+	cmdLines := make([][][]byte, 0, size*2)
+	for _, key := range keys {
+		cmdLines = append(cmdLines, utils.ToCmdLine("INCR", key), utils.ToCmdLine("GET", key))
+	}
+	replies := cc.Pipeline(cmdLines)
+	for i := 0; i < size; i++ {
+		asserts.AssertIntReply(t, replies[2*i], i+1)
+		asserts.AssertBulkReply(t, replies[2*i+1], strconv.Itoa(i+1))
+	}
+	ret = cc.Send(utils.ToCmdLine("PING"))
+	asserts.AssertStatusReply(t, ret, "PONG")
+}
@@ -73,7 +73,8 @@ func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
 	h.activeConn.Store(client, 1)
 
 	// 根据conn连接对象获取一个只读消息的通道，该通道会返回 Payload 类型的数据
-	ch := parser.ParseStream(conn)
+	// read through client, so that blocked commands can find out the client has disconnected
+	ch := parser.ParseStream(client)
 	for payload := range ch {
 		if payload.Err != nil {
 			if payload.Err == io.EOF ||
@@ -42,3 +42,55 @@ func TestListenAndServe(t *testing.T) {
 	closeChan <- struct{}{}
 	time.Sleep(time.Second)
 }
+
+func TestBlockedClientDisconnect(t *testing.T) {
+	closeChan := make(chan struct{})
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	addr := listener.Addr().String()
+	go tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+	defer func() {
+		closeChan <- struct{}{}
+	}()
+
+	blocked, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = blocked.Write([]byte("*3\r\n$8\r\nBZPOPMIN\r\n$7\r\nblocked\r\n$1\r\n0\r\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	_ = blocked.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// member added after disconnecting should not be popped for the gone client
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	bufReader := bufio.NewReader(conn)
+	for _, cmd := range []string{"ZADD blocked 1 a\r\n", "ZCARD blocked\r\n"} {
+		_, err = conn.Write([]byte(cmd))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		line, _, err := bufReader.ReadLine()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(line) != ":1" {
+			t.Errorf("expect :1, actually %s", line)
+		}
+	}
+}